@@ -16,15 +16,21 @@ import (
 
 // Variables used for command line parameters
 var settings struct {
-	Username   string `short:"u" long:"username" required:"false" description:"Parvati username" value-name:"<nick>"`
-	URI        string `long:"uri"  required:"false" description:"Parvati API Uri" value-name:"<url>"`
-	ConfigFile string `short:"c" long:"config" required:"false" value-name:"<path>" description:"Location of a gitconfig style file holding your credentials and password and other preferences."`
+	Username   string   `short:"u" long:"username" required:"false" description:"Parvati username" value-name:"<nick>"`
+	URI        string   `long:"uri"  required:"false" description:"Parvati API Uri" value-name:"<url>"`
+	ConfigFile string   `short:"c" long:"config" required:"false" value-name:"<path>" description:"Location of a gitconfig style file holding your credentials and password and other preferences."`
+	Profile    string   `long:"profile" required:"false" value-name:"<name>" description:"Use the named [profile] section of the config file (default $PARVATI_PROFILE, then parvati.profile)."`
+	Set        []string `long:"set" required:"false" value-name:"<key>=<value>" description:"Override a config file key, over its PARVATI_* environment variable (can be repeated)."`
 
 	Version     func() `long:"version" required:"false" description:"Print tool version and exit."`
 	Debug       bool   `short:"d" long:"debug" description:"Debug API load errors."`
 	ifaceConfig *iface.Config
 }
 
+// Config keys set by --uri, --username and --set, applied over the config
+// file and environment.
+var flagOverrides []parvatigo.ConfigOverride
+
 var buildVersion = "dev"
 var buildDate = "dev"
 var buildCommit = "dev"
@@ -42,41 +48,68 @@ func run() int {
 
 }
 
-func LoadParvatiApi() (*parvatigo.Api, *parvatigo.ApiConfig, error) {
+// Reads the config and makes the API. The password is only looked up, and
+// the auth checked, with credentials set, as that may run a credential
+// helper or secret-tool.
+func LoadParvatiApi(credentials bool) (*parvatigo.Api, *parvatigo.ApiConfig, error) {
 	var config *parvatigo.ApiConfig
 	if settings.ConfigFile == "" {
-		var err error
-		config, err = parvatigo.ReadDefaultConfig()
+		def, err := parvatigo.DefaultConfigFile()
+		if err == nil {
+			config, err = parvatigo.ReadConfigWith(def, flagOverrides)
+		}
 		if err != nil {
 			if !os.IsNotExist(err) {
 				return nil, nil, err
 			}
 			// no config and no parvati credentials, so just do default list show and leave
-			def, _ := parvatigo.DefaultConfigFile()
 			return nil, nil, fmt.Errorf("No default config file (expected: %s), and no config file given with --config / -c\n"+
-				"You must supply a standard gitconfig style file containing at least a value for parvati.password\n", def)
+				"You must supply a standard gitconfig style file containing at least a value for parvati.username\n"+
+				"Run Init to create one.\n", def)
 		}
 	} else {
 		var err error
-		config, err = parvatigo.ReadConfig(settings.ConfigFile)
+		config, err = parvatigo.ReadConfigWith(settings.ConfigFile, flagOverrides)
 		if err != nil {
 			return nil, nil, err
 		}
 	}
-	if config != nil && config.Password == "" {
-		return nil, config, fmt.Errorf("Configuration file did not specify a password with key parvati.password\n")
-	}
-	if settings.URI != "" {
-		config.URI = settings.URI
+	if err := config.UseProfile(settings.Profile); err != nil {
+		return nil, nil, err
 	}
-	if settings.Username != "" {
-		config.Username = settings.Username
+	var credErr error
+	if credentials {
+		config.LoadCredentials()
+		credErr = config.CheckAuth()
 	}
 	api, err := parvatigo.NewApi(config, buildVersion)
 	if err != nil {
 		return nil, config, err
 	}
-	return &api, config, err
+	return &api, config, credErr
+}
+
+// Turns --uri, --username and --set into overrides for reading the config,
+// refusing keys the client does not know.
+func SetFlagOverrides() error {
+	known := cmd_lowlevel.KnownConfigKeys()
+	var err error
+	if settings.URI != "" {
+		if flagOverrides, err = parvatigo.AddFlagOverride(flagOverrides, known, "--uri", "parvati.uri="+settings.URI); err != nil {
+			return err
+		}
+	}
+	if settings.Username != "" {
+		if flagOverrides, err = parvatigo.AddFlagOverride(flagOverrides, known, "--username", "parvati.username="+settings.Username); err != nil {
+			return err
+		}
+	}
+	for _, s := range settings.Set {
+		if flagOverrides, err = parvatigo.AddFlagOverride(flagOverrides, known, "--set", s); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func CliParse() {
@@ -94,14 +127,24 @@ func CliParse() {
 		if cmd == nil {
 			return fmt.Errorf("No command given to execute\n")
 		}
+		if err := SetFlagOverrides(); err != nil {
+			log.Fatalln(err)
+		}
 		if apiCmd, ok := cmd.(cmd_generic.APICommand); ok {
-			api, apiConfig, err := LoadParvatiApi()
+			api, apiConfig, err := LoadParvatiApi(apiCmd.NeedsAPI())
 			if err != nil {
 				if apiCmd.NeedsAPI() || (apiCmd.NeedsAPIConfig() && apiConfig == nil) {
 					log.Fatalln(err)
 				} else if settings.Debug {
 					log.Printf("Warning: unable to load parvati api information: %s", err.Error())
 				}
+				// commands such as Login can still use what did load
+				if apiConfig != nil {
+					apiCmd.SetAPIConfig(apiConfig)
+				}
+				if api != nil {
+					apiCmd.SetAPI(api)
+				}
 			} else {
 				if settings.Debug {
 					api.Verbose = true
@@ -119,6 +162,9 @@ func CliParse() {
 			}
 			confCmd.SetConfigFile(f)
 		}
+		if oCmd, ok := cmd.(cmd_generic.OverridesCommand); ok {
+			oCmd.SetConfigOverrides(flagOverrides)
+		}
 		return cmd.Execute(args)
 	}
 	_, err := cmd_lowlevel.AddCommands(parser.Command)
@@ -14,3 +14,9 @@ type APICommand interface {
 type IfaceCommand interface {
 	SetConfigFile(string)
 }
+
+// Commands reading the config file themselves, rather than through the
+// ApiConfig, are given the command line's overrides to apply over it.
+type OverridesCommand interface {
+	SetConfigOverrides([]parvatigo.ConfigOverride)
+}
@@ -26,10 +26,21 @@ func AddCommands(base *flags.Command) (*flags.Command, error) {
 	if _, err := (&ConfigHelp{}).AddCommands(base); err != nil {
 		return base, err
 	}
+	if _, err := (&Profiles{}).AddCommands(base); err != nil {
+		return base, err
+	}
 	return base, nil
 }
 
-func ShowDefaultList(wantV4, wantV6, filtered bool) error {
+// How ShowDefaultList gathers and renders the interface inventory.
+type ListOptions struct {
+	CheckNAT    bool
+	STUNServers []string
+	Format      string // "text" or "json"
+	Inventory   iface.InventoryOptions
+}
+
+func ShowDefaultList(wantV4, wantV6, filtered bool, opts *ListOptions) error {
 	flags := traceroute.WANT_LIVE_IP
 	fStr := ""
 	if filtered {
@@ -51,8 +62,14 @@ func ShowDefaultList(wantV4, wantV6, filtered bool) error {
 	if err != nil {
 		return err
 	}
+	list.CheckNAT = opts.CheckNAT
+	list.STUNServers = opts.STUNServers
+	inv := list.Inventory(opts.Inventory)
+	if opts.Format == "json" {
+		return inv.WriteJSON(os.Stdout)
+	}
 	fmt.Printf("Default Interface list " + ipTypeStr + ":\n")
-	list.Show(os.Stdout)
+	inv.WriteText(os.Stdout)
 	return nil
 }
 
@@ -85,6 +102,32 @@ func FilterGames(knownGames []swagger.Game, configGames []parvatigo.GameInfo, ig
 	return out, nil
 }
 
+// Pick backend games by url short name or name. No names picks all games.
+func FindGames(knownGames []swagger.Game, names []string) ([]*swagger.Game, error) {
+	out := make([]*swagger.Game, 0, len(knownGames))
+	if len(names) == 0 {
+		for i := range knownGames {
+			out = append(out, &knownGames[i])
+		}
+		return out, nil
+	}
+	for _, name := range names {
+		found := false
+		for i := range knownGames {
+			g := &knownGames[i]
+			if strings.EqualFold(name, g.UrlShortName) || strings.EqualFold(name, g.Name) {
+				out = append(out, g)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("Unknown game: '%s'. Use ListKnownGames to see known games.\n", name)
+		}
+	}
+	return out, nil
+}
+
 func GetIpFlagsFromGames(games []*GameConfig) int {
 	flags := 0
 	all := traceroute.WANT_PUBLIC_V4 | traceroute.WANT_PUBLIC_V6
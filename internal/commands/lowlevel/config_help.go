@@ -37,7 +37,11 @@ func (self *ConfigHelp) SetAPIConfig(api *parvatigo.ApiConfig) {
 }
 
 func (self *ConfigHelp) KnownSections() []string {
-	return []string{"parvati", "interfaces", "game"}
+	out := make([]string, 0, 8)
+	for _, s := range KnownConfigSections() {
+		out = append(out, s.Name)
+	}
+	return out
 }
 
 func (self *ConfigHelp) Execute(args []string) error {
@@ -55,6 +59,11 @@ func (self *ConfigHelp) Execute(args []string) error {
 		if !self.ListSections {
 			fmt.Print("The default configuration file format is a 'git-config' style file.\n")
 			fmt.Print("It can contain the following settings:\n")
+			fmt.Print("Use the Config command to get, set and check them.\n")
+			fmt.Print("Any key can be overridden by an environment variable, PARVATI_ then\n")
+			fmt.Print("the key in upper case with '_' for '.' and no 'parvati.' (e.g. PARVATI_URI,\n")
+			fmt.Print("PARVATI_GAME_NAME_HOSTMESSAGE, one value per line), and that by\n")
+			fmt.Print("--set key=value. 'Config explain' shows where each value came from.\n")
 			self.FilePath = true // so we print at the end too
 		}
 	}
@@ -69,50 +78,58 @@ func (self *ConfigHelp) Execute(args []string) error {
 		}
 		return nil
 	}
-	if doSections["parvati"] {
-		fmt.Print("Section parvati:\n")
-		fmt.Print("  - parvati.username {string}\n")
-		fmt.Print("    This is your current username registered to parvati\n\n")
-		fmt.Print("  - parvati.password {string}\n")
-		fmt.Print("    This is your password, previously registered via e.g. IRC/discord.\n\n")
-		fmt.Print("  - parvati.uri {string}\n")
-		fmt.Print("    Override the default URI for parvati's backend.\n\n")
-		fmt.Print("\n")
-	}
-	if doSections["interfaces"] {
-		fmt.Print("Section interfaces:\n")
-		fmt.Print("  - interfaces.ipv4 {string}\n")
-		fmt.Print("    Force IPv4 to bind to this interface name or number.\n\n")
-		fmt.Print("  - interfaces.ipv6 {string}\n")
-		fmt.Print("    Force IPv6 to bind to this interface name or number.\n\n")
+	keys := KnownConfigKeys()
+	for _, s := range KnownConfigSections() {
+		if !doSections[s.Name] {
+			continue
+		}
+		fmt.Printf("Section %s:\n", s.Name)
+		if s.Description != "" {
+			fmt.Print(wrapText(s.Description, "  "), "\n")
+		}
+		for _, k := range keys {
+			if k.Section() != s.Name {
+				continue
+			}
+			fmt.Printf("  - %s {%s}", strings.Replace(k.Name, ".*.", ".NAME.", 1), k.Type)
+			if k.Default != "" {
+				fmt.Printf(" [default: %s]", k.Default)
+			}
+			fmt.Print("\n", wrapText(k.Description, "    "), "\n")
+		}
 		fmt.Print("\n")
 	}
-	if doSections["game"] {
-		fmt.Print("Section game:\n")
-		fmt.Print("  - game.NAME.enabled {boolean}\n")
-		fmt.Print("    Enable checking of the given game. Defaults to true if other keys\n")
-		fmt.Print("    exist.\n\n")
-		fmt.Print("  - game.NAME.hostMessage {string}\n")
-		fmt.Print("    Host message to use for a game (can be repeated).\n\n")
-		fmt.Print("  - game.NAME.hostMessageOrder {string}\n")
-		fmt.Print("    Order to use messages (can be either 'round-robin' or 'random').\n\n")
-		fmt.Print("  - game.NAME.onJoined {string list}\n")
-		fmt.Print("    If defined will attempt to call this program (with optional\n")
-		fmt.Print("    arguments) when your host is first joined. The first entry is the\n")
-		fmt.Print("    program to run, complete with path as required. Any extra strings\n")
-		fmt.Print("    are arguments to the program, one per entry in order.\n")
-		fmt.Print("    The following substitutions will be made before running to args:\n")
-		fmt.Print("      ${NICK} - will be replaced by the opponent's Parvati NickName'.\n\n")
-		fmt.Print("  - game.NAME.watchPort {integer}\n")
-		fmt.Print("    Override your online default port with this one to check for\n")
-		fmt.Print("    hosting.\n\n")
-	}
 	if self.FilePath {
 		fmt.Printf("The default configuration file path is:\n%s\n", def)
 	}
 	return nil
 }
 
+// Wraps text to 76 columns, each line starting with indent. Lines within the
+// text are kept, along with their own leading spaces.
+func wrapText(text, indent string) string {
+	const width = 76
+	out := ""
+	for _, para := range strings.Split(text, "\n") {
+		words := strings.Fields(para)
+		if len(words) == 0 {
+			continue
+		}
+		prefix := indent + para[:len(para)-len(strings.TrimLeft(para, " "))]
+		line := prefix + words[0]
+		for _, w := range words[1:] {
+			if len(line)+1+len(w) > width {
+				out += line + "\n"
+				line = prefix + w
+				continue
+			}
+			line += " " + w
+		}
+		out += line + "\n"
+	}
+	return out
+}
+
 func argsToMap(args, known []string) (map[string]bool, error) {
 	out := make(map[string]bool)
 	if len(args) == 0 { // do everything if not sections given
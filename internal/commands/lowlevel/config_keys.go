@@ -0,0 +1,97 @@
+package cmd_lowlevel
+
+import (
+	"github.com/jessevdk/go-flags"
+	"github.com/misatosangel/gitconfig"
+	"github.com/misatosangel/parvati-api-client/internal/iface"
+	"github.com/misatosangel/parvati-api-client/pkg/parvatigo"
+	"strings"
+)
+
+// Every key the client reads, grouped by section in the order sections are
+// first found, with the interfaces section after the parvati one.
+func KnownConfigKeys() []parvatigo.ConfigKey {
+	keys := parvatigo.ConfigKeys(&parvatigo.ApiConfig{})
+	ifaceKeys := parvatigo.ConfigKeys(&iface.Config{})
+	order := make([]string, 0, 8)
+	bySection := make(map[string][]parvatigo.ConfigKey)
+	for _, k := range keys {
+		name := k.Section()
+		if _, ok := bySection[name]; !ok {
+			order = append(order, name)
+			if name == "parvati" {
+				order = append(order, "interfaces")
+			}
+		}
+		bySection[name] = append(bySection[name], k)
+	}
+	bySection["interfaces"] = append(bySection["interfaces"], ifaceKeys...)
+	out := make([]parvatigo.ConfigKey, 0, len(keys)+len(ifaceKeys))
+	for _, name := range order {
+		out = append(out, bySection[name]...)
+	}
+	return out
+}
+
+// The sections of KnownConfigKeys, in the same order.
+func KnownConfigSections() []parvatigo.ConfigSection {
+	descs := make(map[string]string)
+	for _, s := range parvatigo.ConfigSections(&parvatigo.ApiConfig{}) {
+		descs[s.Name] = s.Description
+	}
+	out := make([]parvatigo.ConfigSection, 0, 8)
+	for _, k := range KnownConfigKeys() {
+		name := k.Section()
+		if len(out) == 0 || out[len(out)-1].Name != name {
+			out = append(out, parvatigo.ConfigSection{Name: name, Description: descs[name]})
+		}
+	}
+	return out
+}
+
+// A config key given on the command line, completed from KnownConfigKeys.
+// Keys in [section "NAME"] sections complete with the names in the default
+// config file.
+type ConfigKeyArg string
+
+func (self *ConfigKeyArg) Complete(match string) []flags.Completion {
+	subs := make(map[string][]string)
+	if path, err := parvatigo.DefaultConfigFile(); err == nil {
+		if f, err := parvatigo.OpenConfigFile(path); err == nil {
+			names, _ := f.Keys()
+			for _, name := range names {
+				if s, ss, _ := gitconfig.ParseSectionKey(name); ss != "" {
+					subs[s] = appendNew(subs[s], ss)
+				}
+			}
+		}
+	}
+	if s, ss, _ := gitconfig.ParseSectionKey(match); ss != "" {
+		subs[s] = appendNew(subs[s], ss)
+	}
+	out := make([]flags.Completion, 0, 8)
+	for _, k := range KnownConfigKeys() {
+		names := []string{k.Name}
+		if parts := strings.SplitN(k.Name, ".*.", 2); len(parts) == 2 {
+			names = names[:0]
+			for _, ss := range subs[parts[0]] {
+				names = append(names, parts[0]+"."+ss+"."+parts[1])
+			}
+		}
+		for _, name := range names {
+			if len(name) >= len(match) && strings.EqualFold(name[:len(match)], match) {
+				out = append(out, flags.Completion{Item: name, Description: k.Type})
+			}
+		}
+	}
+	return out
+}
+
+func appendNew(list []string, s string) []string {
+	for _, l := range list {
+		if l == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
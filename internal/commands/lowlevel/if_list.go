@@ -5,16 +5,24 @@ import (
 	"github.com/misatosangel/parvati-api-client/pkg/parvatigo"
 
 	"fmt"
+	"github.com/misatosangel/parvati-api-client/internal/iface"
 	"github.com/misatosangel/traceroute"
 	"log"
+	"time"
 )
 
 type IfaceList struct {
 	api          *parvatigo.Api
 	apiConfig    *parvatigo.ApiConfig
-	IgnoreConfig bool `short:"i" long:"ignore-config" required:"false" description:"Ignore game configuration pointers for filtering IP families."`
-	ShowV6       bool `short:"6" required:"false" description:"Include v6 IPs. Implies --ignore-config."`
-	ShowV4       bool `short:"4" required:"false" description:"Include v4 IPs. Implies --ignore-config."`
+	configFile   string
+	overrides    []parvatigo.ConfigOverride
+	STUN         bool          `long:"stun" required:"false" description:"Ask STUN servers to classify the NAT type of each address."`
+	Format       string        `short:"f" long:"format" choice:"text" choice:"json" default:"text" description:"Output format."`
+	Parallel     int           `long:"parallel" default:"4" value-name:"<count>" description:"Number of traceroutes to run at once."`
+	Budget       time.Duration `long:"budget" default:"30s" value-name:"<duration>" description:"Total time allowed for traceroutes; slower traces are cut short."`
+	IgnoreConfig bool          `short:"i" long:"ignore-config" required:"false" description:"Ignore game configuration pointers for filtering IP families."`
+	ShowV6       bool          `short:"6" required:"false" description:"Include v6 IPs. Implies --ignore-config."`
+	ShowV4       bool          `short:"4" required:"false" description:"Include v4 IPs. Implies --ignore-config."`
 }
 
 func (self *IfaceList) AddCommands(base *flags.Command) (*flags.Command, error) {
@@ -43,6 +51,29 @@ func (self *IfaceList) SetAPIConfig(apiConfig *parvatigo.ApiConfig) {
 	self.apiConfig = apiConfig
 }
 
+func (self *IfaceList) SetConfigFile(filePath string) {
+	self.configFile = filePath
+}
+
+func (self *IfaceList) SetConfigOverrides(overrides []parvatigo.ConfigOverride) {
+	self.overrides = overrides
+}
+
+func (self *IfaceList) listOptions() *ListOptions {
+	opts := &ListOptions{
+		CheckNAT:  self.STUN,
+		Format:    self.Format,
+		Inventory: iface.InventoryOptions{Parallel: self.Parallel, Budget: self.Budget},
+	}
+	// STUN servers come from the interfaces section of the configuration
+	if self.configFile != "" {
+		if conf, err := iface.ReadConfigWith(self.configFile, self.overrides); err == nil {
+			opts.STUNServers = conf.STUNServers
+		}
+	}
+	return opts
+}
+
 func (self *IfaceList) Execute(args []string) error {
 	if self.ShowV4 || self.ShowV6 {
 		self.IgnoreConfig = true
@@ -51,7 +82,7 @@ func (self *IfaceList) Execute(args []string) error {
 		self.ShowV6 = true
 	}
 	if self.api == nil || self.apiConfig == nil || self.IgnoreConfig {
-		return ShowDefaultList(self.ShowV4, self.ShowV6, false)
+		return ShowDefaultList(self.ShowV4, self.ShowV6, false, self.listOptions())
 	}
 	knownGames, err := self.api.GetGames()
 	if err != nil {
@@ -77,5 +108,5 @@ func (self *IfaceList) Execute(args []string) error {
 	if ipFlags&traceroute.WANT_PUBLIC_V6 != 0 {
 		wantIPV6 = true
 	}
-	return ShowDefaultList(wantIPV4, wantIPV6, true)
+	return ShowDefaultList(wantIPV4, wantIPV6, true, self.listOptions())
 }
@@ -0,0 +1,103 @@
+package cmd_lowlevel
+
+import (
+	"fmt"
+	"github.com/jessevdk/go-flags"
+	"github.com/misatosangel/parvati-api-client/pkg/parvatigo"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+type Profiles struct {
+}
+
+func (self *Profiles) AddCommands(base *flags.Command) (*flags.Command, error) {
+	c, err := base.AddCommand("Profiles", "Work with config file profiles.", "Profiles are [profile \"name\"] sections of the config file, each a Parvati account to pick with --profile or $"+parvatigo.ProfileEnv+".", self)
+	if err != nil {
+		return nil, err
+	}
+	c.Aliases = append(c.Aliases, "profiles")
+	if _, err := (&ProfilesList{}).AddCommands(c); err != nil {
+		return nil, err
+	}
+	return c, err
+}
+
+type ProfilesList struct {
+	apiConfig *parvatigo.ApiConfig
+}
+
+func (self *ProfilesList) AddCommands(base *flags.Command) (*flags.Command, error) {
+	c, err := base.AddCommand("ls", "List profiles.", "Use this to list the configured profiles, marking the one in use with '*'.", self)
+	if err != nil {
+		return nil, err
+	}
+	c.Aliases = append(c.Aliases, "list")
+	return c, err
+}
+
+func (self *ProfilesList) NeedsAPI() bool {
+	return false
+}
+
+func (self *ProfilesList) NeedsAPIConfig() bool {
+	return true
+}
+
+func (self *ProfilesList) SetAPI(api *parvatigo.Api) {
+}
+
+func (self *ProfilesList) SetAPIConfig(api *parvatigo.ApiConfig) {
+	self.apiConfig = api
+}
+
+func (self *ProfilesList) Execute(args []string) error {
+	conf := self.apiConfig
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "\tPROFILE\tUSERNAME\tURI\tAUTH\tGAMES")
+	mark := func(name string) string {
+		if name == conf.Profile {
+			return "*"
+		}
+		return ""
+	}
+	// the parvati section on its own, when no profile is used
+	base := conf.BaseProfile()
+	fmt.Fprintf(w, "%s\t(default)\t%s\t%s\t%s\t%s\n", mark(""), inherited(base.Username), base.URI, base.AuthMethod, profileGames(conf, ""))
+	for _, name := range conf.ProfileNames() {
+		p := conf.Profiles[name]
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", mark(name), name, inherited(p.Username), inherited(p.URI), inherited(p.AuthMethod), profileGames(conf, name))
+	}
+	return w.Flush()
+}
+
+func inherited(v string) string {
+	if v == "" {
+		return "-"
+	}
+	return v
+}
+
+// The game sections scoped to a profile, or unscoped for "".
+func profileGames(conf *parvatigo.ApiConfig, profile string) string {
+	out := make([]string, 0, len(conf.Games))
+	for n, g := range conf.Games {
+		if profile == "" && len(g.Profiles) == 0 {
+			out = append(out, n)
+			continue
+		}
+		for _, p := range g.Profiles {
+			if p == profile {
+				out = append(out, n)
+				break
+			}
+		}
+	}
+	if len(out) == 0 {
+		return "-"
+	}
+	sort.Strings(out)
+	return strings.Join(out, ",")
+}
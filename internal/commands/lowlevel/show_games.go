@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/jessevdk/go-flags"
 	"github.com/misatosangel/parvati-api-client/pkg/parvatigo"
+	"github.com/misatosangel/parvati-api-client/pkg/probe"
 	"github.com/misatosangel/parvati-api-client/pkg/swagger"
 	"sort"
 	"strings"
@@ -87,6 +88,9 @@ func MakupGame(g swagger.Game, apis, protocols, info bool) {
 			fmt.Printf("Protocols: %s\n", strings.Join(proto, ", "))
 			fmt.Printf("IPv4 Support: %t\n", ipv4Sup)
 			fmt.Printf("IPv6 Support: %t\n", ipv6Sup)
+			if p := probe.ForGame(&g); p != nil {
+				fmt.Printf("Local Probe: %s\n", p.Name())
+			}
 		}
 	}
 	if apis {
@@ -97,7 +101,7 @@ func MakupGame(g swagger.Game, apis, protocols, info bool) {
 		}
 		fmt.Printf("Parvati Checking URIs:\n")
 		for _, u := range g.APIs {
-			fmt.Printf(" - %s\n", u)
+			fmt.Printf(" - %s\n", u.Uri)
 		}
 	}
 }
@@ -3,11 +3,15 @@ package cmd_parvati
 import (
 	"fmt"
 	"github.com/jessevdk/go-flags"
+	"github.com/misatosangel/parvati-api-client/internal/ddns"
 	"github.com/misatosangel/parvati-api-client/internal/iface"
+	"github.com/misatosangel/parvati-api-client/internal/netwatch"
 	"github.com/misatosangel/parvati-api-client/pkg/parvatigo"
 	"github.com/misatosangel/parvati-api-client/pkg/swagger"
 	"github.com/misatosangel/traceroute"
+	"log"
 	"net"
+	"net/http"
 	"time"
 )
 
@@ -21,9 +25,50 @@ func AddCommands(base *flags.Command) (*flags.Command, error) {
 	if _, err := (&HostWatch{}).AddCommands(base); err != nil {
 		return base, err
 	}
+	if _, err := (&Feed{}).AddCommands(base); err != nil {
+		return base, err
+	}
+	if _, err := (&Notify{}).AddCommands(base); err != nil {
+		return base, err
+	}
+	if _, err := (&SelfTest{}).AddCommands(base); err != nil {
+		return base, err
+	}
+	if _, err := (&Diagnose{}).AddCommands(base); err != nil {
+		return base, err
+	}
+	if _, err := (&Login{}).AddCommands(base); err != nil {
+		return base, err
+	}
+	if _, err := (&Logout{}).AddCommands(base); err != nil {
+		return base, err
+	}
+	if _, err := (&Config{}).AddCommands(base); err != nil {
+		return base, err
+	}
+	if _, err := (&Init{}).AddCommands(base); err != nil {
+		return base, err
+	}
 	return base, nil
 }
 
+// Serves the API's metrics at /metrics on the given address in the background.
+func ServeMetrics(api *parvatigo.Api, addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("Unable to listen for metrics on '%s': %s\n", addr, err.Error())
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", api.Metrics)
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			log.Println("Metrics server stopped: " + err.Error())
+		}
+	}()
+	fmt.Printf("Serving metrics on http://%s/metrics\n", ln.Addr().String())
+	return nil
+}
+
 func DumpUserData(user *swagger.User, show_ids, has_admin bool) {
 	def := "[not set]"
 	bDef := "false"
@@ -89,43 +134,43 @@ func TranslateDate(d string) string {
 	return t.String()
 }
 
-func UpdateIPs(api *parvatigo.Api, ipFlags, v4INum, v6INum int, doIt bool) (*swagger.UserDelta, error) {
+// Works out public IPs and updates Parvati with any that changed (if doIt).
+// If dyn is set the same addresses are also pushed to dynamic DNS.
+func UpdateIPs(api *parvatigo.Api, ipFlags int, ifaceConfig *iface.Config, dyn *ddns.Updater, doIt bool) (*swagger.UserDelta, error) {
 	list, err := iface.NewList(ipFlags | traceroute.WANT_LIVE_IP)
 	if err != nil {
 		return nil, err
 	}
+	chain, err := ifaceConfig.ResolverChain()
+	if err != nil {
+		return nil, err
+	}
+	if list.IPv6Policy, err = iface.ParseIPv6Policy(ifaceConfig.IPv6Policy); err != nil {
+		return nil, err
+	}
 	user, err := api.GetDetails()
 	if err != nil {
 		return nil, err
 	}
 
-	var v4, v6 net.IP
+	var v4, v6, pub4, pub6 net.IP
 	var v4Err, v6Err error
 
 	if ipFlags&traceroute.WANT_PUBLIC_V4 != 0 {
-		addr, err := list.GetPublicIP(v4INum, traceroute.WANT_PUBLIC_V4|traceroute.WANT_PRIVATE_V4|traceroute.WANT_LIVE_IP)
-		if err != nil {
-			v4Err = err
-		} else if user.Ipv4 == "" {
-			v4 = addr.RemoteIP
-		} else {
-			uIP := net.ParseIP(user.Ipv4)
-			if !addr.RemoteIP.Equal(uIP) {
-				v4 = addr.RemoteIP
-			}
+		pub4, v4Err = chain.Resolve(list, ifaceConfig.V4ID, false)
+		if v4Err == nil && !pub4.Equal(net.ParseIP(user.Ipv4)) {
+			v4 = pub4
 		}
 	}
 	if ipFlags&traceroute.WANT_PUBLIC_V6 != 0 {
-		addr, err := list.GetPublicIP(v4INum, traceroute.WANT_PUBLIC_V6|traceroute.WANT_PRIVATE_V6|traceroute.WANT_LIVE_IP)
-		if err != nil {
-			v6Err = err
-		} else if user.Ipv4 == "" {
-			v6 = addr.RemoteIP
-		} else {
-			uIP := net.ParseIP(user.Ipv6)
-			if !addr.RemoteIP.Equal(uIP) {
-				v6 = addr.RemoteIP
-			}
+		pub6, v6Err = chain.Resolve(list, ifaceConfig.V6ID, true)
+		if v6Err == nil && !pub6.Equal(net.ParseIP(user.Ipv6)) {
+			v6 = pub6
+		}
+	}
+	if dyn != nil && (pub4 != nil || pub6 != nil) {
+		for _, err := range dyn.Push(pub4, pub6) {
+			log.Println(err)
 		}
 	}
 	// nothing to do, assuming we didn't error earlier
@@ -147,7 +192,7 @@ func UpdateIPs(api *parvatigo.Api, ipFlags, v4INum, v6INum int, doIt bool) (*swa
 			delta.Delta.IPv4 = []string{user.Ipv4, v4.String()}
 		}
 		if v6 != nil {
-			delta.Delta.IPv4 = []string{user.Ipv6, v6.String()}
+			delta.Delta.IPv6 = []string{user.Ipv6, v6.String()}
 		}
 		return delta, nil
 	}
@@ -158,8 +203,29 @@ func UpdateIPs(api *parvatigo.Api, ipFlags, v4INum, v6INum int, doIt bool) (*swa
 	return &d, nil
 }
 
-func ConfigureIfacePrefs(confFile, inV4, inV6 string) (*iface.Config, error) {
-	conf, err := iface.ReadConfig(confFile)
+// How often IPs are rechecked anyway when network change events are
+// available. The public side of a NAT can change with no local event, so
+// this is kept short enough that a new public IP is not missed for long.
+const NetworkRefresh = time.Minute
+
+// Starts watching for local network changes unless poll is set. A nil
+// watcher means change events are unavailable and the caller should poll.
+func WatchNetwork(poll bool) *netwatch.Watcher {
+	if poll {
+		return nil
+	}
+	w, err := netwatch.New()
+	if err != nil {
+		if err != netwatch.ErrUnsupported {
+			log.Printf("Unable to watch for network changes, polling instead: %s", err.Error())
+		}
+		return nil
+	}
+	return w
+}
+
+func ConfigureIfacePrefs(confFile string, overrides []parvatigo.ConfigOverride, inV4, inV6 string) (*iface.Config, error) {
+	conf, err := iface.ReadConfigWith(confFile, overrides)
 	if err != nil {
 		return nil, fmt.Errorf("Unable to read interface information from '%s'\n:%s", confFile, err.Error())
 	}
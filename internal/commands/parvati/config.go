@@ -0,0 +1,505 @@
+package cmd_parvati
+
+import (
+	"fmt"
+	"github.com/jessevdk/go-flags"
+	"github.com/misatosangel/parvati-api-client/internal/commands/lowlevel"
+	"github.com/misatosangel/parvati-api-client/internal/iface"
+	"github.com/misatosangel/parvati-api-client/internal/portmap"
+	"github.com/misatosangel/parvati-api-client/pkg/parvatigo"
+	"os"
+	"os/exec"
+	"strings"
+	"text/tabwriter"
+)
+
+type Config struct {
+}
+
+func (self *Config) AddCommands(base *flags.Command) (*flags.Command, error) {
+	c, err := base.AddCommand("Config", "Read and change the config file.", "Use these to get, set and check config file values without hand-editing it. Comments and layout are kept. Run ConfigHelp for the keys.", self)
+	if err != nil {
+		return nil, err
+	}
+	c.Aliases = append(c.Aliases, "config")
+	subs := []interface {
+		AddCommands(*flags.Command) (*flags.Command, error)
+	}{&ConfigGet{}, &ConfigSet{}, &ConfigUnset{}, &ConfigList{}, &ConfigExplain{}, &ConfigEdit{}, &ConfigValidate{}}
+	for _, sub := range subs {
+		if _, err := sub.AddCommands(c); err != nil {
+			return nil, err
+		}
+	}
+	return c, err
+}
+
+// What all the Config subcommands are given.
+type configCommand struct {
+	api        *parvatigo.Api
+	configFile string
+	overrides  []parvatigo.ConfigOverride
+}
+
+func (self *configCommand) NeedsAPI() bool {
+	return false
+}
+
+func (self *configCommand) NeedsAPIConfig() bool {
+	return false
+}
+
+func (self *configCommand) SetAPI(api *parvatigo.Api) {
+	self.api = api
+}
+
+func (self *configCommand) SetAPIConfig(api *parvatigo.ApiConfig) {
+}
+
+func (self *configCommand) SetConfigFile(filePath string) {
+	self.configFile = filePath
+}
+
+func (self *configCommand) SetConfigOverrides(overrides []parvatigo.ConfigOverride) {
+	self.overrides = overrides
+}
+
+func (self *configCommand) open() (*parvatigo.ConfigFile, error) {
+	if self.configFile == "" {
+		return nil, fmt.Errorf("No config file path; use --config\n")
+	}
+	return parvatigo.OpenConfigFile(self.configFile)
+}
+
+// As open, but the file must be there already.
+func (self *configCommand) openExisting() (*parvatigo.ConfigFile, error) {
+	if self.configFile != "" {
+		if _, err := os.Stat(self.configFile); err != nil {
+			return nil, fmt.Errorf("Unable to read %s: %s\nRun Init to create it.\n", self.configFile, err.Error())
+		}
+	}
+	return self.open()
+}
+
+type ConfigGet struct {
+	configCommand
+	All  bool `short:"a" long:"all" description:"Print every value of a repeated key, not just the last."`
+	Args struct {
+		Key cmd_lowlevel.ConfigKeyArg `positional-arg-name:"<key>" required:"true" description:"section.key or section.subsection.key"`
+	} `positional-args:"yes"`
+}
+
+func (self *ConfigGet) AddCommands(base *flags.Command) (*flags.Command, error) {
+	c, err := base.AddCommand("get", "Print a config value.", "Use this to print the value of a key from the config file. Repeated keys print every value.", self)
+	if err != nil {
+		return nil, err
+	}
+	return c, err
+}
+
+func (self *ConfigGet) Execute(args []string) error {
+	f, err := self.openExisting()
+	if err != nil {
+		return err
+	}
+	name := string(self.Args.Key)
+	values, err := f.Get(name)
+	if err != nil {
+		return err
+	}
+	key := parvatigo.FindConfigKey(cmd_lowlevel.KnownConfigKeys(), name)
+	if len(values) == 0 {
+		if key != nil && key.Default != "" {
+			return fmt.Errorf("Key '%s' is not set (it defaults to '%s')\n", name, key.Default)
+		}
+		return fmt.Errorf("Key '%s' is not set\n", name)
+	}
+	if !self.All && (key == nil || !key.Multi) {
+		values = values[len(values)-1:]
+	}
+	for _, v := range values {
+		fmt.Println(v)
+	}
+	return nil
+}
+
+type ConfigSet struct {
+	configCommand
+	Add   bool `long:"add" description:"Add another value to a repeated key rather than replacing its values."`
+	Force bool `short:"f" long:"force" description:"Save even if the change makes the config invalid."`
+	Args  struct {
+		Key   cmd_lowlevel.ConfigKeyArg `positional-arg-name:"<key>" required:"true" description:"section.key or section.subsection.key"`
+		Value string                    `positional-arg-name:"<value>" required:"true"`
+	} `positional-args:"yes"`
+}
+
+func (self *ConfigSet) AddCommands(base *flags.Command) (*flags.Command, error) {
+	c, err := base.AddCommand("set", "Set a config value.", "Use this to set a key in the config file, replacing any values it has. The value is checked first, and the file is only changed if it stays valid.", self)
+	if err != nil {
+		return nil, err
+	}
+	return c, err
+}
+
+func (self *ConfigSet) Execute(args []string) error {
+	f, err := self.open()
+	if err != nil {
+		return err
+	}
+	name := string(self.Args.Key)
+	key := parvatigo.FindConfigKey(cmd_lowlevel.KnownConfigKeys(), name)
+	if key == nil {
+		fmt.Fprintf(os.Stderr, "Warning: '%s' is not a key the client uses; see ConfigHelp.\n", name)
+	} else {
+		if err := key.Check(self.Args.Value); err != nil {
+			return err
+		}
+		if self.Add && !key.Multi {
+			return fmt.Errorf("%s holds one value, so cannot be given --add\n", key.Name)
+		}
+	}
+	before := problems(f)
+	if self.Add {
+		err = f.Add(name, self.Args.Value)
+	} else {
+		err = f.Set(name, self.Args.Value)
+	}
+	if err != nil {
+		return err
+	}
+	return saveIfValid(f, before, self.Force)
+}
+
+type ConfigUnset struct {
+	configCommand
+	Force bool `short:"f" long:"force" description:"Save even if the change makes the config invalid."`
+	Args  struct {
+		Key cmd_lowlevel.ConfigKeyArg `positional-arg-name:"<key>" required:"true" description:"section.key or section.subsection.key"`
+	} `positional-args:"yes"`
+}
+
+func (self *ConfigUnset) AddCommands(base *flags.Command) (*flags.Command, error) {
+	c, err := base.AddCommand("unset", "Remove a config value.", "Use this to remove every value of a key from the config file.", self)
+	if err != nil {
+		return nil, err
+	}
+	return c, err
+}
+
+func (self *ConfigUnset) Execute(args []string) error {
+	f, err := self.open()
+	if err != nil {
+		return err
+	}
+	before := problems(f)
+	n, err := f.Unset(string(self.Args.Key))
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("Key '%s' is not set\n", self.Args.Key)
+	}
+	return saveIfValid(f, before, self.Force)
+}
+
+// The config-only problems with the file, by message.
+func problems(f *parvatigo.ConfigFile) map[string]bool {
+	out := make(map[string]bool)
+	conf, err := f.Load()
+	if err != nil {
+		out[err.Error()] = true
+		return out
+	}
+	for _, err := range conf.Validate() {
+		out[err.Error()] = true
+	}
+	return out
+}
+
+// Saves the file unless the change brought new problems.
+func saveIfValid(f *parvatigo.ConfigFile, before map[string]bool, force bool) error {
+	added := make([]string, 0)
+	for p := range problems(f) {
+		if !before[p] {
+			added = append(added, strings.TrimSpace(p))
+		}
+	}
+	if len(added) != 0 {
+		if !force {
+			return fmt.Errorf("Not saved, as this makes the config invalid:\n - %s\nUse --force to save anyway.\n", strings.Join(added, "\n - "))
+		}
+		fmt.Fprintf(os.Stderr, "Warning: saving an invalid config:\n - %s\n", strings.Join(added, "\n - "))
+	}
+	return f.Save()
+}
+
+type ConfigList struct {
+	configCommand
+}
+
+func (self *ConfigList) AddCommands(base *flags.Command) (*flags.Command, error) {
+	c, err := base.AddCommand("list", "List config values.", "Use this to print every key set in the config file as key=value, in file order.", self)
+	if err != nil {
+		return nil, err
+	}
+	c.Aliases = append(c.Aliases, "ls")
+	return c, err
+}
+
+func (self *ConfigList) Execute(args []string) error {
+	f, err := self.openExisting()
+	if err != nil {
+		return err
+	}
+	conf, err := f.Parse()
+	if err != nil {
+		return err
+	}
+	names, _ := f.Keys()
+	for _, name := range names {
+		for _, v := range conf.GetKeyValuesStrings(name) {
+			fmt.Printf("%s=%s\n", name, v)
+		}
+	}
+	return nil
+}
+
+type ConfigExplain struct {
+	configCommand
+	apiConfig *parvatigo.ApiConfig
+	Args      struct {
+		Keys []cmd_lowlevel.ConfigKeyArg `positional-arg-name:"<key>" description:"Keys or sections to explain (default all)"`
+	} `positional-args:"yes"`
+}
+
+func (self *ConfigExplain) AddCommands(base *flags.Command) (*flags.Command, error) {
+	c, err := base.AddCommand("explain", "Show where config values come from.", "Use this to print the value the client uses for each key, and whether it came from its default, the config file, a profile, a PARVATI_* environment variable or a --set flag, in increasing precedence. Secrets are not shown.", self)
+	if err != nil {
+		return nil, err
+	}
+	return c, err
+}
+
+func (self *ConfigExplain) SetAPIConfig(api *parvatigo.ApiConfig) {
+	self.apiConfig = api
+}
+
+func (self *ConfigExplain) Execute(args []string) error {
+	f, err := self.open()
+	if err != nil {
+		return err
+	}
+	conf, err := f.Parse()
+	if err != nil {
+		return err
+	}
+	known := cmd_lowlevel.KnownConfigKeys()
+	overrides := parvatigo.ApplyOverrides(conf, known, self.overrides)
+	profile := ""
+	if self.apiConfig != nil {
+		profile = self.apiConfig.Profile
+	}
+	values, err := parvatigo.ExplainConfig(f, known, overrides, profile)
+	if err != nil {
+		return err
+	}
+	if self.apiConfig != nil {
+		values = self.withPassword(values)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tVALUE\tSOURCE")
+	for _, v := range values {
+		if !self.wanted(v.Name) {
+			continue
+		}
+		source := v.Source
+		if v.From != "" {
+			source += " " + v.From
+		}
+		if v.Profile != "" {
+			source += " (profile " + v.Profile + ")"
+		}
+		for i, value := range v.Values {
+			if v.Key.Secret && value != "" {
+				value = "(hidden)"
+			}
+			if i == 0 {
+				fmt.Fprintf(w, "%s\t%s\t%s\n", v.Name, value, source)
+			} else {
+				fmt.Fprintf(w, "\t%s\t\n", value)
+			}
+		}
+	}
+	return w.Flush()
+}
+
+// Looks up the password and adds it, when not from the config.
+func (self *ConfigExplain) withPassword(values []parvatigo.ConfiguredValue) []parvatigo.ConfiguredValue {
+	self.apiConfig.LoadCredentials()
+	switch self.apiConfig.PasswordSource {
+	case "", parvatigo.CredentialsConfig:
+		return values
+	}
+	for _, v := range values {
+		if v.Name == "parvati.password" {
+			return values
+		}
+	}
+	key := parvatigo.FindConfigKey(cmd_lowlevel.KnownConfigKeys(), "parvati.password")
+	pw := parvatigo.ConfiguredValue{Name: key.Name, Key: key, Values: []string{self.apiConfig.Password}, Source: self.apiConfig.PasswordSource}
+	for i, v := range values {
+		if v.Key.Section() != "parvati" {
+			return append(values[:i], append([]parvatigo.ConfiguredValue{pw}, values[i:]...)...)
+		}
+	}
+	return append(values, pw)
+}
+
+// Whether a key was asked for, by its name or section.
+func (self *ConfigExplain) wanted(name string) bool {
+	if len(self.Args.Keys) == 0 {
+		return true
+	}
+	for _, k := range self.Args.Keys {
+		if strings.EqualFold(string(k), name) || strings.EqualFold(string(k), strings.SplitN(name, ".", 2)[0]) {
+			return true
+		}
+	}
+	return false
+}
+
+type ConfigEdit struct {
+	configCommand
+}
+
+func (self *ConfigEdit) AddCommands(base *flags.Command) (*flags.Command, error) {
+	c, err := base.AddCommand("edit", "Edit the config file.", "Use this to open the config file in $VISUAL or $EDITOR (else vi), checking it when you are done.", self)
+	if err != nil {
+		return nil, err
+	}
+	return c, err
+}
+
+func (self *ConfigEdit) Execute(args []string) error {
+	if self.configFile == "" {
+		return fmt.Errorf("No config file path; use --config\n")
+	}
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+	cmd := exec.Command("/bin/sh", "-c", editor+" \"$@\"", editor, self.configFile)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Editor '%s' failed: %s\n", editor, err.Error())
+	}
+	return (&ConfigValidate{configCommand: self.configCommand, Offline: true}).Execute(nil)
+}
+
+type ConfigValidate struct {
+	configCommand
+	Offline bool `long:"offline" description:"Do not check game names against Parvati's game list."`
+}
+
+func (self *ConfigValidate) AddCommands(base *flags.Command) (*flags.Command, error) {
+	c, err := base.AddCommand("validate", "Check the config file.", "Use this to check the config file's values: message orders, ports, interfaces, dynamic DNS and port mapping settings, and that games exist on Parvati. Unknown keys are warned about.", self)
+	if err != nil {
+		return nil, err
+	}
+	c.Aliases = append(c.Aliases, "check")
+	return c, err
+}
+
+func (self *ConfigValidate) Execute(args []string) error {
+	f, err := self.openExisting()
+	if err != nil {
+		return err
+	}
+	errs, warnings := self.check(f)
+	for _, w := range warnings {
+		fmt.Printf("Warning: %s\n", strings.TrimSpace(w))
+	}
+	for _, e := range errs {
+		fmt.Printf("Error: %s\n", strings.TrimSpace(e))
+	}
+	if len(errs) != 0 {
+		return fmt.Errorf("%s has %d error(s)\n", f.Path, len(errs))
+	}
+	fmt.Printf("%s is valid.\n", f.Path)
+	return nil
+}
+
+func (self *ConfigValidate) check(f *parvatigo.ConfigFile) ([]string, []string) {
+	errs := make([]string, 0)
+	warnings := make([]string, 0)
+	parsed, err := f.Parse()
+	if err != nil {
+		return append(errs, err.Error()), warnings
+	}
+	known := cmd_lowlevel.KnownConfigKeys()
+	names, lines := f.Keys()
+	for i, name := range names {
+		key := parvatigo.FindConfigKey(known, name)
+		if key == nil {
+			warnings = append(warnings, fmt.Sprintf("line %d: unknown key '%s'", lines[i], name))
+			continue
+		}
+		for _, v := range parsed.GetKeyValuesStrings(name) {
+			if err := key.Check(v); err != nil {
+				errs = append(errs, fmt.Sprintf("line %d: %s", lines[i], err.Error()))
+			}
+		}
+	}
+	var conf parvatigo.ApiConfig
+	if err := parsed.Load(&conf); err != nil {
+		return append(errs, err.Error()), warnings
+	}
+	for _, err := range conf.Validate() {
+		errs = append(errs, err.Error())
+	}
+	if _, err := NewDDNSUpdater(conf.DDNS, true); err != nil {
+		errs = append(errs, err.Error())
+	}
+	for _, m := range conf.PortMap.Methods {
+		if _, err := portmap.NewMapper(m, nil, nil); err != nil {
+			errs = append(errs, "portmap.method: "+err.Error())
+		}
+	}
+	for _, p := range conf.PortMap.Protocols {
+		if p != "udp" && p != "tcp" {
+			errs = append(errs, fmt.Sprintf("Unknown portmap.protocol '%s' (use udp or tcp)", p))
+		}
+	}
+	var ifaceConf iface.Config
+	if err := parsed.Load(&ifaceConf); err != nil {
+		errs = append(errs, err.Error())
+	} else if err := ifaceConf.Configure(nil); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if len(conf.Games) == 0 {
+		return errs, warnings
+	}
+	if self.Offline || self.api == nil {
+		warnings = append(warnings, "game names were not checked against Parvati's game list")
+		return errs, warnings
+	}
+	knownGames, apiErr := self.api.GetGames()
+	if apiErr != nil {
+		warnings = append(warnings, "unable to fetch Parvati's game list: "+apiErr.Error())
+		return errs, warnings
+	}
+	for name, g := range conf.Games {
+		short := g.Name
+		if short == "" {
+			short = name
+		}
+		if _, err := cmd_lowlevel.FindGames(knownGames, []string{short}); err != nil {
+			errs = append(errs, fmt.Sprintf("game.%s: no game '%s' on Parvati; use ListKnownGames to see them", name, short))
+		}
+	}
+	return errs, warnings
+}
@@ -0,0 +1,68 @@
+package cmd_parvati
+
+import (
+	"fmt"
+	"github.com/misatosangel/parvati-api-client/internal/ddns"
+	"github.com/misatosangel/parvati-api-client/pkg/parvatigo"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Builds an updater for each enabled [ddns "name"] section, in name order.
+// A nil updater means no dynamic DNS is configured.
+func NewDDNSUpdater(confs map[string]parvatigo.DDNSConfig, dryRun bool) (*ddns.Updater, error) {
+	names := make([]string, 0, len(confs))
+	for name, conf := range confs {
+		if conf.Enabled {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+	sort.Strings(names)
+	updater := &ddns.Updater{DryRun: dryRun, Log: os.Stdout}
+	for _, name := range names {
+		conf := confs[name]
+		hostname := conf.Hostname
+		if hostname == "" {
+			hostname = name
+		}
+		var p ddns.Provider
+		switch strings.ToLower(conf.Protocol) {
+		case "dyndns2":
+			d := &ddns.DynDNS2{
+				Server:   conf.Server,
+				Hostname: hostname,
+				Username: conf.Username,
+				Password: conf.Password,
+			}
+			if err := d.Validate(); err != nil {
+				return nil, fmt.Errorf("Bad ddns section '%s': %s", name, err.Error())
+			}
+			p = d
+		case "rfc2136":
+			d := &ddns.RFC2136{
+				Server:       conf.Server,
+				Zone:         conf.Zone,
+				Hostname:     hostname,
+				TTL:          uint32(conf.TTL),
+				KeyName:      conf.KeyName,
+				KeyAlgorithm: conf.KeyAlgorithm,
+				KeySecret:    conf.KeySecret,
+			}
+			if err := d.Validate(); err != nil {
+				return nil, fmt.Errorf("Bad ddns section '%s': %s", name, err.Error())
+			}
+			p = d
+		default:
+			return nil, fmt.Errorf("Bad ddns section '%s': unknown protocol '%s' (use dyndns2 or rfc2136)\n", name, conf.Protocol)
+		}
+		if !conf.IPv4 && !conf.IPv6 {
+			return nil, fmt.Errorf("Bad ddns section '%s': both ipv4 and ipv6 are disabled\n", name)
+		}
+		updater.Providers = append(updater.Providers, ddns.Families(p, conf.IPv4, conf.IPv6))
+	}
+	return updater, nil
+}
@@ -0,0 +1,353 @@
+package cmd_parvati
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/jessevdk/go-flags"
+	"github.com/misatosangel/parvati-api-client/internal/commands/lowlevel"
+	"github.com/misatosangel/parvati-api-client/pkg/parvatigo"
+	"github.com/misatosangel/parvati-api-client/pkg/swagger"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Feed struct {
+	api      *parvatigo.Api
+	Games    []string `short:"g" long:"game" description:"Follow this game (by short name or name); can be repeated. Defaults to all known games." value-name:"<game>"`
+	Format   string   `short:"f" long:"format" choice:"ndjson" choice:"sse" choice:"atom" choice:"rss" default:"ndjson" description:"Output format: newline-delimited JSON or Server-Sent Events event streams, or atom or rss documents of the host list and history."`
+	Listen   string   `short:"l" long:"listen" required:"false" value-name:"<host:port>" description:"Serve the feed over HTTP at /feed rather than writing to stdout."`
+	Interval uint     `short:"i" long:"interval" default:"15" value-name:"<seconds>" description:"Seconds between host list polls, or between rewrites of --output. Served atom and rss documents are reused for as long."`
+	Output   string   `short:"o" long:"output" required:"false" value-name:"<path>" description:"With atom or rss, rewrite this file every interval rather than writing once to stdout."`
+	History  int32    `long:"history" default:"20" value-name:"<count>" description:"With atom or rss, include up to this many recent announcements (100 max)."`
+	User     string   `short:"u" long:"user" required:"false" value-name:"<nick>|<id>" description:"With atom or rss, take history from this user rather than everyone."`
+}
+
+func (self *Feed) AddCommands(base *flags.Command) (*flags.Command, error) {
+	c, err := base.AddCommand("Feed", "Stream host list changes.", "Use this to follow hosts and waiters appearing, changing status and going away, as a stream of events.", self)
+	if err != nil {
+		return nil, err
+	}
+	c.Aliases = append(c.Aliases, "feed")
+	return c, err
+}
+
+func (self *Feed) NeedsAPI() bool {
+	return true
+}
+
+func (self *Feed) NeedsAPIConfig() bool {
+	return false
+}
+
+func (self *Feed) SetAPI(api *parvatigo.Api) {
+	self.api = api
+}
+
+func (self *Feed) SetAPIConfig(api *parvatigo.ApiConfig) {
+}
+
+func (self *Feed) Execute(args []string) error {
+	knownGames, apiErr := self.api.GetGames()
+	if apiErr != nil {
+		return apiErr
+	}
+	games, err := cmd_lowlevel.FindGames(knownGames, self.Games)
+	if err != nil {
+		return err
+	}
+	if len(games) == 0 {
+		return fmt.Errorf("Parvati's backend is not configured; no known games were found.\n")
+	}
+	if self.Format == "atom" || self.Format == "rss" {
+		return self.executeDocument(games)
+	}
+	watcher := parvatigo.NewWatcher(self.api, games, time.Duration(self.Interval)*time.Second)
+	watcher.OnError = func(game *swagger.Game, err *parvatigo.ApiError) {
+		log.Printf("Unable to fetch host list for %s: %s\n", game.Name, err.Error())
+	}
+	go watcher.Run()
+	defer watcher.Stop()
+
+	signalC := make(chan os.Signal, 1)
+	signal.Notify(signalC, os.Interrupt)
+	if self.Listen == "" {
+		return self.writeEvents(os.Stdout, watcher.Events(), signalC)
+	}
+	hub := newFeedHub()
+	ln, err := net.Listen("tcp", self.Listen)
+	if err != nil {
+		return fmt.Errorf("Unable to listen for feed on '%s': %s\n", self.Listen, err.Error())
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/feed", func(w http.ResponseWriter, r *http.Request) {
+		self.serveEvents(hub, w, r)
+	})
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			log.Println("Feed server stopped: " + err.Error())
+		}
+	}()
+	fmt.Fprintf(os.Stderr, "Serving feed on http://%s/feed. Hit CTRL+C to stop.\n", ln.Addr().String())
+	for {
+		select {
+		case ev, ok := <-watcher.Events():
+			if !ok {
+				return nil
+			}
+			hub.publish(ev)
+		case sig := <-signalC:
+			fmt.Fprintln(os.Stderr, "Stopping on signal:", sig)
+			return nil
+		}
+	}
+}
+
+func (self *Feed) executeDocument(games []*swagger.Game) error {
+	if self.History < 0 {
+		return fmt.Errorf("Bad --history %d: give a count of 0 or more\n", self.History)
+	}
+	if self.History > 100 {
+		self.History = 100
+	}
+	if self.Listen == "" && self.Output == "" {
+		return self.writeDocument(os.Stdout, games)
+	}
+	doc := &feedCache{
+		ttl:         time.Duration(self.Interval) * time.Second,
+		contentType: "application/" + self.Format + "+xml",
+		render: func(w io.Writer) error {
+			return self.writeDocument(w, games)
+		},
+	}
+	if self.Listen != "" {
+		ln, err := net.Listen("tcp", self.Listen)
+		if err != nil {
+			return fmt.Errorf("Unable to listen for feed on '%s': %s\n", self.Listen, err.Error())
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/feed", doc)
+		go func() {
+			if err := http.Serve(ln, mux); err != nil {
+				log.Println("Feed server stopped: " + err.Error())
+			}
+		}()
+		fmt.Fprintf(os.Stderr, "Serving %s feed on http://%s/feed. Hit CTRL+C to stop.\n", self.Format, ln.Addr().String())
+	}
+	signalC := make(chan os.Signal, 1)
+	signal.Notify(signalC, os.Interrupt)
+	ticker := time.NewTicker(time.Duration(self.Interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		if self.Output != "" {
+			if err := writeDocumentFile(self.Output, doc); err != nil {
+				log.Println(err)
+			}
+		}
+		select {
+		case <-ticker.C:
+		case sig := <-signalC:
+			fmt.Fprintln(os.Stderr, "Stopping on signal:", sig)
+			return nil
+		}
+	}
+}
+
+func (self *Feed) writeDocument(w io.Writer, games []*swagger.Game) error {
+	entries := make([]parvatigo.FeedEntry, 0, 20)
+	names := make([]string, len(games))
+	for i, game := range games {
+		names[i] = game.Name
+		gEntries, err := self.api.GetFeedEntries(game, self.User, self.History)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, gEntries...)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Waiter.Started.After(entries[j].Waiter.Started)
+	})
+	title := "Parvati hosts: " + strings.Join(names, ", ")
+	return parvatigo.RenderFeed(w, self.Format, title, self.api.Config.BasePath, entries)
+}
+
+// Write via a temporary file so readers never see a partial document.
+func writeDocumentFile(path string, doc *feedCache) error {
+	body, _, err := doc.get()
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	fh, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = fh.Write(body)
+	if closeErr := fh.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// A rendered feed document, reused for ttl so that /feed requests and
+// --output rewrites do not each hit the backend. Clients get an ETag, so
+// polling one that has not changed costs nothing.
+type feedCache struct {
+	ttl         time.Duration
+	contentType string
+	render      func(w io.Writer) error
+
+	mu      sync.Mutex
+	body    []byte
+	etag    string
+	expires time.Time
+}
+
+// The document and its ETag, rendered again if older than ttl.
+func (self *feedCache) get() ([]byte, string, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.body != nil && time.Now().Before(self.expires) {
+		return self.body, self.etag, nil
+	}
+	var buf bytes.Buffer
+	if err := self.render(&buf); err != nil {
+		return nil, "", err
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	self.body = buf.Bytes()
+	self.etag = `"` + hex.EncodeToString(sum[:16]) + `"`
+	self.expires = time.Now().Add(self.ttl)
+	return self.body, self.etag, nil
+}
+
+func (self *feedCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, etag, err := self.get()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(self.ttl.Seconds())))
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", self.contentType)
+	w.Write(body)
+}
+
+func (self *Feed) writeEvents(w io.Writer, events <-chan parvatigo.Event, signalC chan os.Signal) error {
+	var seq uint64
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return nil
+			}
+			seq++
+			if err := WriteEvent(w, self.Format, seq, &ev); err != nil {
+				return err
+			}
+		case sig := <-signalC:
+			fmt.Fprintln(os.Stderr, "Stopping on signal:", sig)
+			return nil
+		}
+	}
+}
+
+func (self *Feed) serveEvents(hub *feedHub, w http.ResponseWriter, r *http.Request) {
+	flusher, canFlush := w.(http.Flusher)
+	if self.Format == "sse" {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.WriteHeader(http.StatusOK)
+	if canFlush {
+		flusher.Flush()
+	}
+	events := hub.subscribe()
+	defer hub.unsubscribe(events)
+	var seq uint64
+	for {
+		select {
+		case ev := <-events:
+			seq++
+			if err := WriteEvent(w, self.Format, seq, &ev); err != nil {
+				return
+			}
+			if canFlush {
+				flusher.Flush()
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// Write a single event as either a JSON line ("ndjson") or a Server-Sent
+// Event ("sse") with the given sequence number as its id.
+func WriteEvent(w io.Writer, format string, seq uint64, ev *parvatigo.Event) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	if format == "sse" {
+		_, err = fmt.Fprintf(w, "event: %s\nid: %d\ndata: %s\n\n", ev.Type, seq, data)
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
+
+// Fans events out to every connected HTTP client. Slow clients miss events
+// rather than holding up the others.
+type feedHub struct {
+	mu      sync.Mutex
+	clients map[chan parvatigo.Event]bool
+}
+
+func newFeedHub() *feedHub {
+	return &feedHub{clients: make(map[chan parvatigo.Event]bool)}
+}
+
+func (self *feedHub) subscribe() chan parvatigo.Event {
+	c := make(chan parvatigo.Event, 32)
+	self.mu.Lock()
+	self.clients[c] = true
+	self.mu.Unlock()
+	return c
+}
+
+func (self *feedHub) unsubscribe(c chan parvatigo.Event) {
+	self.mu.Lock()
+	delete(self.clients, c)
+	self.mu.Unlock()
+}
+
+func (self *feedHub) publish(ev parvatigo.Event) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	for c := range self.clients {
+		select {
+		case c <- ev:
+		default:
+		}
+	}
+}
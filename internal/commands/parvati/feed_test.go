@@ -0,0 +1,50 @@
+package cmd_parvati
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFeedCache(t *testing.T) {
+	renders := 0
+	doc := &feedCache{ttl: time.Hour, contentType: "application/atom+xml", render: func(w io.Writer) error {
+		renders++
+		_, err := fmt.Fprintf(w, "<feed>%d</feed>", renders)
+		return err
+	}}
+	get := func(etag string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/feed", nil)
+		if etag != "" {
+			r.Header.Set("If-None-Match", etag)
+		}
+		w := httptest.NewRecorder()
+		doc.ServeHTTP(w, r)
+		return w
+	}
+	first := get("")
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || first.Body.String() != "<feed>1</feed>" || etag == "" || first.Header().Get("Content-Type") != "application/atom+xml" {
+		t.Fatalf("Unexpected first response %d %q %v", first.Code, first.Body.String(), first.Header())
+	}
+	if again := get(""); again.Body.String() != "<feed>1</feed>" || renders != 1 {
+		t.Errorf("Expected the cached document, got %q after %d renders", again.Body.String(), renders)
+	}
+	if same := get(etag); same.Code != http.StatusNotModified || same.Body.Len() != 0 {
+		t.Errorf("Expected 304 for a matching ETag, got %d %q", same.Code, same.Body.String())
+	}
+
+	doc.expires = time.Now()
+	if next := get(etag); next.Code != http.StatusOK || next.Body.String() != "<feed>2</feed>" || next.Header().Get("ETag") == etag {
+		t.Errorf("Expected a new document once expired, got %d %q", next.Code, next.Body.String())
+	}
+
+	doc.expires = time.Now()
+	doc.render = func(w io.Writer) error { return fmt.Errorf("backend down") }
+	if failed := get(""); failed.Code != http.StatusBadGateway {
+		t.Errorf("Expected a bad gateway when rendering fails, got %d", failed.Code)
+	}
+}
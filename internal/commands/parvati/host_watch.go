@@ -4,8 +4,10 @@ import (
 	"fmt"
 	"github.com/jessevdk/go-flags"
 	"github.com/misatosangel/parvati-api-client/internal/commands/lowlevel"
+	"github.com/misatosangel/parvati-api-client/internal/ddns"
 	"github.com/misatosangel/parvati-api-client/internal/iface"
 	"github.com/misatosangel/parvati-api-client/pkg/parvatigo"
+	"github.com/misatosangel/parvati-api-client/pkg/probe"
 	"github.com/misatosangel/parvati-api-client/pkg/swagger"
 	"log"
 	"net"
@@ -21,12 +23,21 @@ type HostWatch struct {
 	api           *parvatigo.Api
 	apiConfig     *parvatigo.ApiConfig
 	configFile    string
+	overrides     []parvatigo.ConfigOverride
 	EnabledGames  []string `short:"E" long:"enable" description:"Enable a game by (game) name or config section name." value-name:"<game>"`
 	DisabledGames []string `short:"D" long:"disable" description:"Disable a game by (game) name or config section name. This wins over --enable." value-name:"<game>"`
 	V4Iface       string   `long:"iface4" required:"false" value-name:"<name>|<id>" description:"Use this interface name/number for public v4 IP."`
 	V6Iface       string   `long:"iface6" required:"false" value-name:"<name>|<id>" description:"Use this interface name/number for public v6 IP."`
-	HostMessage   string   `short:"m" long:"host-message" decription:"Use this message to host (overrides config files)" value-name:"<text>"`
+	HostMessage   string   `short:"m" long:"host-message" decription:"Use this message to host (overrides config files). May be a template, as for game.NAME.hostMessage" value-name:"<text>"`
 	NoIPUpdate    bool     `long:"no-ip-update" required:"false" description:"Do not also update IPs."`
+	MetricsListen string   `long:"metrics-listen" required:"false" value-name:"<host:port>" description:"Serve Prometheus metrics over HTTP on this address."`
+	MapPorts      bool     `long:"map-ports" required:"false" description:"Ask your router to forward game ports while watching (UPnP, NAT-PMP or PCP)."`
+	SelfTest      bool     `long:"self-test" required:"false" description:"Check each game's port can be reached from outside before watching."`
+	Poll          bool     `long:"poll" required:"false" description:"Recheck IPs every 10s rather than waiting for network change events."`
+	DDNSDryRun    bool     `long:"ddns-dry-run" required:"false" description:"Just show what dynamic DNS updates would be done (implied by --no-ip-update)."`
+	NoDDNS        bool     `long:"no-ddns" required:"false" description:"Do not update configured dynamic DNS records."`
+	LocalCheck    bool     `long:"local-check" required:"false" description:"Probe games that support it on this machine between checks, only asking Parvati's check APIs to confirm before announcing."`
+	APIListen     string   `long:"api-listen" required:"false" value-name:"<host:port>" description:"Serve the local status API on this localhost address (overrides watch.apiListen)."`
 }
 
 func (self *HostWatch) AddCommands(base *flags.Command) (*flags.Command, error) {
@@ -58,7 +69,14 @@ func (self *HostWatch) SetConfigFile(filePath string) {
 	self.configFile = filePath
 }
 
+func (self *HostWatch) SetConfigOverrides(overrides []parvatigo.ConfigOverride) {
+	self.overrides = overrides
+}
+
 func (self *HostWatch) Execute(args []string) error {
+	if _, err := parvatigo.ParseMessage(self.HostMessage); err != nil {
+		return fmt.Errorf("Bad --host-message '%s': %s\n", self.HostMessage, err.Error())
+	}
 	// check available configured games
 	knownGames, apiErr := self.api.GetGames()
 	if apiErr != nil {
@@ -80,123 +98,268 @@ func (self *HostWatch) Execute(args []string) error {
 		return fmt.Errorf("Your filtered games have no IP information.\n")
 	}
 
-	ifaceConfig, err := ConfigureIfacePrefs(self.configFile, self.V4Iface, self.V6Iface)
+	ifaceConfig, err := ConfigureIfacePrefs(self.configFile, self.overrides, self.V4Iface, self.V6Iface)
 	if err != nil {
 		return err
 	}
-	return self.noCuiMode(games, ifaceConfig, ipFlags)
+	var dyn *ddns.Updater
+	if !self.NoDDNS {
+		if dyn, err = NewDDNSUpdater(self.apiConfig.DDNS, self.NoIPUpdate || self.DDNSDryRun); err != nil {
+			return err
+		}
+	}
+	if self.MetricsListen != "" {
+		if err := ServeMetrics(self.api, self.MetricsListen); err != nil {
+			return err
+		}
+	}
+	if self.MapPorts || self.apiConfig.PortMap.Enabled {
+		keeper, err := MapGamePorts(self.api, &self.apiConfig.PortMap, games, ifaceConfig.V4ID)
+		if err != nil {
+			log.Println(err)
+		} else {
+			go keeper.Run()
+			defer func() {
+				if err := keeper.Close(); err != nil {
+					log.Println("Unable to remove port mappings: " + err.Error())
+				}
+			}()
+		}
+	}
+	if self.SelfTest {
+		self.preFlight(games, ifaceConfig)
+	}
+	return self.noCuiMode(games, ifaceConfig, dyn, ipFlags)
+}
+
+// Reports whether each game can be reached; problems are warnings only, as
+// the game may simply not be running yet.
+func (self *HostWatch) preFlight(games []*cmd_lowlevel.GameConfig, ifaceConfig *iface.Config) {
+	user, err := self.api.GetDetails()
+	if err != nil {
+		log.Println("Skipping self test: " + err.Error())
+		return
+	}
+	for _, game := range games {
+		for _, res := range CheckReachability(self.api, ifaceConfig, game, user) {
+			if res.Ok() {
+				fmt.Println("Self test: " + res.String())
+			} else {
+				log.Println("Self test failed: " + res.String())
+			}
+		}
+	}
 }
 
-func (self *HostWatch) noCuiMode(games []*cmd_lowlevel.GameConfig, ifaceConfig *iface.Config, ipFlags int) error {
+func (self *HostWatch) noCuiMode(games []*cmd_lowlevel.GameConfig, ifaceConfig *iface.Config, dyn *ddns.Updater, ipFlags int) error {
+	names := make([]string, len(games))
+	for i, game := range games {
+		names[i] = game.ConfigInfo.PrettyName()
+	}
+	state := NewWatchState(names)
+	rotations, err := LoadRotationState(self.apiConfig.Watch.StateFile, self.apiConfig.Profile)
+	if err != nil {
+		log.Println("Not keeping message rotations: " + err.Error())
+	} else {
+		rotations.Restore(games)
+	}
+	apiListen := self.APIListen
+	if apiListen == "" {
+		apiListen = self.apiConfig.Watch.APIListen
+	}
+	if apiListen != "" {
+		if err := state.Serve(apiListen, self.apiConfig.Watch.APIToken); err != nil {
+			return err
+		}
+	}
+	// Hosts are checked every 10s, but with network change events IPs are
+	// only rechecked on a change or every NetworkRefresh.
+	var changes <-chan struct{}
+	if watcher := WatchNetwork(self.Poll); watcher != nil {
+		defer watcher.Close()
+		changes = watcher.Changes()
+	}
 	// now ready to do it
 	fmt.Printf("Running update continually at 10s intervals. Hit CTRL+C to stop.\n")
 	signalC := make(chan os.Signal, 1)
 	signal.Notify(signalC, os.Interrupt)
 	updateTicker := time.NewTicker(10 * time.Second)
 	defer updateTicker.Stop()
-	statMap := make(map[string]string)
 	first := true
+	var user *swagger.User
+	var ipCheckedAt time.Time
 
 	for {
+		netChanged := false
 		select {
 		case <-updateTicker.C:
-			delta, err := UpdateIPs(self.api, ipFlags, ifaceConfig.V4ID, ifaceConfig.V6ID, !self.NoIPUpdate)
+		case <-state.Triggered():
+		case <-changes:
+			netChanged = true
+		case sig := <-signalC:
+			fmt.Println("Stopping on signal:", sig)
+			return nil
+		}
+		if user == nil || changes == nil || netChanged || time.Since(ipCheckedAt) >= NetworkRefresh {
+			delta, err := UpdateIPs(self.api, ipFlags, ifaceConfig, dyn, !self.NoIPUpdate)
 			if err != nil {
 				log.Println(err)
-				fmt.Println("Aborting host check on this iteration\n")
+				fmt.Println("Aborting host check on this iteration")
 				continue
 			}
 			ProcessIPDelta(delta, self.NoIPUpdate, first)
 			first = false
-			for _, game := range games {
-				name := game.ConfigInfo.PrettyName()
-				status, err := CheckAutoHost(self.api, game, statMap[name], &delta.Player, self.HostMessage)
-				if err != nil {
-					log.Println(err)
-					continue
+			ipCheckedAt = time.Now()
+			user = &delta.Player
+			state.SetUser(user)
+		}
+		for _, game := range games {
+			self.checkGame(state, game, user)
+		}
+		if rotations != nil {
+			if err := rotations.Save(games); err != nil {
+				log.Println("Unable to save message rotations: " + err.Error())
+			}
+		}
+	}
+}
+
+func (self *HostWatch) checkGame(state *WatchState, game *cmd_lowlevel.GameConfig, user *swagger.User) {
+	name := game.ConfigInfo.PrettyName()
+	gState := state.Game(name)
+	if gState.Paused {
+		return
+	}
+	mes := gState.HostMessage
+	if mes == "" {
+		mes = self.HostMessage
+	}
+	vars := parvatigo.NewMessageVars(game.BackendGame, user, gState.HostingSince)
+	vars.SetPlayed(func() int {
+		return playedSince(self.api, game.BackendGame, user, state.Started())
+	})
+	status, announceID, err := CheckAutoHost(self.api, game, gState.Status, user, mes, vars, self.LocalCheck)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	state.Update(name, status, announceID)
+	if status == nil {
+		return
+	}
+	if gState.Status != status.Status && status.Status == "Playing" {
+		log.Println("You have been joined by opponent " + status.Opponent + "\n")
+		joinLen := len(game.ConfigInfo.OnJoined)
+		if joinLen > 0 {
+			go func() {
+				args := make([]string, joinLen-1, joinLen-1)
+				for i, arg := range game.ConfigInfo.OnJoined[1:] {
+					args[i] = strings.Replace(arg, "${NICK}", status.Opponent, -1)
 				}
-				stat := status.Status
-				if statMap[name] != stat && stat == "Playing" {
-					log.Println("You have been joined by opponent " + status.Opponent + "\n")
-					joinLen := len(game.ConfigInfo.OnJoined)
-					if joinLen > 0 {
-						go func() {
-							args := make([]string, joinLen-1, joinLen-1)
-							if joinLen > 0 {
-								for i, arg := range game.ConfigInfo.OnJoined[1:] {
-									args[i] = strings.Replace(arg, "${NICK}", status.Opponent, -1)
-								}
-							}
-							cmd := exec.Command(game.ConfigInfo.OnJoined[0], args...)
-							cmd.Stdin = nil
-							cmd.Stdout = os.Stdout
-							cmd.Stderr = os.Stderr
-							if runErr := cmd.Run(); runErr != nil {
-								log.Println(runErr)
-							}
-						}()
-					}
+				cmd := exec.Command(game.ConfigInfo.OnJoined[0], args...)
+				cmd.Stdin = nil
+				cmd.Stdout = os.Stdout
+				cmd.Stderr = os.Stderr
+				if runErr := cmd.Run(); runErr != nil {
+					log.Println(runErr)
 				}
-				statMap[name] = stat
-			}
-		case sig := <-signalC:
-			fmt.Println("Stopping on signal:", sig)
-			return nil
+			}()
 		}
 	}
+}
 
-	return nil
+// The games of game the user has played since a time, from their history.
+func playedSince(api *parvatigo.Api, game *swagger.Game, user *swagger.User, since time.Time) int {
+	hosts, err := api.GetUserHistory(strconv.FormatUint(user.Id, 10), &since, 100)
+	if err != nil {
+		log.Printf("Unable to count games played: %s", err.Error())
+		return 0
+	}
+	n := 0
+	for _, h := range hosts {
+		if h.BaseInfo.Game.UrlShortName == game.UrlShortName && (h.Opponent.Id != 0 || h.Opponent.Nick != "") {
+			n++
+		}
+	}
+	return n
 }
 
-func CheckAutoHost(api *parvatigo.Api, gameConfig *cmd_lowlevel.GameConfig, lastStat string, user *swagger.User, hostMessage string) (*swagger.GameCheckInfo, error) {
+// Checks whether we are hosting gameConfig and announces it if so. With local
+// set, games that can be probed locally are checked on this machine, and
+// Parvati's check APIs are only asked to confirm others can reach the host
+// before it is announced. Messages are expanded with vars.
+func CheckAutoHost(api *parvatigo.Api, gameConfig *cmd_lowlevel.GameConfig, lastStat string, user *swagger.User, hostMessage string, vars *parvatigo.MessageVars, local bool) (*swagger.GameCheckInfo, uint64, error) {
 	game := gameConfig.BackendGame
 	hoster, waiter, err := api.UserInHostlist(game, user)
 	if err != nil {
-		return nil, fmt.Errorf("Unable to check existing hostlist: %s\n", err.Error())
+		return nil, 0, fmt.Errorf("Unable to check existing hostlist: %s\n", err.Error())
 	}
 	if hoster != nil {
 		info := api.HostAsCheckInfo(hoster)
-		return info, nil // already listed
+		api.Metrics.ObserveStatus(game.UrlShortName, info.Status)
+		return info, hoster.BaseInfo.Id, nil // already listed
+	}
+	var waitID uint64
+	if waiter != nil {
+		waitID = waiter.Id
+	}
+	var result swagger.GameCheckResult
+	remote := true
+	if local && probe.ForGame(game) != nil {
+		result, err = api.CheckLocalHost(game, user, uint(gameConfig.ConfigInfo.Port))
+		// the game is up here, but may not be reachable from outside
+		remote = err == nil && announceable(result.Info.Status)
+	}
+	if remote {
+		result, err = api.CheckHosting(game, user, "basic", uint(gameConfig.ConfigInfo.Port))
 	}
-	result, err := api.CheckHosting(game, user, "basic", uint(gameConfig.ConfigInfo.Port))
 	if err != nil {
-		return nil, err
+		return nil, waitID, err
 	}
 	if result.HostPort == "" {
-		return nil, fmt.Errorf("%s host checking failed: %s\n", game.Name, result.Error)
+		return nil, waitID, fmt.Errorf("%s host checking failed: %s\n", game.Name, result.Error)
 	}
-	switch result.Info.Status {
-	case "Waiting", "Playing", "Relay":
+	switch {
+	case announceable(result.Info.Status):
 		// post the host!
 		ipStr, portStr, err := net.SplitHostPort(result.HostPort)
 		if err != nil {
-			return &result.Info, fmt.Errorf("Failed to parse ip:port result '%s': %s\n", result.HostPort, err.Error())
+			return &result.Info, waitID, fmt.Errorf("Failed to parse ip:port result '%s': %s\n", result.HostPort, err.Error())
 		}
 		ip := net.ParseIP(ipStr)
 		if ip == nil {
-			return &result.Info, fmt.Errorf("Failed to parse ip address in '%s': %s\n", result.HostPort, ipStr)
+			return &result.Info, waitID, fmt.Errorf("Failed to parse ip address in '%s': %s\n", result.HostPort, ipStr)
 		}
 		port, err := strconv.ParseUint(portStr, 10, 32)
 		if err != nil {
-			return &result.Info, fmt.Errorf("Failed to parse port of '%s' as numeric '%s': %s\n", result.HostPort, portStr, err.Error())
+			return &result.Info, waitID, fmt.Errorf("Failed to parse port of '%s' as numeric '%s': %s\n", result.HostPort, portStr, err.Error())
 		}
-		mes := hostMessage
+		mes := parvatigo.ExpandMessage(hostMessage, vars)
 		if mes == "" {
-			mes = gameConfig.ConfigInfo.HostMessage()
+			mes = gameConfig.ConfigInfo.HostMessage(vars)
 		}
-		_, err = api.PostUserHost(game, user, ip, uint(port), mes)
+		posted, err := api.PostUserHost(game, user, ip, uint(port), mes)
 		if err != nil {
-			return &result.Info, fmt.Errorf("%s host announce on %s failed: %s\n", game.Name, result.HostPort, err.Error())
+			return &result.Info, waitID, fmt.Errorf("%s host announce on %s failed: %s\n", game.Name, result.HostPort, err.Error())
 		}
 		fmt.Printf("%s host announce succeeded.\n", game.Name)
-		return &result.Info, nil
+		return &result.Info, posted.Host.BaseInfo.Id, nil
 	default:
 		if result.Info.Status != lastStat {
 			fmt.Printf("%s host check on %s gave result %s\n", game.Name, result.HostPort, result.Info.Status)
 		}
 		if waiter != nil {
-			return nil, nil
+			return nil, waitID, nil
 		}
-		return &result.Info, nil
+		return &result.Info, 0, nil
+	}
+}
+
+// Whether a check status means the game is up and can be announced.
+func announceable(status string) bool {
+	switch status {
+	case "Waiting", "Playing", "Relay":
+		return true
 	}
+	return false
 }
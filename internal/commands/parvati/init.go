@@ -0,0 +1,385 @@
+package cmd_parvati
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/jessevdk/go-flags"
+	"github.com/misatosangel/parvati-api-client/internal/iface"
+	"github.com/misatosangel/parvati-api-client/pkg/parvatigo"
+	"github.com/misatosangel/parvati-api-client/pkg/swagger"
+	"github.com/misatosangel/traceroute"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Init struct {
+	configFile string
+	in         *bufio.Reader
+	Force      bool `short:"f" long:"force" description:"Replace an existing config file, keeping it as a .bak file."`
+	NoNetwork  bool `long:"no-network" description:"Skip detecting interfaces and public IPs."`
+}
+
+// What the wizard found out, to write to the file.
+type initAnswers struct {
+	conf          parvatigo.ApiConfig
+	storedIn      string
+	passwordInCfg bool
+	v4, v6        string
+	games         []initGame
+}
+
+type initGame struct {
+	game     swagger.Game
+	messages []string
+	port     uint
+}
+
+func (self *Init) AddCommands(base *flags.Command) (*flags.Command, error) {
+	c, err := base.AddCommand("Init", "Create your config file.", "Use this when first setting up: it asks for your account, checks it, helps pick interfaces and games, and writes a commented config file.", self)
+	if err != nil {
+		return nil, err
+	}
+	c.Aliases = append(c.Aliases, "init")
+	return c, err
+}
+
+func (self *Init) NeedsAPI() bool {
+	return false
+}
+
+func (self *Init) NeedsAPIConfig() bool {
+	return false
+}
+
+func (self *Init) SetAPI(api *parvatigo.Api) {
+}
+
+func (self *Init) SetAPIConfig(api *parvatigo.ApiConfig) {
+}
+
+func (self *Init) SetConfigFile(filePath string) {
+	self.configFile = filePath
+}
+
+func (self *Init) Execute(args []string) error {
+	if self.configFile == "" {
+		return fmt.Errorf("No config file path; use --config\n")
+	}
+	if _, err := os.Stat(self.configFile); err == nil {
+		if !self.Force {
+			return fmt.Errorf("%s already exists. Use 'Config edit' to change it, or --force to start again.\n", self.configFile)
+		}
+	}
+	if self.in == nil {
+		self.in = bufio.NewReader(os.Stdin)
+	}
+	fmt.Printf("This will write your settings to %s.\nPress enter to take the [default].\n\n", self.configFile)
+
+	answers := &initAnswers{}
+	api, err := self.account(answers)
+	if err != nil {
+		return err
+	}
+	if !self.NoNetwork {
+		self.interfaces(answers)
+	}
+	if api != nil {
+		if err := self.pickGames(api, answers); err != nil {
+			return err
+		}
+	}
+
+	if self.Force {
+		if err := os.Rename(self.configFile, self.configFile+".bak"); err == nil {
+			fmt.Printf("Kept your old config as %s.bak\n", self.configFile)
+		}
+	}
+	f, err := parvatigo.OpenConfigFile(self.configFile)
+	if err != nil {
+		return err
+	}
+	f.Append(initConfigLines(answers)...)
+	if err := f.Save(); err != nil {
+		return err
+	}
+	fmt.Printf("\nWrote %s. Try 'HostWatch' next, or 'Config validate' after any changes.\n", self.configFile)
+	return nil
+}
+
+// Asks for the server and account, checking them and storing the password.
+// A nil api means the account could not be checked, and no password is
+// stored.
+func (self *Init) account(answers *initAnswers) (*parvatigo.Api, error) {
+	conf := &answers.conf
+	def := parvatigo.FindConfigKey(parvatigo.ConfigKeys(conf), "parvati.uri").Default
+	conf.URI = self.ask("Parvati server", def)
+	for conf.Username == "" {
+		conf.Username = self.ask("Username", "")
+	}
+	for tries := 0; ; tries++ {
+		password, err := readPassword(self.in, true)
+		if err != nil {
+			return nil, err
+		}
+		conf.Password = password
+		api, err := parvatigo.NewApi(conf, "")
+		if err != nil {
+			return nil, err
+		}
+		user, apiErr := api.GetDetails()
+		if apiErr == nil {
+			fmt.Printf("Logged in as %s.\n\n", user.Nick)
+			self.storePassword(answers)
+			return &api, nil
+		}
+		fmt.Printf("Login failed: %s\n", strings.TrimSpace(apiErr.Error()))
+		if tries == 2 || !self.yes("Try again?", true) {
+			if !self.yes("Write the config anyway?", false) {
+				return nil, fmt.Errorf("Nothing written\n")
+			}
+			// a password that failed is not kept anywhere
+			conf.Password = ""
+			fmt.Println("No password stored; run Login once your account works.")
+			fmt.Println()
+			return nil, nil
+		}
+	}
+}
+
+func (self *Init) storePassword(answers *initAnswers) {
+	store, err := answers.conf.StoreCredentials("")
+	if err == nil {
+		answers.storedIn = store
+		fmt.Printf("Password stored in your %s.\n\n", store)
+		return
+	}
+	fmt.Printf("Unable to store your password: %s", err.Error())
+	answers.passwordInCfg = self.yes("Keep it in the config file instead (readable only by you)?", true)
+	if !answers.passwordInCfg {
+		fmt.Println("You can store it later with the Login command.")
+	}
+	fmt.Println()
+}
+
+// Shows the interfaces and public IPs found, and asks which to use.
+func (self *Init) interfaces(answers *initAnswers) {
+	list, err := iface.NewList(traceroute.WANT_LIVE_IP | traceroute.WANT_PUBLIC_V4 | traceroute.WANT_PRIVATE_V4 |
+		traceroute.WANT_PUBLIC_V6 | traceroute.WANT_PRIVATE_V6)
+	if err != nil {
+		fmt.Printf("Unable to list interfaces: %s\n", err.Error())
+		return
+	}
+	fmt.Println("Finding your interfaces and public IPs...")
+	list.Inventory(iface.InventoryOptions{Budget: 15 * time.Second}).WriteText(os.Stdout)
+	if chain, err := (&iface.Config{}).ResolverChain(); err == nil {
+		for _, v6 := range []bool{false, true} {
+			if ip, err := chain.Resolve(list, 0, v6); err == nil && ip != nil {
+				fmt.Printf("Your public %s address is %s\n", familyLabel(v6), ip.String())
+			}
+		}
+	}
+	fmt.Println("\nThe client normally picks the interfaces itself. Name one to always use it.")
+	answers.v4 = self.askInterface(list, "IPv4 interface")
+	answers.v6 = self.askInterface(list, "IPv6 interface")
+	fmt.Println()
+}
+
+func familyLabel(v6 bool) string {
+	if v6 {
+		return "IPv6"
+	}
+	return "IPv4"
+}
+
+func (self *Init) askInterface(list *iface.InterfaceList, question string) string {
+	for {
+		name := self.ask(question, "automatic")
+		if name == "automatic" {
+			return ""
+		}
+		if _, err := strconv.Atoi(name); err == nil || list.GetInterfaceNumber(name) != 0 {
+			return name
+		}
+		fmt.Printf("No interface called '%s'.\n", name)
+	}
+}
+
+// Lists Parvati's games and asks which to host, with messages and port.
+func (self *Init) pickGames(api *parvatigo.Api, answers *initAnswers) error {
+	known, apiErr := api.GetGames()
+	if apiErr != nil {
+		fmt.Printf("Unable to fetch Parvati's game list, so no games are set up: %s\n", apiErr.Error())
+		return nil
+	}
+	fmt.Println("Games on Parvati:")
+	for i, g := range known {
+		fmt.Printf("% 3d. %s (%s)\n", i+1, g.Name, g.UrlShortName)
+	}
+	for {
+		picked := self.ask("Games you host, by number or short name, separated by commas", "none")
+		if picked == "none" {
+			return nil
+		}
+		games, err := pickGames(known, picked)
+		if err != nil {
+			fmt.Print(err.Error())
+			continue
+		}
+		for _, g := range games {
+			fmt.Printf("\n%s:\n", g.Name)
+			ig := initGame{game: *g}
+			for {
+				prompt := "Message when you host (blank for none)"
+				if len(ig.messages) != 0 {
+					prompt = "Another message, used in turn (blank to finish)"
+				}
+				m := self.ask(prompt, "")
+				if m == "" {
+					break
+				}
+				ig.messages = append(ig.messages, m)
+			}
+			def := "your Parvati default"
+			if g.Port != 0 {
+				def = fmt.Sprintf("%d", g.Port)
+			}
+			for {
+				port := self.ask("Port you host on", def)
+				if port == def {
+					break
+				}
+				n, err := strconv.ParseUint(port, 10, 16)
+				if err != nil || n == 0 {
+					fmt.Printf("'%s' is not a port number.\n", port)
+					continue
+				}
+				ig.port = uint(n)
+				break
+			}
+			answers.games = append(answers.games, ig)
+		}
+		return nil
+	}
+}
+
+func pickGames(known []swagger.Game, picked string) ([]*swagger.Game, error) {
+	out := make([]*swagger.Game, 0, 2)
+	for _, p := range strings.Split(picked, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if n, err := strconv.Atoi(p); err == nil {
+			if n < 1 || n > len(known) {
+				return nil, fmt.Errorf("No game numbered %d\n", n)
+			}
+			out = append(out, &known[n-1])
+			continue
+		}
+		found := false
+		for i := range known {
+			if strings.EqualFold(p, known[i].UrlShortName) || strings.EqualFold(p, known[i].Name) {
+				out = append(out, &known[i])
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("No game called '%s'\n", p)
+		}
+	}
+	return out, nil
+}
+
+func (self *Init) ask(question, def string) string {
+	if def != "" {
+		fmt.Printf("%s [%s]: ", question, def)
+	} else {
+		fmt.Printf("%s: ", question)
+	}
+	line, _ := self.in.ReadString('\n')
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return def
+	}
+	return line
+}
+
+func (self *Init) yes(question string, def bool) bool {
+	opts := "y/N"
+	if def {
+		opts = "Y/n"
+	}
+	switch strings.ToLower(self.ask(question+" ["+opts+"]", "")) {
+	case "y", "yes":
+		return true
+	case "n", "no":
+		return false
+	}
+	return def
+}
+
+// The commented config file for the answers.
+func initConfigLines(answers *initAnswers) []string {
+	conf := &answers.conf
+	q := parvatigo.QuoteConfigValue
+	lines := []string{
+		"# Parvati client settings, written by Init on " + time.Now().Format("2006-01-02") + ".",
+		"# Run 'ConfigHelp' for every setting, and 'Config set' or 'Config edit'",
+		"# to change them.",
+		"",
+		"[parvati]",
+		"\t# Backend server",
+		"\turi = " + q(conf.URI),
+		"\tusername = " + q(conf.Username),
+	}
+	switch {
+	case answers.passwordInCfg:
+		lines = append(lines, "\t# Better kept in your keyring: run Login, then remove this", "\tpassword = "+q(conf.Password))
+	case answers.storedIn != "":
+		lines = append(lines, "\t# Your password is in your "+answers.storedIn+"; use Login to change it")
+	default:
+		lines = append(lines, "\t# No password stored yet: run Login to store one")
+	}
+	lines = append(lines, "",
+		"[interfaces]",
+		"\t# Interfaces to find your public IPs on. Unset, the client picks them.")
+	if answers.v4 != "" {
+		lines = append(lines, "\tipv4 = "+q(answers.v4))
+	} else {
+		lines = append(lines, "\t# ipv4 = eth0")
+	}
+	if answers.v6 != "" {
+		lines = append(lines, "\tipv6 = "+q(answers.v6))
+	} else {
+		lines = append(lines, "\t# ipv6 = eth0")
+	}
+	if len(answers.games) == 0 {
+		return append(lines, "",
+			"# Add a section for each game you host, named by its short name",
+			"# (see ListKnownGames), e.g.",
+			"# [game \"th123\"]",
+			"#\thostMessage = Come and play!")
+	}
+	for _, g := range answers.games {
+		lines = append(lines, "",
+			"# "+g.game.Name,
+			"[game "+strconv.Quote(g.game.UrlShortName)+"]",
+			"\t# Checked unless you set enabled = false")
+		if len(g.messages) == 0 {
+			lines = append(lines, "\t# Message shown with your host, may be repeated", "\t# hostMessage = Come and play!")
+		}
+		for _, m := range g.messages {
+			lines = append(lines, "\thostMessage = "+q(m))
+		}
+		if len(g.messages) > 1 {
+			lines = append(lines, "\t# Use the messages in turn, or 'random'", "\thostMessageOrder = round-robin")
+		}
+		if g.port != 0 {
+			lines = append(lines, "\t# Port to check for you hosting", fmt.Sprintf("\twatchPort = %d", g.port))
+		}
+	}
+	return lines
+}
@@ -0,0 +1,173 @@
+package cmd_parvati
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/misatosangel/parvati-api-client/pkg/parvatigo"
+	"github.com/misatosangel/parvati-api-client/pkg/swagger"
+)
+
+// A server answering the account check for alice/hunter2 and the game list.
+func newInitServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/users":
+			if user, pass, ok := r.BasicAuth(); !ok || user != "alice" || pass != "hunter2" {
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte(`{"error":"bad password"}`))
+				return
+			}
+			w.Write([]byte(`{"id":7,"nick":"alice"}`))
+		case "/games":
+			json.NewEncoder(w).Encode([]swagger.Game{
+				{Id: 1, Name: "Hisoutensoku", UrlShortName: "th123", Port: 10800},
+				{Id: 2, Name: "Immaterial and Missing Power", UrlShortName: "th075"},
+			})
+		default:
+			t.Errorf("Unexpected request for %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestInitWizard(t *testing.T) {
+	dir, err := ioutil.TempDir("", "init")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// no secret-tool, so the password cannot go in the keyring
+	oldPath := os.Getenv("PATH")
+	defer os.Setenv("PATH", oldPath)
+	os.Setenv("PATH", dir)
+
+	srv := newInitServer(t)
+	defer srv.Close()
+	path := filepath.Join(dir, "config")
+	script := strings.Join([]string{
+		srv.URL,           // Parvati server
+		"alice",           // Username
+		"wrong",           // Password
+		"",                // Try again? [Y/n]
+		"hunter2",         // Password
+		"y",               // Keep it in the config file instead?
+		"th123, 2",        // Games you host
+		"Come & play; #1", // Message when you host
+		"Good {{.TimeOfDay}}",
+		"",      // Another message (blank to finish)
+		"",      // Port, keeping th123's default
+		"",      // no th075 messages
+		"7500x", // not a port
+		"10801", // Port
+	}, "\n") + "\n"
+	wizard := &Init{NoNetwork: true, in: bufio.NewReader(strings.NewReader(script))}
+	wizard.SetConfigFile(path)
+	if err := wizard.Execute(nil); err != nil {
+		t.Fatalf("Init failed: %s", err.Error())
+	}
+
+	conf, err := parvatigo.ReadConfig(path)
+	if err != nil {
+		t.Fatalf("Written config does not read back: %s", err.Error())
+	}
+	if conf.URI != srv.URL || conf.Username != "alice" || conf.Password != "hunter2" {
+		t.Errorf("Unexpected account read back: %s %s %s", conf.URI, conf.Username, conf.Password)
+	}
+	th123, ok := conf.Games["th123"]
+	if !ok || !th123.Enabled || th123.Port != 0 || len(th123.HostMessages) != 2 ||
+		th123.HostMessages[0] != "Come & play; #1" || th123.HostMessages[1] != "Good {{.TimeOfDay}}" || th123.HostOrder != parvatigo.OrderRoundRobin {
+		t.Errorf("Unexpected th123 read back: %+v", th123)
+	}
+	th075, ok := conf.Games["th075"]
+	if !ok || !th075.Enabled || th075.Port != 10801 || len(th075.HostMessages) != 0 {
+		t.Errorf("Unexpected th075 read back: %+v", th075)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Expected a 0600 config file, got %v (%v)", info, err)
+	}
+
+	data, _ := ioutil.ReadFile(path)
+	text := string(data)
+	for _, comment := range []string{
+		"# Parvati client settings, written by Init on ",
+		"\t# Better kept in your keyring: run Login, then remove this\n\tpassword = hunter2\n",
+		"\t# ipv4 = eth0\n",
+		"# Hisoutensoku\n[game \"th123\"]\n\t# Checked unless you set enabled = false\n",
+		"\t# Use the messages in turn, or 'random'\n\thostMessageOrder = round-robin\n",
+		"\t# Message shown with your host, may be repeated\n\t# hostMessage = Come and play!\n",
+		"\t# Port to check for you hosting\n\twatchPort = 10801\n",
+	} {
+		if !strings.Contains(text, comment) {
+			t.Errorf("Expected the config to contain %q:\n%s", comment, text)
+		}
+	}
+
+	// an existing file is only replaced with --force, keeping a backup
+	again := &Init{NoNetwork: true, in: bufio.NewReader(strings.NewReader(""))}
+	again.SetConfigFile(path)
+	if err := again.Execute(nil); err == nil || !strings.Contains(err.Error(), "--force") {
+		t.Errorf("Expected an existing config to be kept, got %v", err)
+	}
+	script = strings.Join([]string{srv.URL, "alice", "hunter2", "n", "none"}, "\n") + "\n"
+	again = &Init{NoNetwork: true, Force: true, in: bufio.NewReader(strings.NewReader(script))}
+	again.SetConfigFile(path)
+	if err := again.Execute(nil); err != nil {
+		t.Fatalf("Init --force failed: %s", err.Error())
+	}
+	if backup, err := ioutil.ReadFile(path + ".bak"); err != nil || string(backup) != text {
+		t.Errorf("Expected the old config kept as a backup (%v)", err)
+	}
+	conf, err = parvatigo.ReadConfig(path)
+	if err != nil || conf.Password != "" || len(conf.Games) != 0 {
+		t.Errorf("Unexpected config after --force: %+v (%v)", conf, err)
+	}
+	data, _ = ioutil.ReadFile(path)
+	for _, comment := range []string{"\t# No password stored yet: run Login to store one\n", "# [game \"th123\"]\n"} {
+		if !strings.Contains(string(data), comment) {
+			t.Errorf("Expected the config to contain %q:\n%s", comment, string(data))
+		}
+	}
+}
+
+func TestInitNoAccount(t *testing.T) {
+	dir, err := ioutil.TempDir("", "init")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	srv := newInitServer(t)
+	defer srv.Close()
+	path := filepath.Join(dir, "config")
+
+	// three failed logins, then not writing anyway
+	script := strings.Join([]string{srv.URL, "alice", "a", "y", "b", "y", "c", "n"}, "\n") + "\n"
+	wizard := &Init{NoNetwork: true, in: bufio.NewReader(strings.NewReader(script))}
+	wizard.SetConfigFile(path)
+	if err := wizard.Execute(nil); err == nil || !strings.Contains(err.Error(), "Nothing written") {
+		t.Errorf("Expected nothing to be written, got %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected no config file, got %v", err)
+	}
+
+	// writing anyway keeps no password
+	script = strings.Join([]string{srv.URL, "alice", "a", "n", "y"}, "\n") + "\n"
+	wizard = &Init{NoNetwork: true, in: bufio.NewReader(strings.NewReader(script))}
+	wizard.SetConfigFile(path)
+	if err := wizard.Execute(nil); err != nil {
+		t.Fatalf("Init failed: %s", err.Error())
+	}
+	data, _ := ioutil.ReadFile(path)
+	if strings.Contains(string(data), "password =") || !strings.Contains(string(data), "\t# No password stored yet: run Login to store one\n") {
+		t.Errorf("Expected no password in the config:\n%s", string(data))
+	}
+}
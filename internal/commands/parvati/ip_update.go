@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/jessevdk/go-flags"
 	"github.com/misatosangel/parvati-api-client/internal/commands/lowlevel"
+	"github.com/misatosangel/parvati-api-client/internal/ddns"
 	"github.com/misatosangel/parvati-api-client/pkg/parvatigo"
 	"github.com/misatosangel/traceroute"
 	"os"
@@ -12,15 +13,20 @@ import (
 )
 
 type UpdateIP struct {
-	api        *parvatigo.Api
-	apiConfig  *parvatigo.ApiConfig
-	configFile string
-	SetV6      bool   `short:"6" required:"false" description:"Update v6 IP (ignores enabled games)."`
-	SetV4      bool   `short:"4" required:"false" description:"Update v4 IP (ignores enabled games)."`
-	Check      bool   `short:"n" long:"no-update" required:"false" description:"Just show what would be done, do not actually update."`
-	V4Iface    string `long:"iface4" required:"false" value-name:"<name>|<id>" description:"Use this interface name/number for public v4 IP."`
-	V6Iface    string `long:"iface6" required:"false" value-name:"<name>|<id>" description:"Use this interface name/number for public v6 IP."`
-	Repeat     bool   `long:"repeat" short:"r" required:"false" description:"Constantly updated over time."`
+	api           *parvatigo.Api
+	apiConfig     *parvatigo.ApiConfig
+	configFile    string
+	overrides     []parvatigo.ConfigOverride
+	SetV6         bool   `short:"6" required:"false" description:"Update v6 IP (ignores enabled games)."`
+	SetV4         bool   `short:"4" required:"false" description:"Update v4 IP (ignores enabled games)."`
+	Check         bool   `short:"n" long:"no-update" required:"false" description:"Just show what would be done, do not actually update."`
+	V4Iface       string `long:"iface4" required:"false" value-name:"<name>|<id>" description:"Use this interface name/number for public v4 IP."`
+	V6Iface       string `long:"iface6" required:"false" value-name:"<name>|<id>" description:"Use this interface name/number for public v6 IP."`
+	Repeat        bool   `long:"repeat" short:"r" required:"false" description:"Constantly updated over time."`
+	MetricsListen string `long:"metrics-listen" required:"false" value-name:"<host:port>" description:"With --repeat, serve Prometheus metrics over HTTP on this address."`
+	Poll          bool   `long:"poll" required:"false" description:"With --repeat, check every 15s rather than waiting for network change events."`
+	DDNSDryRun    bool   `long:"ddns-dry-run" required:"false" description:"Just show what dynamic DNS updates would be done (implied by --no-update)."`
+	NoDDNS        bool   `long:"no-ddns" required:"false" description:"Do not update configured dynamic DNS records."`
 }
 
 func (self *UpdateIP) AddCommands(base *flags.Command) (*flags.Command, error) {
@@ -52,6 +58,10 @@ func (self *UpdateIP) SetConfigFile(filePath string) {
 	self.configFile = filePath
 }
 
+func (self *UpdateIP) SetConfigOverrides(overrides []parvatigo.ConfigOverride) {
+	self.overrides = overrides
+}
+
 func (self *UpdateIP) Execute(args []string) error {
 	var ipFlags int
 	if self.SetV6 {
@@ -84,42 +94,61 @@ func (self *UpdateIP) Execute(args []string) error {
 			return fmt.Errorf("Your filtered games have no IP information.\n" + msgTry)
 		}
 	}
-	ifaceConfig, err := ConfigureIfacePrefs(self.configFile, self.V4Iface, self.V6Iface)
+	ifaceConfig, err := ConfigureIfacePrefs(self.configFile, self.overrides, self.V4Iface, self.V6Iface)
 	if err != nil {
 		return err
 	}
+	var dyn *ddns.Updater
+	if !self.NoDDNS {
+		if dyn, err = NewDDNSUpdater(self.apiConfig.DDNS, self.Check || self.DDNSDryRun); err != nil {
+			return err
+		}
+	}
 	// no ready to do it
-	delta, err := UpdateIPs(self.api, ipFlags, ifaceConfig.V4ID, ifaceConfig.V6ID, !self.Check)
+	delta, err := UpdateIPs(self.api, ipFlags, ifaceConfig, dyn, !self.Check)
 	if err != nil {
 		return err
 	}
 	if !self.Repeat {
 		return ProcessIPDelta(delta, self.Check, true)
 	}
-	fmt.Printf("Running update continually at 15s intervals. Hit CTRL+C to stop.\n")
+	if self.MetricsListen != "" {
+		if err := ServeMetrics(self.api, self.MetricsListen); err != nil {
+			return err
+		}
+	}
+	interval := 15 * time.Second
+	var changes <-chan struct{}
+	if watcher := WatchNetwork(self.Poll); watcher != nil {
+		defer watcher.Close()
+		changes = watcher.Changes()
+		interval = NetworkRefresh
+		fmt.Printf("Updating on network changes (and every %s). Hit CTRL+C to stop.\n", interval)
+	} else {
+		fmt.Printf("Running update continually at 15s intervals. Hit CTRL+C to stop.\n")
+	}
 	err = ProcessIPDelta(delta, self.Check, true)
 	if err != nil {
 		fmt.Println(err)
 	}
 	signalC := make(chan os.Signal, 1)
 	signal.Notify(signalC, os.Interrupt)
-	updateTicker := time.NewTicker(15 * time.Second)
+	updateTicker := time.NewTicker(interval)
 	defer updateTicker.Stop()
 	for {
 		select {
 		case <-updateTicker.C:
-			delta, err := UpdateIPs(self.api, ipFlags, ifaceConfig.V4ID, ifaceConfig.V6ID, !self.Check)
-			if err == nil {
-				err = ProcessIPDelta(delta, self.Check, true)
-			}
-			if err != nil {
-				fmt.Println(err)
-			}
+		case <-changes:
 		case sig := <-signalC:
 			fmt.Println("Stopping on signal:", sig)
 			return nil
 		}
+		delta, err := UpdateIPs(self.api, ipFlags, ifaceConfig, dyn, !self.Check)
+		if err == nil {
+			err = ProcessIPDelta(delta, self.Check, true)
+		}
+		if err != nil {
+			fmt.Println(err)
+		}
 	}
-
-	return nil
 }
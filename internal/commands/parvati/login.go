@@ -0,0 +1,219 @@
+package cmd_parvati
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/jessevdk/go-flags"
+	"github.com/misatosangel/parvati-api-client/pkg/parvatigo"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+type Login struct {
+	api           *parvatigo.Api
+	apiConfig     *parvatigo.ApiConfig
+	Store         string `long:"store" required:"false" choice:"helper" choice:"keyring" description:"Where to keep the password (default parvati.credentialStore, else the helper if set, else the keyring)."`
+	PasswordStdin bool   `long:"password-stdin" required:"false" description:"Read the password from standard input rather than prompting."`
+}
+
+func (self *Login) AddCommands(base *flags.Command) (*flags.Command, error) {
+	c, err := base.AddCommand("Login", "Check and store your Parvati password.", "Use this to check your password works and keep it in your keyring (through secret-tool) or credential helper, rather than in the config file. With parvati.authMethod set to oauth, this authorizes the device instead.", self)
+	if err != nil {
+		return nil, err
+	}
+	c.Aliases = append(c.Aliases, "login")
+	return c, err
+}
+
+func (self *Login) NeedsAPI() bool {
+	return false
+}
+
+func (self *Login) NeedsAPIConfig() bool {
+	return true
+}
+
+func (self *Login) SetAPI(api *parvatigo.Api) {
+	self.api = api
+}
+
+func (self *Login) SetAPIConfig(api *parvatigo.ApiConfig) {
+	self.apiConfig = api
+}
+
+func (self *Login) Execute(args []string) error {
+	switch self.apiConfig.AuthMethod {
+	case parvatigo.AuthOAuth:
+		return self.oauthLogin()
+	case parvatigo.AuthToken:
+		return self.checkLogin("API token in parvati.token")
+	}
+	conf := *self.apiConfig
+	in := bufio.NewReader(os.Stdin)
+	if conf.Username == "" {
+		if self.PasswordStdin {
+			return fmt.Errorf("Set parvati.username or use --username with --password-stdin\n")
+		}
+		fmt.Print("Username: ")
+		name, err := in.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		conf.Username = strings.TrimSpace(name)
+	}
+	password, err := readPassword(in, !self.PasswordStdin)
+	if err != nil {
+		return err
+	}
+	if password == "" {
+		return fmt.Errorf("No password given\n")
+	}
+	if self.api == nil {
+		api, err := parvatigo.NewApi(&conf, "")
+		if err != nil {
+			return err
+		}
+		self.api = &api
+	}
+	self.api.SetCredentials(conf.Username, password)
+	user, apiErr := self.api.GetDetails()
+	if apiErr != nil {
+		return fmt.Errorf("Login failed: %s", apiErr.Error())
+	}
+	conf.Password = password
+	store, err := conf.StoreCredentials(self.Store)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Logged in as %s; password stored in %s.\n", user.Nick, store)
+	if self.apiConfig.Password != "" {
+		fmt.Println("parvati.password is still set in your config file and will be used first; remove it to use the stored password.")
+	}
+	return nil
+}
+
+// Authorizes this device with the OAuth device flow, caching the token.
+func (self *Login) oauthLogin() error {
+	oauth := self.apiConfig.OAuth()
+	if self.api != nil && self.api.OAuth != nil {
+		oauth = self.api.OAuth
+	}
+	_, err := oauth.DeviceLogin(func(code *parvatigo.DeviceCode) {
+		if code.VerificationURIComplete != "" {
+			fmt.Printf("Visit %s to authorize this device,\n", code.VerificationURIComplete)
+			fmt.Printf("or go to %s and enter the code: %s\n", code.VerificationURI, code.UserCode)
+		} else {
+			fmt.Printf("Go to %s and enter the code: %s\n", code.VerificationURI, code.UserCode)
+		}
+		fmt.Println("Waiting for authorization...")
+	})
+	if err != nil {
+		return err
+	}
+	return self.checkLogin("token cached in " + oauth.CacheFile)
+}
+
+// Checks the already configured credentials work.
+func (self *Login) checkLogin(where string) error {
+	if self.api == nil {
+		api, err := parvatigo.NewApi(self.apiConfig, "")
+		if err != nil {
+			return err
+		}
+		self.api = &api
+	}
+	user, apiErr := self.api.GetDetails()
+	if apiErr != nil {
+		return fmt.Errorf("Login failed: %s", apiErr.Error())
+	}
+	fmt.Printf("Logged in as %s; %s.\n", user.Nick, where)
+	return nil
+}
+
+// Reads a line, turning off echo while the user types if asked to prompt
+// and stdin is a terminal.
+func readPassword(in *bufio.Reader, prompt bool) (string, error) {
+	if prompt {
+		fmt.Print("Password: ")
+		if fi, err := os.Stdin.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+			if stty("-echo") == nil {
+				defer func() {
+					stty("echo")
+					fmt.Println()
+				}()
+			}
+		}
+	}
+	line, err := in.ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func stty(arg string) error {
+	cmd := exec.Command("stty", arg)
+	cmd.Stdin = os.Stdin
+	return cmd.Run()
+}
+
+type Logout struct {
+	apiConfig *parvatigo.ApiConfig
+}
+
+func (self *Logout) AddCommands(base *flags.Command) (*flags.Command, error) {
+	c, err := base.AddCommand("Logout", "Forget your stored Parvati password.", "Use this to remove your password from your keyring and credential helper, or your cached OAuth token.", self)
+	if err != nil {
+		return nil, err
+	}
+	c.Aliases = append(c.Aliases, "logout")
+	return c, err
+}
+
+func (self *Logout) NeedsAPI() bool {
+	return false
+}
+
+func (self *Logout) NeedsAPIConfig() bool {
+	return true
+}
+
+func (self *Logout) SetAPI(api *parvatigo.Api) {
+}
+
+func (self *Logout) SetAPIConfig(api *parvatigo.ApiConfig) {
+	self.apiConfig = api
+}
+
+func (self *Logout) Execute(args []string) error {
+	switch self.apiConfig.AuthMethod {
+	case parvatigo.AuthOAuth:
+		oauth := self.apiConfig.OAuth()
+		if err := oauth.Forget(); err != nil {
+			return err
+		}
+		fmt.Printf("Removed cached token from %s.\n", oauth.CacheFile)
+		return nil
+	case parvatigo.AuthToken:
+		fmt.Println("Remove parvati.token from your config file to stop using your API token.")
+		return nil
+	}
+	erased, err := self.apiConfig.EraseCredentials()
+	if err != nil {
+		return err
+	}
+	if len(erased) == 0 {
+		fmt.Println("No keyring or credential helper to remove a password from.")
+	} else {
+		fmt.Printf("Removed stored password from %s.\n", strings.Join(erased, " and "))
+	}
+	self.apiConfig.LoadCredentials()
+	switch self.apiConfig.PasswordSource {
+	case parvatigo.CredentialsConfig:
+		fmt.Println("Your password is still set by parvati.password in your config file.")
+	case parvatigo.CredentialsNetrc:
+		fmt.Println("Your password is still in your netrc file.")
+	}
+	return nil
+}
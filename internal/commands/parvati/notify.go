@@ -0,0 +1,217 @@
+package cmd_parvati
+
+import (
+	"fmt"
+	"github.com/jessevdk/go-flags"
+	"github.com/misatosangel/parvati-api-client/internal/commands/lowlevel"
+	"github.com/misatosangel/parvati-api-client/internal/notify"
+	"github.com/misatosangel/parvati-api-client/pkg/parvatigo"
+	"github.com/misatosangel/parvati-api-client/pkg/swagger"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Notify struct {
+	api       *parvatigo.Api
+	apiConfig *parvatigo.ApiConfig
+	Friends   []string `short:"f" long:"friend" description:"Notify when this nick or user id hosts; can be repeated. Adds to notify.friend." value-name:"<nick>|<id>"`
+	Games     []string `short:"g" long:"game" description:"Watch this game; can be repeated. Overrides notify.game, defaults to all known games." value-name:"<game>"`
+	Via       []string `short:"v" long:"via" description:"Notify using dbus, bell or command; can be repeated. Overrides notify.via, defaults to bell." value-name:"<notifier>"`
+	Waiters   bool     `short:"w" long:"waiters" description:"Also notify when a friend is waiting for a host."`
+	Interval  uint     `short:"i" long:"interval" default:"15" value-name:"<seconds>" description:"Seconds between host list polls."`
+}
+
+func (self *Notify) AddCommands(base *flags.Command) (*flags.Command, error) {
+	c, err := base.AddCommand("Notify", "Notify when friends host.", "Use this to be notified when any of your friends start hosting.", self)
+	if err != nil {
+		return nil, err
+	}
+	c.Aliases = append(c.Aliases, "notify")
+	return c, err
+}
+
+func (self *Notify) NeedsAPI() bool {
+	return true
+}
+
+func (self *Notify) NeedsAPIConfig() bool {
+	return true
+}
+
+func (self *Notify) SetAPI(api *parvatigo.Api) {
+	self.api = api
+}
+
+func (self *Notify) SetAPIConfig(api *parvatigo.ApiConfig) {
+	self.apiConfig = api
+}
+
+func (self *Notify) Execute(args []string) error {
+	conf := parvatigo.NotifyConfig{}
+	if self.apiConfig != nil {
+		conf = self.apiConfig.Notify
+	}
+	friends := NewFriendList(append(conf.Friends, self.Friends...))
+	if friends.Empty() {
+		return fmt.Errorf("No friends to watch for; give some with --friend or notify.friend.\n")
+	}
+	gameNames := conf.Games
+	if len(self.Games) > 0 {
+		gameNames = self.Games
+	}
+	via := conf.Via
+	if len(self.Via) > 0 {
+		via = self.Via
+	}
+	if len(via) == 0 {
+		via = []string{"bell"}
+	}
+	notifiers := make(notify.Multi, 0, len(via))
+	for _, v := range via {
+		n, err := notify.New(v, conf.Command)
+		if err != nil {
+			return err
+		}
+		notifiers = append(notifiers, n)
+	}
+
+	knownGames, apiErr := self.api.GetGames()
+	if apiErr != nil {
+		return apiErr
+	}
+	games, err := cmd_lowlevel.FindGames(knownGames, gameNames)
+	if err != nil {
+		return err
+	}
+	if len(games) == 0 {
+		return fmt.Errorf("Parvati's backend is not configured; no known games were found.\n")
+	}
+	watcher := parvatigo.NewWatcher(self.api, games, time.Duration(self.Interval)*time.Second)
+	watcher.OnError = func(game *swagger.Game, err *parvatigo.ApiError) {
+		log.Printf("Unable to fetch host list for %s: %s\n", game.Name, err.Error())
+	}
+	go watcher.Run()
+	defer watcher.Stop()
+
+	fmt.Printf("Watching for %d friend(s) in %d game(s). Hit CTRL+C to stop.\n", friends.Len(), len(games))
+	signalC := make(chan os.Signal, 1)
+	signal.Notify(signalC, os.Interrupt)
+	seen := make(map[notifyKey]bool)
+	for {
+		select {
+		case ev, ok := <-watcher.Events():
+			if !ok {
+				return nil
+			}
+			n := self.newNotification(&ev, friends, seen)
+			if n == nil {
+				continue
+			}
+			if err := notifiers.Notify(n); err != nil {
+				log.Println(err)
+			}
+		case sig := <-signalC:
+			fmt.Println("Stopping on signal:", sig)
+			return nil
+		}
+	}
+}
+
+// What a notification has been sent for: a user hosting or waiting in a
+// game, whatever announcement they make it with. Users without an id are
+// told apart by nick.
+type notifyKey struct {
+	game string
+	what parvatigo.EventType
+	user uint64
+	nick string
+}
+
+// Returns a notification for the event if it is a friend announcing and
+// one was not already sent for it, recording it in seen.
+func (self *Notify) newNotification(ev *parvatigo.Event, friends *FriendList, seen map[notifyKey]bool) *notify.Notification {
+	n := self.eventNotification(ev, friends)
+	if n == nil {
+		return nil
+	}
+	key := notifyKey{game: ev.Game, what: ev.Type, user: ev.User().Id}
+	if key.user == 0 {
+		key.nick = strings.ToLower(n.Nick)
+	}
+	if seen[key] {
+		return nil
+	}
+	seen[key] = true
+	return n
+}
+
+// Returns a notification for the event if it is a friend announcing, or nil.
+func (self *Notify) eventNotification(ev *parvatigo.Event, friends *FriendList) *notify.Notification {
+	var base *swagger.Waiter
+	what := "is hosting"
+	switch ev.Type {
+	case parvatigo.HostAppeared:
+		base = &ev.Host.Host.BaseInfo
+	case parvatigo.WaiterAppeared:
+		if !self.Waiters {
+			return nil
+		}
+		base = &ev.Waiter.Waiter
+		what = "is waiting for a host"
+	default:
+		return nil
+	}
+	if !friends.Matches(&base.User) {
+		return nil
+	}
+	nick := base.User.Nick
+	if nick == "" {
+		nick = base.DisplayName
+	}
+	body := fmt.Sprintf("%s %s in %s", nick, what, ev.Game)
+	if base.Message != "" {
+		body += ": " + base.Message
+	}
+	return &notify.Notification{Title: "Parvati: " + nick, Body: body, Game: ev.Game, Nick: nick}
+}
+
+// Friends by user id or (case insensitive) nick.
+type FriendList struct {
+	ids   map[uint64]bool
+	nicks map[string]bool
+}
+
+func NewFriendList(friends []string) *FriendList {
+	out := &FriendList{ids: make(map[uint64]bool), nicks: make(map[string]bool)}
+	for _, f := range friends {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		if id, err := strconv.ParseUint(f, 10, 64); err == nil {
+			out.ids[id] = true
+			continue
+		}
+		out.nicks[strings.ToLower(f)] = true
+	}
+	return out
+}
+
+func (self *FriendList) Len() int {
+	return len(self.ids) + len(self.nicks)
+}
+
+func (self *FriendList) Empty() bool {
+	return self.Len() == 0
+}
+
+func (self *FriendList) Matches(user *swagger.User) bool {
+	if user.Id != 0 && self.ids[user.Id] {
+		return true
+	}
+	return user.Nick != "" && self.nicks[strings.ToLower(user.Nick)]
+}
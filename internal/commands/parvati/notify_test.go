@@ -0,0 +1,82 @@
+package cmd_parvati
+
+import (
+	"testing"
+
+	"github.com/misatosangel/parvati-api-client/pkg/parvatigo"
+	"github.com/misatosangel/parvati-api-client/pkg/swagger"
+)
+
+func TestFriendList(t *testing.T) {
+	friends := NewFriendList([]string{" Alice ", "42", "", "  "})
+	if friends.Len() != 2 || friends.Empty() {
+		t.Fatalf("Expected 2 friends, got %d", friends.Len())
+	}
+	for _, test := range []struct {
+		user swagger.User
+		want bool
+	}{
+		{swagger.User{Nick: "alice"}, true},
+		{swagger.User{Nick: "ALICE", Id: 7}, true},
+		{swagger.User{Nick: "bob", Id: 42}, true},
+		{swagger.User{Nick: "bob", Id: 7}, false},
+		{swagger.User{}, false},
+	} {
+		if got := friends.Matches(&test.user); got != test.want {
+			t.Errorf("Expected %+v to match %v, got %v", test.user, test.want, got)
+		}
+	}
+	if !NewFriendList(nil).Empty() {
+		t.Errorf("Expected no friends to be empty")
+	}
+}
+
+func hostEvent(game string, id uint64, user swagger.User) parvatigo.Event {
+	h := &swagger.HosterStatus{}
+	h.Host.BaseInfo = swagger.Waiter{Id: id, User: user, Message: "come play"}
+	return parvatigo.Event{Type: parvatigo.HostAppeared, Game: game, Host: h}
+}
+
+func waiterEvent(game string, id uint64, user swagger.User) parvatigo.Event {
+	w := &swagger.WaiterStatus{Waiter: swagger.Waiter{Id: id, User: user}}
+	return parvatigo.Event{Type: parvatigo.WaiterAppeared, Game: game, Waiter: w}
+}
+
+func TestNotifyDeduplication(t *testing.T) {
+	cmd := &Notify{Waiters: true}
+	friends := NewFriendList([]string{"alice", "carol"})
+	alice := swagger.User{Id: 7, Nick: "alice"}
+	bob := swagger.User{Id: 8, Nick: "bob"}
+	carol := swagger.User{Nick: "carol"}
+	seen := make(map[notifyKey]bool)
+	for i, test := range []struct {
+		ev   parvatigo.Event
+		want string
+	}{
+		{waiterEvent("th123", 1, alice), "alice is waiting for a host in th123"},
+		{hostEvent("th123", 1, alice), "alice is hosting in th123: come play"},
+		{hostEvent("th105", 1, alice), "alice is hosting in th105: come play"},
+		{hostEvent("th123", 1, alice), ""},
+		{waiterEvent("th123", 1, alice), ""},
+		{hostEvent("th123", 2, bob), ""},
+		{hostEvent("th123", 3, alice), ""},
+		{hostEvent("th123", 4, carol), "carol is hosting in th123: come play"},
+		{hostEvent("th123", 5, swagger.User{Nick: "Carol"}), ""},
+	} {
+		n := cmd.newNotification(&test.ev, friends, seen)
+		switch {
+		case test.want == "" && n != nil:
+			t.Errorf("Event %d: expected no notification, got '%s'", i, n.Body)
+		case test.want != "" && n == nil:
+			t.Errorf("Event %d: expected '%s', got none", i, test.want)
+		case n != nil && n.Body != test.want:
+			t.Errorf("Event %d: expected '%s', got '%s'", i, test.want, n.Body)
+		}
+	}
+
+	cmd.Waiters = false
+	ev := waiterEvent("th105", 9, alice)
+	if n := cmd.newNotification(&ev, friends, seen); n != nil {
+		t.Errorf("Expected no waiter notification without --waiters, got '%s'", n.Body)
+	}
+}
@@ -0,0 +1,79 @@
+package cmd_parvati
+
+import (
+	"fmt"
+	"github.com/misatosangel/parvati-api-client/internal/commands/lowlevel"
+	"github.com/misatosangel/parvati-api-client/internal/portmap"
+	"github.com/misatosangel/parvati-api-client/pkg/parvatigo"
+	"github.com/misatosangel/parvati-api-client/pkg/swagger"
+)
+
+// Port a game will be hosted on: the configured watch port, else the
+// user's preferred port, else the game's default.
+func GamePort(game *cmd_lowlevel.GameConfig, user *swagger.User) uint16 {
+	if game.ConfigInfo.Port != 0 {
+		return uint16(game.ConfigInfo.Port)
+	}
+	if user != nil && user.Port != 0 {
+		return uint16(user.Port)
+	}
+	return game.BackendGame.Port
+}
+
+// Asks the gateway to forward each game's port to us. The returned keeper
+// must be run to renew the mappings and closed to remove them.
+func MapGamePorts(api *parvatigo.Api, conf *parvatigo.PortMapConfig, games []*cmd_lowlevel.GameConfig, ifaceIndex int) (*portmap.Keeper, error) {
+	user, apiErr := api.GetDetails()
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	ifaceName, localIP, err := portmap.LocalAddress(ifaceIndex)
+	if err != nil {
+		return nil, err
+	}
+	gateway, err := portmap.FindGateway(ifaceName, localIP)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to find your gateway to map ports: %s\n", err.Error())
+	}
+	protocols := conf.Protocols
+	if len(protocols) == 0 {
+		protocols = []string{"udp"}
+	}
+	var mapper portmap.Mapper
+	var keeper *portmap.Keeper
+	done := make(map[string]bool)
+	for _, game := range games {
+		port := GamePort(game, user)
+		if port == 0 {
+			continue
+		}
+		for _, proto := range protocols {
+			key := fmt.Sprintf("%s/%d", proto, port)
+			if done[key] {
+				continue
+			}
+			done[key] = true
+			var m *portmap.Mapping
+			if mapper == nil {
+				mapper, m, err = portmap.Discover(conf.Methods, gateway, localIP, proto, port, conf.Lifetime)
+			} else {
+				m, err = mapper.AddMapping(proto, port, port, conf.Lifetime)
+			}
+			if err != nil {
+				if keeper != nil {
+					keeper.Close()
+				}
+				return nil, err
+			}
+			fmt.Printf("Mapped port for %s: %s\n", game.ConfigInfo.PrettyName(), m.String())
+			if keeper == nil {
+				keeper = portmap.NewKeeper(mapper)
+			}
+			keeper.Add(m)
+		}
+	}
+	if keeper == nil {
+		return nil, fmt.Errorf("No game ports known to map.\n")
+	}
+	return keeper, nil
+}
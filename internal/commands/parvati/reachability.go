@@ -0,0 +1,271 @@
+package cmd_parvati
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jessevdk/go-flags"
+	"github.com/misatosangel/parvati-api-client/internal/commands/lowlevel"
+	"github.com/misatosangel/parvati-api-client/internal/iface"
+	"github.com/misatosangel/parvati-api-client/pkg/parvatigo"
+	"github.com/misatosangel/parvati-api-client/pkg/swagger"
+	"github.com/misatosangel/traceroute"
+	"net"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type Reachability string
+
+const (
+	Reachable      Reachability = "reachable"
+	GameNotRunning Reachability = "port reachable, but game not running"
+	NotForwarded   Reachability = "port not forwarded"
+	WrongPublicIP  Reachability = "wrong public IP"
+	ReachUnknown   Reachability = "unknown"
+)
+
+// Outcome of asking the checking APIs to reach us on one address family.
+type ReachResult struct {
+	Game         string
+	Family       string
+	Address      string
+	RegisteredIP net.IP
+	PublicIP     net.IP
+	GameRunning  bool
+	Packets      int
+	Checks       []swagger.GameCheckResult
+	Verdict      Reachability
+	Err          error
+}
+
+func (self *ReachResult) Ok() bool {
+	return self.Verdict == Reachable || self.Verdict == GameNotRunning
+}
+
+func (self *ReachResult) String() string {
+	out := fmt.Sprintf("%s (%s) at %s: %s", self.Game, self.Family, self.Address, self.Verdict)
+	switch self.Verdict {
+	case GameNotRunning:
+		out += fmt.Sprintf(" (%d probe packets arrived)", self.Packets)
+	case WrongPublicIP:
+		if self.PublicIP != nil {
+			out += fmt.Sprintf(" (Parvati has %s, you appear to be %s; try UpdateIP)", ipOrNone(self.RegisteredIP), self.PublicIP.String())
+		}
+	case NotForwarded:
+		if self.GameRunning {
+			out += " (the game is running but did not answer the checkers)"
+		} else {
+			out += " (no probe packets arrived)"
+		}
+	}
+	if self.Err != nil {
+		out += ": " + self.Err.Error()
+	}
+	return out
+}
+
+func ipOrNone(ip net.IP) string {
+	if ip == nil {
+		return "no address"
+	}
+	return ip.String()
+}
+
+// Checks a game's port can be reached from outside. If the port is free a
+// UDP listener is opened on it to count the checkers' probe packets;
+// otherwise the game is assumed to be running and must answer them itself.
+func CheckReachability(api *parvatigo.Api, ifaceConfig *iface.Config, game *cmd_lowlevel.GameConfig, user *swagger.User) []*ReachResult {
+	port := GamePort(game, user)
+	name := game.ConfigInfo.PrettyName()
+	chain, chainErr := ifaceConfig.ResolverChain()
+	list, listErr := iface.NewList(traceroute.WANT_LIVE_IP)
+	if listErr == nil {
+		list.IPv6Policy, listErr = iface.ParseIPv6Policy(ifaceConfig.IPv6Policy)
+	}
+	out := make([]*ReachResult, 0, 2)
+	seen := make(map[byte]bool, 2)
+	for _, proto := range game.BackendGame.Protocols {
+		if l := len(proto); l == 0 || (proto[l-1] != '4' && proto[l-1] != '6') || seen[proto[l-1]] {
+			continue
+		}
+		v6 := proto[len(proto)-1] == '6'
+		seen[proto[len(proto)-1]] = true
+		res := &ReachResult{Game: name, Family: "IPv4", Verdict: ReachUnknown}
+		registered := user.Ipv4
+		ifaceNum := ifaceConfig.V4ID
+		if v6 {
+			res.Family = "IPv6"
+			registered = user.Ipv6
+			ifaceNum = ifaceConfig.V6ID
+		}
+		out = append(out, res)
+		res.RegisteredIP = net.ParseIP(registered)
+		if chainErr == nil && listErr == nil {
+			res.PublicIP, _ = chain.Resolve(list, ifaceNum, v6)
+		}
+		if res.RegisteredIP == nil {
+			res.Verdict = WrongPublicIP
+			res.Err = fmt.Errorf("Parvati has no %s address for you", res.Family)
+			continue
+		}
+		res.Address = net.JoinHostPort(res.RegisteredIP.String(), strconv.Itoa(int(port)))
+		probeAddress(api, game.BackendGame, res, port, v6)
+	}
+	return out
+}
+
+func probeAddress(api *parvatigo.Api, game *swagger.Game, res *ReachResult, port uint16, v6 bool) {
+	if len(game.APIs) == 0 {
+		res.Err = fmt.Errorf("No test APIs associated with game %s", game.Name)
+		return
+	}
+	if port == 0 {
+		res.Err = fmt.Errorf("No port to check for game %s", game.Name)
+		return
+	}
+	network := "udp4"
+	if v6 {
+		network = "udp6"
+	}
+	conn, err := net.ListenUDP(network, &net.UDPAddr{Port: int(port)})
+	if err != nil {
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			res.Err = fmt.Errorf("Unable to listen on port %d: %s", port, err.Error())
+			return
+		}
+		res.GameRunning = true
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	if conn != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 1500)
+			for {
+				if _, _, err := conn.ReadFromUDP(buf); err != nil {
+					return
+				}
+				mu.Lock()
+				res.Packets++
+				mu.Unlock()
+			}
+		}()
+	}
+	answered := false
+	live := false
+	for _, entry := range game.APIs {
+		result, apiErr := api.ProbeAddress(entry, res.Address, "basic")
+		if apiErr != nil {
+			// kept even if another checker answers, so a broken one is seen
+			res.Err = fmt.Errorf("Checker %s failed: %s", entry.Uri, apiErr.Error())
+			continue
+		}
+		answered = true
+		res.Checks = append(res.Checks, result)
+		if result.Error == "" && result.Info.Status != "Unreachable" && result.Info.Status != "Unknown" {
+			live = true
+		}
+	}
+	if conn != nil {
+		// allow for stragglers before counting
+		time.Sleep(500 * time.Millisecond)
+		conn.Close()
+		wg.Wait()
+	}
+	switch {
+	case res.GameRunning && live:
+		res.Verdict = Reachable
+	case !res.GameRunning && res.Packets > 0:
+		res.Verdict = GameNotRunning
+	case res.PublicIP != nil && !res.PublicIP.Equal(res.RegisteredIP):
+		res.Verdict = WrongPublicIP
+	case answered:
+		res.Verdict = NotForwarded
+	}
+}
+
+type SelfTest struct {
+	api           *parvatigo.Api
+	apiConfig     *parvatigo.ApiConfig
+	configFile    string
+	overrides     []parvatigo.ConfigOverride
+	EnabledGames  []string `short:"E" long:"enable" description:"Enable a game by (game) name or config section name." value-name:"<game>"`
+	DisabledGames []string `short:"D" long:"disable" description:"Disable a game by (game) name or config section name. This wins over --enable." value-name:"<game>"`
+	V4Iface       string   `long:"iface4" required:"false" value-name:"<name>|<id>" description:"Use this interface name/number for public v4 IP."`
+	V6Iface       string   `long:"iface6" required:"false" value-name:"<name>|<id>" description:"Use this interface name/number for public v6 IP."`
+}
+
+func (self *SelfTest) AddCommands(base *flags.Command) (*flags.Command, error) {
+	c, err := base.AddCommand("SelfTest", "Check others can reach you.", "Use this to check your enabled games' ports can be reached from the internet before hosting.", self)
+	if err != nil {
+		return nil, err
+	}
+	c.Aliases = append(c.Aliases, "self-test")
+	return c, err
+}
+
+func (self *SelfTest) NeedsAPI() bool {
+	return true
+}
+
+func (self *SelfTest) NeedsAPIConfig() bool {
+	return true
+}
+
+func (self *SelfTest) SetAPI(api *parvatigo.Api) {
+	self.api = api
+}
+
+func (self *SelfTest) SetAPIConfig(api *parvatigo.ApiConfig) {
+	self.apiConfig = api
+}
+
+func (self *SelfTest) SetConfigFile(filePath string) {
+	self.configFile = filePath
+}
+
+func (self *SelfTest) SetConfigOverrides(overrides []parvatigo.ConfigOverride) {
+	self.overrides = overrides
+}
+
+func (self *SelfTest) Execute(args []string) error {
+	knownGames, apiErr := self.api.GetGames()
+	if apiErr != nil {
+		return apiErr
+	}
+	if len(knownGames) == 0 {
+		return fmt.Errorf("Parvati's backend is not configured; no known games were found.\n")
+	}
+	enabledGames := self.apiConfig.GetEnabledGames(self.EnabledGames, self.DisabledGames)
+	if len(enabledGames) == 0 {
+		return fmt.Errorf("Your configuration file and/or options does not enable any games.\n")
+	}
+	games, _ := cmd_lowlevel.FilterGames(knownGames, enabledGames, true)
+	if len(games) == 0 {
+		return fmt.Errorf("You have filtered out all known games.\n")
+	}
+	ifaceConfig, err := ConfigureIfacePrefs(self.configFile, self.overrides, self.V4Iface, self.V6Iface)
+	if err != nil {
+		return err
+	}
+	user, apiErr := self.api.GetDetails()
+	if apiErr != nil {
+		return apiErr
+	}
+	failed := 0
+	for _, game := range games {
+		for _, res := range CheckReachability(self.api, ifaceConfig, game, user) {
+			fmt.Println(res.String())
+			if !res.Ok() {
+				failed++
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d reachability check(s) failed.\n", failed)
+	}
+	return nil
+}
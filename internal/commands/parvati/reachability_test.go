@@ -0,0 +1,141 @@
+package cmd_parvati
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/misatosangel/parvati-api-client/pkg/parvatigo"
+	"github.com/misatosangel/parvati-api-client/pkg/swagger"
+)
+
+// A checking API that optionally sends a probe packet to the address it is
+// asked about, then answers with status, or fails with a non-200 code.
+type fakeChecker struct {
+	*httptest.Server
+	probe  bool
+	status string
+	code   int
+	body   string
+	asked  []string
+}
+
+func newFakeChecker(t *testing.T) *fakeChecker {
+	c := &fakeChecker{code: http.StatusOK}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hostPort := strings.TrimPrefix(r.URL.Path, "/check/")
+		c.asked = append(c.asked, hostPort+"?"+r.URL.RawQuery)
+		if c.probe {
+			if conn, err := net.Dial("udp4", hostPort); err == nil {
+				conn.Write([]byte("probe"))
+				conn.Close()
+			}
+		}
+		if c.code != http.StatusOK {
+			http.Error(w, "checker broken", c.code)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if c.body != "" {
+			w.Write([]byte(c.body))
+			return
+		}
+		json.NewEncoder(w).Encode(swagger.GameCheckResult{HostPort: hostPort, Info: swagger.GameCheckInfo{Status: c.status}})
+	}))
+	return c
+}
+
+// A UDP port nothing is listening on.
+func freeUDPPort(t *testing.T) uint16 {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+}
+
+func TestProbeAddressVerdicts(t *testing.T) {
+	checker := newFakeChecker(t)
+	defer checker.Close()
+	api, err := parvatigo.NewApi(&parvatigo.ApiConfig{URI: checker.URL, Username: "alice", Password: "x"}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	game := &swagger.Game{Name: "Hisoutensoku", APIs: []swagger.APIEntry{{Uri: checker.URL}}}
+	registered := net.ParseIP("127.0.0.1")
+
+	for _, test := range []struct {
+		name     string
+		running  bool
+		probe    bool
+		status   string
+		code     int
+		publicIP string
+		want     Reachability
+		ok       bool
+		text     string
+	}{
+		{"game answering", true, false, "Waiting", http.StatusOK, "", Reachable, true, "reachable"},
+		{"probe arrived", false, true, "Unreachable", http.StatusOK, "", GameNotRunning, true, "(1 probe packets arrived)"},
+		{"nothing arrived", false, false, "Unreachable", http.StatusOK, "127.0.0.1", NotForwarded, false, "(no probe packets arrived)"},
+		{"game silent", true, false, "Unreachable", http.StatusOK, "", NotForwarded, false, "(the game is running but did not answer the checkers)"},
+		{"moved", false, false, "Unreachable", http.StatusOK, "127.0.0.2", WrongPublicIP, false, "Parvati has 127.0.0.1, you appear to be 127.0.0.2; try UpdateIP"},
+		{"checker down", false, false, "", http.StatusInternalServerError, "", ReachUnknown, false, ": "},
+	} {
+		port := freeUDPPort(t)
+		if test.running {
+			gameConn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: int(port)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer gameConn.Close()
+		}
+		checker.probe, checker.status, checker.code = test.probe, test.status, test.code
+		res := &ReachResult{Game: "th123", Family: "IPv4", Verdict: ReachUnknown, RegisteredIP: registered,
+			PublicIP: net.ParseIP(test.publicIP), Address: net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port)))}
+		probeAddress(&api, game, res, port, false)
+		if res.Verdict != test.want || res.Ok() != test.ok || res.GameRunning != test.running {
+			t.Errorf("%s: expected %s (ok %v), got %s (ok %v, running %v, err %v)", test.name, test.want, test.ok, res.Verdict, res.Ok(), res.GameRunning, res.Err)
+		}
+		if got := res.String(); !strings.HasPrefix(got, "th123 (IPv4) at "+res.Address+": ") || !strings.Contains(got, test.text) {
+			t.Errorf("%s: expected '%s' in '%s'", test.name, test.text, got)
+		}
+		if (res.Err != nil) != (test.want == ReachUnknown) {
+			t.Errorf("%s: unexpected error %v", test.name, res.Err)
+		}
+	}
+	if len(checker.asked) == 0 || !strings.HasSuffix(checker.asked[0], "?level=basic") {
+		t.Errorf("Expected basic checks, got %q", checker.asked)
+	}
+
+	res := &ReachResult{Game: "th123", Family: "IPv4", Verdict: ReachUnknown, RegisteredIP: registered, Address: "127.0.0.1:1"}
+	probeAddress(&api, &swagger.Game{Name: "Hisoutensoku"}, res, 1, false)
+	if res.Verdict != ReachUnknown || res.Err == nil || !strings.Contains(res.Err.Error(), "No test APIs") {
+		t.Errorf("Expected a game without checkers to be unknown, got %s (%v)", res.Verdict, res.Err)
+	}
+
+	res = &ReachResult{Game: "th123", Family: "IPv4", Verdict: ReachUnknown, RegisteredIP: registered, Address: "127.0.0.1:0"}
+	probeAddress(&api, game, res, 0, false)
+	if res.Verdict != ReachUnknown || res.Err == nil || !strings.Contains(res.Err.Error(), "No port") {
+		t.Errorf("Expected port 0 to be refused, got %s (%v)", res.Verdict, res.Err)
+	}
+
+	// one checker answering does not hide another sending back junk
+	broken := newFakeChecker(t)
+	defer broken.Close()
+	broken.body = "not json"
+	checker.probe, checker.status, checker.code = true, "Unreachable", http.StatusOK
+	port := freeUDPPort(t)
+	res = &ReachResult{Game: "th123", Family: "IPv4", Verdict: ReachUnknown, RegisteredIP: registered,
+		Address: net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port)))}
+	both := &swagger.Game{Name: "Hisoutensoku", APIs: []swagger.APIEntry{{Uri: checker.URL}, {Uri: broken.URL}}}
+	probeAddress(&api, both, res, port, false)
+	if res.Verdict != GameNotRunning || res.Err == nil || !strings.Contains(res.Err.Error(), "Checker "+broken.URL) || !strings.Contains(res.Err.Error(), "invalid character") {
+		t.Errorf("Expected the bad checker's parse error with a verdict, got %s (%v)", res.Verdict, res.Err)
+	}
+}
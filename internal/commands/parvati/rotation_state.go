@@ -0,0 +1,93 @@
+package cmd_parvati
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/misatosangel/parvati-api-client/internal/commands/lowlevel"
+	"github.com/misatosangel/parvati-api-client/pkg/parvatigo"
+)
+
+// Where each game's host and wait message picking is up to, kept in
+// watch.stateFile so HostWatch carries on from there next time. Games are
+// kept apart by profile, as each profile may give them other messages.
+type RotationState struct {
+	Path    string                   `json:"-"`
+	Profile string                   `json:"-"`
+	Games   map[string]*GameRotation `json:"games"`
+	saved   []byte
+}
+
+type GameRotation struct {
+	Host parvatigo.MessageRotation `json:"host"`
+	Wait parvatigo.MessageRotation `json:"wait"`
+}
+
+// Reads the state file, or the default one if path is "", for games of the
+// given profile. A missing or unreadable file just starts afresh.
+func LoadRotationState(path, profile string) (*RotationState, error) {
+	if path == "" {
+		var err error
+		if path, err = parvatigo.DefaultWatchStateFile(); err != nil {
+			return nil, err
+		}
+	}
+	state := &RotationState{Path: path, Profile: profile}
+	data, err := ioutil.ReadFile(path)
+	if err == nil && json.Unmarshal(data, state) == nil {
+		state.saved = data
+	}
+	if state.Games == nil {
+		state.Games = make(map[string]*GameRotation)
+	}
+	return state, nil
+}
+
+// Games of the default profile are keyed by name alone, as they were before
+// profiles.
+func (self *RotationState) key(game *cmd_lowlevel.GameConfig) string {
+	if self.Profile == "" {
+		return game.ConfigInfo.PrettyName()
+	}
+	return self.Profile + "/" + game.ConfigInfo.PrettyName()
+}
+
+// Carries each game on from where it was, if its messages are unchanged.
+func (self *RotationState) Restore(games []*cmd_lowlevel.GameConfig) {
+	for _, game := range games {
+		if r, ok := self.Games[self.key(game)]; ok {
+			game.ConfigInfo.RestoreRotations(r.Host, r.Wait)
+		}
+	}
+}
+
+// Records where each game is up to, writing the file if that changed.
+// Games not being watched keep their saved state.
+func (self *RotationState) Save(games []*cmd_lowlevel.GameConfig) error {
+	for _, game := range games {
+		host, wait := game.ConfigInfo.Rotations()
+		self.Games[self.key(game)] = &GameRotation{Host: host, Wait: wait}
+	}
+	data, err := json.MarshalIndent(self, "", "  ")
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(data, self.saved) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(self.Path), 0700); err != nil {
+		return err
+	}
+	tmp := self.Path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, self.Path); err != nil {
+		return err
+	}
+	self.saved = data
+	return nil
+}
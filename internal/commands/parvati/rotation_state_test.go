@@ -0,0 +1,111 @@
+package cmd_parvati
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/misatosangel/parvati-api-client/internal/commands/lowlevel"
+	"github.com/misatosangel/parvati-api-client/pkg/parvatigo"
+)
+
+func rotationGame(name string, messages ...string) *cmd_lowlevel.GameConfig {
+	return &cmd_lowlevel.GameConfig{ConfigInfo: &parvatigo.GameInfo{Name: name, HostMessages: messages}}
+}
+
+func TestRotationState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "parvati", "hostwatch.json")
+
+	state, err := LoadRotationState(path, "")
+	if err != nil || len(state.Games) != 0 {
+		t.Fatalf("Expected a missing file to start afresh, got %+v (%v)", state, err)
+	}
+	th123 := rotationGame("th123", "a", "b", "c")
+	th105 := rotationGame("th105", "x", "y")
+	th123.ConfigInfo.HostMessage(nil)
+	th105.ConfigInfo.HostMessage(nil)
+	games := []*cmd_lowlevel.GameConfig{th123, th105}
+	if err := state.Save(games); err != nil {
+		t.Fatalf("Save failed: %s", err.Error())
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("Expected a 0600 state file, got %v (%v)", info, err)
+	}
+
+	// nothing changed, so nothing is written
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Save(games); err != nil {
+		t.Fatalf("Save failed: %s", err.Error())
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("Expected an unchanged Save not to write, got %v", err)
+	}
+	th123.ConfigInfo.HostMessage(nil)
+	if err := state.Save(games); err != nil {
+		t.Fatalf("Save failed: %s", err.Error())
+	}
+
+	loaded, err := LoadRotationState(path, "")
+	if err != nil || len(loaded.Games) != 2 {
+		t.Fatalf("Expected 2 saved games, got %+v (%v)", loaded, err)
+	}
+	again := rotationGame("th123", "a", "b", "c")
+	changed := rotationGame("th105", "x", "z")
+	loaded.Restore([]*cmd_lowlevel.GameConfig{again, changed})
+	if got := again.ConfigInfo.HostMessage(nil); got != "c" {
+		t.Errorf("Expected th123 to carry on with 'c', got '%s'", got)
+	}
+	if got := changed.ConfigInfo.HostMessage(nil); got != "x" {
+		t.Errorf("Expected th105 with changed messages to start again, got '%s'", got)
+	}
+	if err := loaded.Save([]*cmd_lowlevel.GameConfig{again}); err != nil {
+		t.Fatalf("Save failed: %s", err.Error())
+	}
+	if loaded, _ = LoadRotationState(path, ""); loaded.Games["th105"] == nil {
+		t.Errorf("Expected an unwatched game to keep its saved state")
+	}
+
+	// another profile's games start afresh and don't disturb these
+	work, err := LoadRotationState(path, "work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := rotationGame("th123", "a", "b", "c")
+	work.Restore([]*cmd_lowlevel.GameConfig{other})
+	if got := other.ConfigInfo.HostMessage(nil); got != "a" {
+		t.Errorf("Expected the work profile's th123 to start with 'a', got '%s'", got)
+	}
+	if err := work.Save([]*cmd_lowlevel.GameConfig{other}); err != nil {
+		t.Fatalf("Save failed: %s", err.Error())
+	}
+	if loaded, _ = LoadRotationState(path, ""); loaded.Games["th123"] == nil || loaded.Games["work/th123"] == nil {
+		t.Errorf("Expected both profiles' th123 to be kept, got %+v", loaded.Games)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("{not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	corrupt, err := LoadRotationState(path, "")
+	if err != nil || len(corrupt.Games) != 0 {
+		t.Fatalf("Expected a corrupt file to start afresh, got %+v (%v)", corrupt, err)
+	}
+	fresh := rotationGame("th123", "a", "b", "c")
+	corrupt.Restore([]*cmd_lowlevel.GameConfig{fresh})
+	if got := fresh.ConfigInfo.HostMessage(nil); got != "a" {
+		t.Errorf("Expected a fresh start with 'a', got '%s'", got)
+	}
+	if err := corrupt.Save([]*cmd_lowlevel.GameConfig{fresh}); err != nil {
+		t.Fatalf("Save over a corrupt file failed: %s", err.Error())
+	}
+	if loaded, _ = LoadRotationState(path, ""); len(loaded.Games) != 1 {
+		t.Errorf("Expected the corrupt file to be replaced, got %+v", loaded.Games)
+	}
+}
@@ -0,0 +1,284 @@
+package cmd_parvati
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/misatosangel/parvati-api-client/pkg/swagger"
+)
+
+// State of a single game being watched by HostWatch.
+type GameWatchState struct {
+	Name        string                 `json:"name"`
+	Status      string                 `json:"status"`
+	Paused      bool                   `json:"paused"`
+	HostMessage string                 `json:"host_message,omitempty"`
+	AnnounceID  uint64                 `json:"announce_id,omitempty"`
+	LastCheck   *swagger.GameCheckInfo `json:"last_check,omitempty"`
+	CheckedAt   time.Time              `json:"checked_at,omitempty"`
+	// When the current host was first seen, zero when not hosting
+	HostingSince time.Time `json:"hosting_since,omitempty"`
+}
+
+// Shared state of a running HostWatch, safe for use from the local
+// status API while the watcher loop updates it.
+type WatchState struct {
+	mu      sync.Mutex
+	games   map[string]*GameWatchState
+	order   []string
+	user    *swagger.User
+	trigger chan struct{}
+	started time.Time
+}
+
+func NewWatchState(names []string) *WatchState {
+	s := &WatchState{
+		games:   make(map[string]*GameWatchState, len(names)),
+		order:   names,
+		trigger: make(chan struct{}, 1),
+		started: time.Now(),
+	}
+	for _, n := range names {
+		s.games[n] = &GameWatchState{Name: n}
+	}
+	return s
+}
+
+// Channel receiving a value whenever an immediate check is requested.
+func (self *WatchState) Triggered() <-chan struct{} {
+	return self.trigger
+}
+
+// Request an immediate check; requests made while one is pending are merged.
+func (self *WatchState) Trigger() {
+	select {
+	case self.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// When the watch began, which is the start of the session for messages.
+func (self *WatchState) Started() time.Time {
+	return self.started
+}
+
+func (self *WatchState) SetUser(user *swagger.User) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	cpy := *user
+	self.user = &cpy
+}
+
+// Returns a copy of the named game's state, or nil if unknown.
+func (self *WatchState) Game(name string) *GameWatchState {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	g := self.games[name]
+	if g == nil {
+		return nil
+	}
+	cpy := *g
+	return &cpy
+}
+
+// Record the outcome of a check. A nil info leaves the last check untouched.
+func (self *WatchState) Update(name string, info *swagger.GameCheckInfo, announceID uint64) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	g := self.games[name]
+	if g == nil {
+		return
+	}
+	g.AnnounceID = announceID
+	g.CheckedAt = time.Now()
+	if info != nil {
+		cpy := *info
+		g.LastCheck = &cpy
+		g.Status = info.Status
+		switch info.Status {
+		case "Waiting", "Playing", "Relay":
+			if g.HostingSince.IsZero() {
+				g.HostingSince = g.CheckedAt
+			}
+		default:
+			g.HostingSince = time.Time{}
+		}
+	}
+}
+
+func (self *WatchState) SetPaused(name string, paused bool) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	g := self.games[name]
+	if g == nil {
+		return fmt.Errorf("Unknown game: '%s'\n", name)
+	}
+	g.Paused = paused
+	return nil
+}
+
+func (self *WatchState) SetHostMessage(name, message string) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	g := self.games[name]
+	if g == nil {
+		return fmt.Errorf("Unknown game: '%s'\n", name)
+	}
+	g.HostMessage = message
+	return nil
+}
+
+type watchStatus struct {
+	User  *swagger.User     `json:"user,omitempty"`
+	Games []*GameWatchState `json:"games"`
+}
+
+func (self *WatchState) snapshot() watchStatus {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	out := watchStatus{User: self.user, Games: make([]*GameWatchState, 0, len(self.order))}
+	for _, n := range self.order {
+		cpy := *self.games[n]
+		out.Games = append(out.Games, &cpy)
+	}
+	return out
+}
+
+// Serves the local status API on addr in the background. Every request must
+// carry the token, either as a bearer token or in the X-Parvati-Token header.
+//
+//	GET  /status                 - user record and all game states
+//	GET  /games/NAME             - a single game state
+//	POST /games/NAME/pause       - stop checking and announcing NAME
+//	POST /games/NAME/resume      - resume NAME
+//	POST /games/NAME/message     - set NAME's host message, body {"message":"..."}
+//	POST /check                  - check all games now
+func (self *WatchState) Serve(addr, token string) error {
+	if token == "" {
+		return fmt.Errorf("Refusing to serve the status API without a token; set watch.apiToken in your configuration file.\n")
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("Unable to parse status API address '%s': %s\n", addr, err.Error())
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("The status API may only listen on localhost, not '%s'\n", host)
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("Unable to listen for status API on '%s': %s\n", addr, err.Error())
+	}
+	go func() {
+		if err := http.Serve(ln, self.Handler(token)); err != nil {
+			log.Println("Status API stopped: " + err.Error())
+		}
+	}()
+	fmt.Printf("Serving status API on http://%s/status\n", ln.Addr().String())
+	return nil
+}
+
+// The status API, as served by Serve.
+func (self *WatchState) Handler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", self.handleStatus)
+	mux.HandleFunc("/games/", self.handleGame)
+	mux.HandleFunc("/check", self.handleCheck)
+	return requireToken(token, mux)
+}
+
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given := r.Header.Get("X-Parvati-Token")
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			given = strings.TrimPrefix(auth, "Bearer ")
+		}
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			writeJSONError(w, http.StatusUnauthorized, "missing or invalid token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]string{"error": strings.TrimSpace(msg)})
+}
+
+func (self *WatchState) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+	writeJSON(w, http.StatusOK, self.snapshot())
+}
+
+func (self *WatchState) handleCheck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	self.Trigger()
+	writeJSON(w, http.StatusAccepted, map[string]bool{"triggered": true})
+}
+
+func (self *WatchState) handleGame(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/games/"), "/"), "/")
+	name := parts[0]
+	if self.Game(name) == nil {
+		writeJSONError(w, http.StatusNotFound, "unknown game: "+name)
+		return
+	}
+	if len(parts) == 1 {
+		if r.Method != http.MethodGet {
+			writeJSONError(w, http.StatusMethodNotAllowed, "use GET")
+			return
+		}
+		writeJSON(w, http.StatusOK, self.Game(name))
+		return
+	}
+	if len(parts) != 2 {
+		writeJSONError(w, http.StatusNotFound, "unknown path: "+r.URL.Path)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	var err error
+	switch parts[1] {
+	case "pause":
+		err = self.SetPaused(name, true)
+	case "resume":
+		err = self.SetPaused(name, false)
+	case "message":
+		var body struct {
+			Message string `json:"message"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "body must be JSON of the form {\"message\":\"...\"}")
+			return
+		}
+		err = self.SetHostMessage(name, body.Message)
+	default:
+		writeJSONError(w, http.StatusNotFound, "unknown action: "+parts[1])
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, self.Game(name))
+}
@@ -0,0 +1,134 @@
+package cmd_parvati
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/misatosangel/parvati-api-client/pkg/swagger"
+)
+
+// Makes a request to the status API, decoding a JSON answer into out.
+func statusRequest(t *testing.T, srv *httptest.Server, method, path, token, body string, out interface{}) int {
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("%s %s gave bad JSON: %s", method, path, err.Error())
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestStatusAPIToken(t *testing.T) {
+	state := NewWatchState([]string{"th123"})
+	srv := httptest.NewServer(state.Handler("s3cret"))
+	defer srv.Close()
+
+	for _, token := range []string{"", "wrong", "s3cret-not"} {
+		var body map[string]string
+		if code := statusRequest(t, srv, "GET", "/status", token, "", &body); code != http.StatusUnauthorized || body["error"] == "" {
+			t.Errorf("Expected token '%s' to be refused, got %d %v", token, code, body)
+		}
+	}
+	if code := statusRequest(t, srv, "POST", "/games/th123/pause", "wrong", "", nil); code != http.StatusUnauthorized {
+		t.Errorf("Expected pause with a wrong token to be refused, got %d", code)
+	}
+	if state.Game("th123").Paused {
+		t.Errorf("Refused request paused the game")
+	}
+
+	var status watchStatus
+	if code := statusRequest(t, srv, "GET", "/status", "s3cret", "", &status); code != http.StatusOK || len(status.Games) != 1 {
+		t.Errorf("Expected status with a bearer token, got %d %+v", code, status)
+	}
+	req, _ := http.NewRequest("GET", srv.URL+"/games/th123", nil)
+	req.Header.Set("X-Parvati-Token", "s3cret")
+	if resp, err := srv.Client().Do(req); err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected X-Parvati-Token to be accepted, got %v %v", resp, err)
+	}
+
+	if err := state.Serve("127.0.0.1:0", ""); err == nil {
+		t.Errorf("Expected serving without a token to fail")
+	}
+	if err := state.Serve("0.0.0.0:0", "s3cret"); err == nil {
+		t.Errorf("Expected serving beyond localhost to fail")
+	}
+}
+
+func TestStatusAPIControl(t *testing.T) {
+	state := NewWatchState([]string{"th123", "th105"})
+	state.Update("th123", &swagger.GameCheckInfo{Status: "Waiting"}, 42)
+	srv := httptest.NewServer(state.Handler("s3cret"))
+	defer srv.Close()
+
+	var game GameWatchState
+	if code := statusRequest(t, srv, "POST", "/games/th123/pause", "s3cret", "", &game); code != http.StatusOK || !game.Paused {
+		t.Errorf("Expected pause to answer with the paused game, got %d %+v", code, game)
+	}
+	if !state.Game("th123").Paused || state.Game("th105").Paused {
+		t.Errorf("Pause did not change only th123")
+	}
+	if code := statusRequest(t, srv, "POST", "/games/th123/resume", "s3cret", "", &game); code != http.StatusOK || game.Paused {
+		t.Errorf("Expected resume to answer with the resumed game, got %d %+v", code, game)
+	}
+	if state.Game("th123").Paused {
+		t.Errorf("Resume did not change the state")
+	}
+	if g := state.Game("th123"); g.Status != "Waiting" || g.AnnounceID != 42 || g.HostingSince.IsZero() {
+		t.Errorf("Pause and resume lost the game's state: %+v", g)
+	}
+
+	if code := statusRequest(t, srv, "POST", "/games/th123/message", "s3cret", `{"message":"back at 9"}`, &game); code != http.StatusOK || game.HostMessage != "back at 9" {
+		t.Errorf("Expected the message to be set, got %d %+v", code, game)
+	}
+	if got := state.Game("th123").HostMessage; got != "back at 9" {
+		t.Errorf("Message override not applied, got '%s'", got)
+	}
+	if code := statusRequest(t, srv, "POST", "/games/th123/message", "s3cret", `not json`, nil); code != http.StatusBadRequest {
+		t.Errorf("Expected a bad body to be refused, got %d", code)
+	}
+	game = GameWatchState{}
+	if code := statusRequest(t, srv, "POST", "/games/th123/message", "s3cret", `{"message":""}`, &game); code != http.StatusOK || game.HostMessage != "" {
+		t.Errorf("Expected the message to be cleared, got %d %+v", code, game)
+	}
+	if got := state.Game("th123").HostMessage; got != "" {
+		t.Errorf("Message override not cleared, got '%s'", got)
+	}
+
+	for _, c := range []struct {
+		method, path string
+		want         int
+	}{
+		{"POST", "/games/nope/pause", http.StatusNotFound},
+		{"POST", "/games/th123/explode", http.StatusNotFound},
+		{"GET", "/games/th123/pause", http.StatusMethodNotAllowed},
+		{"POST", "/status", http.StatusMethodNotAllowed},
+	} {
+		if code := statusRequest(t, srv, c.method, c.path, "s3cret", "", nil); code != c.want {
+			t.Errorf("Expected %s %s to give %d, got %d", c.method, c.path, c.want, code)
+		}
+	}
+
+	if code := statusRequest(t, srv, "POST", "/check", "s3cret", "", nil); code != http.StatusAccepted {
+		t.Errorf("Expected check to be accepted, got %d", code)
+	}
+	select {
+	case <-state.Triggered():
+	case <-time.After(time.Second):
+		t.Errorf("Check did not trigger")
+	}
+}
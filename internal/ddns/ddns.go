@@ -0,0 +1,113 @@
+// Package ddns publishes our public addresses to dynamic DNS providers,
+// either with RFC 2136 dynamic updates or the dyndns2 HTTP protocol.
+package ddns
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// A dynamic DNS record we keep pointing at our public addresses.
+type Provider interface {
+	// Short description for logs, e.g. "rfc2136 host.example.com"
+	Name() string
+	// Publishes the addresses; a nil address leaves that family alone.
+	Update(v4, v6 net.IP) error
+}
+
+// Pushes addresses to providers, only when they differ from what each
+// provider was last given.
+type Updater struct {
+	Providers []Provider
+	// Only log what would be sent
+	DryRun bool
+	Log    io.Writer
+	last   map[int][2]string
+}
+
+// Publishes any changed addresses, returning one error per failed provider.
+// Providers that fail are retried next time.
+func (self *Updater) Push(v4, v6 net.IP) []error {
+	if self.last == nil {
+		self.last = make(map[int][2]string, len(self.Providers))
+	}
+	errs := make([]error, 0)
+	for i, p := range self.Providers {
+		want4, want6 := v4, v6
+		if f, ok := p.(*familyFilter); ok {
+			want4, want6 = f.filter(v4, v6)
+		}
+		sent := self.last[i]
+		var send4, send6 net.IP
+		if want4 != nil && want4.String() != sent[0] {
+			send4 = want4
+			sent[0] = want4.String()
+		}
+		if want6 != nil && want6.String() != sent[1] {
+			send6 = want6
+			sent[1] = want6.String()
+		}
+		if send4 == nil && send6 == nil {
+			continue
+		}
+		what := strings.TrimSpace(ipString(send4) + " " + ipString(send6))
+		if self.DryRun {
+			self.logf("Would update %s to %s\n", p.Name(), what)
+			self.last[i] = sent
+			continue
+		}
+		if err := p.Update(send4, send6); err != nil {
+			errs = append(errs, fmt.Errorf("Unable to update %s: %s", p.Name(), err.Error()))
+			continue
+		}
+		self.logf("Updated %s to %s\n", p.Name(), what)
+		self.last[i] = sent
+	}
+	return errs
+}
+
+func (self *Updater) logf(format string, args ...interface{}) {
+	if self.Log != nil {
+		fmt.Fprintf(self.Log, format, args...)
+	}
+}
+
+func ipString(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+type familyFilter struct {
+	Provider
+	v4, v6 bool
+}
+
+// Restricts a provider to the address families allowed.
+func Families(p Provider, v4, v6 bool) Provider {
+	if v4 && v6 {
+		return p
+	}
+	return &familyFilter{Provider: p, v4: v4, v6: v6}
+}
+
+func (self *familyFilter) filter(v4, v6 net.IP) (net.IP, net.IP) {
+	if !self.v4 {
+		v4 = nil
+	}
+	if !self.v6 {
+		v6 = nil
+	}
+	return v4, v6
+}
+
+func (self *familyFilter) Update(v4, v6 net.IP) error {
+	v4, v6 = self.filter(v4, v6)
+	if v4 == nil && v6 == nil {
+		return nil
+	}
+	return self.Provider.Update(v4, v6)
+}
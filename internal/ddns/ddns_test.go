@@ -0,0 +1,296 @@
+package ddns
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const testSecret = "c2VjcmV0LWtleS1mb3ItdGVzdHM=" // "secret-key-for-tests"
+
+type testRR struct {
+	name  string
+	typ   uint16
+	class uint16
+	ttl   uint32
+	rdata []byte
+}
+
+func readName(b []byte, off int) (string, int, error) {
+	labels := make([]string, 0, 4)
+	for {
+		if off >= len(b) {
+			return "", 0, fmt.Errorf("name overruns message")
+		}
+		l := int(b[off])
+		off++
+		if l == 0 {
+			return strings.Join(labels, "."), off, nil
+		}
+		if off+l > len(b) {
+			return "", 0, fmt.Errorf("label overruns message")
+		}
+		labels = append(labels, string(b[off:off+l]))
+		off += l
+	}
+}
+
+func readRR(b []byte, off int) (*testRR, int, error) {
+	name, off, err := readName(b, off)
+	if err != nil {
+		return nil, 0, err
+	}
+	if off+10 > len(b) {
+		return nil, 0, fmt.Errorf("short RR")
+	}
+	rr := &testRR{name: name, typ: binary.BigEndian.Uint16(b[off:]), class: binary.BigEndian.Uint16(b[off+2:]), ttl: binary.BigEndian.Uint32(b[off+4:])}
+	l := int(binary.BigEndian.Uint16(b[off+8:]))
+	off += 10
+	if off+l > len(b) {
+		return nil, 0, fmt.Errorf("short rdata")
+	}
+	rr.rdata = b[off : off+l]
+	return rr, off + l, nil
+}
+
+// An authoritative server accepting signed updates, which checks the TSIG
+// the way a real server would.
+type fakeDNS struct {
+	conn    *net.UDPConn
+	mu      sync.Mutex
+	zone    string
+	updates [][]*testRR
+	rcode   byte
+}
+
+func newFakeDNS(t *testing.T) *fakeDNS {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err.Error())
+	}
+	f := &fakeDNS{conn: conn}
+	go f.serve()
+	return f
+}
+
+func (self *fakeDNS) serve() {
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := self.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		req := append([]byte(nil), buf[:n]...)
+		resp := append([]byte(nil), req[:dnsHeaderLen]...)
+		resp[2] |= 0x80
+		resp[3] = self.handle(req)
+		for i := 4; i < dnsHeaderLen; i++ {
+			resp[i] = 0
+		}
+		self.conn.WriteToUDP(resp, from)
+	}
+}
+
+func (self *fakeDNS) handle(req []byte) byte {
+	if req[2]>>3&0x0f != dnsOpUpdate {
+		return 4
+	}
+	zone, off, err := readName(req, dnsHeaderLen)
+	if err != nil {
+		return 1
+	}
+	off += 4
+	rrs := make([]*testRR, 0, 4)
+	for i := 0; i < int(binary.BigEndian.Uint16(req[8:10])); i++ {
+		var rr *testRR
+		if rr, off, err = readRR(req, off); err != nil {
+			return 1
+		}
+		rrs = append(rrs, rr)
+	}
+	if binary.BigEndian.Uint16(req[10:12]) != 1 {
+		return 9 // unsigned
+	}
+	tsigStart := off
+	tsig, _, err := readRR(req, off)
+	if err != nil || tsig.typ != dnsTypeTSIG || tsig.name != "update-key" {
+		return 9
+	}
+	alg, roff, _ := readName(tsig.rdata, 0)
+	if alg != "hmac-sha256" {
+		return 9
+	}
+	fixed := tsig.rdata[roff : roff+10]
+	macLen := int(binary.BigEndian.Uint16(fixed[8:10]))
+	mac := tsig.rdata[roff+10 : roff+10+macLen]
+
+	unsigned := append([]byte(nil), req[:tsigStart]...)
+	binary.BigEndian.PutUint16(unsigned[10:12], 0)
+	secret, _ := base64.StdEncoding.DecodeString(testSecret)
+	h := hmac.New(sha256.New, secret)
+	h.Write(unsigned)
+	h.Write([]byte("\x0aupdate-key\x00"))
+	h.Write([]byte{0, dnsClassAny, 0, 0, 0, 0})
+	h.Write([]byte("\x0bhmac-sha256\x00"))
+	h.Write(fixed[0:8])
+	h.Write([]byte{0, 0, 0, 0})
+	if !hmac.Equal(h.Sum(nil), mac) {
+		return 9
+	}
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.zone = zone
+	self.updates = append(self.updates, rrs)
+	return self.rcode
+}
+
+func TestRFC2136(t *testing.T) {
+	srv := newFakeDNS(t)
+	defer srv.conn.Close()
+	p := &RFC2136{
+		Server:    srv.conn.LocalAddr().String(),
+		Hostname:  "host.example.com",
+		TTL:       60,
+		KeyName:   "update-key",
+		KeySecret: testSecret,
+	}
+	if err := p.Update(net.ParseIP("203.0.113.7"), net.ParseIP("2001:db8::7")); err != nil {
+		t.Fatalf("Update failed: %s", err.Error())
+	}
+	srv.mu.Lock()
+	if srv.zone != "example.com" || len(srv.updates) != 1 {
+		t.Fatalf("Unexpected zone %s or updates %d", srv.zone, len(srv.updates))
+	}
+	rrs := srv.updates[0]
+	srv.mu.Unlock()
+	if len(rrs) != 4 {
+		t.Fatalf("Expected 4 update records, got %d", len(rrs))
+	}
+	if rrs[0].typ != dnsTypeA || rrs[0].class != dnsClassAny || len(rrs[0].rdata) != 0 {
+		t.Errorf("First record should delete the A RRset: %+v", rrs[0])
+	}
+	if rrs[1].typ != dnsTypeA || rrs[1].ttl != 60 || !net.IP(rrs[1].rdata).Equal(net.ParseIP("203.0.113.7")) {
+		t.Errorf("Second record should add the A record: %+v", rrs[1])
+	}
+	if rrs[3].typ != dnsTypeAAAA || !net.IP(rrs[3].rdata).Equal(net.ParseIP("2001:db8::7")) {
+		t.Errorf("Fourth record should add the AAAA record: %+v", rrs[3])
+	}
+
+	bad := *p
+	bad.KeySecret = base64.StdEncoding.EncodeToString([]byte("wrong"))
+	if err := bad.Update(net.ParseIP("203.0.113.7"), nil); err == nil || !strings.Contains(err.Error(), "(9)") {
+		t.Errorf("Expected NOTAUTH with the wrong key, got %v", err)
+	}
+	srv.mu.Lock()
+	srv.rcode = 5
+	srv.mu.Unlock()
+	if err := p.Update(net.ParseIP("203.0.113.7"), nil); err == nil || !strings.Contains(err.Error(), "refused") {
+		t.Errorf("Expected refusal to be reported, got %v", err)
+	}
+	if err := (&RFC2136{Server: "x", Hostname: "a.example.org", Zone: "example.com"}).Validate(); err == nil {
+		t.Errorf("Expected hostname outside zone to be rejected")
+	}
+}
+
+func TestDynDNS2(t *testing.T) {
+	var mu sync.Mutex
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, _ := r.BasicAuth()
+		if r.URL.Path != "/nic/update" || user != "me" || pass != "pw" {
+			w.Write([]byte("badauth"))
+			return
+		}
+		mu.Lock()
+		got = append(got, r.URL.Query().Get("myip"))
+		mu.Unlock()
+		if r.URL.Query().Get("hostname") != "host.example.com" {
+			w.Write([]byte("nohost"))
+			return
+		}
+		w.Write([]byte("good " + r.URL.Query().Get("myip")))
+	}))
+	defer srv.Close()
+
+	p := &DynDNS2{Server: srv.URL, Hostname: "host.example.com", Username: "me", Password: "pw"}
+	if err := p.Update(net.ParseIP("203.0.113.7"), net.ParseIP("2001:db8::7")); err != nil {
+		t.Fatalf("Update failed: %s", err.Error())
+	}
+	mu.Lock()
+	if len(got) != 1 || got[0] != "203.0.113.7,2001:db8::7" {
+		t.Errorf("Unexpected myip sent: %v", got)
+	}
+	mu.Unlock()
+	bad := *p
+	bad.Password = "nope"
+	if err := bad.Update(net.ParseIP("203.0.113.7"), nil); err == nil || !strings.Contains(err.Error(), "badauth") {
+		t.Errorf("Expected badauth, got %v", err)
+	}
+	bad = *p
+	bad.Hostname = "other.example.com"
+	if err := bad.Update(net.ParseIP("203.0.113.7"), nil); err == nil || !strings.Contains(err.Error(), "nohost") {
+		t.Errorf("Expected nohost, got %v", err)
+	}
+}
+
+type recordingProvider struct {
+	calls []string
+	fail  bool
+}
+
+func (self *recordingProvider) Name() string {
+	return "recording"
+}
+
+func (self *recordingProvider) Update(v4, v6 net.IP) error {
+	self.calls = append(self.calls, ipString(v4)+"|"+ipString(v6))
+	if self.fail {
+		return fmt.Errorf("failed")
+	}
+	return nil
+}
+
+func TestUpdaterPushesChanges(t *testing.T) {
+	both := &recordingProvider{}
+	onlyV6 := &recordingProvider{}
+	u := &Updater{Providers: []Provider{both, Families(onlyV6, false, true)}}
+	a4, b4 := net.ParseIP("203.0.113.7"), net.ParseIP("203.0.113.8")
+	a6 := net.ParseIP("2001:db8::7")
+
+	u.Push(a4, a6)
+	u.Push(a4, a6)
+	u.Push(b4, nil)
+	u.Push(b4, a6)
+	if strings.Join(both.calls, " ") != "203.0.113.7|2001:db8::7 203.0.113.8|" {
+		t.Errorf("Unexpected updates: %v", both.calls)
+	}
+	if strings.Join(onlyV6.calls, " ") != "|2001:db8::7" {
+		t.Errorf("Unexpected v6 only updates: %v", onlyV6.calls)
+	}
+
+	both.fail = true
+	if errs := u.Push(a4, a6); len(errs) != 1 {
+		t.Errorf("Expected one error, got %v", errs)
+	}
+	both.fail = false
+	u.Push(a4, a6)
+	if n := len(both.calls); n != 4 || both.calls[3] != "203.0.113.7|" {
+		t.Errorf("Failed update was not retried: %v", both.calls)
+	}
+
+	dry := &recordingProvider{}
+	var log strings.Builder
+	u = &Updater{Providers: []Provider{dry}, DryRun: true, Log: &log}
+	u.Push(a4, nil)
+	if len(dry.calls) != 0 || !strings.Contains(log.String(), "Would update recording to 203.0.113.7") {
+		t.Errorf("Dry run sent %v, logged %q", dry.calls, log.String())
+	}
+}
@@ -0,0 +1,106 @@
+package ddns
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const DefaultDynDNS2Server = "https://members.dyndns.org"
+
+var dyndns2Errors = map[string]string{
+	"badauth":  "bad username or password",
+	"!donator": "feature not available to this account",
+	"notfqdn":  "hostname is not a fully qualified domain name",
+	"nohost":   "hostname does not exist in this account",
+	"numhost":  "too many hosts in update",
+	"abuse":    "hostname blocked for abuse",
+	"badagent": "client rejected by provider",
+	"dnserr":   "provider DNS error",
+	"911":      "provider is having problems",
+}
+
+// The dyndns2 protocol, spoken by DynDNS, No-IP, Google Domains and many
+// routers: GET /nic/update?hostname=...&myip=... with basic auth.
+type DynDNS2 struct {
+	Server    string
+	Hostname  string
+	Username  string
+	Password  string
+	UserAgent string
+	Timeout   time.Duration
+}
+
+func (self *DynDNS2) Name() string {
+	return "dyndns2 " + self.Hostname
+}
+
+func (self *DynDNS2) Update(v4, v6 net.IP) error {
+	server := self.Server
+	if server == "" {
+		server = DefaultDynDNS2Server
+	}
+	if !strings.Contains(server, "://") {
+		server = "https://" + server
+	}
+	ips := make([]string, 0, 2)
+	for _, ip := range []net.IP{v4, v6} {
+		if ip != nil {
+			ips = append(ips, ip.String())
+		}
+	}
+	q := url.Values{}
+	q.Set("hostname", self.Hostname)
+	q.Set("myip", strings.Join(ips, ","))
+	req, err := http.NewRequest("GET", strings.TrimSuffix(server, "/")+"/nic/update?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(self.Username, self.Password)
+	agent := self.UserAgent
+	if agent == "" {
+		agent = "Parvati-Client"
+	}
+	req.Header.Set("User-Agent", agent)
+	timeout := self.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	resp, err := (&http.Client{Timeout: timeout}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(string(body))
+	if len(fields) == 0 {
+		return fmt.Errorf("Empty reply from %s (%s)\n", server, resp.Status)
+	}
+	switch fields[0] {
+	case "good", "nochg":
+		return nil
+	}
+	if reason, ok := dyndns2Errors[fields[0]]; ok {
+		return fmt.Errorf("%s (%s)\n", reason, fields[0])
+	}
+	return fmt.Errorf("Unexpected reply from %s: %s\n", server, strings.TrimSpace(string(body)))
+}
+
+// Checks the settings make a usable update, without sending anything.
+func (self *DynDNS2) Validate() error {
+	if self.Hostname == "" {
+		return fmt.Errorf("No hostname is set for dyndns2 updates\n")
+	}
+	if self.Username == "" {
+		return fmt.Errorf("No username is set for dyndns2 updates of %s\n", self.Hostname)
+	}
+	return nil
+}
@@ -0,0 +1,274 @@
+package ddns
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	dnsOpUpdate  = 5
+	dnsTypeA     = 1
+	dnsTypeSOA   = 6
+	dnsTypeAAAA  = 28
+	dnsTypeTSIG  = 250
+	dnsClassIN   = 1
+	dnsClassAny  = 255
+	dnsHeaderLen = 12
+	tsigFudge    = 300
+)
+
+var dnsRcodes = map[int]string{
+	1:  "format error",
+	2:  "server failure",
+	3:  "name does not exist",
+	4:  "not implemented",
+	5:  "refused",
+	6:  "name exists when it should not",
+	7:  "RRset exists when it should not",
+	8:  "RRset does not exist when it should",
+	9:  "server not authoritative for zone or bad key",
+	10: "name not contained in zone",
+}
+
+var tsigAlgorithms = map[string]struct {
+	name string
+	hash func() hash.Hash
+}{
+	"hmac-md5":    {"hmac-md5.sig-alg.reg.int.", md5.New},
+	"hmac-sha1":   {"hmac-sha1.", sha1.New},
+	"hmac-sha256": {"hmac-sha256.", sha256.New},
+	"hmac-sha512": {"hmac-sha512.", sha512.New},
+}
+
+// RFC 2136 dynamic update of a name's A/AAAA records, optionally signed
+// with a TSIG (RFC 8945) key.
+type RFC2136 struct {
+	// Authoritative server, host[:port]
+	Server   string
+	Zone     string
+	Hostname string
+	TTL      uint32
+	// TSIG key name, algorithm (hmac-sha256 if empty) and base64 secret
+	KeyName      string
+	KeyAlgorithm string
+	KeySecret    string
+	Timeout      time.Duration
+}
+
+func (self *RFC2136) Name() string {
+	return "rfc2136 " + self.Hostname
+}
+
+// Checks the settings make a usable update, without sending anything.
+func (self *RFC2136) Validate() error {
+	if self.Server == "" {
+		return fmt.Errorf("No server is set for dynamic updates of %s\n", self.Hostname)
+	}
+	if self.Hostname == "" {
+		return fmt.Errorf("No hostname is set for dynamic updates\n")
+	}
+	if !inZone(self.Hostname, self.zone()) {
+		return fmt.Errorf("Hostname %s is not in zone %s\n", self.Hostname, self.zone())
+	}
+	if self.KeyName == "" {
+		return nil
+	}
+	if _, ok := tsigAlgorithms[self.algorithm()]; !ok {
+		return fmt.Errorf("Unknown TSIG algorithm '%s'\n", self.KeyAlgorithm)
+	}
+	if _, err := base64.StdEncoding.DecodeString(self.KeySecret); err != nil {
+		return fmt.Errorf("TSIG secret for key %s is not valid base64: %s\n", self.KeyName, err.Error())
+	}
+	return nil
+}
+
+func (self *RFC2136) algorithm() string {
+	if self.KeyAlgorithm == "" {
+		return "hmac-sha256"
+	}
+	return strings.ToLower(strings.TrimSuffix(self.KeyAlgorithm, "."))
+}
+
+// The zone defaults to the hostname less its first label.
+func (self *RFC2136) zone() string {
+	if self.Zone != "" {
+		return self.Zone
+	}
+	if i := strings.IndexByte(self.Hostname, '.'); i >= 0 {
+		return self.Hostname[i+1:]
+	}
+	return self.Hostname
+}
+
+func (self *RFC2136) Update(v4, v6 net.IP) error {
+	if err := self.Validate(); err != nil {
+		return err
+	}
+	msg, id, err := self.message(v4, v6, time.Now())
+	if err != nil {
+		return err
+	}
+	server := self.Server
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	timeout := self.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	conn, err := net.DialTimeout("udp", server, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(msg); err != nil {
+		return err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return fmt.Errorf("No answer from %s: %s\n", server, err.Error())
+		}
+		if n < dnsHeaderLen || binary.BigEndian.Uint16(buf[0:2]) != id || buf[2]&0x80 == 0 {
+			continue
+		}
+		if rcode := int(buf[3] & 0x0f); rcode != 0 {
+			reason, ok := dnsRcodes[rcode]
+			if !ok {
+				reason = "unknown error"
+			}
+			return fmt.Errorf("Server %s refused update: %s (%d)\n", server, reason, rcode)
+		}
+		return nil
+	}
+}
+
+// Builds the update: replace the RRset of each family we have an address for.
+func (self *RFC2136) message(v4, v6 net.IP, now time.Time) ([]byte, uint16, error) {
+	idBytes := make([]byte, 2)
+	rand.Read(idBytes)
+	id := binary.BigEndian.Uint16(idBytes)
+	name, err := encodeName(self.Hostname)
+	if err != nil {
+		return nil, 0, err
+	}
+	zone, err := encodeName(self.zone())
+	if err != nil {
+		return nil, 0, err
+	}
+	ttl := self.TTL
+	if ttl == 0 {
+		ttl = 300
+	}
+	updates := make([]byte, 0, 128)
+	count := 0
+	if v4 = v4.To4(); v4 != nil {
+		updates = appendRR(updates, name, dnsTypeA, dnsClassAny, 0, nil)
+		updates = appendRR(updates, name, dnsTypeA, dnsClassIN, ttl, v4)
+		count += 2
+	}
+	if v6 != nil && v6.To4() == nil {
+		updates = appendRR(updates, name, dnsTypeAAAA, dnsClassAny, 0, nil)
+		updates = appendRR(updates, name, dnsTypeAAAA, dnsClassIN, ttl, v6.To16())
+		count += 2
+	}
+	if count == 0 {
+		return nil, 0, fmt.Errorf("No addresses to update %s with\n", self.Hostname)
+	}
+	msg := make([]byte, dnsHeaderLen, dnsHeaderLen+len(zone)+4+len(updates))
+	binary.BigEndian.PutUint16(msg[0:2], id)
+	msg[2] = dnsOpUpdate << 3
+	binary.BigEndian.PutUint16(msg[4:6], 1) // zone count
+	binary.BigEndian.PutUint16(msg[8:10], uint16(count))
+	msg = append(msg, zone...)
+	msg = append(msg, 0, dnsTypeSOA, 0, dnsClassIN)
+	msg = append(msg, updates...)
+	if self.KeyName != "" {
+		if msg, err = self.sign(msg, id, now); err != nil {
+			return nil, 0, err
+		}
+	}
+	return msg, id, nil
+}
+
+// Appends a TSIG record covering msg.
+func (self *RFC2136) sign(msg []byte, id uint16, now time.Time) ([]byte, error) {
+	alg := tsigAlgorithms[self.algorithm()]
+	secret, err := base64.StdEncoding.DecodeString(self.KeySecret)
+	if err != nil {
+		return nil, err
+	}
+	keyName, err := encodeName(strings.ToLower(self.KeyName))
+	if err != nil {
+		return nil, err
+	}
+	algName, _ := encodeName(alg.name)
+	timeSigned := make([]byte, 8)
+	binary.BigEndian.PutUint64(timeSigned, uint64(now.Unix()))
+	timeSigned = timeSigned[2:]
+
+	mac := hmac.New(alg.hash, secret)
+	mac.Write(msg)
+	mac.Write(keyName)
+	mac.Write([]byte{0, dnsClassAny, 0, 0, 0, 0})
+	mac.Write(algName)
+	mac.Write(timeSigned)
+	mac.Write([]byte{tsigFudge >> 8, tsigFudge & 0xff, 0, 0, 0, 0}) // fudge, error, other length
+	sum := mac.Sum(nil)
+
+	rdata := make([]byte, 0, len(algName)+16+len(sum))
+	rdata = append(rdata, algName...)
+	rdata = append(rdata, timeSigned...)
+	rdata = append(rdata, tsigFudge>>8, tsigFudge&0xff, byte(len(sum)>>8), byte(len(sum)))
+	rdata = append(rdata, sum...)
+	rdata = append(rdata, byte(id>>8), byte(id), 0, 0, 0, 0)
+	out := appendRR(msg, keyName, dnsTypeTSIG, dnsClassAny, 0, rdata)
+	binary.BigEndian.PutUint16(out[10:12], binary.BigEndian.Uint16(out[10:12])+1)
+	return out, nil
+}
+
+func appendRR(b, name []byte, rrType, class uint16, ttl uint32, rdata []byte) []byte {
+	b = append(b, name...)
+	b = append(b, byte(rrType>>8), byte(rrType), byte(class>>8), byte(class))
+	b = append(b, byte(ttl>>24), byte(ttl>>16), byte(ttl>>8), byte(ttl))
+	b = append(b, byte(len(rdata)>>8), byte(len(rdata)))
+	return append(b, rdata...)
+}
+
+func encodeName(name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	out := make([]byte, 0, len(name)+2)
+	if name == "" {
+		return append(out, 0), nil
+	}
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("Invalid DNS name '%s'\n", name)
+		}
+		out = append(out, byte(len(label)))
+		out = append(out, label...)
+	}
+	if len(out) > 254 {
+		return nil, fmt.Errorf("DNS name too long: '%s'\n", name)
+	}
+	return append(out, 0), nil
+}
+
+func inZone(name, zone string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	zone = strings.ToLower(strings.TrimSuffix(zone, "."))
+	return name == zone || strings.HasSuffix(name, "."+zone)
+}
@@ -2,30 +2,58 @@ package iface
 
 import (
 	"fmt"
-	"github.com/misatosangel/gitconfig"
+	"github.com/misatosangel/parvati-api-client/pkg/parvatigo"
+	"net"
 	"strconv"
+	"strings"
 )
 
 type Config struct {
-	V4Iface string `gcKey:"interfaces.ipv4"`
-	V6Iface string `gcKey:"interfaces.ipv6"`
-	v4Name  string
-	v6Name  string
-	V4ID    int
-	V6ID    int
+	V4Iface string `gcKey:"interfaces.ipv4" gcDesc:"Force IPv4 to bind to this interface name or number."`
+	V6Iface string `gcKey:"interfaces.ipv6" gcDesc:"Force IPv6 to bind to this interface name or number."`
+	// STUN servers (host:port) used to find public IPs and NAT types
+	STUNServers []string `gcKey:"interfaces.stunServer" gcDesc:"STUN server (host:port) used to find your public IP when it cannot be worked out from your interfaces, and to classify your NAT type. Can be repeated; servers are tried in order. Defaults to stun.stunprotocol.org:3478 then stun.l.google.com:19302."`
+	// Ordered resolvers used to find public IPs, and how to combine them
+	Resolvers      []string `gcKey:"interfaces.resolvers" gcDesc:"Ordered ways to find your public IP, separated by commas or spaces (can be repeated). Any of: 'iface' (interface addresses, using traceroute past NAT), 'stun', 'http' (echo services), 'dns' (myip.opendns.com) and 'static'. Defaults to 'iface, stun'."`
+	ResolverMode   string   `gcKey:"interfaces.resolverMode" gcDefault:"first" gcDesc:"'first' uses the first resolver to answer, later ones being fallbacks. 'consensus' asks them all and needs resolverQuorum of them to agree."`
+	ResolverQuorum int      `gcKey:"interfaces.resolverQuorum" gcDefault:"2" gcDesc:"Resolvers that must agree in consensus mode."`
+	HTTPEcho       []string `gcKey:"interfaces.httpEcho" gcDesc:"URL replying with your IP as plain text, for the 'http' resolver (can be repeated). Defaults to https://api.ipify.org then https://icanhazip.com."`
+	DNSServer      string   `gcKey:"interfaces.dnsServer" gcDesc:"DNS server for the 'dns' resolver. Defaults to resolver1.opendns.com:53."`
+	StaticIPv4     string   `gcKey:"interfaces.staticIPv4" gcDesc:"Fixed public IPv4 address given by the 'static' resolver."`
+	StaticIPv6     string   `gcKey:"interfaces.staticIPv6" gcDesc:"Fixed public IPv6 address given by the 'static' resolver."`
+	// Rules for choosing between several IPv6 addresses
+	IPv6Policy []string `gcKey:"interfaces.ipv6Policy" gcDesc:"Rules for choosing between several public IPv6 addresses, in order, separated by commas or spaces (can be repeated). Any of: 'stable' (avoid temporary privacy addresses), 'temporary', 'lifetime' (longest preferred lifetime), 'prefix:<cidr>' and 'rfc6724' (avoid deprecated addresses, prefer global over ULA/6to4/Teredo). Address flags are only known on Linux. Defaults to 'rfc6724 stable lifetime'."`
+	v4Name     string
+	v6Name     string
+	V4ID       int
+	V6ID       int
 }
 
+// Reads the interfaces section, with any environment variables applied over
+// it.
 func ReadConfig(file string) (*Config, error) {
-	conf, err := gitconfig.NewConfigFromFile(file)
+	return ReadConfigWith(file, nil)
+}
+
+// Reads the interfaces section, with any environment variables and then the
+// command line's overrides applied over it.
+func ReadConfigWith(file string, flags []parvatigo.ConfigOverride) (*Config, error) {
+	var ifaceConfig Config
+	conf, _, err := parvatigo.ReadGitConfig(file, parvatigo.ConfigKeys(&ifaceConfig), flags)
 	if err != nil {
 		return nil, err
 	}
-	var ifaceConfig Config
 	err = conf.Load(&ifaceConfig)
 	return &ifaceConfig, err
 }
 
 func (self *Config) Configure(list *InterfaceList) error {
+	if _, err := self.ResolverChain(); err != nil {
+		return err
+	}
+	if _, err := ParseIPv6Policy(self.IPv6Policy); err != nil {
+		return err
+	}
 	if err := self.ConfigureV4(list); err != nil {
 		return err
 	}
@@ -84,3 +112,56 @@ func (self *Config) ConfigureV6(list *InterfaceList) error {
 	self.V6ID = val
 	return nil
 }
+
+// Builds the public IP resolver chain from interfaces.resolvers. Each value
+// may hold several names separated by commas or spaces.
+func (self *Config) ResolverChain() (*ResolverChain, error) {
+	names := make([]string, 0, len(self.Resolvers))
+	for _, r := range self.Resolvers {
+		names = append(names, strings.FieldsFunc(r, func(c rune) bool {
+			return c == ',' || c == ' ' || c == '\t'
+		})...)
+	}
+	if len(names) == 0 {
+		names = DefaultResolvers
+	}
+	chain := &ResolverChain{Mode: self.ResolverMode, Quorum: self.ResolverQuorum}
+	switch chain.Mode {
+	case "":
+		chain.Mode = "first"
+	case "first", "consensus":
+	default:
+		return nil, fmt.Errorf("Unknown interfaces.resolverMode: '%s'. Use first or consensus.\n", chain.Mode)
+	}
+	for _, name := range names {
+		switch strings.ToLower(name) {
+		case "iface", "traceroute":
+			chain.Resolvers = append(chain.Resolvers, &InterfaceResolver{})
+		case "stun":
+			chain.Resolvers = append(chain.Resolvers, &STUNResolver{Servers: self.STUNServers})
+		case "http":
+			chain.Resolvers = append(chain.Resolvers, &HTTPResolver{URLs: self.HTTPEcho})
+		case "dns":
+			chain.Resolvers = append(chain.Resolvers, &DNSResolver{Server: self.DNSServer})
+		case "static":
+			static := &StaticResolver{}
+			if self.StaticIPv4 != "" {
+				if static.V4 = net.ParseIP(self.StaticIPv4).To4(); static.V4 == nil {
+					return nil, fmt.Errorf("Unable to parse interfaces.staticIPv4 '%s' as an IPv4 address\n", self.StaticIPv4)
+				}
+			}
+			if self.StaticIPv6 != "" {
+				if static.V6 = net.ParseIP(self.StaticIPv6); static.V6 == nil || static.V6.To4() != nil {
+					return nil, fmt.Errorf("Unable to parse interfaces.staticIPv6 '%s' as an IPv6 address\n", self.StaticIPv6)
+				}
+			}
+			chain.Resolvers = append(chain.Resolvers, static)
+		default:
+			return nil, fmt.Errorf("Unknown resolver '%s' in interfaces.resolvers. Use iface, stun, http, dns or static.\n", name)
+		}
+	}
+	if chain.Mode == "consensus" && chain.Quorum > len(chain.Resolvers) {
+		return nil, fmt.Errorf("interfaces.resolverQuorum is %d but only %d resolvers are configured\n", chain.Quorum, len(chain.Resolvers))
+	}
+	return chain, nil
+}
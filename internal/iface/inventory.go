@@ -0,0 +1,289 @@
+package iface
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/misatosangel/parvati-api-client/internal/stun"
+	"github.com/misatosangel/traceroute"
+)
+
+// A single traceroute hop; IP is empty and TimedOut set if it gave no answer.
+type Hop struct {
+	IP       string  `json:"ip,omitempty"`
+	RTTms    float64 `json:"rtt_ms,omitempty"`
+	TimedOut bool    `json:"timed_out,omitempty"`
+}
+
+type AddressInfo struct {
+	LocalIP       string `json:"local_ip"`
+	RemoteIP      string `json:"remote_ip,omitempty"`
+	NAT           bool   `json:"nat"`
+	Error         string `json:"error,omitempty"`
+	GatewayIP     string `json:"gateway_ip,omitempty"`
+	GatewayError  string `json:"gateway_error,omitempty"`
+	Hops          []Hop  `json:"hops,omitempty"`
+	ReachedPublic bool   `json:"reached_public,omitempty"`
+	TraceError    string `json:"trace_error,omitempty"`
+	NATType       string `json:"nat_type,omitempty"`
+	STUNMapped    string `json:"stun_mapped,omitempty"`
+	STUNServer    string `json:"stun_server,omitempty"`
+	STUNError     string `json:"stun_error,omitempty"`
+}
+
+type InterfaceInfo struct {
+	Index     int           `json:"index"`
+	Name      string        `json:"name"`
+	MAC       string        `json:"mac,omitempty"`
+	Error     string        `json:"error,omitempty"`
+	Addresses []AddressInfo `json:"addresses"`
+}
+
+// Everything known about the local interfaces and their routes out, for
+// diagnosing hosting problems.
+type InterfaceInventory struct {
+	Generated  time.Time       `json:"generated"`
+	Filter     string          `json:"filter"`
+	Incomplete bool            `json:"incomplete,omitempty"`
+	Interfaces []InterfaceInfo `json:"interfaces"`
+}
+
+type InventoryOptions struct {
+	// Traces run at once; defaults to 4.
+	Parallel int
+	// Total time allowed for tracing; traces still running when it runs
+	// out stop at their next hop. Defaults to 30s.
+	Budget time.Duration
+	// Per hop timeout in milliseconds; defaults to 500.
+	HopTimeout int
+}
+
+// Builds the inventory, tracing NATed addresses in parallel. NAT types are
+// classified with STUN if the list's CheckNAT is set.
+func (self *InterfaceList) Inventory(opts InventoryOptions) *InterfaceInventory {
+	if opts.Parallel <= 0 {
+		opts.Parallel = 4
+	}
+	if opts.Budget <= 0 {
+		opts.Budget = 30 * time.Second
+	}
+	if opts.HopTimeout <= 0 {
+		opts.HopTimeout = 500
+	}
+	inv := &InterfaceInventory{
+		Generated:  time.Now(),
+		Filter:     traceroute.FilterToString(self.Filter),
+		Interfaces: make([]InterfaceInfo, 0, len(self.List)),
+	}
+	deadline := inv.Generated.Add(opts.Budget)
+	type job struct {
+		iface net.Interface
+		addr  traceroute.IPAddrMap
+		info  *AddressInfo
+	}
+	ifaces := make([]net.Interface, 0, len(self.List))
+	raw := make([][]traceroute.IPAddrMap, 0, len(self.List))
+	for _, iface := range self.List {
+		addrs, err := traceroute.FilterInterfaceIPs(iface, self.Filter)
+		if err == nil && len(addrs) == 0 {
+			continue
+		}
+		info := InterfaceInfo{Index: iface.Index, Name: iface.Name, MAC: iface.HardwareAddr.String()}
+		if err != nil {
+			info.Error = err.Error()
+		}
+		info.Addresses = make([]AddressInfo, len(addrs))
+		inv.Interfaces = append(inv.Interfaces, info)
+		ifaces = append(ifaces, iface)
+		raw = append(raw, addrs)
+	}
+	jobs := make([]job, 0, 4)
+	for i := range inv.Interfaces {
+		for j, addr := range raw[i] {
+			a := &inv.Interfaces[i].Addresses[j]
+			a.LocalIP = addr.LocalIP.String()
+			if addr.RemoteIP != nil {
+				a.RemoteIP = addr.RemoteIP.String()
+			}
+			if addr.Error != nil {
+				a.Error = addr.Error.Error()
+				continue
+			}
+			a.NAT = addr.HasNAT()
+			if a.NAT || self.CheckNAT {
+				jobs = append(jobs, job{iface: ifaces[i], addr: addr, info: a})
+			}
+		}
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	sem := make(chan struct{}, opts.Parallel)
+	for _, j := range jobs {
+		wg.Add(1)
+		go func(j job) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			complete := true
+			if j.info.NAT {
+				complete = traceAddress(j.iface, j.addr, j.info, deadline, opts.HopTimeout)
+			}
+			if self.CheckNAT {
+				classifyAddress(j.addr.LocalIP, self.STUNServers, j.info)
+			}
+			if !complete {
+				mu.Lock()
+				inv.Incomplete = true
+				mu.Unlock()
+			}
+		}(j)
+	}
+	wg.Wait()
+	return inv
+}
+
+// Traces hop by hop towards the address's public IP until it is reached,
+// three hops in a row time out or the deadline passes. Returns false if the
+// deadline cut it short.
+func traceAddress(iface net.Interface, addr traceroute.IPAddrMap, info *AddressInfo, deadline time.Time, hopTimeout int) bool {
+	pubIP := addr.RemoteIP
+	pubIpStr := pubIP.String()
+	gatewayIP, err := traceroute.FindGateway(pubIpStr, "", iface.Name, addr.LocalIP)
+	if err != nil {
+		info.GatewayError = err.Error()
+	} else {
+		info.GatewayIP = gatewayIP.String()
+	}
+	var bestRoutes []traceroute.TraceRoute
+	lastLen := 0
+	complete := true
+	for hops := 1; hops > 0; hops++ {
+		if time.Now().After(deadline) {
+			info.TraceError = "time budget exceeded"
+			complete = false
+			break
+		}
+		routes, err := traceroute.Trace(pubIpStr, "", iface.Name, hops, hopTimeout)
+		if err != nil {
+			info.TraceError = err.Error()
+			break
+		}
+		curLen := len(routes)
+		if curLen <= lastLen {
+			break
+		}
+		lastLen = curLen
+		bestRoutes = routes
+		if pubIP.Equal(routes[curLen-1].IP) {
+			info.ReachedPublic = true
+			break
+		}
+		// last three are timeouts? give up
+		if curLen > 3 && routes[curLen-1].IP == nil && routes[curLen-2].IP == nil && routes[curLen-3].IP == nil {
+			break
+		}
+	}
+	for _, route := range bestRoutes {
+		if route.Time == 0 {
+			info.Hops = append(info.Hops, Hop{TimedOut: true})
+		} else {
+			info.Hops = append(info.Hops, Hop{IP: route.IP.String(), RTTms: route.Time})
+		}
+	}
+	return complete
+}
+
+func classifyAddress(localIP net.IP, servers []string, info *AddressInfo) {
+	network := "udp4"
+	if localIP.To4() == nil {
+		network = "udp6"
+	}
+	res, err := stun.Discover(network, localIP, servers, true)
+	if err != nil {
+		info.STUNError = err.Error()
+		return
+	}
+	info.NATType = string(res.NAT)
+	info.STUNServer = res.Server
+	if res.Mapped != nil {
+		info.STUNMapped = res.Mapped.String()
+	}
+}
+
+func (self *InterfaceInventory) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(self)
+}
+
+func (self *InterfaceInventory) WriteText(w io.Writer) {
+	for _, iface := range self.Interfaces {
+		fmt.Fprintf(w, "%d. %s", iface.Index, iface.Name)
+		if iface.MAC != "" {
+			fmt.Fprintf(w, " [MAC: %s]", iface.MAC)
+		}
+		fmt.Fprint(w, "\n")
+		if iface.Error != "" {
+			fmt.Fprintf(w, "Could not find addreses: %s\n", iface.Error)
+			continue
+		}
+		for _, addr := range iface.Addresses {
+			if addr.Error != "" {
+				fmt.Fprintf(w, " - %s (%s)\n", addr.LocalIP, addr.Error)
+				continue
+			}
+			if !addr.NAT {
+				fmt.Fprintf(w, " - %s (no-NAT)\n", addr.LocalIP)
+			} else {
+				fmt.Fprintf(w, " - %s", addr.LocalIP)
+				if addr.GatewayError != "" {
+					fmt.Fprintf(w, " [Gateway IP detection failed: '%s']", addr.GatewayError)
+				} else {
+					fmt.Fprintf(w, " [Router LAN IP: %s]", addr.GatewayIP)
+				}
+				if len(addr.Hops) > 0 {
+					for _, hop := range addr.Hops {
+						if hop.TimedOut {
+							fmt.Fprintf(w, " --NAT [timed out]--> ???")
+						} else {
+							fmt.Fprintf(w, " --NAT [%0.3f ms]--> %s", hop.RTTms, hop.IP)
+						}
+					}
+					if !addr.ReachedPublic {
+						fmt.Fprintf(w, " --???--> %s", addr.RemoteIP)
+					}
+					if addr.TraceError != "" {
+						fmt.Fprintf(w, " [%s]", addr.TraceError)
+					}
+				} else if addr.TraceError == "" {
+					fmt.Fprintf(w, " --NAT--> %s [No info from traceroute]", addr.RemoteIP)
+				} else {
+					fmt.Fprintf(w, " --NAT--> %s [Error reading route: %s]", addr.RemoteIP, addr.TraceError)
+				}
+				fmt.Fprintf(w, "\n")
+			}
+			if addr.STUNError != "" {
+				fmt.Fprintf(w, "   [STUN failed: %s]\n", strings.TrimSpace(addr.STUNError))
+			} else if addr.NATType != "" {
+				fmt.Fprintf(w, "   [NAT type: %s", addr.NATType)
+				if addr.STUNMapped != "" {
+					fmt.Fprintf(w, ", public address %s", addr.STUNMapped)
+				}
+				fmt.Fprintf(w, " (via %s)", addr.STUNServer)
+				if nt := stun.NATType(addr.NATType); !nt.Hostable() && nt != stun.NATUnknown && nt != stun.NATBlocked {
+					fmt.Fprintf(w, ", others may not be able to join without port forwarding")
+				}
+				fmt.Fprintf(w, "]\n")
+			}
+		}
+		fmt.Fprint(w, "\n")
+	}
+	if self.Incomplete {
+		fmt.Fprint(w, "Some traces were cut short by the time budget.\n")
+	}
+}
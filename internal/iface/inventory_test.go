@@ -0,0 +1,163 @@
+package iface
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/misatosangel/parvati-api-client/internal/stun"
+	"github.com/misatosangel/traceroute"
+)
+
+// A STUN server on one address, answering each binding request with the
+// address it came from.
+func newFakeSTUN(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			req, err := stun.Decode(buf[:n])
+			if err != nil || req.Type != stun.TypeBindingRequest {
+				continue
+			}
+			resp := &stun.Message{Type: stun.TypeBindingResponse, TransactionID: req.TransactionID}
+			resp.AddAddress(stun.AttrXORMappedAddress, from)
+			conn.WriteToUDP(resp.Encode(), from)
+		}
+	}()
+	return conn
+}
+
+func loopbackList(t *testing.T, want int) *InterfaceList {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range ifaces {
+		if i.Flags&net.FlagLoopback != 0 && i.Flags&net.FlagUp != 0 {
+			return &InterfaceList{List: []net.Interface{i}, Filter: want}
+		}
+	}
+	t.Skip("No loopback interface")
+	return nil
+}
+
+func TestInventoryCollect(t *testing.T) {
+	list := loopbackList(t, traceroute.WANT_LOOPBACK_V4)
+	inv := list.Inventory(InventoryOptions{})
+	if len(inv.Interfaces) != 1 || inv.Incomplete || inv.Filter != traceroute.FilterToString(traceroute.WANT_LOOPBACK_V4) {
+		t.Fatalf("Unexpected inventory: %+v", inv)
+	}
+	lo := inv.Interfaces[0]
+	if lo.Name != list.List[0].Name || lo.Index != list.List[0].Index || len(lo.Addresses) == 0 {
+		t.Fatalf("Unexpected loopback entry: %+v", lo)
+	}
+	for _, a := range lo.Addresses {
+		if ip := net.ParseIP(a.LocalIP); ip == nil || !ip.IsLoopback() || a.NAT || a.Error != "" || len(a.Hops) != 0 || a.NATType != "" {
+			t.Errorf("Unexpected loopback address: %+v", a)
+		}
+	}
+
+	// interfaces without a wanted address are left out
+	list.Filter = traceroute.WANT_PUBLIC_V6
+	if inv := list.Inventory(InventoryOptions{}); len(inv.Interfaces) != 0 {
+		t.Errorf("Expected no interfaces, got %+v", inv.Interfaces)
+	}
+
+	server := newFakeSTUN(t)
+	defer server.Close()
+	list.Filter = traceroute.WANT_LOOPBACK_V4
+	list.CheckNAT = true
+	list.STUNServers = []string{server.LocalAddr().String()}
+	inv = list.Inventory(InventoryOptions{Parallel: 1})
+	for _, a := range inv.Interfaces[0].Addresses {
+		if a.NATType != string(stun.NATNone) || a.STUNServer != list.STUNServers[0] || a.STUNError != "" ||
+			!strings.HasPrefix(a.STUNMapped, a.LocalIP+":") {
+			t.Errorf("Expected the address to be classified, got %+v", a)
+		}
+	}
+}
+
+func testInventory() *InterfaceInventory {
+	return &InterfaceInventory{
+		Filter:     "v4-public,v4-private",
+		Incomplete: true,
+		Interfaces: []InterfaceInfo{
+			{Index: 1, Name: "eth0", MAC: "00:11:22:33:44:55", Addresses: []AddressInfo{
+				{LocalIP: "203.0.113.5", RemoteIP: "203.0.113.5"},
+				{LocalIP: "192.168.1.2", RemoteIP: "198.51.100.9", NAT: true, GatewayIP: "192.168.1.1",
+					Hops: []Hop{{IP: "192.168.1.1", RTTms: 1.25}, {TimedOut: true}, {IP: "198.51.100.9", RTTms: 9.5}}, ReachedPublic: true,
+					NATType: string(stun.NATSymmetric), STUNMapped: "198.51.100.9:4000", STUNServer: "stun.example.com"},
+				{LocalIP: "192.168.1.3", RemoteIP: "198.51.100.9", NAT: true, GatewayError: "no route",
+					Hops: []Hop{{IP: "192.168.1.1", RTTms: 2}}, TraceError: "time budget exceeded", STUNError: "timeout\n"},
+				{LocalIP: "10.0.0.2", Error: "not connected"},
+			}},
+			{Index: 2, Name: "wlan0", Addresses: []AddressInfo{
+				{LocalIP: "10.1.0.2", RemoteIP: "198.51.100.10", NAT: true, GatewayIP: "10.1.0.1", NATType: string(stun.NATFullCone), STUNServer: "stun.example.com"},
+				{LocalIP: "10.1.0.3", RemoteIP: "198.51.100.10", NAT: true, GatewayIP: "10.1.0.1", TraceError: "permission denied"},
+			}},
+			{Index: 3, Name: "tun0", Error: "no addresses"},
+		},
+	}
+}
+
+func TestInventoryWriteText(t *testing.T) {
+	var buf bytes.Buffer
+	testInventory().WriteText(&buf)
+	want := `1. eth0 [MAC: 00:11:22:33:44:55]
+ - 203.0.113.5 (no-NAT)
+ - 192.168.1.2 [Router LAN IP: 192.168.1.1] --NAT [1.250 ms]--> 192.168.1.1 --NAT [timed out]--> ??? --NAT [9.500 ms]--> 198.51.100.9
+   [NAT type: symmetric, public address 198.51.100.9:4000 (via stun.example.com), others may not be able to join without port forwarding]
+ - 192.168.1.3 [Gateway IP detection failed: 'no route'] --NAT [2.000 ms]--> 192.168.1.1 --???--> 198.51.100.9 [time budget exceeded]
+   [STUN failed: timeout]
+ - 10.0.0.2 (not connected)
+
+2. wlan0
+ - 10.1.0.2 [Router LAN IP: 10.1.0.1] --NAT--> 198.51.100.10 [No info from traceroute]
+   [NAT type: full cone (via stun.example.com)]
+ - 10.1.0.3 [Router LAN IP: 10.1.0.1] --NAT--> 198.51.100.10 [Error reading route: permission denied]
+
+3. tun0
+Could not find addreses: no addresses
+Some traces were cut short by the time budget.
+`
+	if got := buf.String(); got != want {
+		t.Errorf("Unexpected text inventory:\n%s\nwanted:\n%s", got, want)
+	}
+}
+
+func TestInventoryWriteJSON(t *testing.T) {
+	var buf bytes.Buffer
+	inv := testInventory()
+	if err := inv.WriteJSON(&buf); err != nil {
+		t.Fatalf("WriteJSON failed: %s", err.Error())
+	}
+	var back InterfaceInventory
+	if err := json.Unmarshal(buf.Bytes(), &back); err != nil {
+		t.Fatalf("JSON inventory does not parse: %s", err.Error())
+	}
+	if !back.Incomplete || back.Filter != inv.Filter || len(back.Interfaces) != 3 || back.Interfaces[2].Error != "no addresses" {
+		t.Fatalf("Unexpected inventory read back: %+v", back)
+	}
+	a := back.Interfaces[0].Addresses[1]
+	if !a.NAT || a.GatewayIP != "192.168.1.1" || len(a.Hops) != 3 || !a.Hops[1].TimedOut || a.Hops[2].RTTms != 9.5 || a.NATType != "symmetric" {
+		t.Errorf("Unexpected address read back: %+v", a)
+	}
+	for _, key := range []string{`"local_ip": "203.0.113.5"`, `"nat": false`, `"timed_out": true`, `"reached_public": true`} {
+		if !strings.Contains(buf.String(), key) {
+			t.Errorf("Expected %s in the JSON:\n%s", key, buf.String())
+		}
+	}
+	if strings.Contains(buf.String(), `"trace_error": ""`) {
+		t.Errorf("Expected empty fields to be left out:\n%s", buf.String())
+	}
+}
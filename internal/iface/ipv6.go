@@ -0,0 +1,170 @@
+package iface
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Rules used to choose between several IPv6 addresses when no
+// interfaces.ipv6Policy is configured.
+var DefaultIPv6Policy = []string{"rfc6724", "stable", "lifetime"}
+
+// What the kernel knows about a local IPv6 address. Only Linux reports
+// this; elsewhere addresses have no flags and lifetimes are unknown (zero).
+type IPv6AddrInfo struct {
+	IP         net.IP
+	PrefixLen  int
+	Temporary  bool
+	Deprecated bool
+	Tentative  bool
+	Permanent  bool
+	Preferred  time.Duration
+	Valid      time.Duration
+}
+
+// An ordered list of rules; the first rule to prefer one address over
+// another decides. Rules are:
+//
+//	stable     - prefer addresses that are not temporary privacy addresses
+//	temporary  - prefer temporary privacy addresses
+//	lifetime   - prefer the longest preferred lifetime
+//	prefix:P   - prefer addresses within prefix P, e.g. prefix:2001:db8::/48
+//	rfc6724    - avoid deprecated and tentative addresses, then prefer
+//	             global addresses over ULA, 6to4 and Teredo (RFC 6724)
+type IPv6Policy []ipv6Rule
+
+type ipv6Rule struct {
+	name   string
+	prefix *net.IPNet
+}
+
+// Parses policy rules; each value may hold several rules separated by
+// commas or spaces. An empty list gives the default policy.
+func ParseIPv6Policy(values []string) (IPv6Policy, error) {
+	names := make([]string, 0, len(values))
+	for _, v := range values {
+		names = append(names, strings.FieldsFunc(v, func(c rune) bool {
+			return c == ',' || c == ' ' || c == '\t'
+		})...)
+	}
+	if len(names) == 0 {
+		names = DefaultIPv6Policy
+	}
+	out := make(IPv6Policy, 0, len(names))
+	for _, n := range names {
+		lower := strings.ToLower(n)
+		switch {
+		case lower == "stable" || lower == "temporary" || lower == "lifetime" || lower == "rfc6724":
+			out = append(out, ipv6Rule{name: lower})
+		case strings.HasPrefix(lower, "prefix:"):
+			_, ipNet, err := net.ParseCIDR(n[len("prefix:"):])
+			if err != nil || ipNet.IP.To4() != nil {
+				return nil, fmt.Errorf("Unable to parse IPv6 prefix in interfaces.ipv6Policy rule '%s'\n", n)
+			}
+			out = append(out, ipv6Rule{name: "prefix", prefix: ipNet})
+		default:
+			return nil, fmt.Errorf("Unknown rule '%s' in interfaces.ipv6Policy. Use stable, temporary, lifetime, prefix:<cidr> or rfc6724.\n", n)
+		}
+	}
+	return out, nil
+}
+
+// Picks one address from the candidates. info may be nil, or lack some
+// addresses, in which case rules needing flags treat them as equal. It is
+// an error if no rule separates the best two candidates.
+func (self IPv6Policy) Select(candidates []net.IP, info map[string]*IPv6AddrInfo) (net.IP, error) {
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("No IPv6 addresses to choose from\n")
+	}
+	best := candidates[0]
+	tied := false
+	for _, c := range candidates[1:] {
+		switch self.compare(c, best, info) {
+		case -1:
+			best = c
+			tied = false
+		case 0:
+			tied = true
+		}
+	}
+	if tied {
+		ips := make([]string, len(candidates))
+		for i, c := range candidates {
+			ips[i] = "'" + c.String() + "'"
+		}
+		return nil, fmt.Errorf("interfaces.ipv6Policy could not choose between IPv6 addresses: %s.\n", strings.Join(ips, ", "))
+	}
+	return best, nil
+}
+
+// -1 if a is preferred, 1 if b is, 0 if no rule can tell them apart.
+func (self IPv6Policy) compare(a, b net.IP, info map[string]*IPv6AddrInfo) int {
+	ai, bi := info[a.String()], info[b.String()]
+	if ai == nil {
+		ai = &IPv6AddrInfo{IP: a}
+	}
+	if bi == nil {
+		bi = &IPv6AddrInfo{IP: b}
+	}
+	for _, rule := range self {
+		var c int
+		switch rule.name {
+		case "stable":
+			c = preferTrue(!ai.Temporary, !bi.Temporary)
+		case "temporary":
+			c = preferTrue(ai.Temporary, bi.Temporary)
+		case "lifetime":
+			c = preferTrue(ai.Preferred > bi.Preferred, bi.Preferred > ai.Preferred)
+		case "prefix":
+			c = preferTrue(rule.prefix.Contains(a), rule.prefix.Contains(b))
+		case "rfc6724":
+			if c = preferTrue(!ai.Deprecated, !bi.Deprecated); c == 0 {
+				if c = preferTrue(!ai.Tentative, !bi.Tentative); c == 0 {
+					pa, pb := precedence6724(a), precedence6724(b)
+					c = preferTrue(pa > pb, pb > pa)
+				}
+			}
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+func preferTrue(a, b bool) int {
+	if a == b {
+		return 0
+	}
+	if a {
+		return -1
+	}
+	return 1
+}
+
+var rfc6724Table = []struct {
+	prefix     string
+	precedence int
+}{
+	{"::1/128", 50},
+	{"::ffff:0:0/96", 35},
+	{"2002::/16", 30},
+	{"2001::/32", 5},
+	{"fc00::/7", 3},
+	{"::/96", 1},
+	{"fec0::/10", 1},
+	{"3ffe::/16", 1},
+}
+
+// Precedence of an address from the RFC 6724 default policy table.
+func precedence6724(ip net.IP) int {
+	for _, e := range rfc6724Table {
+		_, ipNet, _ := net.ParseCIDR(e.prefix)
+		if ipNet.Contains(ip) {
+			return e.precedence
+		}
+	}
+	return 40
+}
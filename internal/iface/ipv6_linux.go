@@ -0,0 +1,84 @@
+package iface
+
+import (
+	"net"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// ifaddr flags and attributes, from linux/if_addr.h
+const (
+	ifaFTemporary  = 0x01
+	ifaFDeprecated = 0x20
+	ifaFTentative  = 0x40
+	ifaFPermanent  = 0x80
+	ifaCacheInfo   = 6
+	ifaFlags       = 8
+	// lifetime meaning forever
+	infinityLifetime = 0xffffffff
+)
+
+// Reads flags and lifetimes of every local IPv6 address, keyed by address.
+func IPv6AddrFlags() (map[string]*IPv6AddrInfo, error) {
+	data, err := syscall.NetlinkRIB(syscall.RTM_GETADDR, syscall.AF_INET6)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := syscall.ParseNetlinkMessage(data)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]*IPv6AddrInfo)
+	for i := range msgs {
+		m := &msgs[i]
+		if m.Header.Type != syscall.RTM_NEWADDR || len(m.Data) < syscall.SizeofIfAddrmsg {
+			continue
+		}
+		ifa := (*syscall.IfAddrmsg)(unsafe.Pointer(&m.Data[0]))
+		attrs, err := syscall.ParseNetlinkRouteAttr(m)
+		if err != nil {
+			continue
+		}
+		info := &IPv6AddrInfo{PrefixLen: int(ifa.Prefixlen)}
+		flags := uint32(ifa.Flags)
+		for _, a := range attrs {
+			switch a.Attr.Type {
+			case syscall.IFA_ADDRESS:
+				if len(a.Value) == net.IPv6len {
+					info.IP = net.IP(append([]byte(nil), a.Value...))
+				}
+			case ifaFlags:
+				if len(a.Value) >= 4 {
+					flags = *(*uint32)(unsafe.Pointer(&a.Value[0]))
+				}
+			case ifaCacheInfo:
+				if len(a.Value) >= 8 {
+					info.Preferred = lifetime(*(*uint32)(unsafe.Pointer(&a.Value[0])))
+					info.Valid = lifetime(*(*uint32)(unsafe.Pointer(&a.Value[4])))
+				}
+			}
+		}
+		if info.IP == nil {
+			continue
+		}
+		info.Temporary = flags&ifaFTemporary != 0
+		info.Deprecated = flags&ifaFDeprecated != 0
+		info.Tentative = flags&ifaFTentative != 0
+		info.Permanent = flags&ifaFPermanent != 0
+		if info.Permanent {
+			info.Preferred = lifetime(infinityLifetime)
+			info.Valid = info.Preferred
+		}
+		out[info.IP.String()] = info
+	}
+	return out, nil
+}
+
+func lifetime(secs uint32) time.Duration {
+	if secs == infinityLifetime {
+		// longer than any real lifetime
+		return time.Duration(1<<63 - 1)
+	}
+	return time.Duration(secs) * time.Second
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package iface
+
+// Address flags are only available on Linux; elsewhere policy rules that
+// need them cannot separate addresses.
+func IPv6AddrFlags() (map[string]*IPv6AddrInfo, error) {
+	return nil, nil
+}
@@ -0,0 +1,71 @@
+package iface
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestIPv6PolicySelect(t *testing.T) {
+	stable := net.ParseIP("2001:db8:1::10")
+	temp := net.ParseIP("2001:db8:1::beef")
+	dhcp := net.ParseIP("2001:db8:2::5")
+	ula := net.ParseIP("fd00::5")
+	old := net.ParseIP("2001:db8:3::1")
+	info := map[string]*IPv6AddrInfo{
+		stable.String(): {IP: stable, Preferred: time.Hour},
+		temp.String():   {IP: temp, Temporary: true, Preferred: 2 * time.Hour},
+		dhcp.String():   {IP: dhcp, Preferred: 3 * time.Hour},
+		ula.String():    {IP: ula, Preferred: 4 * time.Hour},
+		old.String():    {IP: old, Deprecated: true, Preferred: 5 * time.Hour},
+	}
+	all := []net.IP{temp, stable, dhcp, ula, old}
+	tests := []struct {
+		rules []string
+		ips   []net.IP
+		want  net.IP
+	}{
+		{nil, all, dhcp},
+		{[]string{"stable"}, []net.IP{temp, stable}, stable},
+		{[]string{"temporary"}, []net.IP{stable, temp}, temp},
+		{[]string{"lifetime"}, all, old},
+		{[]string{"rfc6724, temporary"}, all, temp},
+		{[]string{"prefix:2001:db8:1::/48", "stable"}, all, stable},
+		{[]string{"stable"}, []net.IP{stable, dhcp}, nil},
+	}
+	for i, test := range tests {
+		policy, err := ParseIPv6Policy(test.rules)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := policy.Select(test.ips, info)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("Policy %d: expected a tie error, got %s", i, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Policy %d: %s", i, err)
+		} else if !got.Equal(test.want) {
+			t.Errorf("Policy %d: expected %s, got %s", i, test.want, got)
+		}
+	}
+	for _, bad := range []string{"newest", "prefix:10.0.0.0/8", "prefix:nonsense"} {
+		if _, err := ParseIPv6Policy([]string{bad}); err == nil {
+			t.Errorf("Expected rule '%s' to be rejected", bad)
+		}
+	}
+}
+
+func TestIPv6AddrFlags(t *testing.T) {
+	info, err := IPv6AddrFlags()
+	if err != nil {
+		t.Skipf("Unable to read address flags: %s", err)
+	}
+	for k, v := range info {
+		if v.IP.To4() != nil || k != v.IP.String() {
+			t.Errorf("Unexpected entry %s: %+v", k, v)
+		}
+	}
+}
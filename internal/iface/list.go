@@ -11,6 +11,11 @@ import (
 type InterfaceList struct {
 	List   []net.Interface
 	Filter int
+	// If set, Show also classifies NAT using these STUN servers
+	CheckNAT    bool
+	STUNServers []string
+	// Chooses between several IPv6 addresses; nil means DefaultIPv6Policy
+	IPv6Policy IPv6Policy
 }
 
 func NewList(want int) (*InterfaceList, error) {
@@ -30,12 +35,17 @@ func (self *InterfaceList) GetInterfaceNumber(name string) int {
 	return 0
 }
 
+// An interface's public addresses, as found by GetPublicIP.
+type interfaceIPs struct {
+	iface net.Interface
+	addrs []traceroute.IPAddrMap
+}
+
 func (self *InterfaceList) GetPublicIP(ifaceNum, filter int) (*traceroute.IPAddrMap, error) {
-	var found *traceroute.IPAddrMap
-	total := 0
 	if filter == 0 {
 		filter = self.Filter
 	}
+	found := make([]interfaceIPs, 0, 2)
 	for _, iface := range self.List {
 		if ifaceNum != 0 && ifaceNum != iface.Index {
 			continue
@@ -44,34 +54,46 @@ func (self *InterfaceList) GetPublicIP(ifaceNum, filter int) (*traceroute.IPAddr
 		if err != nil {
 			return nil, err
 		}
-		cnt := len(addrs)
-		realAddrs := make([]traceroute.IPAddrMap, 0, cnt)
+		realAddrs := make([]traceroute.IPAddrMap, 0, len(addrs))
 		for _, a := range addrs {
 			if a.RemoteIP != nil {
 				realAddrs = append(realAddrs, a)
 			}
 		}
-		cnt = len(realAddrs)
+		found = append(found, interfaceIPs{iface: iface, addrs: realAddrs})
+	}
+	return self.choosePublicIP(found, ifaceNum, filter)
+}
+
+// Chooses the public IP from each interface's addresses. Several IPv6
+// addresses are only chosen between with the IPv6 policy when they are on
+// the same interface; otherwise the interfaces are listed so one can be
+// picked.
+func (self *InterfaceList) choosePublicIP(found []interfaceIPs, ifaceNum, filter int) (*traceroute.IPAddrMap, error) {
+	withIPs := make([]interfaceIPs, 0, len(found))
+	for _, f := range found {
+		cnt := len(f.addrs)
 		if ifaceNum != 0 {
 			switch cnt {
 			case 0:
-				return nil, fmt.Errorf("Interface %d. (%s) did not contain any public IPs.\n", iface.Index, iface.Name)
+				return nil, fmt.Errorf("Interface %d. (%s) did not contain any public IPs.\n", f.iface.Index, f.iface.Name)
 			case 1:
-				val := realAddrs[0]
+				val := f.addrs[0]
 				return &val, nil
 			default:
+				if best := self.pickIPv6(f.addrs); best != nil {
+					return best, nil
+				}
 				ips := make([]string, cnt, cnt)
-				for i, a := range realAddrs {
+				for i, a := range f.addrs {
 					ips[i] = "'" + a.RemoteIP.String() + "'"
 				}
-				return nil, fmt.Errorf("Interface %d. (%s) contains multiple public IPs: %s.\n", iface.Index, iface.Name, strings.Join(ips, ", "))
+				return nil, fmt.Errorf("Interface %d. (%s) contains multiple public IPs: %s.\n", f.iface.Index, f.iface.Name, strings.Join(ips, ", "))
 			}
 		}
-		total += cnt
-		if cnt == 0 {
-			continue
+		if cnt != 0 {
+			withIPs = append(withIPs, f)
 		}
-		found = &(realAddrs[0])
 	}
 	if ifaceNum != 0 {
 		ifaces := ""
@@ -85,12 +107,17 @@ func (self *InterfaceList) GetPublicIP(ifaceNum, filter int) (*traceroute.IPAddr
 		return nil, fmt.Errorf("No suitable %s IPs were found in interface %d. Known interfaces were:\n"+ifaces, vStr, ifaceNum)
 	}
 
-	if total == 0 {
+	if len(withIPs) == 0 {
 		vStr := traceroute.FilterToString(filter)
 		return nil, fmt.Errorf("No suitable %s IPs were found in any interface. Are you connected to the internet?\n", vStr)
 	}
-	if total == 1 {
-		return found, nil
+	if len(withIPs) == 1 {
+		if len(withIPs[0].addrs) == 1 {
+			return &withIPs[0].addrs[0], nil
+		}
+		if best := self.pickIPv6(withIPs[0].addrs); best != nil {
+			return best, nil
+		}
 	}
 	ifaces := ""
 	for _, iface := range self.List {
@@ -104,6 +131,43 @@ func (self *InterfaceList) GetPublicIP(ifaceNum, filter int) (*traceroute.IPAddr
 	return nil, fmt.Errorf("Found more than one %s IP. Please specify which interface you wish to use.\n"+ifaces, vStr)
 }
 
+// Where pickIPv6 finds address flags; replaced by tests.
+var ipv6AddrFlags = IPv6AddrFlags
+
+// Chooses between one interface's IPv6 addresses with the list's policy.
+// Gives nil if any of the addresses is not IPv6 or the policy cannot
+// choose, so the caller's usual "multiple IPs" handling applies.
+func (self *InterfaceList) pickIPv6(addrs []traceroute.IPAddrMap) *traceroute.IPAddrMap {
+	candidates := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		if a.LocalIP.To4() != nil {
+			return nil
+		}
+		candidates[i] = a.LocalIP
+	}
+	policy := self.IPv6Policy
+	if policy == nil {
+		var err error
+		if policy, err = ParseIPv6Policy(nil); err != nil {
+			return nil
+		}
+	}
+	info, err := ipv6AddrFlags()
+	if err != nil {
+		return nil
+	}
+	best, err := policy.Select(candidates, info)
+	if err != nil {
+		return nil
+	}
+	for i := range addrs {
+		if addrs[i].LocalIP.Equal(best) {
+			return &addrs[i]
+		}
+	}
+	return nil
+}
+
 func InterfaceToPublicIPString(iface net.Interface, filter int, terse bool) string {
 	addrs, err := traceroute.FilterInterfaceIPs(iface, filter|traceroute.WANT_LIVE_IP)
 	vStr := traceroute.FilterToString(filter)
@@ -169,86 +233,5 @@ func (self *InterfaceList) GetFilteredList(filter int) ([]traceroute.IPAddrMap,
 }
 
 func (self *InterfaceList) Show(w io.Writer) {
-	for _, iface := range self.List {
-		addrs, err := traceroute.FilterInterfaceIPs(iface, self.Filter)
-		if err == nil && len(addrs) == 0 {
-			continue
-		}
-		fmt.Fprintf(w, "%d. %s", iface.Index, iface.Name)
-		macStr := iface.HardwareAddr.String()
-		if macStr != "" {
-			fmt.Fprintf(w, " [MAC: %s]", macStr)
-		}
-		fmt.Fprint(w, "\n")
-		if err != nil {
-			fmt.Fprintf(w, "Could not find addreses: %s\n", err.Error())
-			continue
-		}
-		for _, addr := range addrs {
-			privIP := addr.LocalIP
-			pubIP := addr.RemoteIP
-			if addr.Error != nil {
-				fmt.Fprintf(w, " - %s (%s)\n", privIP.String(), addr.Error.Error())
-				continue
-			}
-			if addr.HasNAT() {
-				var bestRoutes []traceroute.TraceRoute
-				var routeErr error
-				pubIpStr := pubIP.String()
-				foundPublic := false
-				lastLen := 0
-				for hops := 1; hops > 0; hops++ {
-					routes, err := traceroute.Trace(pubIpStr, "", iface.Name, hops, 500)
-					if err != nil {
-						routeErr = err
-						break
-					}
-					curLen := len(routes)
-					if curLen <= lastLen {
-						break
-					}
-					lastLen = curLen
-					bestRoutes = routes
-
-					if pubIP.Equal(routes[curLen-1].IP) {
-						foundPublic = true
-						break
-					}
-					// last three are timeouts? give up
-					if curLen > 3 && routes[curLen-1].IP == nil && routes[curLen-2].IP == nil && routes[curLen-3].IP == nil {
-						break
-					}
-				}
-				fmt.Fprintf(w, " - %s", privIP.String())
-				gatewayIP, err := traceroute.FindGateway(pubIpStr, "", iface.Name, privIP)
-				if err != nil {
-					fmt.Fprintf(w, " [Gateway IP detection failed: '%s']", err.Error())
-				} else {
-					fmt.Fprintf(w, " [Router LAN IP: %s]", gatewayIP.String())
-				}
-				if bestRoutes != nil {
-					for _, route := range bestRoutes {
-						if route.Time == 0 {
-							fmt.Fprintf(w, " --NAT [timed out]--> ???")
-						} else {
-							fmt.Fprintf(w, " --NAT [%0.3f ms]--> %s", route.Time, route.IP.String())
-						}
-					}
-					if !foundPublic {
-						fmt.Fprintf(w, " --???--> %s", pubIpStr)
-					}
-				} else {
-					if routeErr == nil {
-						fmt.Fprintf(w, " --NAT--> %s [No info from traceroute]", pubIpStr)
-					} else {
-						fmt.Fprintf(w, " --NAT--> %s [Error reading route: %s]", pubIpStr, routeErr.Error())
-					}
-				}
-				fmt.Fprintf(w, "\n")
-			} else {
-				fmt.Fprintf(w, " - %s (no-NAT)\n", privIP.String())
-			}
-		}
-		fmt.Fprint(w, "\n")
-	}
+	self.Inventory(InventoryOptions{}).WriteText(w)
 }
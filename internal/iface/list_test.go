@@ -0,0 +1,59 @@
+package iface
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/misatosangel/traceroute"
+)
+
+func publicAddr(ip string) traceroute.IPAddrMap {
+	local := net.ParseIP(ip)
+	return traceroute.IPAddrMap{LocalIP: local, RemoteIP: local, IsPublic: true, IsV4: local.To4() != nil}
+}
+
+func TestChoosePublicIP(t *testing.T) {
+	stable := net.ParseIP("2001:db8:1::10")
+	temp := net.ParseIP("2001:db8:1::beef")
+	other := net.ParseIP("2001:db8:2::10")
+	info := map[string]*IPv6AddrInfo{
+		stable.String(): {IP: stable, Preferred: time.Hour},
+		temp.String():   {IP: temp, Temporary: true, Preferred: time.Hour},
+		other.String():  {IP: other, Preferred: time.Hour},
+	}
+	defer func(f func() (map[string]*IPv6AddrInfo, error)) { ipv6AddrFlags = f }(ipv6AddrFlags)
+	ipv6AddrFlags = func() (map[string]*IPv6AddrInfo, error) { return info, nil }
+
+	eth0 := net.Interface{Index: 9001, Name: "fake0"}
+	eth1 := net.Interface{Index: 9002, Name: "fake1"}
+	list := &InterfaceList{List: []net.Interface{eth0, eth1}, Filter: traceroute.WANT_PUBLIC_V6}
+	for _, test := range []struct {
+		name     string
+		ifaceNum int
+		found    []interfaceIPs
+		want     string
+		err      string
+	}{
+		{"one interface", 0, []interfaceIPs{{eth0, []traceroute.IPAddrMap{publicAddr(temp.String()), publicAddr(stable.String())}}, {eth1, nil}}, stable.String(), ""},
+		{"chosen interface", 9001, []interfaceIPs{{eth0, []traceroute.IPAddrMap{publicAddr(temp.String()), publicAddr(stable.String())}}}, stable.String(), ""},
+		{"two interfaces", 0, []interfaceIPs{{eth0, []traceroute.IPAddrMap{publicAddr(temp.String())}}, {eth1, []traceroute.IPAddrMap{publicAddr(stable.String())}}}, "", "Please specify which interface"},
+		{"tie", 0, []interfaceIPs{{eth0, []traceroute.IPAddrMap{publicAddr(stable.String()), publicAddr(other.String())}}}, "", " - 9001. (fake0) "},
+		{"tie in chosen interface", 9001, []interfaceIPs{{eth0, []traceroute.IPAddrMap{publicAddr(stable.String()), publicAddr(other.String())}}}, "", "contains multiple public IPs: '" + stable.String() + "', '" + other.String() + "'"},
+		{"mixed families", 0, []interfaceIPs{{eth0, []traceroute.IPAddrMap{publicAddr("192.0.2.1"), publicAddr(stable.String())}}}, "", "Please specify which interface"},
+		{"none", 0, []interfaceIPs{{eth0, nil}}, "", "No suitable"},
+	} {
+		got, err := list.choosePublicIP(test.found, test.ifaceNum, 0)
+		switch {
+		case test.err != "":
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected an error with '%s', got %v (%v)", test.name, test.err, got, err)
+			}
+		case err != nil:
+			t.Errorf("%s: %s", test.name, err)
+		case !got.LocalIP.Equal(net.ParseIP(test.want)):
+			t.Errorf("%s: expected %s, got %s", test.name, test.want, got.LocalIP)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package iface
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/misatosangel/traceroute"
+)
+
+// Names usable in interfaces.resolvers, in the default order.
+var DefaultResolvers = []string{"iface", "stun"}
+
+var DefaultHTTPEcho = []string{"https://api.ipify.org", "https://icanhazip.com"}
+
+const DefaultDNSServer = "resolver1.opendns.com:53"
+
+// A way of learning the public IP of an interface (0 for any) in a family.
+type IPResolver interface {
+	Name() string
+	Resolve(list *InterfaceList, ifaceNum int, v6 bool) (net.IP, error)
+}
+
+func familyName(v6 bool) string {
+	if v6 {
+		return "IPv6"
+	}
+	return "IPv4"
+}
+
+// Current behaviour: interface addresses, with traceroute finding what NATed
+// addresses map to.
+type InterfaceResolver struct{}
+
+func (self *InterfaceResolver) Name() string {
+	return "iface"
+}
+
+func (self *InterfaceResolver) Resolve(list *InterfaceList, ifaceNum int, v6 bool) (net.IP, error) {
+	filter := traceroute.WANT_PUBLIC_V4 | traceroute.WANT_PRIVATE_V4 | traceroute.WANT_LIVE_IP
+	if v6 {
+		filter = traceroute.WANT_PUBLIC_V6 | traceroute.WANT_PRIVATE_V6 | traceroute.WANT_LIVE_IP
+	}
+	addr, err := list.GetPublicIP(ifaceNum, filter)
+	if err != nil {
+		return nil, err
+	}
+	return addr.RemoteIP, nil
+}
+
+type STUNResolver struct {
+	Servers []string
+}
+
+func (self *STUNResolver) Name() string {
+	return "stun"
+}
+
+func (self *STUNResolver) Resolve(list *InterfaceList, ifaceNum int, v6 bool) (net.IP, error) {
+	res, err := list.GetSTUNAddress(ifaceNum, v6, self.Servers, false)
+	if err != nil {
+		return nil, err
+	}
+	return res.Mapped.IP, nil
+}
+
+// Asks web services that reply with the caller's IP as plain text.
+type HTTPResolver struct {
+	URLs    []string
+	Timeout time.Duration
+}
+
+func (self *HTTPResolver) Name() string {
+	return "http"
+}
+
+func (self *HTTPResolver) Resolve(list *InterfaceList, ifaceNum int, v6 bool) (net.IP, error) {
+	dialer := &net.Dialer{Timeout: self.timeout()}
+	if ifaceNum != 0 {
+		ip, err := list.localIP(ifaceNum, v6)
+		if err != nil {
+			return nil, err
+		}
+		dialer.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	network := "tcp4"
+	if v6 {
+		network = "tcp6"
+	}
+	client := &http.Client{
+		Timeout: self.timeout(),
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, addr)
+			},
+		},
+	}
+	urls := self.URLs
+	if len(urls) == 0 {
+		urls = DefaultHTTPEcho
+	}
+	errs := make([]string, 0, len(urls))
+	for _, u := range urls {
+		ip, err := httpEcho(client, u, v6)
+		if err == nil {
+			return ip, nil
+		}
+		errs = append(errs, err.Error())
+	}
+	return nil, fmt.Errorf("No HTTP echo service gave an %s address: %s\n", familyName(v6), strings.Join(errs, "; "))
+}
+
+func (self *HTTPResolver) timeout() time.Duration {
+	if self.Timeout == 0 {
+		return 5 * time.Second
+	}
+	return self.Timeout
+}
+
+func httpEcho(client *http.Client, url string, v6 bool) (net.IP, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(strings.TrimSpace(string(body)))
+	if ip == nil || (ip.To4() == nil) != v6 {
+		return nil, fmt.Errorf("%s did not return an %s address", url, familyName(v6))
+	}
+	return ip, nil
+}
+
+// Asks a DNS server that answers myip.opendns.com with the querier's IP.
+type DNSResolver struct {
+	Server  string
+	Query   string
+	Timeout time.Duration
+}
+
+func (self *DNSResolver) Name() string {
+	return "dns"
+}
+
+func (self *DNSResolver) Resolve(list *InterfaceList, ifaceNum int, v6 bool) (net.IP, error) {
+	server := self.Server
+	if server == "" {
+		server = DefaultDNSServer
+	}
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	timeout := self.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	if ifaceNum != 0 {
+		ip, err := list.localIP(ifaceNum, v6)
+		if err != nil {
+			return nil, err
+		}
+		dialer.LocalAddr = &net.UDPAddr{IP: ip}
+	}
+	network, ipNet := "udp4", "ip4"
+	if v6 {
+		network, ipNet = "udp6", "ip6"
+	}
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, server)
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	name := self.Query
+	if name == "" {
+		name = "myip.opendns.com"
+	}
+	ips, err := resolver.LookupIP(ctx, ipNet, name)
+	if err != nil {
+		return nil, fmt.Errorf("DNS lookup of %s via %s failed: %s\n", name, server, err.Error())
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("DNS lookup of %s via %s gave no %s address\n", name, server, familyName(v6))
+	}
+	return ips[0], nil
+}
+
+// Fixed addresses from configuration, for when nothing can detect them.
+type StaticResolver struct {
+	V4 net.IP
+	V6 net.IP
+}
+
+func (self *StaticResolver) Name() string {
+	return "static"
+}
+
+func (self *StaticResolver) Resolve(list *InterfaceList, ifaceNum int, v6 bool) (net.IP, error) {
+	ip := self.V4
+	if v6 {
+		ip = self.V6
+	}
+	if ip == nil {
+		return nil, fmt.Errorf("No static %s address configured\n", familyName(v6))
+	}
+	return ip, nil
+}
+
+// An ordered list of resolvers. In "first" mode the first to answer wins
+// and later ones are only fallbacks. In "consensus" mode every resolver is
+// asked and an address must be reported by at least Quorum of them; ties go
+// to whichever was reported earliest in the chain.
+type ResolverChain struct {
+	Resolvers []IPResolver
+	Mode      string
+	Quorum    int
+}
+
+func (self *ResolverChain) Resolve(list *InterfaceList, ifaceNum int, v6 bool) (net.IP, error) {
+	if len(self.Resolvers) == 0 {
+		return nil, fmt.Errorf("No IP resolvers configured\n")
+	}
+	errs := make([]string, 0, len(self.Resolvers))
+	if self.Mode != "consensus" {
+		for _, r := range self.Resolvers {
+			ip, err := r.Resolve(list, ifaceNum, v6)
+			if err == nil {
+				return ip, nil
+			}
+			errs = append(errs, r.Name()+": "+strings.TrimSpace(err.Error()))
+		}
+		return nil, fmt.Errorf("Unable to find your public %s address:\n - %s\n", familyName(v6), strings.Join(errs, "\n - "))
+	}
+	quorum := self.Quorum
+	if quorum <= 0 {
+		quorum = 2
+	}
+	votes := make(map[string]int)
+	order := make([]net.IP, 0, len(self.Resolvers))
+	answers := make([]string, 0, len(self.Resolvers))
+	for _, r := range self.Resolvers {
+		ip, err := r.Resolve(list, ifaceNum, v6)
+		if err != nil {
+			errs = append(errs, r.Name()+": "+strings.TrimSpace(err.Error()))
+			continue
+		}
+		key := ip.String()
+		if votes[key] == 0 {
+			order = append(order, ip)
+		}
+		votes[key]++
+		answers = append(answers, r.Name()+" said "+key)
+	}
+	var best net.IP
+	for _, ip := range order {
+		if best == nil || votes[ip.String()] > votes[best.String()] {
+			best = ip
+		}
+	}
+	if best != nil && votes[best.String()] >= quorum {
+		return best, nil
+	}
+	return nil, fmt.Errorf("Resolvers did not agree on your public %s address (%d needed): %s\n", familyName(v6), quorum, strings.Join(append(answers, errs...), "; "))
+}
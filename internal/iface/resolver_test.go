@@ -0,0 +1,110 @@
+package iface
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type fakeResolver struct {
+	name string
+	ip   string
+}
+
+func (self *fakeResolver) Name() string {
+	return self.name
+}
+
+func (self *fakeResolver) Resolve(list *InterfaceList, ifaceNum int, v6 bool) (net.IP, error) {
+	if self.ip == "" {
+		return nil, fmt.Errorf("%s failed", self.name)
+	}
+	return net.ParseIP(self.ip), nil
+}
+
+func TestResolverChain(t *testing.T) {
+	a := &fakeResolver{"a", "198.51.100.1"}
+	b := &fakeResolver{"b", "198.51.100.2"}
+	c := &fakeResolver{"c", "198.51.100.2"}
+	bad := &fakeResolver{"bad", ""}
+	tests := []struct {
+		chain ResolverChain
+		want  string
+	}{
+		{ResolverChain{Resolvers: []IPResolver{bad, a, b}}, "198.51.100.1"},
+		{ResolverChain{Resolvers: []IPResolver{bad}}, ""},
+		{ResolverChain{Resolvers: []IPResolver{a, b, bad, c}, Mode: "consensus"}, "198.51.100.2"},
+		{ResolverChain{Resolvers: []IPResolver{a, b, bad}, Mode: "consensus"}, ""},
+		{ResolverChain{Resolvers: []IPResolver{a, b, bad}, Mode: "consensus", Quorum: 1}, "198.51.100.1"},
+	}
+	for i, test := range tests {
+		ip, err := test.chain.Resolve(nil, 0, false)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("Chain %d: expected an error, got %s", i, ip)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Chain %d: %s", i, err)
+		} else if ip.String() != test.want {
+			t.Errorf("Chain %d: expected %s, got %s", i, test.want, ip)
+		}
+	}
+}
+
+func TestHTTPResolver(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "198.51.100.7")
+	}))
+	defer srv.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	defer down.Close()
+	r := &HTTPResolver{URLs: []string{down.URL, srv.URL}}
+	ip, err := r.Resolve(nil, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.String() != "198.51.100.7" {
+		t.Errorf("Expected 198.51.100.7, got %s", ip)
+	}
+	if _, err := (&HTTPResolver{URLs: []string{srv.URL}}).Resolve(nil, 0, true); err == nil {
+		t.Errorf("Expected an IPv4 reply to be rejected when asking for IPv6")
+	}
+}
+
+func TestConfigResolverChain(t *testing.T) {
+	conf := &Config{Resolvers: []string{"static, http", "dns"}, StaticIPv4: "203.0.113.9"}
+	chain, err := conf.ResolverChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := ""
+	for _, r := range chain.Resolvers {
+		names += r.Name() + " "
+	}
+	if names != "static http dns " {
+		t.Errorf("Expected resolvers 'static http dns', got '%s'", names)
+	}
+	if ip, err := chain.Resolvers[0].Resolve(nil, 0, false); err != nil || ip.String() != "203.0.113.9" {
+		t.Errorf("Expected static 203.0.113.9, got %s (%v)", ip, err)
+	}
+	if _, err := chain.Resolvers[0].Resolve(nil, 0, true); err == nil {
+		t.Errorf("Expected an error with no static IPv6 configured")
+	}
+	for _, bad := range []*Config{
+		{Resolvers: []string{"carrier-pigeon"}},
+		{ResolverMode: "vote"},
+		{Resolvers: []string{"static"}, StaticIPv4: "2001:db8::1"},
+		{Resolvers: []string{"iface"}, ResolverMode: "consensus", ResolverQuorum: 2},
+	} {
+		if _, err := bad.ResolverChain(); err == nil {
+			t.Errorf("Expected config %+v to be rejected", bad)
+		}
+	}
+	if chain, err := (&Config{}).ResolverChain(); err != nil || len(chain.Resolvers) != len(DefaultResolvers) {
+		t.Errorf("Expected the default chain, got %v (%v)", chain, err)
+	}
+}
@@ -0,0 +1,52 @@
+package iface
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/misatosangel/parvati-api-client/internal/stun"
+)
+
+// Asks STUN servers for the public IP of an interface (0 for whichever the
+// default route uses). Unlike GetPublicIP this gives a single answer on
+// multi-homed machines, as it only looks at the address actually used.
+func (self *InterfaceList) GetSTUNAddress(ifaceNum int, v6 bool, servers []string, classify bool) (*stun.Result, error) {
+	network := "udp4"
+	if v6 {
+		network = "udp6"
+	}
+	var localIP net.IP
+	if ifaceNum != 0 {
+		var err error
+		localIP, err = self.localIP(ifaceNum, v6)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return stun.Discover(network, localIP, servers, classify)
+}
+
+func (self *InterfaceList) localIP(ifaceNum int, v6 bool) (net.IP, error) {
+	for _, iface := range self.List {
+		if iface.Index != ifaceNum {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			ipNet, ok := a.(*net.IPNet)
+			if !ok || !ipNet.IP.IsGlobalUnicast() || (ipNet.IP.To4() == nil) != v6 {
+				continue
+			}
+			return ipNet.IP, nil
+		}
+		family := "IPv4"
+		if v6 {
+			family = "IPv6"
+		}
+		return nil, fmt.Errorf("Interface %d. (%s) has no %s address to send STUN requests from.\n", iface.Index, iface.Name, family)
+	}
+	return nil, fmt.Errorf("No interface numbered %d.\n", ifaceNum)
+}
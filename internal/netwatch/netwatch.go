@@ -0,0 +1,103 @@
+// Package netwatch reports changes to local addresses, links and the default
+// route as they happen, so public IPs only need rechecking when something
+// actually changed. Only Linux (rtnetlink) is supported; elsewhere New
+// returns ErrUnsupported and callers should poll.
+package netwatch
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+var ErrUnsupported = fmt.Errorf("Network change events are not supported on this platform\n")
+
+// How long to wait for a burst of changes (e.g. a reconnect) to settle
+// before reporting it.
+const Settle = time.Second
+
+// How often a change is reported once events stop, so callers carry on
+// as if polling.
+const PollInterval = 15 * time.Second
+
+type Watcher struct {
+	changes chan struct{}
+	mu      sync.Mutex
+	timer   *time.Timer
+	closed  bool
+	sys     sysWatcher
+}
+
+// Starts watching for changes.
+func New() (*Watcher, error) {
+	w := &Watcher{changes: make(chan struct{}, 1)}
+	sys, err := newSysWatcher(w.changed, w.failed)
+	if err != nil {
+		return nil, err
+	}
+	w.sys = sys
+	return w, nil
+}
+
+// Receives a value after each settled burst of changes. Bursts seen while
+// a value is pending are merged.
+func (self *Watcher) Changes() <-chan struct{} {
+	return self.changes
+}
+
+func (self *Watcher) Close() error {
+	self.mu.Lock()
+	self.closed = true
+	if self.timer != nil {
+		self.timer.Stop()
+	}
+	self.mu.Unlock()
+	return self.sys.Close()
+}
+
+func (self *Watcher) changed() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.closed {
+		return
+	}
+	if self.timer != nil {
+		self.timer.Reset(Settle)
+		return
+	}
+	self.timer = time.AfterFunc(Settle, func() {
+		self.mu.Lock()
+		self.timer = nil
+		self.mu.Unlock()
+		select {
+		case self.changes <- struct{}{}:
+		default:
+		}
+	})
+}
+
+// Events have stopped, so report a change every PollInterval instead.
+func (self *Watcher) failed(err error) {
+	log.Printf("Network change events stopped, polling instead: %s", err.Error())
+	// anything could have changed since
+	self.changed()
+	ticker := time.NewTicker(PollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		self.mu.Lock()
+		closed := self.closed
+		self.mu.Unlock()
+		if closed {
+			return
+		}
+		select {
+		case self.changes <- struct{}{}:
+		default:
+		}
+	}
+}
+
+type sysWatcher interface {
+	Close() error
+}
@@ -0,0 +1,97 @@
+package netwatch
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// rtnetlink multicast groups, from linux/rtnetlink.h
+const (
+	rtmgrpLink       = 0x1
+	rtmgrpIPv4IfAddr = 0x10
+	rtmgrpIPv4Route  = 0x40
+	rtmgrpIPv6IfAddr = 0x100
+	rtmgrpIPv6Route  = 0x400
+)
+
+type netlinkWatcher struct {
+	file io.ReadCloser
+}
+
+func newSysWatcher(onChange func(), onFail func(error)) (sysWatcher, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	addr := &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Groups: rtmgrpLink | rtmgrpIPv4IfAddr | rtmgrpIPv6IfAddr | rtmgrpIPv4Route | rtmgrpIPv6Route,
+	}
+	if err := syscall.Bind(fd, addr); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	// non-blocking so the runtime poller is used and Close unblocks Read
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("setnonblock", err)
+	}
+	w := &netlinkWatcher{file: os.NewFile(uintptr(fd), "rtnetlink")}
+	go w.run(onChange, onFail)
+	return w, nil
+}
+
+func (self *netlinkWatcher) Close() error {
+	return self.file.Close()
+}
+
+// Reads change messages until the socket is closed, or fails with onFail
+// called.
+func (self *netlinkWatcher) run(onChange func(), onFail func(error)) {
+	buf := make([]byte, 65536)
+	for {
+		n, err := self.file.Read(buf)
+		if err != nil {
+			// the error comes wrapped in an *os.PathError
+			if errors.Is(err, syscall.ENOBUFS) {
+				// we missed some messages; assume something changed
+				onChange()
+				continue
+			}
+			if !errors.Is(err, os.ErrClosed) {
+				onFail(err)
+			}
+			return
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			continue
+		}
+		if relevant(msgs) {
+			onChange()
+		}
+	}
+}
+
+// Address and link changes always matter; routes only if they are a
+// default route in the main table.
+func relevant(msgs []syscall.NetlinkMessage) bool {
+	for _, m := range msgs {
+		switch m.Header.Type {
+		case syscall.RTM_NEWADDR, syscall.RTM_DELADDR, syscall.RTM_NEWLINK, syscall.RTM_DELLINK:
+			return true
+		case syscall.RTM_NEWROUTE, syscall.RTM_DELROUTE:
+			if len(m.Data) < syscall.SizeofRtMsg {
+				continue
+			}
+			rt := (*syscall.RtMsg)(unsafe.Pointer(&m.Data[0]))
+			if rt.Dst_len == 0 && rt.Table == syscall.RT_TABLE_MAIN {
+				return true
+			}
+		}
+	}
+	return false
+}
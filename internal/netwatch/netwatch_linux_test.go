@@ -0,0 +1,123 @@
+package netwatch
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func routeMsg(typ uint16, dstLen uint8, table uint8) syscall.NetlinkMessage {
+	rt := syscall.RtMsg{Family: syscall.AF_INET, Dst_len: dstLen, Table: table}
+	data := make([]byte, syscall.SizeofRtMsg)
+	copy(data, (*[syscall.SizeofRtMsg]byte)(unsafe.Pointer(&rt))[:])
+	return syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: typ}, Data: data}
+}
+
+func TestRelevant(t *testing.T) {
+	tests := []struct {
+		msgs []syscall.NetlinkMessage
+		want bool
+	}{
+		{[]syscall.NetlinkMessage{{Header: syscall.NlMsghdr{Type: syscall.RTM_NEWADDR}}}, true},
+		{[]syscall.NetlinkMessage{{Header: syscall.NlMsghdr{Type: syscall.RTM_DELLINK}}}, true},
+		{[]syscall.NetlinkMessage{routeMsg(syscall.RTM_NEWROUTE, 0, syscall.RT_TABLE_MAIN)}, true},
+		{[]syscall.NetlinkMessage{routeMsg(syscall.RTM_DELROUTE, 24, syscall.RT_TABLE_MAIN)}, false},
+		{[]syscall.NetlinkMessage{routeMsg(syscall.RTM_NEWROUTE, 0, syscall.RT_TABLE_LOCAL)}, false},
+		{[]syscall.NetlinkMessage{{Header: syscall.NlMsghdr{Type: syscall.RTM_NEWNEIGH}}}, false},
+	}
+	for i, test := range tests {
+		if got := relevant(test.msgs); got != test.want {
+			t.Errorf("Messages %d: expected relevant=%v, got %v", i, test.want, got)
+		}
+	}
+}
+
+func TestChangesSettle(t *testing.T) {
+	w := &Watcher{changes: make(chan struct{}, 1), sys: nopWatcher{}}
+	defer w.Close()
+	for i := 0; i < 5; i++ {
+		w.changed()
+	}
+	select {
+	case <-w.Changes():
+		t.Fatalf("Change reported before settling")
+	case <-time.After(Settle / 2):
+	}
+	select {
+	case <-w.Changes():
+	case <-time.After(2 * Settle):
+		t.Fatalf("No change reported after settling")
+	}
+	select {
+	case <-w.Changes():
+		t.Errorf("Burst of changes reported more than once")
+	case <-time.After(Settle + Settle/2):
+	}
+}
+
+type nopWatcher struct{}
+
+func (nopWatcher) Close() error {
+	return nil
+}
+
+// Reads each of its errors in turn, then blocks until closed.
+type fakeNetlink struct {
+	errs   []error
+	closed chan struct{}
+}
+
+func (self *fakeNetlink) Read(buf []byte) (int, error) {
+	if len(self.errs) == 0 {
+		<-self.closed
+		return 0, &os.PathError{Op: "read", Path: "rtnetlink", Err: os.ErrClosed}
+	}
+	err := self.errs[0]
+	self.errs = self.errs[1:]
+	return 0, err
+}
+
+func (self *fakeNetlink) Close() error {
+	close(self.closed)
+	return nil
+}
+
+func TestRunOverflow(t *testing.T) {
+	for _, test := range []struct {
+		errs    []error
+		changes int
+		failed  bool
+	}{
+		{[]error{&os.PathError{Op: "read", Path: "rtnetlink", Err: syscall.ENOBUFS}, &os.PathError{Op: "read", Path: "rtnetlink", Err: syscall.ENOBUFS}}, 2, false},
+		{[]error{&os.PathError{Op: "read", Path: "rtnetlink", Err: syscall.ENOBUFS}, &os.PathError{Op: "read", Path: "rtnetlink", Err: syscall.EBADF}}, 1, true},
+		{nil, 0, false},
+	} {
+		fake := &fakeNetlink{errs: test.errs, closed: make(chan struct{})}
+		w := &netlinkWatcher{file: fake}
+		changes := 0
+		var failed error
+		done := make(chan struct{})
+		go func() {
+			w.run(func() { changes++ }, func(err error) { failed = err })
+			close(done)
+		}()
+		if !test.failed {
+			time.Sleep(10 * time.Millisecond)
+			w.Close()
+		}
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("run did not return for %v", test.errs)
+		}
+		if changes != test.changes {
+			t.Errorf("Expected %d changes for %v, got %d", test.changes, test.errs, changes)
+		}
+		if (failed != nil) != test.failed || (failed != nil && !errors.Is(failed, syscall.EBADF)) {
+			t.Errorf("Unexpected failure for %v: %v", test.errs, failed)
+		}
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package netwatch
+
+func newSysWatcher(onChange func(), onFail func(error)) (sysWatcher, error) {
+	return nil, ErrUnsupported
+}
@@ -0,0 +1,116 @@
+package notify
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Something worth telling the user about.
+type Notification struct {
+	Title string
+	Body  string
+	Game  string
+	Nick  string
+}
+
+// A way of getting a notification in front of the user.
+type Notifier interface {
+	Notify(n *Notification) error
+}
+
+// Sends to the freedesktop notification service over the session D-Bus,
+// by way of the gdbus tool shipped with glib.
+type DBusNotifier struct {
+	AppName   string
+	TimeoutMS int
+}
+
+func (self *DBusNotifier) Notify(n *Notification) error {
+	app := self.AppName
+	if app == "" {
+		app = "parvati"
+	}
+	timeout := self.TimeoutMS
+	if timeout == 0 {
+		timeout = 5000
+	}
+	cmd := exec.Command("gdbus", "call", "--session",
+		"--dest", "org.freedesktop.Notifications",
+		"--object-path", "/org/freedesktop/Notifications",
+		"--method", "org.freedesktop.Notifications.Notify",
+		app, "0", "", n.Title, n.Body, "[]", "{}", fmt.Sprintf("%d", timeout))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("D-Bus notification failed: %s %s\n", err.Error(), strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// Rings the terminal bell and prints the notification.
+type BellNotifier struct {
+	Out io.Writer
+}
+
+func (self *BellNotifier) Notify(n *Notification) error {
+	out := self.Out
+	if out == nil {
+		out = os.Stdout
+	}
+	_, err := fmt.Fprintf(out, "\a%s: %s\n", n.Title, n.Body)
+	return err
+}
+
+// Runs a program for each notification. The first entry is the program,
+// the rest are arguments with ${NICK}, ${GAME}, ${TITLE} and ${MESSAGE}
+// replaced before running.
+type CommandNotifier struct {
+	Command []string
+}
+
+func (self *CommandNotifier) Notify(n *Notification) error {
+	if len(self.Command) == 0 {
+		return fmt.Errorf("No notification command configured.\n")
+	}
+	r := strings.NewReplacer("${NICK}", n.Nick, "${GAME}", n.Game, "${TITLE}", n.Title, "${MESSAGE}", n.Body)
+	args := make([]string, len(self.Command)-1)
+	for i, arg := range self.Command[1:] {
+		args[i] = r.Replace(arg)
+	}
+	cmd := exec.Command(self.Command[0], args...)
+	cmd.Stdin = nil
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// Sends every notification to each notifier in turn, returning the last error.
+type Multi []Notifier
+
+func (self Multi) Notify(n *Notification) error {
+	var lastErr error
+	for _, notifier := range self {
+		if err := notifier.Notify(n); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// Make a notifier by name: "dbus", "bell" or "command". The command
+// is only used by the "command" notifier.
+func New(kind string, command []string) (Notifier, error) {
+	switch strings.ToLower(kind) {
+	case "dbus", "desktop":
+		return &DBusNotifier{}, nil
+	case "bell", "terminal":
+		return &BellNotifier{}, nil
+	case "command", "exec":
+		if len(command) == 0 {
+			return nil, fmt.Errorf("The command notifier needs notify.command to be set.\n")
+		}
+		return &CommandNotifier{Command: command}, nil
+	}
+	return nil, fmt.Errorf("Unknown notifier: '%s'. Use one of dbus, bell or command.\n", kind)
+}
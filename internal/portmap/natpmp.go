@@ -0,0 +1,160 @@
+package portmap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	pmpPort          = 5351
+	pmpOpExternalIP  = 0
+	pmpOpMapUDP      = 1
+	pmpOpMapTCP      = 2
+	pmpResultSuccess = 0
+)
+
+var pmpResults = map[uint16]string{
+	1: "unsupported version",
+	2: "not authorized/refused",
+	3: "network failure",
+	4: "out of resources",
+	5: "unsupported opcode",
+}
+
+// NAT-PMP (RFC 6886) client.
+type NATPMP struct {
+	Gateway net.IP
+	// Port on the gateway, defaults to 5351
+	Port int
+	// Total time to wait for an answer, defaults to 2s
+	Timeout time.Duration
+}
+
+func (self *NATPMP) Name() string {
+	return "natpmp"
+}
+
+func (self *NATPMP) addr() *net.UDPAddr {
+	port := self.Port
+	if port == 0 {
+		port = pmpPort
+	}
+	return &net.UDPAddr{IP: self.Gateway, Port: port}
+}
+
+func pmpResultError(code uint16) error {
+	reason, ok := pmpResults[code]
+	if !ok {
+		reason = "unknown error"
+	}
+	return fmt.Errorf("Gateway refused request: %s (%d)\n", reason, code)
+}
+
+// Asks the gateway for its public address.
+func (self *NATPMP) ExternalIP() (net.IP, error) {
+	resp, err := udpRequest(self.addr(), []byte{0, pmpOpExternalIP}, self.Timeout, 12, func(b []byte) bool {
+		return b[0] == 0 && b[1] == 128+pmpOpExternalIP
+	})
+	if err != nil {
+		return nil, err
+	}
+	if code := binary.BigEndian.Uint16(resp[2:4]); code != pmpResultSuccess {
+		return nil, pmpResultError(code)
+	}
+	return net.IPv4(resp[8], resp[9], resp[10], resp[11]), nil
+}
+
+func (self *NATPMP) request(protocol string, internalPort, externalPort uint16, lifetime time.Duration) ([]byte, error) {
+	op := byte(pmpOpMapUDP)
+	switch protocol {
+	case "udp":
+	case "tcp":
+		op = pmpOpMapTCP
+	default:
+		return nil, fmt.Errorf("Unknown protocol: '%s'\n", protocol)
+	}
+	req := make([]byte, 12)
+	req[1] = op
+	binary.BigEndian.PutUint16(req[4:6], internalPort)
+	binary.BigEndian.PutUint16(req[6:8], externalPort)
+	binary.BigEndian.PutUint32(req[8:12], uint32(lifetime/time.Second))
+	resp, err := udpRequest(self.addr(), req, self.Timeout, 16, func(b []byte) bool {
+		return b[0] == 0 && b[1] == 128+op && binary.BigEndian.Uint16(b[8:10]) == internalPort
+	})
+	if err != nil {
+		return nil, err
+	}
+	if code := binary.BigEndian.Uint16(resp[2:4]); code != pmpResultSuccess {
+		return nil, pmpResultError(code)
+	}
+	return resp, nil
+}
+
+func (self *NATPMP) AddMapping(protocol string, internalPort, externalPort uint16, lifetime time.Duration) (*Mapping, error) {
+	if lifetime <= 0 {
+		lifetime = DefaultLifetime
+	}
+	resp, err := self.request(protocol, internalPort, externalPort, lifetime)
+	if err != nil {
+		return nil, err
+	}
+	granted := time.Duration(binary.BigEndian.Uint32(resp[12:16])) * time.Second
+	m := &Mapping{
+		Protocol:     protocol,
+		InternalPort: internalPort,
+		ExternalPort: binary.BigEndian.Uint16(resp[10:12]),
+		Lifetime:     granted,
+		Method:       self.Name(),
+		Expires:      time.Now().Add(granted),
+	}
+	return withExternalIP(m, self.ExternalIP), nil
+}
+
+func (self *NATPMP) DeleteMapping(m *Mapping) error {
+	_, err := self.request(m.Protocol, m.InternalPort, 0, 0)
+	return err
+}
+
+// Sends req to addr, retrying with backoff until a response of at least
+// minLen bytes that passes check arrives or the timeout passes.
+func udpRequest(addr *net.UDPAddr, req []byte, timeout time.Duration, minLen int, check func([]byte) bool) ([]byte, error) {
+	if timeout == 0 {
+		timeout = 2 * time.Second
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(timeout)
+	wait := 250 * time.Millisecond
+	buf := make([]byte, 1100)
+	for time.Now().Before(deadline) {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		tryUntil := time.Now().Add(wait)
+		if tryUntil.After(deadline) {
+			tryUntil = deadline
+		}
+		conn.SetReadDeadline(tryUntil)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				if nErr, ok := err.(net.Error); ok && nErr.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			if n >= minLen && check(buf[:n]) {
+				out := make([]byte, n)
+				copy(out, buf[:n])
+				return out, nil
+			}
+		}
+		wait *= 2
+	}
+	return nil, fmt.Errorf("No response from gateway %s within %s\n", addr.String(), timeout.String())
+}
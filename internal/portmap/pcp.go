@@ -0,0 +1,189 @@
+package portmap
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	pcpVersion    = 2
+	pcpOpAnnounce = 0
+	pcpOpMap      = 1
+	pcpHeaderLen  = 24
+	pcpMapLen     = 36
+	pcpResultOK   = 0
+	ipProtoTCP    = 6
+	ipProtoUDP    = 17
+	pcpNonceBytes = 12
+)
+
+var pcpResults = map[byte]string{
+	1:  "unsupported version",
+	2:  "not authorized",
+	3:  "malformed request",
+	4:  "unsupported opcode",
+	5:  "unsupported option",
+	6:  "malformed option",
+	7:  "network failure",
+	8:  "no resources",
+	9:  "unsupported protocol",
+	10: "user exceeded quota",
+	11: "cannot provide external",
+	12: "address mismatch",
+	13: "excessive remote peers",
+}
+
+// PCP (RFC 6887) client, using MAP requests.
+type PCP struct {
+	Gateway net.IP
+	// Address the gateway sees us as, put in requests
+	LocalIP net.IP
+	// Port on the gateway, defaults to 5351
+	Port int
+	// Total time to wait for an answer, defaults to 2s
+	Timeout time.Duration
+	// Renewals and deletes may come from different goroutines
+	mu     sync.Mutex
+	nonces map[string][]byte
+}
+
+func (self *PCP) Name() string {
+	return "pcp"
+}
+
+// Each mapping keeps its nonce so it can be renewed and deleted.
+func (self *PCP) nonce(protocol string, internalPort uint16) []byte {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.nonces == nil {
+		self.nonces = make(map[string][]byte)
+	}
+	key := fmt.Sprintf("%s/%d", protocol, internalPort)
+	n := self.nonces[key]
+	if n == nil {
+		n = make([]byte, pcpNonceBytes)
+		rand.Read(n)
+		self.nonces[key] = n
+	}
+	return n
+}
+
+func (self *PCP) request(protocol string, internalPort, externalPort uint16, lifetime time.Duration) ([]byte, error) {
+	var proto byte
+	switch protocol {
+	case "udp":
+		proto = ipProtoUDP
+	case "tcp":
+		proto = ipProtoTCP
+	default:
+		return nil, fmt.Errorf("Unknown protocol: '%s'\n", protocol)
+	}
+	if self.LocalIP == nil {
+		return nil, fmt.Errorf("PCP needs the local IP address to be known.\n")
+	}
+	nonce := self.nonce(protocol, internalPort)
+	req := make([]byte, pcpHeaderLen+pcpMapLen)
+	req[0] = pcpVersion
+	req[1] = pcpOpMap
+	binary.BigEndian.PutUint32(req[4:8], uint32(lifetime/time.Second))
+	copy(req[8:24], self.LocalIP.To16())
+	body := req[pcpHeaderLen:]
+	copy(body[0:12], nonce)
+	body[12] = proto
+	binary.BigEndian.PutUint16(body[16:18], internalPort)
+	binary.BigEndian.PutUint16(body[18:20], externalPort)
+	// suggest "any" external address of the same family
+	if self.LocalIP.To4() != nil {
+		copy(body[20:36], net.IPv4zero.To16())
+	}
+	port := self.Port
+	if port == 0 {
+		port = pmpPort
+	}
+	resp, err := udpRequest(&net.UDPAddr{IP: self.Gateway, Port: port}, req, self.Timeout, pcpHeaderLen, func(b []byte) bool {
+		if b[1] != 0x80|pcpOpMap {
+			return false
+		}
+		// errors may come back without a body
+		return b[3] != pcpResultOK || (len(b) >= pcpHeaderLen+pcpMapLen && bytes.Equal(b[pcpHeaderLen:pcpHeaderLen+12], nonce))
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := pcpResultError(resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func pcpResultError(resp []byte) error {
+	if resp[0] != pcpVersion {
+		return fmt.Errorf("Gateway does not support PCP (version %d reply)\n", resp[0])
+	}
+	if code := resp[3]; code != pcpResultOK {
+		reason, ok := pcpResults[code]
+		if !ok {
+			reason = "unknown error"
+		}
+		return fmt.Errorf("Gateway refused request: %s (%d)\n", reason, code)
+	}
+	return nil
+}
+
+// Checks the gateway speaks PCP with an ANNOUNCE request, which maps nothing.
+func (self *PCP) Announce() error {
+	if self.LocalIP == nil {
+		return fmt.Errorf("PCP needs the local IP address to be known.\n")
+	}
+	req := make([]byte, pcpHeaderLen)
+	req[0] = pcpVersion
+	req[1] = pcpOpAnnounce
+	copy(req[8:24], self.LocalIP.To16())
+	port := self.Port
+	if port == 0 {
+		port = pmpPort
+	}
+	resp, err := udpRequest(&net.UDPAddr{IP: self.Gateway, Port: port}, req, self.Timeout, 4, func(b []byte) bool {
+		return b[1] == 0x80|pcpOpAnnounce
+	})
+	if err != nil {
+		return err
+	}
+	return pcpResultError(resp)
+}
+
+func (self *PCP) AddMapping(protocol string, internalPort, externalPort uint16, lifetime time.Duration) (*Mapping, error) {
+	if lifetime <= 0 {
+		lifetime = DefaultLifetime
+	}
+	resp, err := self.request(protocol, internalPort, externalPort, lifetime)
+	if err != nil {
+		return nil, err
+	}
+	granted := time.Duration(binary.BigEndian.Uint32(resp[4:8])) * time.Second
+	body := resp[pcpHeaderLen:]
+	extIP := make(net.IP, 16)
+	copy(extIP, body[20:36])
+	if v4 := extIP.To4(); v4 != nil {
+		extIP = v4
+	}
+	return &Mapping{
+		Protocol:     protocol,
+		InternalPort: internalPort,
+		ExternalPort: binary.BigEndian.Uint16(body[18:20]),
+		ExternalIP:   extIP,
+		Lifetime:     granted,
+		Method:       self.Name(),
+		Expires:      time.Now().Add(granted),
+	}, nil
+}
+
+func (self *PCP) DeleteMapping(m *Mapping) error {
+	_, err := self.request(m.Protocol, m.InternalPort, 0, 0)
+	return err
+}
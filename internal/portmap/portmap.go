@@ -0,0 +1,339 @@
+// Package portmap asks the local gateway to forward ports to us, using
+// UPnP IGD, NAT-PMP or PCP, whichever the gateway speaks.
+package portmap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/misatosangel/traceroute"
+)
+
+const DefaultLifetime = 2 * time.Hour
+
+// A port forwarded by the gateway.
+type Mapping struct {
+	Protocol     string // "udp" or "tcp"
+	InternalPort uint16
+	ExternalPort uint16
+	ExternalIP   net.IP
+	Lifetime     time.Duration
+	Method       string
+	Expires      time.Time
+}
+
+func (self *Mapping) String() string {
+	ext := "?"
+	if self.ExternalIP != nil {
+		ext = self.ExternalIP.String()
+	}
+	return fmt.Sprintf("%s %s:%d -> :%d via %s (expires %s)", strings.ToUpper(self.Protocol), ext, self.ExternalPort,
+		self.InternalPort, self.Method, self.Expires.Format(time.RFC3339))
+}
+
+// A port mapping protocol spoken to a single gateway.
+type Mapper interface {
+	// Protocol name, e.g. "natpmp".
+	Name() string
+	// Ask for protocol ("udp" or "tcp") traffic to externalPort to be sent to
+	// internalPort. The gateway may pick a different external port.
+	AddMapping(protocol string, internalPort, externalPort uint16, lifetime time.Duration) (*Mapping, error)
+	DeleteMapping(m *Mapping) error
+}
+
+// Fills in the public address the mapper reports, if it can. Failing to is
+// not fatal, as the mapping itself is in place.
+func withExternalIP(m *Mapping, externalIP func() (net.IP, error)) *Mapping {
+	m.ExternalIP, _ = externalIP()
+	return m
+}
+
+// Known method names in the default order they are tried.
+var DefaultMethods = []string{"pcp", "natpmp", "upnp"}
+
+// Make a mapper for one method, talking to the gateway from localIP.
+func NewMapper(method string, gateway, localIP net.IP) (Mapper, error) {
+	switch strings.ToLower(method) {
+	case "pcp":
+		return &PCP{Gateway: gateway, LocalIP: localIP}, nil
+	case "natpmp", "nat-pmp":
+		return &NATPMP{Gateway: gateway}, nil
+	case "upnp", "igd":
+		return &UPnP{LocalIP: localIP}, nil
+	}
+	return nil, fmt.Errorf("Unknown port mapping method: '%s'. Use one of %s.\n", method, strings.Join(DefaultMethods, ", "))
+}
+
+// Try each method in turn, returning the first mapping which succeeds along
+// with the mapper that made it.
+func Discover(methods []string, gateway, localIP net.IP, protocol string, port uint16, lifetime time.Duration) (Mapper, *Mapping, error) {
+	if len(methods) == 0 {
+		methods = DefaultMethods
+	}
+	errs := make([]string, 0, len(methods))
+	for _, method := range methods {
+		mapper, err := NewMapper(method, gateway, localIP)
+		if err != nil {
+			return nil, nil, err
+		}
+		m, err := mapper.AddMapping(protocol, port, port, lifetime)
+		if err == nil {
+			return mapper, m, nil
+		}
+		errs = append(errs, mapper.Name()+": "+strings.TrimSpace(err.Error()))
+	}
+	return nil, nil, fmt.Errorf("No port mapping method worked for %s port %d:\n - %s\n", protocol, port, strings.Join(errs, "\n - "))
+}
+
+// Whether a gateway answered one mapping method, and the public address it
+// reported if the method gives one.
+type ProbeResult struct {
+	Method     string
+	ExternalIP net.IP
+	Err        error
+}
+
+// Asks the gateway about each method without mapping anything.
+func Probe(methods []string, gateway, localIP net.IP) []ProbeResult {
+	if len(methods) == 0 {
+		methods = DefaultMethods
+	}
+	out := make([]ProbeResult, 0, len(methods))
+	for _, method := range methods {
+		res := ProbeResult{Method: method}
+		mapper, err := NewMapper(method, gateway, localIP)
+		if err != nil {
+			res.Err = err
+			out = append(out, res)
+			continue
+		}
+		switch m := mapper.(type) {
+		case *NATPMP:
+			res.ExternalIP, res.Err = m.ExternalIP()
+		case *UPnP:
+			res.ExternalIP, res.Err = m.ExternalIP()
+		case *PCP:
+			res.Err = m.Announce()
+		}
+		out = append(out, res)
+	}
+	return out
+}
+
+// Finds the LAN IP of the router for the given interface and local IP.
+// Uses the route command via traceroute.FindGateway, falling back to the
+// kernel routing table on Linux.
+func FindGateway(ifaceName string, localIP net.IP) (net.IP, error) {
+	dest := "8.8.8.8"
+	if localIP != nil && localIP.To4() == nil {
+		dest = "2001:4860:4860::8888"
+	}
+	gw, err := traceroute.FindGateway(dest, "", ifaceName, localIP)
+	if err == nil && gw != nil {
+		return gw, nil
+	}
+	if runtime.GOOS == "linux" {
+		if gw, lErr := linuxDefaultGateway(ifaceName); lErr == nil {
+			return gw, nil
+		}
+	}
+	if err == nil {
+		err = fmt.Errorf("No gateway found for interface '%s'\n", ifaceName)
+	}
+	return nil, err
+}
+
+// Reads the IPv4 default route from /proc/net/route
+func linuxDefaultGateway(ifaceName string) (net.IP, error) {
+	fh, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// Iface Destination Gateway Flags ...
+		if len(fields) < 4 || fields[1] != "00000000" {
+			continue
+		}
+		if ifaceName != "" && fields[0] != ifaceName {
+			continue
+		}
+		raw, err := hex.DecodeString(fields[2])
+		if err != nil || len(raw) != 4 {
+			continue
+		}
+		// stored little endian
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, binary.LittleEndian.Uint32(raw))
+		return ip, nil
+	}
+	return nil, fmt.Errorf("No default route found in /proc/net/route\n")
+}
+
+// Keeps a set of mappings alive, renewing each at half its lifetime, and
+// removes them all on Close.
+type Keeper struct {
+	mu        sync.Mutex
+	mapper    Mapper
+	mappings  []*Mapping
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewKeeper(mapper Mapper, mappings ...*Mapping) *Keeper {
+	return &Keeper{mapper: mapper, mappings: mappings, stop: make(chan struct{})}
+}
+
+// Current mappings.
+func (self *Keeper) Mappings() []*Mapping {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	out := make([]*Mapping, len(self.mappings))
+	copy(out, self.mappings)
+	return out
+}
+
+func (self *Keeper) Add(m *Mapping) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.mappings = append(self.mappings, m)
+}
+
+func (self *Keeper) nextRenewal() time.Duration {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	next := time.Hour
+	for _, m := range self.mappings {
+		if d := time.Until(m.Expires) / 2; d < next {
+			next = d
+		}
+	}
+	if next < time.Second {
+		next = time.Second
+	}
+	return next
+}
+
+// Mappings past half their lifetime.
+func (self *Keeper) due() []*Mapping {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	var out []*Mapping
+	for _, m := range self.mappings {
+		if time.Until(m.Expires) <= m.Lifetime/2 {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// Swaps old for renewed, returning false if old has gone, i.e. on Close.
+func (self *Keeper) replace(old, renewed *Mapping) bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	for i, m := range self.mappings {
+		if m == old {
+			self.mappings[i] = renewed
+			return true
+		}
+	}
+	return false
+}
+
+// Renews mappings until Close is called. The gateway is not talked to
+// while holding the lock, so Mappings and Add don't wait on it.
+func (self *Keeper) Run() {
+	for {
+		select {
+		case <-time.After(self.nextRenewal()):
+		case <-self.stop:
+			return
+		}
+		for _, m := range self.due() {
+			renewed, err := self.mapper.AddMapping(m.Protocol, m.InternalPort, m.ExternalPort, m.Lifetime)
+			if err != nil {
+				log.Printf("Unable to renew port mapping %s: %s\n", m.String(), err.Error())
+				continue
+			}
+			if !self.replace(m, renewed) {
+				// closed while renewing, so don't leave it behind
+				self.mapper.DeleteMapping(renewed)
+			}
+		}
+	}
+}
+
+// Stops renewing and deletes all mappings from the gateway. Later calls do
+// nothing.
+func (self *Keeper) Close() error {
+	var lastErr error
+	self.closeOnce.Do(func() {
+		close(self.stop)
+		self.mu.Lock()
+		mappings := self.mappings
+		self.mappings = nil
+		self.mu.Unlock()
+		for _, m := range mappings {
+			if err := self.mapper.DeleteMapping(m); err != nil {
+				lastErr = err
+			}
+		}
+	})
+	return lastErr
+}
+
+// Finds the interface name and local IPv4 address to map ports for. With a
+// non-zero interface index that interface is used, otherwise the one
+// holding the default route.
+func LocalAddress(ifaceIndex int) (string, net.IP, error) {
+	if ifaceIndex != 0 {
+		iface, err := net.InterfaceByIndex(ifaceIndex)
+		if err != nil {
+			return "", nil, err
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return "", nil, err
+		}
+		for _, a := range addrs {
+			if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.To4() != nil && !ipNet.IP.IsLoopback() {
+				return iface.Name, ipNet.IP.To4(), nil
+			}
+		}
+		return "", nil, fmt.Errorf("Interface %d. (%s) has no IPv4 address to map ports for.\n", iface.Index, iface.Name)
+	}
+	// no packets are sent by a UDP dial; this just asks for a route
+	conn, err := net.Dial("udp4", "192.0.2.1:9")
+	if err != nil {
+		return "", nil, err
+	}
+	ip := conn.LocalAddr().(*net.UDPAddr).IP
+	conn.Close()
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", nil, err
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+				return iface.Name, ip, nil
+			}
+		}
+	}
+	return "", ip, nil
+}
@@ -0,0 +1,282 @@
+package portmap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A local gateway speaking both NAT-PMP and PCP on one UDP port.
+type fakeGateway struct {
+	conn     *net.UDPConn
+	extIP    net.IP
+	mu       sync.Mutex
+	mappings map[string]uint32 // "udp/10800" -> lifetime
+	noPCP    bool
+}
+
+func newFakeGateway(t *testing.T, noPCP bool) *fakeGateway {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err.Error())
+	}
+	g := &fakeGateway{conn: conn, extIP: net.IPv4(203, 0, 113, 7).To4(), mappings: make(map[string]uint32), noPCP: noPCP}
+	go g.serve()
+	return g
+}
+
+func (self *fakeGateway) port() int {
+	return self.conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func (self *fakeGateway) mapping(key string) (uint32, bool) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	l, ok := self.mappings[key]
+	return l, ok
+}
+
+func (self *fakeGateway) setMapping(key string, lifetime uint32) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if lifetime == 0 {
+		delete(self.mappings, key)
+		return
+	}
+	self.mappings[key] = lifetime
+}
+
+func (self *fakeGateway) serve() {
+	buf := make([]byte, 1100)
+	for {
+		n, from, err := self.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		req := buf[:n]
+		var resp []byte
+		switch req[0] {
+		case 0:
+			resp = self.natpmp(req)
+		case 2:
+			if self.noPCP {
+				resp = []byte{0, 0x80 | req[1], 0, 1}
+				break
+			}
+			resp = self.pcp(req)
+		}
+		if resp != nil {
+			self.conn.WriteToUDP(resp, from)
+		}
+	}
+}
+
+func (self *fakeGateway) natpmp(req []byte) []byte {
+	if req[1] == pmpOpExternalIP {
+		resp := make([]byte, 12)
+		resp[1] = 128
+		copy(resp[8:], self.extIP)
+		return resp
+	}
+	proto := "udp"
+	if req[1] == pmpOpMapTCP {
+		proto = "tcp"
+	}
+	internal := binary.BigEndian.Uint16(req[4:6])
+	lifetime := binary.BigEndian.Uint32(req[8:12])
+	self.setMapping(fmt.Sprintf("%s/%d", proto, internal), lifetime)
+	resp := make([]byte, 16)
+	resp[1] = 128 + req[1]
+	binary.BigEndian.PutUint16(resp[8:10], internal)
+	binary.BigEndian.PutUint16(resp[10:12], internal+1)
+	binary.BigEndian.PutUint32(resp[12:16], lifetime)
+	return resp
+}
+
+func (self *fakeGateway) pcp(req []byte) []byte {
+	resp := make([]byte, pcpHeaderLen+pcpMapLen)
+	resp[0] = pcpVersion
+	resp[1] = 0x80 | req[1]
+	copy(resp[4:8], req[4:8])
+	copy(resp[pcpHeaderLen:], req[pcpHeaderLen:])
+	body := resp[pcpHeaderLen:]
+	proto := "udp"
+	if body[12] == ipProtoTCP {
+		proto = "tcp"
+	}
+	internal := binary.BigEndian.Uint16(body[16:18])
+	self.setMapping(fmt.Sprintf("%s/%d", proto, internal), binary.BigEndian.Uint32(req[4:8]))
+	binary.BigEndian.PutUint16(body[18:20], internal)
+	copy(body[20:36], self.extIP.To16())
+	return resp
+}
+
+func TestNATPMP(t *testing.T) {
+	g := newFakeGateway(t, false)
+	defer g.conn.Close()
+	c := &NATPMP{Gateway: net.IPv4(127, 0, 0, 1), Port: g.port()}
+	m, err := c.AddMapping("udp", 10800, 10800, time.Hour)
+	if err != nil {
+		t.Fatalf("AddMapping failed: %s", err.Error())
+	}
+	if m.ExternalPort != 10801 || !m.ExternalIP.Equal(g.extIP) || m.Lifetime != time.Hour {
+		t.Errorf("Unexpected mapping: %s", m.String())
+	}
+	if _, ok := g.mapping("udp/10800"); !ok {
+		t.Errorf("Gateway did not record mapping")
+	}
+	if err := c.DeleteMapping(m); err != nil {
+		t.Errorf("DeleteMapping failed: %s", err.Error())
+	}
+	if _, ok := g.mapping("udp/10800"); ok {
+		t.Errorf("Gateway still has mapping after delete")
+	}
+}
+
+func TestPCP(t *testing.T) {
+	g := newFakeGateway(t, false)
+	defer g.conn.Close()
+	c := &PCP{Gateway: net.IPv4(127, 0, 0, 1), LocalIP: net.IPv4(192, 168, 0, 2), Port: g.port()}
+	m, err := c.AddMapping("tcp", 10800, 10800, time.Hour)
+	if err != nil {
+		t.Fatalf("AddMapping failed: %s", err.Error())
+	}
+	if m.ExternalPort != 10800 || !m.ExternalIP.Equal(g.extIP) {
+		t.Errorf("Unexpected mapping: %s", m.String())
+	}
+	if err := c.DeleteMapping(m); err != nil {
+		t.Errorf("DeleteMapping failed: %s", err.Error())
+	}
+	if _, ok := g.mapping("tcp/10800"); ok {
+		t.Errorf("Gateway still has mapping after delete")
+	}
+	if err := c.Announce(); err != nil {
+		t.Errorf("Announce failed: %s", err.Error())
+	}
+
+	old := newFakeGateway(t, true)
+	defer old.conn.Close()
+	c = &PCP{Gateway: net.IPv4(127, 0, 0, 1), LocalIP: net.IPv4(192, 168, 0, 2), Port: old.port()}
+	if _, err := c.AddMapping("udp", 10800, 10800, time.Hour); err == nil {
+		t.Errorf("Expected PCP to fail against a NAT-PMP only gateway")
+	}
+	if err := c.Announce(); err == nil {
+		t.Errorf("Expected PCP announce to fail against a NAT-PMP only gateway")
+	}
+}
+
+const testIGDDescription = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+ <device>
+  <deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+  <deviceList><device>
+   <deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+   <deviceList><device>
+    <deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+    <serviceList><service>
+     <serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+     <controlURL>/ctl/IPConn</controlURL>
+    </service></serviceList>
+   </device></deviceList>
+  </device></deviceList>
+ </device>
+</root>`
+
+func TestUPnP(t *testing.T) {
+	var mu sync.Mutex
+	actions := make([]string, 0, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/desc.xml" {
+			w.Write([]byte(testIGDDescription))
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		action := r.Header.Get("SOAPAction")
+		mu.Lock()
+		actions = append(actions, action)
+		mu.Unlock()
+		if strings.Contains(action, "AddPortMapping") && !strings.Contains(string(body), "<NewInternalClient>192.168.0.2</NewInternalClient>") {
+			w.WriteHeader(500)
+			w.Write([]byte(`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault><faultstring>UPnPError</faultstring><detail><UPnPError><errorCode>402</errorCode><errorDescription>Invalid Args</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`))
+			return
+		}
+		w.Write([]byte(`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>` +
+			`<u:Response xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1"><NewExternalIPAddress>198.51.100.9</NewExternalIPAddress></u:Response>` +
+			`</s:Body></s:Envelope>`))
+	}))
+	defer srv.Close()
+
+	// SSDP responder pointing at the description
+	ssdp, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err.Error())
+	}
+	defer ssdp.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		n, from, err := ssdp.ReadFromUDP(buf)
+		if err != nil || !strings.HasPrefix(string(buf[:n]), "M-SEARCH") {
+			return
+		}
+		ssdp.WriteToUDP([]byte("HTTP/1.1 200 OK\r\nLOCATION: "+srv.URL+"/desc.xml\r\nST: upnp:rootdevice\r\n\r\n"), from)
+	}()
+
+	c := &UPnP{LocalIP: net.IPv4(192, 168, 0, 2), SSDPAddr: ssdp.LocalAddr().String()}
+	m, err := c.AddMapping("udp", 10800, 10800, time.Hour)
+	if err != nil {
+		t.Fatalf("AddMapping failed: %s", err.Error())
+	}
+	if !m.ExternalIP.Equal(net.ParseIP("198.51.100.9")) {
+		t.Errorf("Unexpected external IP in mapping: %s", m.String())
+	}
+	if err := c.DeleteMapping(m); err != nil {
+		t.Errorf("DeleteMapping failed: %s", err.Error())
+	}
+	bad := &UPnP{LocalIP: net.IPv4(192, 168, 0, 3), Location: srv.URL + "/desc.xml"}
+	if _, err := bad.AddMapping("udp", 10800, 10800, time.Hour); err == nil || !strings.Contains(err.Error(), "402") {
+		t.Errorf("Expected fault 402 from gateway, got %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(actions) < 3 || !strings.HasSuffix(actions[0], "#AddPortMapping\"") {
+		t.Errorf("Unexpected SOAP actions: %v", actions)
+	}
+}
+
+func TestKeeperRenewsAndCloses(t *testing.T) {
+	g := newFakeGateway(t, false)
+	defer g.conn.Close()
+	c := &NATPMP{Gateway: net.IPv4(127, 0, 0, 1), Port: g.port()}
+	m, err := c.AddMapping("udp", 10800, 10800, 2*time.Second)
+	if err != nil {
+		t.Fatalf("AddMapping failed: %s", err.Error())
+	}
+	k := NewKeeper(c, m)
+	go k.Run()
+	time.Sleep(1500 * time.Millisecond)
+	if renewed := k.Mappings()[0]; !renewed.Expires.After(m.Expires) {
+		t.Errorf("Mapping was not renewed: %s", renewed.String())
+	}
+	// closing from several goroutines at once is safe
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := k.Close(); err != nil {
+				t.Errorf("Close failed: %s", err.Error())
+			}
+		}()
+	}
+	wg.Wait()
+	if _, ok := g.mapping("udp/10800"); ok {
+		t.Errorf("Gateway still has mapping after close")
+	}
+}
@@ -0,0 +1,268 @@
+package portmap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const ssdpAddr = "239.255.255.250:1900"
+
+var igdServiceTypes = []string{
+	"urn:schemas-upnp-org:service:WANIPConnection:2",
+	"urn:schemas-upnp-org:service:WANIPConnection:1",
+	"urn:schemas-upnp-org:service:WANPPPConnection:1",
+}
+
+// UPnP Internet Gateway Device client.
+type UPnP struct {
+	// Address sent as the internal client of mappings
+	LocalIP net.IP
+	// Where to send SSDP searches, defaults to the standard multicast group
+	SSDPAddr string
+	// Device description URL; found by SSDP search if empty
+	Location string
+	// Total time to wait for SSDP answers, defaults to 2s
+	Timeout     time.Duration
+	controlURL  string
+	serviceType string
+}
+
+func (self *UPnP) Name() string {
+	return "upnp"
+}
+
+type igdDevice struct {
+	DeviceType string       `xml:"deviceType"`
+	Services   []igdService `xml:"serviceList>service"`
+	Devices    []igdDevice  `xml:"deviceList>device"`
+}
+
+type igdService struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+type igdRoot struct {
+	URLBase string    `xml:"URLBase"`
+	Device  igdDevice `xml:"device"`
+}
+
+func (self *igdDevice) findService(serviceType string) *igdService {
+	for i := range self.Services {
+		if self.Services[i].ServiceType == serviceType {
+			return &self.Services[i]
+		}
+	}
+	for i := range self.Devices {
+		if s := self.Devices[i].findService(serviceType); s != nil {
+			return s
+		}
+	}
+	return nil
+}
+
+// Finds the gateway's device description URL with an SSDP M-SEARCH.
+func (self *UPnP) search() (string, error) {
+	target := self.SSDPAddr
+	if target == "" {
+		target = ssdpAddr
+	}
+	addr, err := net.ResolveUDPAddr("udp4", target)
+	if err != nil {
+		return "", err
+	}
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	timeout := self.Timeout
+	if timeout == 0 {
+		timeout = 2 * time.Second
+	}
+	req := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + ssdpAddr + "\r\n" +
+		"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n\r\n"
+	if _, err := conn.WriteToUDP([]byte(req), addr); err != nil {
+		return "", err
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return "", fmt.Errorf("No UPnP gateway answered: %s\n", err.Error())
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+		if loc := resp.Header.Get("Location"); loc != "" {
+			return loc, nil
+		}
+	}
+}
+
+// Finds the WAN connection service's control URL.
+func (self *UPnP) discover() error {
+	if self.controlURL != "" {
+		return nil
+	}
+	loc := self.Location
+	if loc == "" {
+		var err error
+		if loc, err = self.search(); err != nil {
+			return err
+		}
+	}
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(loc)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var root igdRoot
+	if err := xml.NewDecoder(resp.Body).Decode(&root); err != nil {
+		return fmt.Errorf("Unable to parse gateway description from %s: %s\n", loc, err.Error())
+	}
+	base, err := url.Parse(loc)
+	if err != nil {
+		return err
+	}
+	if root.URLBase != "" {
+		if b, err := url.Parse(root.URLBase); err == nil {
+			base = b
+		}
+	}
+	for _, st := range igdServiceTypes {
+		if s := root.Device.findService(st); s != nil {
+			ctrl, err := base.Parse(s.ControlURL)
+			if err != nil {
+				return err
+			}
+			self.controlURL = ctrl.String()
+			self.serviceType = st
+			return nil
+		}
+	}
+	return fmt.Errorf("Gateway at %s has no WAN connection service\n", loc)
+}
+
+type soapEnvelope struct {
+	Body struct {
+		Fault *struct {
+			String string `xml:"faultstring"`
+			Detail string `xml:"detail>UPnPError>errorDescription"`
+			Code   string `xml:"detail>UPnPError>errorCode"`
+		} `xml:"Fault"`
+		Inner struct {
+			ExternalIP string `xml:"NewExternalIPAddress"`
+		} `xml:",any"`
+	} `xml:"Body"`
+}
+
+func (self *UPnP) call(action string, args [][2]string) (*soapEnvelope, error) {
+	if err := self.discover(); err != nil {
+		return nil, err
+	}
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body><u:` + action + ` xmlns:u="` + self.serviceType + `">`)
+	for _, a := range args {
+		body.WriteString("<" + a[0] + ">")
+		xml.EscapeText(&body, []byte(a[1]))
+		body.WriteString("</" + a[0] + ">")
+	}
+	body.WriteString(`</u:` + action + `></s:Body></s:Envelope>`)
+	req, err := http.NewRequest("POST", self.controlURL, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", `"`+self.serviceType+"#"+action+`"`)
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var env soapEnvelope
+	if err := xml.Unmarshal(data, &env); err != nil {
+		return nil, fmt.Errorf("Unable to parse %s reply: %s\n", action, err.Error())
+	}
+	if f := env.Body.Fault; f != nil {
+		return nil, fmt.Errorf("Gateway refused %s: %s %s\n", action, f.Code, strings.TrimSpace(f.Detail+" "+f.String))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Gateway refused %s: %s\n", action, resp.Status)
+	}
+	return &env, nil
+}
+
+// Asks the gateway for its public address.
+func (self *UPnP) ExternalIP() (net.IP, error) {
+	env, err := self.call("GetExternalIPAddress", nil)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(strings.TrimSpace(env.Body.Inner.ExternalIP))
+	if ip == nil {
+		return nil, fmt.Errorf("Gateway gave unparsable external IP '%s'\n", env.Body.Inner.ExternalIP)
+	}
+	return ip, nil
+}
+
+func (self *UPnP) AddMapping(protocol string, internalPort, externalPort uint16, lifetime time.Duration) (*Mapping, error) {
+	if self.LocalIP == nil {
+		return nil, fmt.Errorf("UPnP needs the local IP address to be known.\n")
+	}
+	if lifetime <= 0 {
+		lifetime = DefaultLifetime
+	}
+	_, err := self.call("AddPortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", fmt.Sprintf("%d", externalPort)},
+		{"NewProtocol", strings.ToUpper(protocol)},
+		{"NewInternalPort", fmt.Sprintf("%d", internalPort)},
+		{"NewInternalClient", self.LocalIP.String()},
+		{"NewEnabled", "1"},
+		{"NewPortMappingDescription", "Parvati client"},
+		{"NewLeaseDuration", fmt.Sprintf("%d", int64(lifetime/time.Second))},
+	})
+	if err != nil {
+		return nil, err
+	}
+	m := &Mapping{
+		Protocol:     protocol,
+		InternalPort: internalPort,
+		ExternalPort: externalPort,
+		Lifetime:     lifetime,
+		Method:       self.Name(),
+		Expires:      time.Now().Add(lifetime),
+	}
+	return withExternalIP(m, self.ExternalIP), nil
+}
+
+func (self *UPnP) DeleteMapping(m *Mapping) error {
+	_, err := self.call("DeletePortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", fmt.Sprintf("%d", m.ExternalPort)},
+		{"NewProtocol", strings.ToUpper(m.Protocol)},
+	})
+	return err
+}
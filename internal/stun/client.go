@@ -0,0 +1,270 @@
+package stun
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Servers used when none are configured. The first supports RFC 5780 so
+// can classify NATs; the second only reports addresses.
+var DefaultServers = []string{"stun.stunprotocol.org:3478", "stun.l.google.com:19302"}
+
+type NATType string
+
+const (
+	NATUnknown        NATType = "unknown"
+	NATNone           NATType = "no NAT"
+	NATFirewall       NATType = "no NAT, filtered"
+	NATFullCone       NATType = "full cone"
+	NATRestricted     NATType = "restricted cone"
+	NATPortRestricted NATType = "port restricted cone"
+	NATSymmetric      NATType = "symmetric"
+	NATBlocked        NATType = "UDP blocked"
+)
+
+// Whether others can usually reach a host behind this type of NAT
+// without port forwarding.
+func (self NATType) Hostable() bool {
+	return self == NATNone || self == NATFullCone
+}
+
+type Result struct {
+	Server string
+	Local  *net.UDPAddr
+	Mapped *net.UDPAddr
+	NAT    NATType
+}
+
+// Talks to STUN servers from a single local socket.
+type Client struct {
+	conn    *net.UDPConn
+	Timeout time.Duration
+}
+
+// Opens a client on the given local IP (nil for any), for "udp4" or "udp6".
+func NewClient(network string, localIP net.IP) (*Client, error) {
+	conn, err := net.ListenUDP(network, &net.UDPAddr{IP: localIP})
+	if err != nil {
+		return nil, err
+	}
+	return &Client{conn: conn, Timeout: 2 * time.Second}, nil
+}
+
+func (self *Client) Close() error {
+	return self.conn.Close()
+}
+
+func (self *Client) LocalAddr() *net.UDPAddr {
+	return self.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// Sends a binding request, retransmitting until a response with a matching
+// transaction id arrives. A nil message with nil error means no answer.
+func (self *Client) Request(server *net.UDPAddr, change uint32) (*Message, error) {
+	req := NewBindingRequest(change)
+	data := req.Encode()
+	deadline := time.Now().Add(self.Timeout)
+	wait := 200 * time.Millisecond
+	buf := make([]byte, 1500)
+	for time.Now().Before(deadline) {
+		if _, err := self.conn.WriteToUDP(data, server); err != nil {
+			return nil, err
+		}
+		tryUntil := time.Now().Add(wait)
+		if tryUntil.After(deadline) {
+			tryUntil = deadline
+		}
+		self.conn.SetReadDeadline(tryUntil)
+		for {
+			n, _, err := self.conn.ReadFromUDP(buf)
+			if err != nil {
+				if nErr, ok := err.(net.Error); ok && nErr.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			resp, err := Decode(buf[:n])
+			if err != nil || !bytes.Equal(resp.TransactionID[:], req.TransactionID[:]) {
+				continue
+			}
+			if resp.Type != TypeBindingResponse {
+				return nil, fmt.Errorf("STUN server %s returned an error response\n", server.String())
+			}
+			return resp, nil
+		}
+		wait *= 2
+	}
+	return nil, nil
+}
+
+func resolve(network, server string) (*net.UDPAddr, error) {
+	if !strings.Contains(server, ":") || strings.HasSuffix(server, "]") {
+		server = net.JoinHostPort(strings.Trim(server, "[]"), "3478")
+	}
+	return net.ResolveUDPAddr(network, server)
+}
+
+// Finds our mapped address using the first server that answers.
+func (self *Client) MappedAddress(network string, servers []string) (*Result, error) {
+	if len(servers) == 0 {
+		servers = DefaultServers
+	}
+	errs := make([]string, 0, len(servers))
+	for _, s := range servers {
+		addr, err := resolve(network, s)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		resp, err := self.Request(addr, 0)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if resp == nil || resp.MappedAddress() == nil {
+			errs = append(errs, "no answer from "+s)
+			continue
+		}
+		return &Result{Server: s, Local: self.LocalAddr(), Mapped: resp.MappedAddress(), NAT: NATUnknown}, nil
+	}
+	return nil, fmt.Errorf("No STUN server gave us an address: %s\n", strings.Join(errs, "; "))
+}
+
+// Whether mapped is our own address, i.e. nothing translated it. Bound to
+// the wildcard address we only know the port, so the mapped IP is checked
+// against those of our interfaces.
+func isLocal(mapped, local *net.UDPAddr) bool {
+	if mapped.Port != local.Port {
+		return false
+	}
+	if !local.IP.IsUnspecified() {
+		return mapped.IP.Equal(local.IP)
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.Equal(mapped.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Runs the classic behaviour tests against a server with an alternate
+// address to work out what kind of NAT (if any) we are behind.
+func (self *Client) Classify(network, server string) (*Result, error) {
+	addr, err := resolve(network, server)
+	if err != nil {
+		return nil, err
+	}
+	res := &Result{Server: server, Local: self.LocalAddr(), NAT: NATUnknown}
+	// Test I: plain binding
+	resp, err := self.Request(addr, 0)
+	if err != nil {
+		return nil, err
+	}
+	if resp == nil {
+		res.NAT = NATBlocked
+		return res, nil
+	}
+	res.Mapped = resp.MappedAddress()
+	other := resp.OtherAddress()
+	if res.Mapped == nil {
+		return nil, fmt.Errorf("STUN server %s did not give a mapped address\n", server)
+	}
+	notNATed := isLocal(res.Mapped, res.Local)
+	if other == nil {
+		// can't do the other tests with this server
+		if notNATed {
+			res.NAT = NATNone
+		}
+		return res, nil
+	}
+	// Test II: answer from the other IP and port
+	resp, err = self.Request(addr, ChangeIP|ChangePort)
+	if err != nil {
+		return nil, err
+	}
+	if notNATed {
+		if resp != nil {
+			res.NAT = NATNone
+		} else {
+			res.NAT = NATFirewall
+		}
+		return res, nil
+	}
+	if resp != nil {
+		res.NAT = NATFullCone
+		return res, nil
+	}
+	// Test I again, to the other address: does our mapping change?
+	resp, err = self.Request(other, 0)
+	if err != nil {
+		return nil, err
+	}
+	if resp == nil {
+		return res, nil
+	}
+	if m := resp.MappedAddress(); m == nil || !m.IP.Equal(res.Mapped.IP) || m.Port != res.Mapped.Port {
+		res.NAT = NATSymmetric
+		return res, nil
+	}
+	// Test III: answer from the other port only
+	resp, err = self.Request(addr, ChangePort)
+	if err != nil {
+		return nil, err
+	}
+	if resp != nil {
+		res.NAT = NATRestricted
+	} else {
+		res.NAT = NATPortRestricted
+	}
+	return res, nil
+}
+
+// Finds the public address for a local IP (nil for the default route) and
+// family ("udp4" or "udp6"), classifying the NAT when classify is set and a
+// server supports it.
+func Discover(network string, localIP net.IP, servers []string, classify bool) (*Result, error) {
+	if len(servers) == 0 {
+		servers = DefaultServers
+	}
+	client, err := NewClient(network, localIP)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	if !classify {
+		return client.MappedAddress(network, servers)
+	}
+	var lastErr error
+	var partial *Result
+	for _, s := range servers {
+		res, err := client.Classify(network, s)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if res.Mapped == nil {
+			continue
+		}
+		if res.NAT != NATUnknown {
+			return res, nil
+		}
+		if partial == nil {
+			partial = res
+		}
+	}
+	if partial != nil {
+		return partial, nil
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("No STUN server answered\n")
+	}
+	return nil, lastErr
+}
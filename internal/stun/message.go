@@ -0,0 +1,181 @@
+// Package stun implements enough of STUN (RFC 5389) to learn our public
+// address, plus the RFC 5780 behaviour tests used to classify a NAT.
+package stun
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+const (
+	magicCookie = 0x2112A442
+	headerLen   = 20
+
+	TypeBindingRequest  = 0x0001
+	TypeBindingResponse = 0x0101
+	TypeBindingError    = 0x0111
+
+	AttrMappedAddress    = 0x0001
+	AttrChangeRequest    = 0x0003
+	AttrSourceAddress    = 0x0004
+	AttrChangedAddress   = 0x0005
+	AttrXORMappedAddress = 0x0020
+	AttrResponseOrigin   = 0x802b
+	AttrOtherAddress     = 0x802c
+
+	ChangeIP   = 0x04
+	ChangePort = 0x02
+)
+
+type Attribute struct {
+	Type  uint16
+	Value []byte
+}
+
+type Message struct {
+	Type          uint16
+	TransactionID [12]byte
+	Attributes    []Attribute
+}
+
+func NewBindingRequest(change uint32) *Message {
+	m := &Message{Type: TypeBindingRequest}
+	rand.Read(m.TransactionID[:])
+	if change != 0 {
+		v := make([]byte, 4)
+		binary.BigEndian.PutUint32(v, change)
+		m.Attributes = append(m.Attributes, Attribute{Type: AttrChangeRequest, Value: v})
+	}
+	return m
+}
+
+func (self *Message) Encode() []byte {
+	size := 0
+	for _, a := range self.Attributes {
+		size += 4 + (len(a.Value)+3)&^3
+	}
+	out := make([]byte, headerLen+size)
+	binary.BigEndian.PutUint16(out[0:2], self.Type)
+	binary.BigEndian.PutUint16(out[2:4], uint16(size))
+	binary.BigEndian.PutUint32(out[4:8], magicCookie)
+	copy(out[8:20], self.TransactionID[:])
+	off := headerLen
+	for _, a := range self.Attributes {
+		binary.BigEndian.PutUint16(out[off:off+2], a.Type)
+		binary.BigEndian.PutUint16(out[off+2:off+4], uint16(len(a.Value)))
+		copy(out[off+4:], a.Value)
+		off += 4 + (len(a.Value)+3)&^3
+	}
+	return out
+}
+
+func Decode(data []byte) (*Message, error) {
+	if len(data) < headerLen {
+		return nil, fmt.Errorf("STUN message too short: %d bytes\n", len(data))
+	}
+	if binary.BigEndian.Uint32(data[4:8]) != magicCookie {
+		return nil, fmt.Errorf("Not a STUN message (bad magic cookie)\n")
+	}
+	size := int(binary.BigEndian.Uint16(data[2:4]))
+	if headerLen+size > len(data) {
+		return nil, fmt.Errorf("STUN message truncated\n")
+	}
+	m := &Message{Type: binary.BigEndian.Uint16(data[0:2])}
+	copy(m.TransactionID[:], data[8:20])
+	body := data[headerLen : headerLen+size]
+	for len(body) >= 4 {
+		t := binary.BigEndian.Uint16(body[0:2])
+		l := int(binary.BigEndian.Uint16(body[2:4]))
+		if 4+l > len(body) {
+			return nil, fmt.Errorf("STUN attribute %#x truncated\n", t)
+		}
+		m.Attributes = append(m.Attributes, Attribute{Type: t, Value: body[4 : 4+l]})
+		padded := 4 + (l+3)&^3
+		if padded > len(body) {
+			break
+		}
+		body = body[padded:]
+	}
+	return m, nil
+}
+
+func (self *Message) Get(t uint16) []byte {
+	for _, a := range self.Attributes {
+		if a.Type == t {
+			return a.Value
+		}
+	}
+	return nil
+}
+
+// Adds an address attribute, XORed with the cookie and transaction id for
+// XOR-MAPPED-ADDRESS.
+func (self *Message) AddAddress(t uint16, addr *net.UDPAddr) {
+	ip := addr.IP.To4()
+	family := byte(1)
+	if ip == nil {
+		ip = addr.IP.To16()
+		family = 2
+	}
+	v := make([]byte, 4+len(ip))
+	v[1] = family
+	binary.BigEndian.PutUint16(v[2:4], uint16(addr.Port))
+	copy(v[4:], ip)
+	if t == AttrXORMappedAddress {
+		self.xor(v)
+	}
+	self.Attributes = append(self.Attributes, Attribute{Type: t, Value: v})
+}
+
+func (self *Message) xor(v []byte) {
+	var key [16]byte
+	binary.BigEndian.PutUint32(key[0:4], magicCookie)
+	copy(key[4:], self.TransactionID[:])
+	v[2] ^= key[0]
+	v[3] ^= key[1]
+	for i := 4; i < len(v); i++ {
+		v[i] ^= key[i-4]
+	}
+}
+
+// Reads an address attribute, undoing the XOR for XOR-MAPPED-ADDRESS.
+func (self *Message) Address(t uint16) *net.UDPAddr {
+	raw := self.Get(t)
+	if len(raw) < 8 {
+		return nil
+	}
+	v := make([]byte, len(raw))
+	copy(v, raw)
+	if t == AttrXORMappedAddress {
+		self.xor(v)
+	}
+	port := int(binary.BigEndian.Uint16(v[2:4]))
+	switch v[1] {
+	case 1:
+		return &net.UDPAddr{IP: net.IP(v[4:8]), Port: port}
+	case 2:
+		if len(v) < 20 {
+			return nil
+		}
+		return &net.UDPAddr{IP: net.IP(v[4:20]), Port: port}
+	}
+	return nil
+}
+
+// Our address as seen by the server; XOR-MAPPED-ADDRESS if present.
+func (self *Message) MappedAddress() *net.UDPAddr {
+	if a := self.Address(AttrXORMappedAddress); a != nil {
+		return a
+	}
+	return self.Address(AttrMappedAddress)
+}
+
+// The server's alternate address, for RFC 5780 (or RFC 3489) servers.
+func (self *Message) OtherAddress() *net.UDPAddr {
+	if a := self.Address(AttrOtherAddress); a != nil {
+		return a
+	}
+	return self.Address(AttrChangedAddress)
+}
@@ -0,0 +1,197 @@
+package stun
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// In-process RFC 5780 server on two loopback IPs with two ports each. It
+// pretends the client is behind the given kind of NAT by rewriting the
+// mapped address and dropping the answers that NAT would filter.
+type testServer struct {
+	conns [2][2]*net.UDPConn
+	nat   NATType
+}
+
+func newTestServer(t *testing.T, nat NATType) *testServer {
+	s := &testServer{nat: nat}
+	for i, ip := range []string{"127.0.0.1", "127.0.0.2"} {
+		for j := 0; j < 2; j++ {
+			c, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP(ip)})
+			if err != nil {
+				t.Skipf("Unable to listen on %s: %s", ip, err)
+			}
+			s.conns[i][j] = c
+		}
+	}
+	for i := range s.conns {
+		for j := range s.conns[i] {
+			go s.serve(i, j)
+		}
+	}
+	return s
+}
+
+func (self *testServer) addr(i, j int) *net.UDPAddr {
+	return self.conns[i][j].LocalAddr().(*net.UDPAddr)
+}
+
+func (self *testServer) Close() {
+	for i := range self.conns {
+		for j := range self.conns[i] {
+			self.conns[i][j].Close()
+		}
+	}
+}
+
+func (self *testServer) serve(i, j int) {
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := self.conns[i][j].ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		req, err := Decode(buf[:n])
+		if err != nil || req.Type != TypeBindingRequest {
+			continue
+		}
+		ri, rj := i, j
+		var change uint32
+		if v := req.Get(AttrChangeRequest); len(v) == 4 {
+			change = uint32(v[3])
+		}
+		if change&ChangeIP != 0 {
+			ri = 1 - i
+		}
+		if change&ChangePort != 0 {
+			rj = 1 - j
+		}
+		if !self.allowed(ri != i, rj != j) {
+			continue
+		}
+		mapped := from
+		if self.nat != NATNone && self.nat != NATFirewall {
+			port := from.Port + 1000
+			if self.nat == NATSymmetric {
+				port += i*100 + j*10
+			}
+			mapped = &net.UDPAddr{IP: net.ParseIP("203.0.113.7"), Port: port}
+		}
+		resp := &Message{Type: TypeBindingResponse, TransactionID: req.TransactionID}
+		resp.AddAddress(AttrXORMappedAddress, mapped)
+		resp.AddAddress(AttrOtherAddress, self.addr(1-i, 1-j))
+		resp.AddAddress(AttrResponseOrigin, self.addr(ri, rj))
+		self.conns[ri][rj].WriteToUDP(resp.Encode(), from)
+	}
+}
+
+func (self *testServer) allowed(ipChanged, portChanged bool) bool {
+	switch self.nat {
+	case NATBlocked:
+		return false
+	case NATNone, NATFullCone:
+		return true
+	case NATRestricted:
+		return !ipChanged
+	}
+	return !ipChanged && !portChanged
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	m := NewBindingRequest(ChangeIP | ChangePort)
+	v4 := &net.UDPAddr{IP: net.ParseIP("198.51.100.1").To4(), Port: 10800}
+	v6 := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 10801}
+	m.AddAddress(AttrXORMappedAddress, v6)
+	m.AddAddress(AttrOtherAddress, v4)
+	got, err := Decode(m.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.TransactionID != m.TransactionID {
+		t.Errorf("Transaction id changed in round trip")
+	}
+	if a := got.MappedAddress(); a == nil || !a.IP.Equal(v6.IP) || a.Port != v6.Port {
+		t.Errorf("Expected mapped address %s, got %v", v6, a)
+	}
+	if a := got.OtherAddress(); a == nil || !a.IP.Equal(v4.IP) || a.Port != v4.Port {
+		t.Errorf("Expected other address %s, got %v", v4, a)
+	}
+	if v := got.Get(AttrChangeRequest); len(v) != 4 || v[3] != ChangeIP|ChangePort {
+		t.Errorf("Expected change request flags, got %v", v)
+	}
+	if _, err := Decode([]byte("not a stun message at all")); err == nil {
+		t.Errorf("Expected garbage to fail to decode")
+	}
+}
+
+func TestClassify(t *testing.T) {
+	for _, nat := range []NATType{NATNone, NATFirewall, NATFullCone, NATRestricted, NATPortRestricted, NATSymmetric, NATBlocked} {
+		srv := newTestServer(t, nat)
+		client, err := NewClient("udp4", net.ParseIP("127.0.0.1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.Timeout = 300 * time.Millisecond
+		res, err := client.Classify("udp4", srv.addr(0, 0).String())
+		client.Close()
+		srv.Close()
+		if err != nil {
+			t.Errorf("%s: %s", nat, err)
+			continue
+		}
+		if res.NAT != nat {
+			t.Errorf("Expected NAT type '%s', got '%s'", nat, res.NAT)
+		}
+		if nat != NATBlocked && res.Mapped == nil {
+			t.Errorf("%s: expected a mapped address", nat)
+		}
+	}
+}
+
+func TestMappedAddressFallsBack(t *testing.T) {
+	srv := newTestServer(t, NATPortRestricted)
+	defer srv.Close()
+	dead, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dead.Close()
+	client, err := NewClient("udp4", net.ParseIP("127.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Timeout = 300 * time.Millisecond
+	res, err := client.MappedAddress("udp4", []string{dead.LocalAddr().String(), srv.addr(0, 0).String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Server != srv.addr(0, 0).String() {
+		t.Errorf("Expected answer from the live server, got %s", res.Server)
+	}
+	if !res.Mapped.IP.Equal(net.ParseIP("203.0.113.7")) {
+		t.Errorf("Expected mapped IP 203.0.113.7, got %s", res.Mapped.IP)
+	}
+}
+
+func TestDiscoverBoundToLocalIP(t *testing.T) {
+	srv := newTestServer(t, NATNone)
+	defer srv.Close()
+	servers := []string{srv.addr(0, 0).String()}
+	res, err := Discover("udp4", net.ParseIP("127.0.0.1"), servers, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.NAT != NATNone || !res.Local.IP.Equal(res.Mapped.IP) {
+		t.Errorf("Expected no NAT bound to the outbound address, got '%s' (%s from %s)", res.NAT, res.Mapped, res.Local)
+	}
+	// bound to any address, the mapped one is found among our interfaces
+	res, err = Discover("udp4", nil, servers, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.NAT != NATNone {
+		t.Errorf("Expected no NAT for an unbound client, got '%s' (%s from %s)", res.NAT, res.Mapped, res.Local)
+	}
+}
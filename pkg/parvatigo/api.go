@@ -6,12 +6,14 @@ import (
 	"github.com/go-resty/resty/v2"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/user"
 	"path/filepath"
 	"strings"
 	"time"
 
+	"github.com/misatosangel/parvati-api-client/pkg/probe"
 	"github.com/misatosangel/parvati-api-client/pkg/swagger"
 )
 
@@ -25,7 +27,10 @@ type Api struct {
 	userID    string
 	announcer string
 	Verbose   bool
-	log       *log.Logger
+	Metrics   *Metrics
+	// Set when authenticating with OAuth
+	OAuth *OAuth
+	log   *log.Logger
 }
 
 type StatusUpdate struct {
@@ -55,6 +60,8 @@ func NewApi(conf *ApiConfig, buildVersion string) (Api, error) {
 				return a, err
 			}
 			conf = &ApiConfig{}
+		} else if err := conf.UseProfile(""); err != nil {
+			return a, err
 		}
 	}
 	if conf.URI == "" {
@@ -68,6 +75,18 @@ func NewApi(conf *ApiConfig, buildVersion string) (Api, error) {
 	if conf.Password != "" {
 		c.Password = conf.Password
 	}
+	switch conf.AuthMethod {
+	case "", AuthBasic:
+	case AuthToken:
+		c.Password = ""
+		c.AddDefaultHeader("Token", conf.Token)
+	case AuthOAuth:
+		c.Password = ""
+		oauth := conf.OAuth()
+		a.OAuth = oauth
+	default:
+		return a, fmt.Errorf("Unknown parvati.authMethod '%s' (use %s, %s or %s)\n", conf.AuthMethod, AuthBasic, AuthToken, AuthOAuth)
+	}
 	a.announcer = conf.Announcer
 	if a.announcer == "" {
 		a.announcer = "ApiClient"
@@ -76,11 +95,95 @@ func NewApi(conf *ApiConfig, buildVersion string) (Api, error) {
 	a.GApi = &swagger.GamesApi{Configuration: *c}
 	a.UApi = &swagger.UsersApi{Configuration: *c}
 	a.log = log.New(os.Stderr, "API> ", log.LstdFlags)
+	a.Metrics = NewMetrics()
 	return a, nil
 }
 
+// Changes the username and password used for later calls.
+func (self *Api) SetCredentials(username, password string) {
+	self.Config.UserName = username
+	self.Config.Password = password
+	self.HApi.Configuration = *self.Config
+	self.GApi.Configuration = *self.Config
+	self.UApi.Configuration = *self.Config
+	self.userID = ""
+}
+
+// The generated APIs to make a call with.
+type apiClients struct {
+	HApi *swagger.HostsApi
+	GApi *swagger.GamesApi
+	UApi *swagger.UsersApi
+}
+
+// Our APIs, or with OAuth copies of them sending the current access token.
+// The copies get their own headers, so concurrent calls don't share them.
+func (self *Api) clients() (*apiClients, error) {
+	if self.OAuth == nil {
+		return &apiClients{HApi: self.HApi, GApi: self.GApi, UApi: self.UApi}, nil
+	}
+	headers := make(map[string]string, len(self.Config.DefaultHeader)+1)
+	for k, v := range self.Config.DefaultHeader {
+		headers[k] = v
+	}
+	if err := self.setBearer(headers); err != nil {
+		return nil, err
+	}
+	h, g, u := *self.HApi, *self.GApi, *self.UApi
+	h.Configuration.DefaultHeader = headers
+	g.Configuration.DefaultHeader = headers
+	u.Configuration.DefaultHeader = headers
+	return &apiClients{HApi: &h, GApi: &g, UApi: &u}, nil
+}
+
+// Adds the OAuth access token, if we have one, to headers.
+func (self *Api) setBearer(headers map[string]string) error {
+	if self.OAuth == nil {
+		return nil
+	}
+	tok, err := self.OAuth.Token()
+	if err != nil {
+		return err
+	}
+	if tok != nil {
+		headers["Authorization"] = "Bearer " + tok.AccessToken
+	}
+	return nil
+}
+
+// Makes a call with the generated APIs. If OAuth's access token is refused,
+// it is refreshed and the call made once more.
+func (self *Api) call(do func(c *apiClients) (*swagger.APIResponse, error)) (*swagger.APIResponse, error) {
+	c, err := self.clients()
+	if err != nil {
+		return nil, err
+	}
+	r, err := do(c)
+	if !self.unauthorized(r) {
+		return r, err
+	}
+	if c, err = self.clients(); err != nil {
+		return r, err
+	}
+	return do(c)
+}
+
+// Whether the call was refused and a refreshed OAuth token may help.
+func (self *Api) unauthorized(r *swagger.APIResponse) bool {
+	if self.OAuth == nil || r == nil || r.Response == nil || r.StatusCode != http.StatusUnauthorized {
+		return false
+	}
+	_, err := self.OAuth.Refresh()
+	return err == nil
+}
+
 func (self *Api) GetGames() ([]swagger.Game, *ApiError) {
-	data, r, err := self.GApi.GamesGet("")
+	var data []swagger.Game
+	r, err := self.call(func(c *apiClients) (r *swagger.APIResponse, err error) {
+		data, r, err = c.GApi.GamesGet("")
+		return
+	})
+	self.Metrics.observeCall("games", r, err)
 	if err != nil {
 		return nil, ApiErr(r, err)
 	}
@@ -101,7 +204,21 @@ func (self *Api) UpdateIPs(v4, v6 net.IP) (swagger.UserDelta, *ApiError) {
 	if v6 != nil {
 		ipMap["ipv6"] = v6.String()
 	}
-	delta, r, err := self.UApi.UpdateUser(self.userID, ipMap)
+	var delta swagger.UserDelta
+	r, err := self.call(func(c *apiClients) (r *swagger.APIResponse, err error) {
+		delta, r, err = c.UApi.UpdateUser(self.userID, ipMap)
+		return
+	})
+	self.Metrics.observeCall("user_update", r, err)
+	if err == nil {
+		if v4 != nil {
+			self.Metrics.Add(MetricIPChanges, 1, "family", "ipv4")
+		}
+		if v6 != nil {
+			self.Metrics.Add(MetricIPChanges, 1, "family", "ipv6")
+		}
+		self.Metrics.Set(MetricLastIPUpdate, float64(time.Now().Unix()))
+	}
 	return delta, ApiErr(r, err)
 }
 
@@ -116,7 +233,12 @@ func (self *Api) GetDetails() (*swagger.User, *ApiError) {
 		}
 	}
 
-	data, r, err := self.UApi.UserGet(lookupId)
+	var data swagger.User
+	r, err := self.call(func(c *apiClients) (r *swagger.APIResponse, err error) {
+		data, r, err = c.UApi.UserGet(lookupId)
+		return
+	})
+	self.Metrics.observeCall("user_get", r, err)
 	if err != nil {
 		return nil, ApiErr(r, err)
 	}
@@ -130,7 +252,12 @@ func (self *Api) GetDetails() (*swagger.User, *ApiError) {
 }
 
 func (self *Api) GetUserDetails(user string) (*swagger.User, *ApiError) {
-	data, r, err := self.UApi.UserGet(user)
+	var data swagger.User
+	r, err := self.call(func(c *apiClients) (r *swagger.APIResponse, err error) {
+		data, r, err = c.UApi.UserGet(user)
+		return
+	})
+	self.Metrics.observeCall("user_get", r, err)
 	return &data, ApiErr(r, err)
 }
 
@@ -150,7 +277,11 @@ func DefaultConfigFile() (string, error) {
 
 func (self *Api) Info() string {
 	s := "Connection to: " + self.Config.BasePath
-	if self.Config.UserName != "" && self.Config.Password != "" {
+	if self.OAuth != nil {
+		s += " as " + self.Config.UserName + " (OAuth)"
+	} else if self.Config.DefaultHeader["Token"] != "" {
+		s += " as " + self.Config.UserName + " (API token)"
+	} else if self.Config.UserName != "" && self.Config.Password != "" {
 		s += " as " + self.Config.UserName
 	} else {
 		s += " (no credentials)"
@@ -159,7 +290,12 @@ func (self *Api) Info() string {
 }
 
 func (self *Api) UpdateWaitTime(game *swagger.Game, plyrId uint64, until time.Duration, message string) *ApiError {
-	_, resp, err := self.HApi.DeclareWait(plyrId, game.UrlShortName, self.announcer, until, message)
+	resp, err := self.call(func(c *apiClients) (r *swagger.APIResponse, err error) {
+		_, r, err = c.HApi.DeclareWait(plyrId, game.UrlShortName, self.announcer, until, message)
+		return
+	})
+	self.Metrics.observeCall("wait_declare", resp, err)
+	self.Metrics.observeAnnounce(game.UrlShortName, err)
 	return ApiErr(resp, err)
 }
 
@@ -169,7 +305,12 @@ func (self *Api) MakeUnregisteredUser( ip net.IP, port uint16 ) (*swagger.User,
 	if port == 0 {
 		port = 10800
 	}
-	delta, r, apiErr := self.UApi.UserCreate("", nick, ip, int(port))
+	var delta swagger.UserDelta
+	r, apiErr := self.call(func(c *apiClients) (r *swagger.APIResponse, err error) {
+		delta, r, err = c.UApi.UserCreate("", nick, ip, int(port))
+		return
+	})
+	self.Metrics.observeCall("user_create", r, apiErr)
 	if apiErr != nil {
 		return nil, ApiErr(r, fmt.Errorf("Unable to create new unknown user: '%s': %s", nick, apiErr.Error()))
 	}
@@ -206,7 +347,12 @@ func (self *Api) UpdateHostStatus(game *swagger.Game, info StatusUpdate) (*swagg
 	if op != nil {
 		sendData.OpponentId = op.Id
 	}
-	cresult, r, err := self.HApi.GamesGameIdHostHostIdPost(fmt.Sprintf("%d", game.Id), fmt.Sprintf("%d", info.HosterId), sendData)
+	var cresult *swagger.StatusCheckResult
+	r, err := self.call(func(c *apiClients) (r *swagger.APIResponse, err error) {
+		cresult, r, err = c.HApi.GamesGameIdHostHostIdPost(fmt.Sprintf("%d", game.Id), fmt.Sprintf("%d", info.HosterId), sendData)
+		return
+	})
+	self.Metrics.observeCall("host_status", r, err)
 	return cresult, ApiErr(r, err)
 }
 
@@ -214,7 +360,13 @@ func (self *Api) PostUserHost(game *swagger.Game, user *swagger.User, ip net.IP,
 	if self.Verbose {
 		self.log.Printf("Posting host for user: '%d' for game: '%s' on ip: '%s' port: '%d' in host list\n", user.Id, game.UrlShortName, ip.String(), port)
 	}
-	stat, r, err := self.HApi.DeclareHost(user.Id, game.UrlShortName, self.announcer, hostMessage, ip, int(port))
+	var stat *swagger.HosterStatus
+	r, err := self.call(func(c *apiClients) (r *swagger.APIResponse, err error) {
+		stat, r, err = c.HApi.DeclareHost(user.Id, game.UrlShortName, self.announcer, hostMessage, ip, int(port))
+		return
+	})
+	self.Metrics.observeCall("host_declare", r, err)
+	self.Metrics.observeAnnounce(game.UrlShortName, err)
 	return stat, ApiErr(r, err)
 }
 
@@ -272,7 +424,12 @@ func (self *Api) CheckListedHosts(game *swagger.Game, user *swagger.User) (*swag
 			self.log.Printf("Checking listed hosts for '%s'\n", game.UrlShortName)
 		}
 	}
-	list, r, err := self.HApi.GamesGameIdHostsGet(game.UrlShortName, "", nil, userName, nil)
+	var list *swagger.HostList
+	r, err := self.call(func(c *apiClients) (r *swagger.APIResponse, err error) {
+		list, r, err = c.HApi.GamesGameIdHostsGet(game.UrlShortName, "", nil, userName, nil)
+		return
+	})
+	self.Metrics.observeCall("host_list", r, err)
 	if self.Verbose {
 		if err != nil {
 			self.log.Println("Checking listed hosts failed with error: " + err.Error())
@@ -287,6 +444,10 @@ func (self *Api) CheckListedHosts(game *swagger.Game, user *swagger.User) (*swag
 // state - attempts to check who is playing, whether spectate is possible,
 //         spectate will only be determined if nobody is currently spectating
 // full - as above, but includes all current game info, if playing. Not currently supported.
+//
+// Only the check APIs can say whether others can reach the host, so their
+// error is returned if none answer; a local probe from here would go through
+// our own NAT and prove nothing (see CheckLocalHost for that).
 func (self *Api) CheckHosting(game *swagger.Game, user *swagger.User, check string, forcePort uint) (swagger.GameCheckResult, *ApiError) {
 	var lastErrResult swagger.GameCheckResult
 	if len(game.APIs) == 0 {
@@ -295,6 +456,40 @@ func (self *Api) CheckHosting(game *swagger.Game, user *swagger.User, check stri
 	if check == "" {
 		check = "basic"
 	}
+	hostPorts, apiErr := HostAddresses(game, user, forcePort)
+	if apiErr != nil {
+		return lastErrResult, apiErr
+	}
+	var lastErr *ApiError
+	for _, api := range game.APIs {
+		for _, hp := range hostPorts {
+			if self.Verbose {
+				self.log.Printf("Checking host status of: '%s'\n", hp)
+			}
+			result, err := self.ProbeAddress(api, hp, check)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			if result.Error != "" || result.Info.Status == "Unreachable" || result.Info.Status == "Unknown" {
+				lastErrResult = result
+				continue
+			}
+			self.Metrics.ObserveStatus(game.UrlShortName, result.Info.Status)
+			return result, nil
+		}
+
+	}
+	if lastErrResult.Request == "" {
+		return lastErrResult, lastErr
+	}
+	self.Metrics.ObserveStatus(game.UrlShortName, lastErrResult.Info.Status)
+	return lastErrResult, nil
+}
+
+// The "ip:port" addresses user hosts game on, v6 first, going by the IP
+// families the game's protocols use. forcePort overrides the user's port.
+func HostAddresses(game *swagger.Game, user *swagger.User, forcePort uint) ([]string, *ApiError) {
 	var ipv4, ipv6 net.IP
 	for _, proto := range game.Protocols {
 		l := len(proto)
@@ -322,7 +517,7 @@ func (self *Api) CheckHosting(game *swagger.Game, user *swagger.User, check stri
 		ips = append(ips, ipv4)
 	}
 	if len(ips) == 0 {
-		return lastErrResult, ApiErr(nil, fmt.Errorf("No IPs associated with user %s for game %s.\n", user.Nick, game.Name))
+		return nil, ApiErr(nil, fmt.Errorf("No IPs associated with user %s for game %s.\n", user.Nick, game.Name))
 	}
 	userPort := forcePort
 	if userPort == 0 {
@@ -332,57 +527,91 @@ func (self *Api) CheckHosting(game *swagger.Game, user *swagger.User, check stri
 		}
 	}
 	userPortStr := fmt.Sprintf("%d", userPort)
-	var lastErr *ApiError
-	for _, api := range game.APIs {
-		base_uri := api.Uri
-		if !strings.HasSuffix(base_uri, "/") {
-			base_uri += "/"
-		}
-		base_uri += "check/"
-		for _, ip := range ips {
-			hp := net.JoinHostPort(ip.String(), userPortStr)
-			uri := base_uri + hp
-			if self.Verbose {
-				self.log.Printf("Checking host status of: '%s'\n", hp)
-			}
+	out := make([]string, len(ips))
+	for i, ip := range ips {
+		out[i] = net.JoinHostPort(ip.String(), userPortStr)
+	}
+	return out, nil
+}
 
-			request := resty.New().R()
-			request.SetBasicAuth(self.Config.UserName, self.Config.Password)
-			request.SetQueryParam("level", check)
-			var result swagger.GameCheckResult
-			request.SetResult(&result)
-			response, err := request.Get(uri)
-			if err != nil {
-				lastErr = HttpErr(response.RawResponse, err)
-				if self.Verbose {
-					self.log.Println("Check failed: " + err.Error())
-				}
-				continue
-			}
+// Checks the game running on this machine by speaking its protocol rather
+// than asking a check API, so works offline. The result carries the public
+// address from HostAddresses, as a check API's would.
+func (self *Api) CheckLocalHost(game *swagger.Game, user *swagger.User, forcePort uint) (swagger.GameCheckResult, *ApiError) {
+	var result swagger.GameCheckResult
+	proto := probe.ForGame(game)
+	if proto == nil {
+		return result, ApiErr(nil, fmt.Errorf("No local probe for game %s.\n", game.Name))
+	}
+	hostPorts, apiErr := HostAddresses(game, user, forcePort)
+	if apiErr != nil {
+		return result, apiErr
+	}
+	_, port, _ := net.SplitHostPort(hostPorts[0])
+	local := net.JoinHostPort("127.0.0.1", port)
+	if self.Verbose {
+		self.log.Printf("Checking local host status of: '%s'\n", local)
+	}
+	info, err := proto.Check(local, "state")
+	if err != nil {
+		return result, ApiErr(nil, err)
+	}
+	info.Address = hostPorts[0]
+	result = swagger.GameCheckResult{Request: "local:" + proto.Name(), HostPort: hostPorts[0], Info: info}
+	self.Metrics.ObserveStatus(game.UrlShortName, info.Status)
+	return result, nil
+}
 
-			err = json.Unmarshal(response.Body(), &result)
-			if err != nil {
-				if self.Verbose {
-					self.log.Println("Host check did not produce valid JSON: " + err.Error())
-				}
-				return lastErrResult, HttpErr(response.RawResponse, err)
-			}
-			if !response.IsSuccess() || result.Error != "" ||
-				result.Info.Status == "Unreachable" || result.Info.Status == "Unknown" {
-				if self.Verbose {
-					self.log.Printf("Check returned status: %d and error: '%s'", response.StatusCode(), result.Error)
-				}
-				lastErrResult = result
-				continue
-			}
-			return result, nil
+// Asks a single checking API to probe hostPort (as "ip:port") at the given
+// check level. The result is returned with a nil error whenever the API gave
+// an answer, even if that answer was an error or an unreachable host.
+func (self *Api) ProbeAddress(entry swagger.APIEntry, hostPort, check string) (swagger.GameCheckResult, *ApiError) {
+	var result swagger.GameCheckResult
+	uri := entry.Uri
+	if !strings.HasSuffix(uri, "/") {
+		uri += "/"
+	}
+	uri += "check/" + hostPort
+	get := func() (*resty.Response, error) {
+		headers := self.Config.GenDefaultHeaders()
+		if err := self.setBearer(headers); err != nil {
+			return nil, err
 		}
-
+		request := resty.New().R()
+		request.SetHeaders(headers)
+		request.SetQueryParam("level", check)
+		request.SetResult(&result)
+		return request.Get(uri)
 	}
-	if lastErrResult.Request == "" {
-		return lastErrResult, lastErr
+	response, err := get()
+	if err == nil && self.unauthorized(swagger.NewAPIResponse(response.RawResponse)) {
+		response, err = get()
 	}
-	return lastErrResult, nil
+	if response != nil {
+		self.Metrics.observeCall("check", swagger.NewAPIResponse(response.RawResponse), err)
+	}
+	if err != nil {
+		if self.Verbose {
+			self.log.Println("Check failed: " + err.Error())
+		}
+		return result, HttpErr(response.RawResponse, err)
+	}
+	err = json.Unmarshal(response.Body(), &result)
+	if err != nil {
+		if self.Verbose {
+			self.log.Println("Host check did not produce valid JSON: " + err.Error())
+		}
+		return result, HttpErr(response.RawResponse, err)
+	}
+	if !response.IsSuccess() {
+		if self.Verbose {
+			self.log.Printf("Check returned status: %d and error: '%s'", response.StatusCode(), result.Error)
+		}
+		if result.Error == "" {
+			result.Error = response.Status()
+		}
+	}
+	return result, nil
 }
 
 func (self *Api) HostAsCheckInfo(host *swagger.Host) *swagger.GameCheckInfo {
@@ -2,31 +2,102 @@ package parvatigo
 
 import (
 	"fmt"
-	"github.com/misatosangel/gitconfig"
-	"math/rand"
+	"net"
 	"strings"
+	"time"
 )
 
 type ApiConfig struct {
-	URI       string              `gcKey:"parvati.uri" gcDefault:"https://parvati.phi.al"`
-	Username  string              `gcKey:"parvati.username"`
-	Password  string              `gcKey:"parvati.password"`
-	Announcer string              `gcKey:"parvati.announcer"`
-	Games     map[string]GameInfo `gcKey:"game"`
+	URI              string                   `gcKey:"parvati.uri" gcDefault:"https://parvati.phi.al" gcDesc:"Override the default URI for parvati's backend."`
+	Username         string                   `gcKey:"parvati.username" gcDesc:"This is your current username registered to parvati."`
+	Password         string                   `gcKey:"parvati.password" gcSecret:"true" gcDesc:"This is your password, previously registered via e.g. IRC/discord. Rather than keep it here, use the Login command to store it in your keyring or credential helper. If unset, the password is looked up from parvati.credentialHelper, then the Secret Service keyring (via secret-tool, from libsecret-tools), then ~/.netrc (or $NETRC) by the URI's host."`
+	Announcer        string                   `gcKey:"parvati.announcer" gcDesc:"Name to announce your hosts as, if not your username."`
+	CredentialHelper string                   `gcKey:"parvati.credentialHelper" gcDesc:"Program speaking git's credential helper protocol (get, store and erase). A bare NAME runs git-credential-NAME, so git's helpers work; a value starting with '!' is run by the shell."`
+	CredentialStore  string                   `gcKey:"parvati.credentialStore" gcDesc:"Where Login stores your password: 'helper' or 'keyring'. Defaults to the helper if one is set, else the keyring."`
+	AuthMethod       string                   `gcKey:"parvati.authMethod" gcDefault:"basic" gcDesc:"How to authenticate: 'basic' (username and password), 'token' (an API token from parvati.token) or 'oauth' (run Login once to authorize this device; tokens are then cached and refreshed automatically)."`
+	Token            string                   `gcKey:"parvati.token" gcSecret:"true" gcDesc:"API token used when parvati.authMethod is 'token'."`
+	OAuthClientID    string                   `gcKey:"parvati.oauthClientId" gcDesc:"OAuth client ID to use when parvati.authMethod is 'oauth'. Defaults to parvati-cli."`
+	OAuthDeviceURL   string                   `gcKey:"parvati.oauthDeviceUrl" gcDesc:"OAuth device authorization endpoint. Defaults to /oauth/device/code under parvati.uri."`
+	OAuthTokenURL    string                   `gcKey:"parvati.oauthTokenUrl" gcDesc:"OAuth token endpoint. Defaults to /oauth/token under parvati.uri."`
+	OAuthScope       string                   `gcKey:"parvati.oauthScope" gcDesc:"Scope to request when authorizing, if the server needs one."`
+	TokenCache       string                   `gcKey:"parvati.tokenCache" gcDesc:"File to cache OAuth tokens in. Defaults to parvati/tokens.json in your user cache directory (e.g. ~/.cache)."`
+	Games            map[string]GameInfo      `gcKey:"game" gcDesc:"Each [game \"NAME\"] section sets up hosting one game, named by its short name on Parvati (see ListKnownGames)."`
+	Watch            WatchConfig              `gcKey:"watch"`
+	Notify           NotifyConfig             `gcKey:"notify"`
+	PortMap          PortMapConfig            `gcKey:"portmap"`
+	DDNS             map[string]DDNSConfig    `gcKey:"ddns" gcDesc:"Each [ddns \"NAME\"] section keeps a DNS name pointing at the public IPs UpdateIP and HostWatch find, updating it when they change."`
+	DefaultProfile   string                   `gcKey:"parvati.profile" gcDesc:"Profile to use when neither --profile nor $PARVATI_PROFILE is given. See the profile section."`
+	Profiles         map[string]ProfileConfig `gcKey:"profile" gcInherits:"parvati" gcDesc:"Each [profile \"NAME\"] section is another account, used with --profile NAME or $PARVATI_PROFILE. It takes the same keys as the parvati section, and inherits any it does not set. A profile setting its own uri or username does not inherit the password or token. Use 'Profiles ls' to list them."`
+	// Which of the Credentials* sources the password came from
+	PasswordSource string
+	// Why sources were skipped while looking for the password
+	CredentialErrors []error
+	// The profile applied by UseProfile, if any
+	Profile string
+	base    *ProfileConfig
+	// The environment and flag settings applied over the file
+	Overrides []ConfigOverride
+}
+
+// Settings for HostWatch's local status API
+type WatchConfig struct {
+	APIListen string `gcKey:"apiListen" gcDesc:"Serve HostWatch's local status API on this localhost host:port."`
+	APIToken  string `gcKey:"apiToken" gcSecret:"true" gcDesc:"Token clients of the local status API must present, either as 'Authorization: Bearer TOKEN' or 'X-Parvati-Token: TOKEN'. Required to serve the status API."`
+	StateFile string `gcKey:"stateFile" gcDesc:"File HostWatch keeps each game's place in its host and wait messages in, to carry on from next time. Each profile's games are kept apart. Defaults to parvati/hostwatch.json in your user cache directory."`
 }
 
 type GameInfo struct {
-	Name            string `gcKey:"name"`
-	ConfigName      string
-	HostMessages    []string `gcKey:"hostMessage"`
-	WaitMessages    []string `gcKey:"waitMessage"`
-	HostOrder       string   `gcKey:"hostMessageOrder" default:"round-robin"`
-	WaitOrder       string   `gcKey:"waitMessageOrder" default:"round-robin"`
-	Port            uint     `gcKey:"watchPort" gcRequired:"false" gcDefault:"0"`
-	Enabled         bool     `gcKey:"enabled" gcDefault:"true"`
-	OnJoined        []string `gcKey:"onJoined" gcRequired:"false"`
-	lastHostMessage uint
-	lastWaitMessage uint
+	Name         string `gcKey:"name" gcDesc:"The game's short name on Parvati, if not NAME."`
+	ConfigName   string
+	HostMessages []string `gcKey:"hostMessage" gcDesc:"Host message to use for a game (can be repeated). Messages are Go templates that can use {{.Game}}, {{.ShortName}}, {{.Nick}}, {{.Region}} (your continent, e.g. Europe or Asia), {{.Uptime}} (of the host), {{.Played}} (games of it played this session), {{.TimeOfDay}} (morning, afternoon, evening or night) and {{.Time}}, e.g. 'Good {{.TimeOfDay}} from {{.Region}}!'. Bad templates are reported when the config is read."`
+	WaitMessages []string `gcKey:"waitMessage" gcDesc:"Message to use while waiting for an opponent (can be repeated). A template, as for hostMessage."`
+	HostOrder    string   `gcKey:"hostMessageOrder" gcDefault:"round-robin" gcDesc:"How to pick host messages: 'round-robin', 'random', 'weighted' (random, by hostMessageWeight), 'shuffle' (each once in a random order, then reshuffled), 'schedule' (in turn, from those whose hostMessageSchedule covers the time) or 'sticky' (one random message for the whole HostWatch run). Where HostWatch is up to is kept in watch.stateFile."`
+	WaitOrder    string   `gcKey:"waitMessageOrder" gcDefault:"round-robin" gcDesc:"How to pick wait messages, as for hostMessageOrder."`
+	HostWeights  []uint   `gcKey:"hostMessageWeight" gcDesc:"Weight of each host message in turn for the 'weighted' order (can be repeated). Messages without one weigh 1."`
+	WaitWeights  []uint   `gcKey:"waitMessageWeight" gcDesc:"Weight of each wait message in turn, as for hostMessageWeight."`
+	HostSchedule []string `gcKey:"hostMessageSchedule" gcDesc:"Time of day each host message in turn is used for the 'schedule' order, as HH:MM-HH:MM in local time, or '*' for any time (can be repeated). Messages without one are used at any time, and all are used if none are due."`
+	WaitSchedule []string `gcKey:"waitMessageSchedule" gcDesc:"Time of day each wait message in turn is used, as for hostMessageSchedule."`
+	Port         uint     `gcKey:"watchPort" gcRequired:"false" gcDefault:"0" gcDesc:"Override your online default port with this one to check for hosting. 0 uses your Parvati default."`
+	Enabled      bool     `gcKey:"enabled" gcDefault:"true" gcDesc:"Enable checking of the given game."`
+	OnJoined     []string `gcKey:"onJoined" gcRequired:"false" gcDesc:"If defined will attempt to call this program (with optional arguments) when your host is first joined. The first entry is the program to run, complete with path as required. Any extra strings are arguments to the program, one per entry in order. The following substitutions will be made before running to args:\n  ${NICK} - will be replaced by the opponent's Parvati NickName."`
+	Profiles     []string `gcKey:"profile" gcDesc:"Only use this game section with these profiles (can be repeated). It then replaces any section without a profile for the same game, so set game.NAME.name when NAME is not the game's own name."`
+	// the messages ready to pick from, by ParseMessages
+	host   messageList
+	wait   messageList
+	parsed bool
+}
+
+// Settings for the Notify command
+type NotifyConfig struct {
+	Friends []string `gcKey:"friend" gcDesc:"Nick or user id to be notified about when they host (can be repeated)."`
+	Games   []string `gcKey:"game" gcDesc:"Only watch these games (can be repeated). Defaults to all."`
+	Via     []string `gcKey:"via" gcDesc:"How to notify: 'dbus' (desktop notification), 'bell' (terminal) or 'command' (can be repeated). Defaults to 'bell'."`
+	Command []string `gcKey:"command" gcDesc:"Program and arguments run by the 'command' notifier, one per entry in order. The following substitutions are made to args:\n  ${NICK} ${GAME} ${TITLE} ${MESSAGE}"`
+}
+
+// Settings for asking the gateway to forward game ports while hosting
+type PortMapConfig struct {
+	Enabled   bool          `gcKey:"enabled" gcDefault:"false" gcDesc:"Ask your router to forward game ports while HostWatch runs, as with --map-ports."`
+	Methods   []string      `gcKey:"method" gcDesc:"Methods to try in order: 'pcp', 'natpmp' or 'upnp' (can be repeated). Defaults to all three in that order."`
+	Protocols []string      `gcKey:"protocol" gcDesc:"Protocols to forward: 'udp' and/or 'tcp'. Defaults to 'udp'."`
+	Lifetime  time.Duration `gcKey:"lifetime" gcDefault:"2h" gcDesc:"Lease time to ask for, e.g. '30m'. Leases are renewed at half their lifetime."`
+}
+
+// Settings for one dynamic DNS record kept pointing at our public IPs
+type DDNSConfig struct {
+	Protocol     string `gcKey:"protocol" gcDefault:"dyndns2" gcDesc:"'dyndns2' (DynDNS, No-IP and most HTTP providers) or 'rfc2136' (DNS UPDATE sent to your own nameserver)."`
+	Hostname     string `gcKey:"hostname" gcDesc:"Name to update. Defaults to NAME."`
+	Server       string `gcKey:"server" gcDesc:"For dyndns2 the provider's base URL, defaulting to https://members.dyndns.org. For rfc2136 the authoritative server as host[:port] (required)."`
+	Zone         string `gcKey:"zone" gcDesc:"rfc2136 zone to update. Defaults to hostname less its first label."`
+	TTL          uint   `gcKey:"ttl" gcDefault:"300" gcDesc:"rfc2136 record TTL in seconds."`
+	Username     string `gcKey:"username" gcDesc:"dyndns2 account username."`
+	Password     string `gcKey:"password" gcSecret:"true" gcDesc:"dyndns2 account password."`
+	KeyName      string `gcKey:"keyName" gcDesc:"Name of the TSIG key to sign rfc2136 updates with."`
+	KeyAlgorithm string `gcKey:"keyAlgorithm" gcDefault:"hmac-sha256" gcDesc:"TSIG algorithm: hmac-sha256, hmac-sha512, hmac-sha1 or hmac-md5."`
+	KeySecret    string `gcKey:"keySecret" gcSecret:"true" gcDesc:"TSIG secret, base64 as in a BIND key file."`
+	IPv4         bool   `gcKey:"ipv4" gcDefault:"true" gcDesc:"Publish your public IPv4 address."`
+	IPv6         bool   `gcKey:"ipv6" gcDefault:"true" gcDesc:"Publish your public IPv6 address."`
+	Enabled      bool   `gcKey:"enabled" gcDefault:"true" gcDesc:"Keep this name updated."`
 }
 
 func ReadDefaultConfig() (*ApiConfig, error) {
@@ -37,21 +108,91 @@ func ReadDefaultConfig() (*ApiConfig, error) {
 	return ReadConfig(path)
 }
 
+// Reads the config file, with any environment variables applied over it.
 func ReadConfig(file string) (*ApiConfig, error) {
-	conf, err := gitconfig.NewConfigFromFile(file)
+	return ReadConfigWith(file, nil)
+}
+
+// Reads the config file, with any environment variables and then the
+// command line's overrides applied over it. A missing file is an error
+// unless they set something.
+func ReadConfigWith(file string, flags []ConfigOverride) (*ApiConfig, error) {
+	conf, applied, err := ReadGitConfig(file, ConfigKeys(&ApiConfig{}), flags)
 	if err != nil {
 		return nil, err
 	}
-	var apiConfig ApiConfig
-	err = conf.Load(&apiConfig)
-	return &apiConfig, err
+	apiConfig := ApiConfig{Overrides: applied}
+	if err = conf.Load(&apiConfig); err != nil {
+		return &apiConfig, err
+	}
+	return &apiConfig, apiConfig.ParseMessages()
+}
+
+// Checks values the config file syntax allows but the client does not,
+// returning every problem found.
+func (self *ApiConfig) Validate() []error {
+	errs := make([]error, 0)
+	switch self.AuthMethod {
+	case "", AuthBasic, AuthToken, AuthOAuth:
+	default:
+		errs = append(errs, fmt.Errorf("Unknown parvati.authMethod '%s' (use %s, %s or %s)\n", self.AuthMethod, AuthBasic, AuthToken, AuthOAuth))
+	}
+	switch self.CredentialStore {
+	case "", CredentialsHelper, CredentialsKeyring:
+	default:
+		errs = append(errs, fmt.Errorf("Unknown parvati.credentialStore '%s' (use %s or %s)\n", self.CredentialStore, CredentialsHelper, CredentialsKeyring))
+	}
+	if _, ok := self.Profiles[self.DefaultProfile]; self.DefaultProfile != "" && !ok {
+		errs = append(errs, fmt.Errorf("parvati.profile is '%s', but there is no such profile\n", self.DefaultProfile))
+	}
+	if self.Watch.APIListen != "" {
+		if _, _, err := net.SplitHostPort(self.Watch.APIListen); err != nil {
+			errs = append(errs, fmt.Errorf("Bad watch.apiListen '%s': %s\n", self.Watch.APIListen, err.Error()))
+		}
+	}
+	for name, g := range self.Games {
+		if err := g.parseMessages(name); err != nil {
+			errs = append(errs, err)
+		}
+		if g.Port > 65535 {
+			errs = append(errs, fmt.Errorf("game.%s.watchPort %d is not a port number\n", name, g.Port))
+		}
+		for _, p := range g.Profiles {
+			if _, ok := self.Profiles[p]; !ok {
+				errs = append(errs, fmt.Errorf("game.%s.profile is '%s', but there is no such profile\n", name, p))
+			}
+		}
+	}
+	return errs
 }
 
 // return a list of games with enabled flags overridden by
 // the lists passed in. Only enabled games will be returned.
+// Games scoped to the active profile replace unscoped ones of the same name.
 func (self *ApiConfig) GetEnabledGames(enable, disable []string) []GameInfo {
 	out := make([]GameInfo, 0, len(self.Games))
+	scoped := make(map[string]bool)
+	for n, g := range self.Games {
+		if len(g.Profiles) != 0 && self.inProfile(&g) {
+			if g.Name == "" {
+				g.Name = n
+			}
+			scoped[strings.ToLower(g.Name)] = true
+		}
+	}
 	for n, g := range self.Games {
+		if !self.inProfile(&g) {
+			continue
+		}
+		if len(g.Profiles) == 0 {
+			name := g.Name
+			if name == "" {
+				name = n
+			}
+			if scoped[strings.ToLower(name)] {
+				continue
+			}
+		}
 		if disable != nil {
 			shouldDisable := false
 			for _, x := range disable {
@@ -85,40 +226,31 @@ func (self *ApiConfig) GetEnabledGames(enable, disable []string) []GameInfo {
 	return out
 }
 
-func (self *GameInfo) HostMessage() string {
-	max := uint(len(self.HostMessages))
-	if max == 0 {
-		return ""
-	}
-	if self.HostOrder == "round-robin" {
-		last := self.lastHostMessage
-		if last >= max {
-			last = 0
-		}
-		m := self.HostMessages[last]
-		self.lastHostMessage = last + 1
-		return m
-	}
-	self.lastHostMessage = uint(rand.Int31n(int32(max)))
-	return self.HostMessages[self.lastHostMessage]
+// The next host message, expanded with vars.
+func (self *GameInfo) HostMessage(vars *MessageVars) string {
+	self.ensureParsed()
+	return self.host.next(vars)
 }
 
-func (self *GameInfo) WaitMessage() string {
-	max := uint(len(self.WaitMessages))
-	if max == 0 {
-		return ""
-	}
-	if self.WaitOrder == "round-robin" {
-		last := self.lastWaitMessage
-		if last >= max {
-			last = 0
-		}
-		m := self.WaitMessages[last]
-		self.lastWaitMessage = last + 1
-		return m
-	}
-	self.lastWaitMessage = uint(rand.Int31n(int32(max)))
-	return self.WaitMessages[self.lastWaitMessage]
+// The next wait message, expanded with vars.
+func (self *GameInfo) WaitMessage(vars *MessageVars) string {
+	self.ensureParsed()
+	return self.wait.next(vars)
+}
+
+// Where picking the host and wait messages is up to, to carry on from in
+// the next run.
+func (self *GameInfo) Rotations() (MessageRotation, MessageRotation) {
+	self.ensureParsed()
+	return self.host.rotation, self.wait.rotation
+}
+
+// Carries on from saved rotations, unless the messages or their order have
+// changed since.
+func (self *GameInfo) RestoreRotations(host, wait MessageRotation) {
+	self.ensureParsed()
+	self.host.restore(host)
+	self.wait.restore(wait)
 }
 
 func (self *GameInfo) PrettyName() string {
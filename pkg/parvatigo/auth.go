@@ -0,0 +1,486 @@
+package parvatigo
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Values for parvati.authMethod
+const (
+	AuthBasic = "basic"
+	AuthToken = "token"
+	AuthOAuth = "oauth"
+)
+
+// Checks the config has what its auth method needs, saying how to fix it if
+// not. Call after LoadCredentials.
+func (self *ApiConfig) CheckAuth() error {
+	switch self.AuthMethod {
+	case "", AuthBasic:
+		if self.Password == "" {
+			msg := "No password found in parvati.password, parvati.credentialHelper, your keyring or ~/.netrc\n"
+			for _, err := range self.CredentialErrors {
+				msg += " - " + strings.TrimSpace(err.Error()) + "\n"
+			}
+			return fmt.Errorf("%sUse the Login command to store one.\n", msg)
+		}
+	case AuthToken:
+		if self.Token == "" {
+			return fmt.Errorf("parvati.authMethod is token, but no parvati.token is set\n")
+		}
+	case AuthOAuth:
+		tok, err := self.OAuth().Token()
+		if err != nil {
+			return err
+		}
+		if tok == nil {
+			return fmt.Errorf("This device is not authorized yet; use the Login command to do so.\n")
+		}
+	default:
+		return fmt.Errorf("Unknown parvati.authMethod '%s' (use %s, %s or %s)\n", self.AuthMethod, AuthBasic, AuthToken, AuthOAuth)
+	}
+	return nil
+}
+
+// An OAuth2 access token, as cached on disk.
+type OAuthToken struct {
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token,omitempty"`
+	TokenType    string    `json:"token_type,omitempty"`
+	Expiry       time.Time `json:"expiry,omitempty"`
+}
+
+// Whether the token can still be used, allowing for clock skew.
+func (self *OAuthToken) Valid() bool {
+	return self != nil && self.AccessToken != "" && (self.Expiry.IsZero() || time.Now().Add(30*time.Second).Before(self.Expiry))
+}
+
+// The device authorization response (RFC 8628) to show the user.
+type DeviceCode struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	RefreshToken     string `json:"refresh_token"`
+	TokenType        string `json:"token_type"`
+	ExpiresIn        int    `json:"expires_in"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// An OAuth2 client using the device flow to log in, which suits a CLI, and
+// refresh tokens after that. Tokens are cached on disk between runs.
+type OAuth struct {
+	ClientID  string
+	DeviceURL string
+	TokenURL  string
+	Scope     string
+	// JSON file holding tokens, shared by all servers and clients
+	CacheFile string
+	// Keeps the tokens of different profiles apart in the cache
+	Profile string
+	// Defaults to one giving up after tokenTimeout
+	Client *http.Client
+	mu     sync.Mutex
+	token  *OAuthToken
+}
+
+// How long token requests may take with the default client.
+const tokenTimeout = 30 * time.Second
+
+var tokenClient = &http.Client{Timeout: tokenTimeout}
+
+// Held while refreshing, one per cached token, as ApiConfig.OAuth gives
+// each caller its own OAuth.
+var refreshLocks sync.Map
+
+func (self *OAuth) refreshLock() *sync.Mutex {
+	l, _ := refreshLocks.LoadOrStore(self.CacheFile+"\x00"+self.cacheKey(), &sync.Mutex{})
+	return l.(*sync.Mutex)
+}
+
+// The OAuth client for this config. Endpoints default to /oauth/device/code
+// and /oauth/token on the server.
+func (self *ApiConfig) OAuth() *OAuth {
+	base := strings.TrimSuffix(self.URI, "/")
+	if base == "" {
+		base = defUri
+	}
+	o := &OAuth{
+		ClientID:  self.OAuthClientID,
+		DeviceURL: self.OAuthDeviceURL,
+		TokenURL:  self.OAuthTokenURL,
+		Scope:     self.OAuthScope,
+		CacheFile: self.TokenCache,
+		Profile:   self.Profile,
+	}
+	if o.ClientID == "" {
+		o.ClientID = "parvati-cli"
+	}
+	if o.DeviceURL == "" {
+		o.DeviceURL = base + "/oauth/device/code"
+	}
+	if o.TokenURL == "" {
+		o.TokenURL = base + "/oauth/token"
+	}
+	if o.CacheFile == "" {
+		o.CacheFile, _ = DefaultTokenCache()
+	}
+	return o
+}
+
+// ~/.cache/parvati/tokens.json or the OS's equivalent.
+func DefaultTokenCache() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "parvati", "tokens.json"), nil
+}
+
+// Tokens are cached per client, token endpoint and profile.
+func (self *OAuth) cacheKey() string {
+	key := self.ClientID + " " + self.TokenURL
+	if self.Profile != "" {
+		key += " " + self.Profile
+	}
+	return key
+}
+
+func (self *OAuth) readCache() (map[string]*OAuthToken, error) {
+	out := make(map[string]*OAuthToken)
+	if self.CacheFile == "" {
+		return out, nil
+	}
+	data, err := ioutil.ReadFile(self.CacheFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return out, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, fmt.Errorf("Bad token cache '%s': %s\n", self.CacheFile, err.Error())
+	}
+	return out, nil
+}
+
+// Stores tok (or removes the entry if nil), readable only by us.
+func (self *OAuth) writeCache(tok *OAuthToken) error {
+	if self.CacheFile == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(self.CacheFile), 0700); err != nil {
+		return err
+	}
+	unlock, err := self.lockCache()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	all, err := self.readCache()
+	if err != nil {
+		all = make(map[string]*OAuthToken)
+	}
+	if tok == nil {
+		delete(all, self.cacheKey())
+	} else {
+		all[self.cacheKey()] = tok
+	}
+	data, err := json.MarshalIndent(all, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(self.CacheFile), filepath.Base(self.CacheFile)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), self.CacheFile)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// How long to wait for another process to finish writing the cache, and
+// after which its lock is taken to have been left behind.
+const cacheLockWait = 10 * time.Second
+
+// Takes the lock file beside the cache, so other processes writing it
+// don't lose our tokens or we theirs. Call the returned func to release it.
+func (self *OAuth) lockCache() (func(), error) {
+	lock := self.CacheFile + ".lock"
+	deadline := time.Now().Add(cacheLockWait)
+	for {
+		f, err := os.OpenFile(lock, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(lock) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if fi, err := os.Stat(lock); err == nil && time.Since(fi.ModTime()) > cacheLockWait {
+			os.Remove(lock)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("Token cache '%s' is locked; remove '%s' if nothing else is running.\n", self.CacheFile, lock)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// A usable token from memory or the cache, refreshing it if it has expired.
+// A nil token means we need to log in.
+func (self *OAuth) Token() (*OAuthToken, error) {
+	tok, err := self.current()
+	if err != nil || tok == nil {
+		return nil, err
+	}
+	if tok.Valid() {
+		return tok, nil
+	}
+	if tok.RefreshToken == "" {
+		return nil, nil
+	}
+	return self.refresh(tok)
+}
+
+// Swaps the refresh token for a new access token, as the current one was
+// rejected.
+func (self *OAuth) Refresh() (*OAuthToken, error) {
+	tok, err := self.current()
+	if err != nil {
+		return nil, err
+	}
+	return self.refresh(tok)
+}
+
+// The token in memory, else the cached one.
+func (self *OAuth) current() (*OAuthToken, error) {
+	self.mu.Lock()
+	tok := self.token
+	self.mu.Unlock()
+	if tok != nil {
+		return tok, nil
+	}
+	tok, err := self.latest()
+	if tok == nil || err != nil {
+		return nil, err
+	}
+	self.mu.Lock()
+	self.token = tok
+	self.mu.Unlock()
+	return tok, nil
+}
+
+// The token as last saved by anyone: the cached one, or the one in memory
+// without a cache.
+func (self *OAuth) latest() (*OAuthToken, error) {
+	if self.CacheFile == "" {
+		self.mu.Lock()
+		defer self.mu.Unlock()
+		return self.token, nil
+	}
+	all, err := self.readCache()
+	if err != nil {
+		return nil, err
+	}
+	return all[self.cacheKey()], nil
+}
+
+// Refreshes rejected. Refresh tokens may only be usable once, so refreshes
+// in this process are done one at a time, and one already done by another
+// caller or process is used rather than trying the old refresh token again.
+func (self *OAuth) refresh(rejected *OAuthToken) (*OAuthToken, error) {
+	lock := self.refreshLock()
+	lock.Lock()
+	defer lock.Unlock()
+	if tok := self.replaced(rejected); tok != nil {
+		return tok, nil
+	}
+	if rejected == nil || rejected.RefreshToken == "" {
+		return nil, fmt.Errorf("No refresh token; use the Login command to authorize again.\n")
+	}
+	resp, err := self.post(self.TokenURL, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {rejected.RefreshToken},
+		"client_id":     {self.ClientID},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		if resp.Error == "invalid_grant" {
+			// another process may have just used it
+			if tok := self.replaced(rejected); tok != nil {
+				return tok, nil
+			}
+			// the refresh token is dead, so don't keep trying it
+			if tok, err := self.latest(); err == nil && (tok == nil || tok.same(rejected)) {
+				self.Forget()
+			}
+		}
+		return nil, fmt.Errorf("Token refresh failed: %s\n", resp.describe())
+	}
+	if resp.RefreshToken == "" {
+		resp.RefreshToken = rejected.RefreshToken
+	}
+	return self.save(resp)
+}
+
+// The latest token if it is usable and not rejected, which is then used.
+func (self *OAuth) replaced(rejected *OAuthToken) *OAuthToken {
+	tok, err := self.latest()
+	if err != nil || !tok.Valid() || tok.same(rejected) {
+		return nil
+	}
+	self.mu.Lock()
+	self.token = tok
+	self.mu.Unlock()
+	return tok
+}
+
+func (self *OAuthToken) same(other *OAuthToken) bool {
+	if self == nil || other == nil {
+		return self == other
+	}
+	return self.AccessToken == other.AccessToken && self.RefreshToken == other.RefreshToken
+}
+
+// Runs the device flow: show is given the code for the user to enter at the
+// verification URI, then the token endpoint is polled until they do.
+func (self *OAuth) DeviceLogin(show func(*DeviceCode)) (*OAuthToken, error) {
+	form := url.Values{"client_id": {self.ClientID}}
+	if self.Scope != "" {
+		form.Set("scope", self.Scope)
+	}
+	var code DeviceCode
+	if err := self.postJSON(self.DeviceURL, form, &code); err != nil {
+		return nil, err
+	}
+	if code.DeviceCode == "" || code.UserCode == "" {
+		return nil, fmt.Errorf("Device authorization at %s gave no code\n", self.DeviceURL)
+	}
+	show(&code)
+	interval := time.Duration(code.Interval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	expires := time.Duration(code.ExpiresIn) * time.Second
+	if expires <= 0 {
+		expires = 10 * time.Minute
+	}
+	deadline := time.Now().Add(expires)
+	for time.Now().Before(deadline) {
+		time.Sleep(interval)
+		resp, err := self.post(self.TokenURL, url.Values{
+			"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+			"device_code": {code.DeviceCode},
+			"client_id":   {self.ClientID},
+		})
+		if err != nil {
+			return nil, err
+		}
+		switch resp.Error {
+		case "":
+			return self.save(resp)
+		case "authorization_pending":
+		case "slow_down":
+			interval += 5 * time.Second
+		default:
+			return nil, fmt.Errorf("Authorization failed: %s\n", resp.describe())
+		}
+	}
+	return nil, fmt.Errorf("Authorization timed out; use the Login command to try again.\n")
+}
+
+// Drops the cached token.
+func (self *OAuth) Forget() error {
+	self.mu.Lock()
+	self.token = nil
+	self.mu.Unlock()
+	return self.writeCache(nil)
+}
+
+func (self *OAuth) save(resp *tokenResponse) (*OAuthToken, error) {
+	if resp.AccessToken == "" {
+		return nil, fmt.Errorf("Token endpoint %s gave no access token\n", self.TokenURL)
+	}
+	tok := &OAuthToken{AccessToken: resp.AccessToken, RefreshToken: resp.RefreshToken, TokenType: resp.TokenType}
+	if resp.ExpiresIn > 0 {
+		tok.Expiry = time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second)
+	}
+	self.mu.Lock()
+	self.token = tok
+	self.mu.Unlock()
+	return tok, self.writeCache(tok)
+}
+
+// Posts a token request. OAuth errors come back as 400s with a JSON body,
+// so those are returned in the response rather than as errors.
+func (self *OAuth) post(uri string, form url.Values) (*tokenResponse, error) {
+	var resp tokenResponse
+	if err := self.postJSON(uri, form, &resp); err != nil && resp.Error == "" {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (self *OAuth) postJSON(uri string, form url.Values, out interface{}) error {
+	client := self.Client
+	if client == nil {
+		client = tokenClient
+	}
+	req, err := http.NewRequest("POST", uri, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	jsonErr := json.Unmarshal(body, out)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s returned %s\n", uri, resp.Status)
+	}
+	if jsonErr != nil {
+		return fmt.Errorf("%s did not give valid JSON: %s\n", uri, jsonErr.Error())
+	}
+	return nil
+}
+
+func (self *tokenResponse) describe() string {
+	if self.ErrorDescription != "" {
+		return self.Error + ": " + self.ErrorDescription
+	}
+	return self.Error
+}
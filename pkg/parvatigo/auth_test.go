@@ -0,0 +1,263 @@
+package parvatigo
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A server with OAuth endpoints and a /users endpoint wanting a bearer token.
+type fakeOAuthServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	polls    int
+	access   string
+	refreshs int
+	// with rotate, each refresh token works once and is replaced
+	rotate  bool
+	refresh string
+}
+
+func newFakeOAuthServer() *fakeOAuthServer {
+	s := &fakeOAuthServer{access: "first", refresh: "r1"}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+func (self *fakeOAuthServer) serve(w http.ResponseWriter, r *http.Request) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	r.ParseForm()
+	switch r.URL.Path {
+	case "/oauth/device/code":
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"device_code": "dev", "user_code": "ABCD-EFGH",
+			"verification_uri": self.URL + "/device", "expires_in": 30, "interval": 1,
+		})
+	case "/oauth/token":
+		switch r.Form.Get("grant_type") {
+		case "urn:ietf:params:oauth:grant-type:device_code":
+			self.polls++
+			if self.polls == 1 {
+				w.WriteHeader(400)
+				w.Write([]byte(`{"error":"authorization_pending"}`))
+				return
+			}
+			w.Write([]byte(`{"access_token":"first","refresh_token":"r1","token_type":"Bearer","expires_in":3600}`))
+		case "refresh_token":
+			if r.Form.Get("refresh_token") != self.refresh {
+				w.WriteHeader(400)
+				w.Write([]byte(`{"error":"invalid_grant"}`))
+				return
+			}
+			self.refreshs++
+			if !self.rotate {
+				w.Write([]byte(`{"access_token":"second","token_type":"Bearer","expires_in":3600}`))
+				return
+			}
+			self.refresh = fmt.Sprintf("r%d", self.refreshs+1)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"access_token": "second", "refresh_token": self.refresh, "token_type": "Bearer", "expires_in": 3600,
+			})
+		}
+	case "/users":
+		if r.Header.Get("Authorization") != "Bearer "+self.access {
+			w.WriteHeader(401)
+			return
+		}
+		w.Write([]byte(`{"nick":"alice"}`))
+	default:
+		w.WriteHeader(404)
+	}
+}
+
+func TestOAuthDeviceLogin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	srv := newFakeOAuthServer()
+	defer srv.Close()
+	conf := &ApiConfig{URI: srv.URL, AuthMethod: AuthOAuth, TokenCache: filepath.Join(dir, "tokens.json")}
+	if err := conf.CheckAuth(); err == nil {
+		t.Errorf("Expected an unauthorized device to fail CheckAuth")
+	}
+
+	shown := ""
+	tok, err := conf.OAuth().DeviceLogin(func(code *DeviceCode) { shown = code.UserCode })
+	if err != nil {
+		t.Fatalf("DeviceLogin failed: %s", err.Error())
+	}
+	if shown != "ABCD-EFGH" || tok.AccessToken != "first" || tok.RefreshToken != "r1" || !tok.Valid() {
+		t.Errorf("Unexpected login: code %s token %+v", shown, tok)
+	}
+	if fi, err := os.Stat(conf.TokenCache); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("Token cache missing or readable by others: %v %v", fi, err)
+	}
+	if err := conf.CheckAuth(); err != nil {
+		t.Errorf("Cached token not found: %s", err.Error())
+	}
+	if err := conf.OAuth().Forget(); err != nil {
+		t.Errorf("Forget failed: %s", err.Error())
+	}
+	if tok, _ := conf.OAuth().Token(); tok != nil {
+		t.Errorf("Token still cached after Forget: %+v", tok)
+	}
+}
+
+func TestOAuthRefresh(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	srv := newFakeOAuthServer()
+	defer srv.Close()
+	conf := &ApiConfig{URI: srv.URL, AuthMethod: AuthOAuth, TokenCache: filepath.Join(dir, "tokens.json")}
+
+	// an expired token is refreshed before use
+	expired := conf.OAuth()
+	expired.save(&tokenResponse{AccessToken: "first", RefreshToken: "r1"})
+	expired.token.Expiry = time.Now().Add(-time.Minute)
+	expired.writeCache(expired.token)
+	tok, err := conf.OAuth().Token()
+	if err != nil || tok == nil || tok.AccessToken != "second" || tok.RefreshToken != "r1" {
+		t.Errorf("Expected refreshed token, got %+v (%v)", tok, err)
+	}
+
+	// a revoked token is refreshed on a 401 and the call retried
+	conf.OAuth().save(&tokenResponse{AccessToken: "first", RefreshToken: "r1", ExpiresIn: 3600})
+	srv.mu.Lock()
+	srv.access = "second"
+	srv.refreshs = 0
+	srv.mu.Unlock()
+	api, err := NewApi(conf, "test")
+	if err != nil {
+		t.Fatalf("NewApi failed: %s", err.Error())
+	}
+	user, apiErr := api.GetUserDetails("alice")
+	if apiErr != nil || user.Nick != "alice" {
+		t.Errorf("Expected call to succeed after refresh, got %+v (%v)", user, apiErr)
+	}
+	if srv.refreshs != 1 {
+		t.Errorf("Expected one refresh, got %d", srv.refreshs)
+	}
+}
+
+func TestOAuthConcurrentRefresh(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	srv := newFakeOAuthServer()
+	defer srv.Close()
+	srv.rotate = true
+	conf := &ApiConfig{URI: srv.URL, AuthMethod: AuthOAuth, TokenCache: filepath.Join(dir, "tokens.json")}
+	conf.OAuth().save(&tokenResponse{AccessToken: "first", RefreshToken: "r1", ExpiresIn: 3600})
+
+	// callers of one client, and of another for the same token, all had
+	// it rejected
+	shared, other := conf.OAuth(), conf.OAuth()
+	shared.Token()
+	other.Token()
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		o := shared
+		if i%2 == 1 {
+			o = other
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if tok, err := o.Refresh(); err != nil || tok.AccessToken != "second" {
+				errs <- fmt.Errorf("Refresh gave %+v (%v)", tok, err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if srv.refreshs != 1 {
+		t.Errorf("Expected one refresh, got %d", srv.refreshs)
+	}
+	if tok, err := conf.OAuth().Token(); err != nil || tok == nil || tok.RefreshToken != "r2" {
+		t.Errorf("Expected the rotated token to stay cached, got %+v (%v)", tok, err)
+	}
+
+	// a client still holding the old token does not forget the new one
+	stale := conf.OAuth()
+	stale.token = &OAuthToken{AccessToken: "first", RefreshToken: "r1"}
+	if tok, err := stale.Refresh(); err != nil || tok.RefreshToken != "r2" {
+		t.Errorf("Expected the newer cached token, got %+v (%v)", tok, err)
+	}
+
+	// a dead refresh token that is still the cached one is forgotten
+	srv.mu.Lock()
+	srv.refresh = "elsewhere"
+	srv.mu.Unlock()
+	if _, err := conf.OAuth().Refresh(); err == nil {
+		t.Errorf("Expected refreshing a revoked token to fail")
+	}
+	if tok, _ := conf.OAuth().Token(); tok != nil {
+		t.Errorf("Expected the revoked token to be forgotten, got %+v", tok)
+	}
+}
+
+func TestTokenCacheConcurrentWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache := filepath.Join(dir, "tokens.json")
+
+	// writers for different profiles each keep their own token
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		o := &OAuth{ClientID: "c", TokenURL: "t", CacheFile: cache, Profile: fmt.Sprintf("p%d", i)}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := o.writeCache(&OAuthToken{AccessToken: o.Profile}); err != nil {
+				t.Errorf("writeCache failed: %s", err.Error())
+			}
+		}()
+	}
+	wg.Wait()
+	all, err := (&OAuth{CacheFile: cache}).readCache()
+	if err != nil || len(all) != 8 {
+		t.Errorf("Expected 8 cached tokens, got %d (%v)", len(all), err)
+	}
+	if left, _ := filepath.Glob(filepath.Join(dir, "tokens.json.*")); len(left) != 0 {
+		t.Errorf("Lock or temporary files left behind: %v", left)
+	}
+}
+
+func TestTokenAuth(t *testing.T) {
+	conf := &ApiConfig{URI: "https://parvati.example.com", Username: "alice", Password: "secret", AuthMethod: AuthToken, Token: "t0ken"}
+	api, err := NewApi(conf, "test")
+	if err != nil {
+		t.Fatalf("NewApi failed: %s", err.Error())
+	}
+	headers := api.Config.GenDefaultHeaders()
+	if headers["Token"] != "t0ken" || headers["Authorization"] != "" {
+		t.Errorf("Unexpected auth headers: %v", headers)
+	}
+	conf.AuthMethod = "cookie"
+	if _, err := NewApi(conf, "test"); err == nil {
+		t.Errorf("Expected unknown auth method to fail")
+	}
+}
@@ -0,0 +1,312 @@
+package parvatigo
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/misatosangel/gitconfig"
+)
+
+// A config file edited in place, as git config does: only the lines for
+// the keys changed are touched, so comments and layout are kept.
+type ConfigFile struct {
+	Path  string
+	lines []string
+	mode  os.FileMode
+}
+
+// One section header or key = value entry, which may span several lines.
+type configLine struct {
+	section string // lower case
+	sub     string
+	key     string // lower case, empty for a header
+	start   int
+	end     int // last line, for values continued with '\'
+	// the header, for a key on the same line as it
+	header string
+}
+
+// Reads the file, which need not exist yet.
+func OpenConfigFile(path string) (*ConfigFile, error) {
+	self := &ConfigFile{Path: path, mode: 0600}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return self, nil
+		}
+		return nil, err
+	}
+	if fi, err := os.Stat(path); err == nil {
+		self.mode = fi.Mode().Perm()
+	}
+	text := strings.TrimSuffix(strings.Replace(string(data), "\r\n", "\n", -1), "\n")
+	if text != "" {
+		self.lines = strings.Split(text, "\n")
+	}
+	return self, nil
+}
+
+func (self *ConfigFile) String() string {
+	if len(self.lines) == 0 {
+		return ""
+	}
+	return strings.Join(self.lines, "\n") + "\n"
+}
+
+// Parses the current contents.
+func (self *ConfigFile) Parse() (*gitconfig.Config, error) {
+	return gitconfig.NewConfigFromString(self.String())
+}
+
+// Loads the current contents into an ApiConfig, as ReadConfig does.
+func (self *ConfigFile) Load() (*ApiConfig, error) {
+	conf, err := self.Parse()
+	if err != nil {
+		return nil, err
+	}
+	var apiConfig ApiConfig
+	err = conf.Load(&apiConfig)
+	return &apiConfig, err
+}
+
+// Writes the file back, keeping its permissions.
+func (self *ConfigFile) Save() error {
+	if err := os.MkdirAll(filepath.Dir(self.Path), 0700); err != nil {
+		return err
+	}
+	tmp := self.Path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(self.String()), self.mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp, self.Path)
+}
+
+// The values of a key, in file order. Nil if it is not set.
+func (self *ConfigFile) Get(name string) ([]string, error) {
+	conf, err := self.Parse()
+	if err != nil {
+		return nil, err
+	}
+	return conf.GetKeyValuesStrings(name), nil
+}
+
+// The names of all keys set, as section[.subsection].key in file order,
+// each name once, with the line it is first set on.
+func (self *ConfigFile) Keys() ([]string, []int) {
+	names := make([]string, 0, len(self.lines))
+	lines := make([]int, 0, len(self.lines))
+	seen := make(map[string]bool)
+	for _, e := range self.scan() {
+		if e.key == "" {
+			continue
+		}
+		name := e.section + "." + e.key
+		if e.sub != "" {
+			name = e.section + "." + e.sub + "." + e.key
+		}
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+		lines = append(lines, e.start+1)
+	}
+	return names, lines
+}
+
+// Replaces all values of the key with one, adding it (and its section) if
+// it is not set.
+func (self *ConfigFile) Set(name, value string) error {
+	matches, err := self.find(name)
+	if err != nil {
+		return err
+	}
+	if len(matches) == 0 {
+		return self.Add(name, value)
+	}
+	self.replaceEntry(matches[len(matches)-1], self.keyLine(name, value))
+	for i := len(matches) - 2; i >= 0; i-- {
+		self.replaceEntry(matches[i])
+	}
+	return nil
+}
+
+// Adds another value for a multi-valued key, after any it already has.
+func (self *ConfigFile) Add(name, value string) error {
+	matches, err := self.find(name)
+	if err != nil {
+		return err
+	}
+	line := self.keyLine(name, value)
+	if len(matches) != 0 {
+		self.insert(matches[len(matches)-1].end+1, line)
+		return nil
+	}
+	// after the last entry in the section, before any trailing comments
+	s, ss, _ := gitconfig.ParseSectionKey(name)
+	at := -1
+	for _, e := range self.scan() {
+		if e.section == s && e.sub == ss {
+			at = e.end + 1
+		}
+	}
+	if at >= 0 {
+		self.insert(at, line)
+		return nil
+	}
+	self.lines = append(self.lines, sectionHeader(name), line)
+	return nil
+}
+
+// Adds lines, such as comments or whole sections, to the end of the file.
+func (self *ConfigFile) Append(lines ...string) {
+	self.lines = append(self.lines, lines...)
+}
+
+// Removes every value of the key, returning how many there were.
+func (self *ConfigFile) Unset(name string) (int, error) {
+	matches, err := self.find(name)
+	if err != nil {
+		return 0, err
+	}
+	for i := len(matches) - 1; i >= 0; i-- {
+		self.replaceEntry(matches[i])
+	}
+	return len(matches), nil
+}
+
+func (self *ConfigFile) find(name string) ([]configLine, error) {
+	s, ss, k := gitconfig.ParseSectionKey(name)
+	if s == "" || k == "" {
+		return nil, fmt.Errorf("Bad key '%s': use section.key or section.subsection.key\n", name)
+	}
+	out := make([]configLine, 0, 2)
+	for _, e := range self.scan() {
+		if e.key == k && e.section == s && e.sub == ss {
+			out = append(out, e)
+		}
+	}
+	return out, nil
+}
+
+// Replaces lines start to end (inclusive) with the given lines.
+func (self *ConfigFile) replace(start, end int, with ...string) {
+	out := make([]string, 0, len(self.lines)+len(with))
+	out = append(out, self.lines[:start]...)
+	out = append(out, with...)
+	self.lines = append(out, self.lines[end+1:]...)
+}
+
+// Replaces an entry, keeping its section header if it shares its line.
+func (self *ConfigFile) replaceEntry(e configLine, with ...string) {
+	if e.header != "" {
+		with = append([]string{e.header}, with...)
+	}
+	self.replace(e.start, e.end, with...)
+}
+
+func (self *ConfigFile) insert(at int, line string) {
+	self.replace(at, at-1, line)
+}
+
+func (self *ConfigFile) keyLine(name, value string) string {
+	parts := strings.Split(name, ".")
+	return "\t" + parts[len(parts)-1] + " = " + QuoteConfigValue(value)
+}
+
+func sectionHeader(name string) string {
+	parts := strings.Split(name, ".")
+	if len(parts) == 2 {
+		return "[" + parts[0] + "]"
+	}
+	sub := strings.Join(parts[1:len(parts)-1], ".")
+	sub = strings.Replace(sub, "\\", "\\\\", -1)
+	sub = strings.Replace(sub, "\"", "\\\"", -1)
+	return "[" + parts[0] + " \"" + sub + "\"]"
+}
+
+// Quotes a value for a config file if git would otherwise lose part of it.
+func QuoteConfigValue(value string) string {
+	quote := strings.ContainsAny(value, "#;") || strings.TrimSpace(value) != value
+	value = strings.Replace(value, "\\", "\\\\", -1)
+	value = strings.Replace(value, "\"", "\\\"", -1)
+	value = strings.Replace(value, "\n", "\\n", -1)
+	value = strings.Replace(value, "\t", "\\t", -1)
+	if quote {
+		return "\"" + value + "\""
+	}
+	return value
+}
+
+// Finds the headers and entries in the file.
+func (self *ConfigFile) scan() []configLine {
+	out := make([]configLine, 0, len(self.lines))
+	section, sub := "", ""
+	for i := 0; i < len(self.lines); i++ {
+		text := strings.TrimSpace(self.lines[i])
+		if text == "" || text[0] == '#' || text[0] == ';' {
+			continue
+		}
+		header := ""
+		if text[0] == '[' {
+			var rest string
+			section, sub, rest = parseSectionHeader(text)
+			out = append(out, configLine{section: section, sub: sub, start: i, end: i})
+			header = strings.TrimSpace(text[:len(text)-len(rest)])
+			text = strings.TrimSpace(rest)
+			if text == "" || text[0] == '#' || text[0] == ';' {
+				continue
+			}
+		}
+		key := text
+		if n := strings.IndexFunc(text, func(r rune) bool { return !(unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-') }); n >= 0 {
+			key = text[:n]
+		}
+		e := configLine{section: section, sub: sub, key: strings.ToLower(key), start: i, end: i, header: header}
+		for continues(self.lines[e.end]) && e.end+1 < len(self.lines) {
+			e.end++
+		}
+		i = e.end
+		out = append(out, e)
+	}
+	return out
+}
+
+// Splits '[section "sub"] rest' into its parts.
+func parseSectionHeader(text string) (string, string, string) {
+	text = text[1:]
+	end := strings.IndexAny(text, "\"]")
+	if end < 0 {
+		return strings.ToLower(strings.TrimSpace(text)), "", ""
+	}
+	section := strings.ToLower(strings.TrimSpace(text[:end]))
+	if text[end] == ']' {
+		return section, "", text[end+1:]
+	}
+	sub := ""
+	i := end + 1
+	for ; i < len(text) && text[i] != '"'; i++ {
+		if text[i] == '\\' && i+1 < len(text) {
+			i++
+		}
+		sub += string(text[i])
+	}
+	rest := text[i:]
+	if n := strings.IndexByte(rest, ']'); n >= 0 {
+		rest = rest[n+1:]
+	}
+	return section, sub, rest
+}
+
+// Whether a value line ends in an unescaped '\', carrying on to the next.
+func continues(line string) bool {
+	n := 0
+	for i := len(line) - 1; i >= 0 && line[i] == '\\'; i-- {
+		n++
+	}
+	return n%2 == 1
+}
@@ -0,0 +1,203 @@
+package parvatigo
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testEditConfig = `# my settings
+[parvati]
+	username = alice ; me
+	password = secret
+[game "th123"] hostMessage = first
+	hostMessage = second \
+continued
+	; keep this
+[interfaces]
+	ipv4 = eth0
+`
+
+func TestConfigFileEdit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "configfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := writeFile(t, dir, "config", testEditConfig, 0640)
+
+	f, err := OpenConfigFile(path)
+	if err != nil {
+		t.Fatalf("Open failed: %s", err.Error())
+	}
+	if err := f.Set("parvati.uri", "https://staging.example.com"); err != nil {
+		t.Fatalf("Set failed: %s", err.Error())
+	}
+	if err := f.Set("game.th123.hostMessage", "only; one"); err != nil {
+		t.Fatalf("Set failed: %s", err.Error())
+	}
+	if err := f.Add("game.th105.hostMessage", "new game"); err != nil {
+		t.Fatalf("Add failed: %s", err.Error())
+	}
+	if n, err := f.Unset("parvati.password"); n != 1 || err != nil {
+		t.Errorf("Expected one value unset, got %d (%v)", n, err)
+	}
+	if n, _ := f.Unset("parvati.password"); n != 0 {
+		t.Errorf("Unset removed %d values of an unset key", n)
+	}
+	if err := f.Save(); err != nil {
+		t.Fatalf("Save failed: %s", err.Error())
+	}
+
+	want := `# my settings
+[parvati]
+	username = alice ; me
+	uri = https://staging.example.com
+[game "th123"]
+	hostMessage = "only; one"
+	; keep this
+[interfaces]
+	ipv4 = eth0
+[game "th105"]
+	hostMessage = new game
+`
+	data, _ := ioutil.ReadFile(path)
+	if string(data) != want {
+		t.Errorf("Unexpected file:\n%s\nwanted:\n%s", string(data), want)
+	}
+	if fi, _ := os.Stat(path); fi.Mode().Perm() != 0640 {
+		t.Errorf("File mode changed to %v", fi.Mode())
+	}
+	f, _ = OpenConfigFile(path)
+	if v, _ := f.Get("game.th123.hostmessage"); len(v) != 1 || v[0] != "only; one" {
+		t.Errorf("Unexpected value after reload: %v", v)
+	}
+	if names, lines := f.Keys(); len(names) != 5 || names[1] != "parvati.uri" || lines[1] != 4 {
+		t.Errorf("Unexpected keys: %v at %v", names, lines)
+	}
+
+	f, _ = OpenConfigFile(filepath.Join(dir, "new", "config"))
+	f.Set("parvati.username", "bob")
+	if err := f.Save(); err != nil {
+		t.Fatalf("Save of new file failed: %s", err.Error())
+	}
+	if f.String() != "[parvati]\n\tusername = bob\n" {
+		t.Errorf("Unexpected new file: %q", f.String())
+	}
+}
+
+func TestConfigKeys(t *testing.T) {
+	keys := ConfigKeys(&ApiConfig{})
+	for _, c := range []struct {
+		name, tp string
+		multi    bool
+	}{
+		{"parvati.uri", "string", false},
+		{"Game.th123.hostMessage", "string list", true},
+		{"portmap.lifetime", "duration", false},
+		{"ddns.home.ttl", "integer", false},
+		{"watch.apiListen", "string", false},
+	} {
+		key := FindConfigKey(keys, c.name)
+		if key == nil || key.Type != c.tp || key.Multi != c.multi {
+			t.Errorf("Unexpected key for %s: %+v", c.name, key)
+		}
+	}
+	for _, name := range []string{"parvati.nope", "game.hostMessage", "portmap.x.enabled"} {
+		if key := FindConfigKey(keys, name); key != nil {
+			t.Errorf("Unexpected match for %s: %+v", name, key)
+		}
+	}
+	for _, key := range keys {
+		if key.Description == "" {
+			t.Errorf("No gcDesc for %s", key.Name)
+		}
+	}
+	if key := FindConfigKey(keys, "game.th123.hostMessageOrder"); key.Default != "round-robin" {
+		t.Errorf("Unexpected hostMessageOrder default '%s'", key.Default)
+	}
+	sections := ConfigSections(&ApiConfig{})
+	if len(sections) != 7 || sections[1].Name != "game" || sections[1].Description == "" || sections[0].Description != "" {
+		t.Errorf("Unexpected sections: %+v", sections)
+	}
+	if err := FindConfigKey(keys, "portmap.lifetime").Check("2h"); err != nil {
+		t.Errorf("Valid duration refused: %s", err.Error())
+	}
+	if err := FindConfigKey(keys, "portmap.enabled").Check("maybe"); err == nil {
+		t.Errorf("Expected bad boolean to fail")
+	}
+}
+
+func TestConfigFileAppend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "configfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sub", "config")
+
+	f, err := OpenConfigFile(path)
+	if err != nil {
+		t.Fatalf("Open failed: %s", err.Error())
+	}
+	values := []string{"plain", "a; b", "#hash", " padded ", `back\slash`, `say "hi"`, "tab\there", "line\nbreak"}
+	f.Append("# written by a test", "[game \"th123\"]")
+	for _, v := range values {
+		f.Append("\thostMessage = " + QuoteConfigValue(v))
+	}
+	f.Append("", "[parvati]", "\tusername = alice")
+	if err := f.Save(); err != nil {
+		t.Fatalf("Save failed: %s", err.Error())
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("Expected a new 0600 file, got %v (%v)", info, err)
+	}
+
+	conf, err := ReadConfig(path)
+	if err != nil {
+		t.Fatalf("ReadConfig failed: %s", err.Error())
+	}
+	got := conf.Games["th123"].HostMessages
+	if len(got) != len(values) {
+		t.Fatalf("Expected %d messages back, got %q", len(values), got)
+	}
+	for i, v := range values {
+		if got[i] != v {
+			t.Errorf("Expected %q back, got %q (written as %s)", v, got[i], QuoteConfigValue(v))
+		}
+	}
+	if conf.Username != "alice" {
+		t.Errorf("Expected username alice, got '%s'", conf.Username)
+	}
+
+	// appending keeps what is there
+	f, _ = OpenConfigFile(path)
+	f.Append("[interfaces]", "\tipv4 = eth0")
+	if err := f.Save(); err != nil {
+		t.Fatalf("Save failed: %s", err.Error())
+	}
+	data, _ := ioutil.ReadFile(path)
+	if !strings.HasPrefix(string(data), "# written by a test\n") || !strings.HasSuffix(string(data), "\tusername = alice\n[interfaces]\n\tipv4 = eth0\n") {
+		t.Errorf("Unexpected file after a second append:\n%s", string(data))
+	}
+}
+
+func TestQuoteConfigValue(t *testing.T) {
+	for in, want := range map[string]string{
+		"plain":       "plain",
+		"a; b":        `"a; b"`,
+		"#hash":       `"#hash"`,
+		" padded ":    `" padded "`,
+		`back\slash`:  `back\\slash`,
+		`say "hi"`:    `say \"hi\"`,
+		"tab\there":   `tab\there`,
+		"line\nbreak": `line\nbreak`,
+		"":            "",
+	} {
+		if got := QuoteConfigValue(in); got != want {
+			t.Errorf("Expected %q quoted as %s, got %s", in, want, got)
+		}
+	}
+}
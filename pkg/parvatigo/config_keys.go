@@ -0,0 +1,172 @@
+package parvatigo
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/misatosangel/gitconfig"
+)
+
+// A key the config file can hold, as found from gcKey struct tags. Keys in
+// [section "NAME"] sections have '*' as their subsection. The description
+// comes from the gcDesc tag, or for keys without one in a section whose map
+// field has a gcInherits tag, from the section they are inherited from.
+type ConfigKey struct {
+	Name        string
+	Type        string
+	Default     string
+	Description string
+	// Whether the key may be repeated
+	Multi bool
+	// Whether the value should not be shown, from the gcSecret tag
+	Secret bool
+}
+
+// A section of the config file, described by the gcDesc tag of the struct
+// or map field holding it, if any.
+type ConfigSection struct {
+	Name        string
+	Description string
+}
+
+var durationKind = reflect.TypeOf(time.Duration(0))
+
+// The keys loaded into v, a pointer to a struct with gcKey tags.
+func ConfigKeys(v interface{}) []ConfigKey {
+	out := make([]ConfigKey, 0, 32)
+	return appendConfigKeys(out, reflect.TypeOf(v).Elem(), "")
+}
+
+func appendConfigKeys(out []ConfigKey, tp reflect.Type, prefix string) []ConfigKey {
+	for i := 0; i < tp.NumField(); i++ {
+		field := tp.Field(i)
+		name := field.Tag.Get("gcKey")
+		if name == "" {
+			continue
+		}
+		name = prefix + name
+		ft := field.Type
+		switch {
+		case ft.Kind() == reflect.Map:
+			n := len(out)
+			out = appendConfigKeys(out, ft.Elem(), name+".*.")
+			if from := field.Tag.Get("gcInherits"); from != "" {
+				for j := n; j < len(out); j++ {
+					if out[j].Description == "" {
+						out[j].Description = fmt.Sprintf("This %s's %s.%s.", name, from, strings.TrimPrefix(out[j].Name, name+".*."))
+					}
+				}
+			}
+			continue
+		case ft.Kind() == reflect.Struct && ft != durationKind:
+			out = appendConfigKeys(out, ft, name+".")
+			continue
+		}
+		key := ConfigKey{Name: name, Default: field.Tag.Get("gcDefault"), Description: field.Tag.Get("gcDesc"), Secret: field.Tag.Get("gcSecret") == "true"}
+		if ft.Kind() == reflect.Slice {
+			key.Multi = true
+			ft = ft.Elem()
+		}
+		key.Type = configType(ft)
+		if key.Multi {
+			key.Type += " list"
+		}
+		out = append(out, key)
+	}
+	return out
+}
+
+// The sections of v's keys, in the order their keys are first found.
+func ConfigSections(v interface{}) []ConfigSection {
+	out := make([]ConfigSection, 0, 8)
+	tp := reflect.TypeOf(v).Elem()
+	for i := 0; i < tp.NumField(); i++ {
+		field := tp.Field(i)
+		name := field.Tag.Get("gcKey")
+		if name == "" {
+			continue
+		}
+		desc := field.Tag.Get("gcDesc")
+		if n := strings.IndexByte(name, '.'); n >= 0 {
+			name, desc = name[:n], ""
+		}
+		found := false
+		for j := range out {
+			if out[j].Name == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			out = append(out, ConfigSection{Name: name, Description: desc})
+		}
+	}
+	return out
+}
+
+// The key's section: the part of its name before the first '.'.
+func (self *ConfigKey) Section() string {
+	return strings.SplitN(self.Name, ".", 2)[0]
+}
+
+func configType(tp reflect.Type) string {
+	if tp == durationKind {
+		return "duration"
+	}
+	switch tp.Kind() {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	}
+	return "string"
+}
+
+// Whether name (section.key or section.subsection.key) is this key.
+// Section and key names are not case sensitive; subsections are.
+func (self *ConfigKey) Matches(name string) bool {
+	s, ss, k := gitconfig.ParseSectionKey(name)
+	ps, pss, pk := gitconfig.ParseSectionKey(self.Name)
+	if s != ps || k != pk {
+		return false
+	}
+	if pss == "*" {
+		return ss != ""
+	}
+	return ss == pss
+}
+
+// The key matching name, or nil if it is not known.
+func FindConfigKey(keys []ConfigKey, name string) *ConfigKey {
+	for i := range keys {
+		if keys[i].Matches(name) {
+			return &keys[i]
+		}
+	}
+	return nil
+}
+
+// Checks value can be loaded as the key's type.
+func (self *ConfigKey) Check(value string) error {
+	var err error
+	switch strings.TrimSuffix(self.Type, " list") {
+	case "integer":
+		_, err = strconv.ParseInt(value, 10, 64)
+	case "duration":
+		_, err = time.ParseDuration(value)
+	case "boolean":
+		switch strings.ToLower(value) {
+		case "true", "false", "yes", "no", "on", "off", "1", "0", "":
+		default:
+			err = fmt.Errorf("not true or false")
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Bad value '%s' for %s {%s}: %s\n", value, self.Name, self.Type, err.Error())
+	}
+	return nil
+}
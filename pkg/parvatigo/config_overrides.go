@@ -0,0 +1,289 @@
+package parvatigo
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/misatosangel/gitconfig"
+)
+
+// Where a config value came from. Later ones take precedence.
+const (
+	SourceDefault = "default"
+	SourceFile    = "file"
+	SourceEnv     = "env"
+	SourceFlag    = "flag"
+)
+
+// Prefix of the environment variables overriding config keys: parvati.KEY
+// is PARVATI_KEY, SECTION.KEY is PARVATI_SECTION_KEY and SECTION.NAME.KEY is
+// PARVATI_SECTION_NAME_KEY, all upper case. Repeated keys take one value
+// per line.
+const EnvPrefix = "PARVATI_"
+
+// Values replacing those of a key in the config file.
+type ConfigOverride struct {
+	// section.key or section.subsection.key
+	Key    string
+	Values []string
+	Source string
+	// The variable or flag that gave it
+	From string
+}
+
+// Adds a --set style key=value, given by the flag from, to the command
+// line overrides, which are applied over the environment by ReadConfigWith.
+// The key must be one of keys. Setting a key again adds another value.
+func AddFlagOverride(overrides []ConfigOverride, keys []ConfigKey, from, setting string) ([]ConfigOverride, error) {
+	n := strings.IndexByte(setting, '=')
+	if n <= 0 {
+		return overrides, fmt.Errorf("Bad %s '%s': use key=value\n", from, setting)
+	}
+	key, value := setting[:n], setting[n+1:]
+	if FindConfigKey(keys, key) == nil {
+		return overrides, fmt.Errorf("Unknown config key '%s' given to %s; see ConfigHelp\n", key, from)
+	}
+	for i := range overrides {
+		if sameKey(overrides[i].Key, key) {
+			overrides[i].Values = append(overrides[i].Values, value)
+			return overrides, nil
+		}
+	}
+	return append(overrides, ConfigOverride{Key: key, Values: []string{value}, Source: SourceFlag, From: from}), nil
+}
+
+// The environment variable for a key. Keys in [section "NAME"] sections
+// have '*' in place of NAME.
+func EnvName(key string) string {
+	name := strings.TrimPrefix(key, "parvati.")
+	return EnvPrefix + strings.ToUpper(strings.Replace(name, ".", "_", -1))
+}
+
+// The environment variables setting any of keys, sorted by name. NAME in a
+// variable matches the subsection of conf it equals ignoring case, and is
+// otherwise taken as lower case.
+func EnvOverrides(conf *gitconfig.Config, keys []ConfigKey) []ConfigOverride {
+	env := os.Environ()
+	sort.Strings(env)
+	out := make([]ConfigOverride, 0, 4)
+	for _, kv := range env {
+		n := strings.IndexByte(kv, '=')
+		if n < 0 || !strings.HasPrefix(kv, EnvPrefix) {
+			continue
+		}
+		name, value := kv[:n], kv[n+1:]
+		for i := range keys {
+			key, ok := envKey(conf, &keys[i], name)
+			if !ok {
+				continue
+			}
+			values := []string{value}
+			if keys[i].Multi {
+				values = strings.Split(value, "\n")
+			}
+			out = append(out, ConfigOverride{Key: key, Values: values, Source: SourceEnv, From: name})
+			break
+		}
+	}
+	return out
+}
+
+// The key a variable sets, if it is this one's.
+func envKey(conf *gitconfig.Config, key *ConfigKey, name string) (string, bool) {
+	parts := strings.SplitN(EnvName(key.Name), "*", 2)
+	if len(parts) == 1 {
+		return key.Name, parts[0] == name
+	}
+	if len(name) <= len(parts[0])+len(parts[1]) || !strings.HasPrefix(name, parts[0]) || !strings.HasSuffix(name, parts[1]) {
+		return "", false
+	}
+	sub := name[len(parts[0]) : len(name)-len(parts[1])]
+	section := key.Section()
+	found := strings.ToLower(sub)
+	if s := conf.GetSection(section, false); s != nil {
+		for ss := range s.SubSections {
+			if strings.EqualFold(ss, sub) {
+				found = ss
+				break
+			}
+		}
+	}
+	return strings.Replace(key.Name, ".*.", "."+found+".", 1), true
+}
+
+// Replaces the values in conf of the keys set in the environment or by the
+// command line's flags, returning the overrides used in the order applied.
+func ApplyOverrides(conf *gitconfig.Config, keys []ConfigKey, flags []ConfigOverride) []ConfigOverride {
+	applied := EnvOverrides(conf, keys)
+	for _, o := range flags {
+		if FindConfigKey(keys, o.Key) != nil {
+			applied = append(applied, o)
+		}
+	}
+	for _, o := range applied {
+		s, ss, k := gitconfig.ParseSectionKey(o.Key)
+		cv := conf.GetConfigValues(s, ss, k, true)
+		cv.Value = make([]*string, 0, len(o.Values))
+		for i := range o.Values {
+			cv.Value = append(cv.Value, &o.Values[i])
+		}
+	}
+	return applied
+}
+
+// Reads a config file with the environment's and flags' overrides for keys
+// applied. A missing (or empty) path is fine if the overrides set something.
+func ReadGitConfig(file string, keys []ConfigKey, flags []ConfigOverride) (*gitconfig.Config, []ConfigOverride, error) {
+	conf := gitconfig.NewConfig()
+	var missing error
+	if file != "" {
+		var err error
+		if _, missing = os.Stat(file); missing == nil {
+			if conf, err = gitconfig.NewConfigFromFile(file); err != nil {
+				return nil, nil, err
+			}
+		} else if !os.IsNotExist(missing) {
+			return nil, nil, missing
+		}
+	}
+	applied := ApplyOverrides(conf, keys, flags)
+	if missing != nil && len(applied) == 0 {
+		return nil, nil, missing
+	}
+	return conf, applied, nil
+}
+
+// The override applied to a key, if any; a flag beats the environment.
+func (self *ApiConfig) Override(key string) *ConfigOverride {
+	return findOverride(self.Overrides, key)
+}
+
+func findOverride(overrides []ConfigOverride, key string) *ConfigOverride {
+	for i := len(overrides) - 1; i >= 0; i-- {
+		if sameKey(overrides[i].Key, key) {
+			return &overrides[i]
+		}
+	}
+	return nil
+}
+
+// Whether two key names are the same, ignoring the case of sections and keys.
+func sameKey(a, b string) bool {
+	as, ass, ak := gitconfig.ParseSectionKey(a)
+	bs, bss, bk := gitconfig.ParseSectionKey(b)
+	return as == bs && ass == bss && ak == bk
+}
+
+// An effective setting and where it came from, as told by ExplainConfig.
+type ConfiguredValue struct {
+	Name   string
+	Key    *ConfigKey
+	Values []string
+	// SourceDefault, SourceFile, SourceEnv or SourceFlag
+	Source string
+	// e.g. the line of the file or the variable name
+	From string
+	// The profile it came from, for parvati keys
+	Profile string
+}
+
+// The effective value of every known key that has one, with the file's
+// values overlaid by overrides and, for parvati keys, the named profile.
+func ExplainConfig(f *ConfigFile, keys []ConfigKey, overrides []ConfigOverride, profile string) ([]ConfiguredValue, error) {
+	conf, err := f.Parse()
+	if err != nil {
+		return nil, err
+	}
+	names, lines := f.Keys()
+	fileLine := make(map[string]int)
+	for i, n := range names {
+		fileLine[n] = lines[i]
+	}
+	// from the layers above the defaults
+	set := func(name string, key *ConfigKey) *ConfiguredValue {
+		if o := findOverride(overrides, name); o != nil {
+			return &ConfiguredValue{Name: name, Key: key, Values: o.Values, Source: o.Source, From: o.From}
+		}
+		s, ss, k := gitconfig.ParseSectionKey(name)
+		lc := s + "." + k
+		if ss != "" {
+			lc = s + "." + ss + "." + k
+		}
+		if line, ok := fileLine[lc]; ok {
+			return &ConfiguredValue{Name: name, Key: key, Values: conf.GetKeyValuesStrings(name), Source: SourceFile, From: fmt.Sprintf("%s:%d", f.Path, line)}
+		}
+		return nil
+	}
+
+	// as UseProfile, another account does not inherit the secrets
+	otherAccount := false
+	if profile != "" {
+		for _, k := range []string{"uri", "username"} {
+			if set("profile."+profile+"."+k, nil) != nil {
+				otherAccount = true
+			}
+		}
+	}
+
+	out := make([]ConfiguredValue, 0, len(keys))
+	for i := 0; i < len(keys); i++ {
+		key := &keys[i]
+		if !strings.Contains(key.Name, ".*.") {
+			var v *ConfiguredValue
+			if profile != "" && key.Section() == "parvati" && findOverride(overrides, key.Name) == nil {
+				if v = set("profile."+profile+"."+strings.TrimPrefix(key.Name, "parvati."), key); v != nil {
+					v.Name, v.Profile = key.Name, profile
+				} else if otherAccount && (key.Name == "parvati.password" || key.Name == "parvati.token") {
+					continue
+				}
+			}
+			if v == nil {
+				v = set(key.Name, key)
+			}
+			if v == nil && key.Default != "" {
+				v = &ConfiguredValue{Name: key.Name, Key: key, Values: []string{key.Default}, Source: SourceDefault}
+			}
+			if v != nil {
+				out = append(out, *v)
+			}
+			continue
+		}
+		// the section's keys, for each of its subsections in turn
+		section := key.Section()
+		end := i + 1
+		for end < len(keys) && keys[end].Section() == section {
+			end++
+		}
+		for _, ss := range configSubsections(section, names, overrides) {
+			for j := i; j < end; j++ {
+				name := strings.Replace(keys[j].Name, ".*.", "."+ss+".", 1)
+				if v := set(name, &keys[j]); v != nil {
+					out = append(out, *v)
+				} else if keys[j].Default != "" {
+					out = append(out, ConfiguredValue{Name: name, Key: &keys[j], Values: []string{keys[j].Default}, Source: SourceDefault})
+				}
+			}
+		}
+		i = end - 1
+	}
+	return out, nil
+}
+
+// The subsections of section set in the file or by overrides, in order.
+func configSubsections(section string, names []string, overrides []ConfigOverride) []string {
+	all := append([]string{}, names...)
+	for _, o := range overrides {
+		all = append(all, o.Key)
+	}
+	out := make([]string, 0, 4)
+	seen := make(map[string]bool)
+	for _, n := range all {
+		if s, ss, _ := gitconfig.ParseSectionKey(n); s == section && ss != "" && !seen[ss] {
+			seen[ss] = true
+			out = append(out, ss)
+		}
+	}
+	return out
+}
@@ -0,0 +1,105 @@
+package parvatigo
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testOverrideConfig = `[parvati]
+	username = alice
+	password = secret
+[profile "work"]
+	username = bob
+[game "Th123"]
+	hostMessage = from the file
+	watchPort = 10800
+`
+
+func TestConfigOverrides(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overrides")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := writeFile(t, dir, "config", testOverrideConfig, 0600)
+
+	env := map[string]string{
+		"PARVATI_URI":                    "https://env.example.com",
+		"PARVATI_USERNAME":               "carol",
+		"PARVATI_GAME_TH123_HOSTMESSAGE": "one\ntwo",
+		"PARVATI_PORTMAP_LIFETIME":       "30m",
+	}
+	for k, v := range env {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+	keys := ConfigKeys(&ApiConfig{})
+	flags, err := AddFlagOverride(nil, keys, "--set", "parvati.uri=https://flag.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AddFlagOverride(flags, keys, "--set", "nonsense"); err == nil {
+		t.Errorf("Expected a setting without '=' to fail")
+	}
+	if got, err := AddFlagOverride(flags, keys, "--set", "parvati.nonsense=1"); err == nil || len(got) != 1 {
+		t.Errorf("Expected an unknown key to be refused, got %+v (%v)", got, err)
+	}
+
+	conf, err := ReadConfigWith(path, flags)
+	if err != nil {
+		t.Fatalf("ReadConfig failed: %s", err.Error())
+	}
+	if conf.URI != "https://flag.example.com" || conf.Username != "carol" || conf.PortMap.Lifetime.Minutes() != 30 {
+		t.Errorf("Overrides not applied: %s %s %v", conf.URI, conf.Username, conf.PortMap.Lifetime)
+	}
+	g := conf.Games["Th123"]
+	if len(g.HostMessages) != 2 || g.HostMessages[1] != "two" || g.Port != 10800 {
+		t.Errorf("Unexpected game: %+v", g)
+	}
+	if o := conf.Override("PARVATI.URI"); o == nil || o.Source != SourceFlag {
+		t.Errorf("Expected the flag to win, got %+v", o)
+	}
+	// the environment beats the profile, which still drops the password
+	if err := conf.UseProfile("work"); err != nil {
+		t.Fatal(err)
+	}
+	if conf.Username != "carol" || conf.Password != "" {
+		t.Errorf("Unexpected account after UseProfile: %s %s", conf.Username, conf.Password)
+	}
+
+	f, _ := OpenConfigFile(path)
+	values, err := ExplainConfig(f, keys, conf.Overrides, "work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sources := make(map[string]string)
+	for _, v := range values {
+		sources[v.Name] = v.Source
+	}
+	for name, want := range map[string]string{
+		"parvati.uri":                 SourceFlag,
+		"parvati.username":            SourceEnv,
+		"parvati.authMethod":          SourceDefault,
+		"game.Th123.hostMessage":      SourceEnv,
+		"game.Th123.watchPort":        SourceFile,
+		"game.Th123.hostMessageOrder": SourceDefault,
+		"parvati.password":            "",
+	} {
+		if sources[name] != want {
+			t.Errorf("Expected %s from '%s', got '%s'", name, want, sources[name])
+		}
+	}
+
+	// overrides alone are enough without a file
+	if _, err := ReadConfigWith(filepath.Join(dir, "missing"), flags); err != nil {
+		t.Errorf("Expected overrides to stand in for a missing file: %s", err.Error())
+	}
+	for k := range env {
+		os.Unsetenv(k)
+	}
+	if _, err := ReadConfig(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Errorf("Expected a missing file error, got %v", err)
+	}
+}
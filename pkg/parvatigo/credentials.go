@@ -0,0 +1,478 @@
+package parvatigo
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+// Where a password can come from, in the order they are tried.
+const (
+	CredentialsConfig  = "config"
+	CredentialsHelper  = "helper"
+	CredentialsKeyring = "keyring"
+	CredentialsNetrc   = "netrc"
+)
+
+// A username and password for a Parvati server.
+type Credential struct {
+	Protocol string
+	Host     string
+	Username string
+	Password string
+}
+
+// Fills in the password (and username, if not set) when it is not in the
+// config file, trying the credential helper, the keyring then ~/.netrc.
+// Finding nothing is not an error; PasswordSource is left empty. A source
+// that fails, or the keyring when secret-tool is missing, is noted in
+// CredentialErrors and the next one tried. Only basic auth uses a password.
+func (self *ApiConfig) LoadCredentials() {
+	self.CredentialErrors = nil
+	if self.AuthMethod != "" && self.AuthMethod != AuthBasic {
+		return
+	}
+	if self.Password != "" {
+		self.PasswordSource = CredentialsConfig
+		return
+	}
+	want := self.Credential()
+	if self.CredentialHelper != "" {
+		cred, err := (&CredentialHelper{Command: self.CredentialHelper}).Get(want)
+		if err != nil {
+			self.CredentialErrors = append(self.CredentialErrors, err)
+		} else if self.useCredential(cred) {
+			self.PasswordSource = CredentialsHelper
+			return
+		}
+	}
+	keyring := &SecretService{}
+	if err := keyring.Check(); err != nil {
+		self.CredentialErrors = append(self.CredentialErrors, err)
+	} else if cred, err := keyring.Get(want); err != nil {
+		self.CredentialErrors = append(self.CredentialErrors, err)
+	} else if self.useCredential(cred) {
+		self.PasswordSource = CredentialsKeyring
+		return
+	}
+	path, err := NetrcPath()
+	if err != nil {
+		self.CredentialErrors = append(self.CredentialErrors, err)
+		return
+	}
+	cred, err := ReadNetrc(path, want)
+	if err != nil {
+		self.CredentialErrors = append(self.CredentialErrors, fmt.Errorf("Unable to read '%s': %s\n", path, err.Error()))
+		return
+	}
+	if self.useCredential(cred) {
+		self.PasswordSource = CredentialsNetrc
+		if err := checkNetrcMode(path); err != nil {
+			log.Printf("Warning: %s", err.Error())
+		}
+	}
+}
+
+func (self *ApiConfig) useCredential(cred *Credential) bool {
+	if cred == nil || cred.Password == "" {
+		return false
+	}
+	if self.Username != "" && cred.Username != "" && cred.Username != self.Username {
+		return false
+	}
+	if self.Username == "" {
+		self.Username = cred.Username
+	}
+	self.Password = cred.Password
+	return true
+}
+
+// The credential to look up for this config's server and username.
+func (self *ApiConfig) Credential() *Credential {
+	uri := self.URI
+	if uri == "" {
+		uri = defUri
+	}
+	c := &Credential{Protocol: "https", Host: uri, Username: self.Username, Password: self.Password}
+	if u, err := url.Parse(uri); err == nil && u.Host != "" {
+		c.Protocol = u.Scheme
+		c.Host = u.Host
+	}
+	return c
+}
+
+// Saves the config's username and password to store (helper or keyring).
+// An empty store means the helper if one is configured, else the keyring.
+func (self *ApiConfig) StoreCredentials(store string) (string, error) {
+	if store == "" {
+		store = self.CredentialStore
+	}
+	if store == "" {
+		store = CredentialsKeyring
+		if self.CredentialHelper != "" {
+			store = CredentialsHelper
+		}
+	}
+	cred := self.Credential()
+	switch store {
+	case CredentialsHelper:
+		if self.CredentialHelper == "" {
+			return store, fmt.Errorf("No credential helper is set with parvati.credentialHelper\n")
+		}
+		return store, (&CredentialHelper{Command: self.CredentialHelper}).Store(cred)
+	case CredentialsKeyring:
+		keyring := &SecretService{}
+		if err := keyring.Check(); err != nil {
+			return store, err
+		}
+		return store, keyring.Store(cred)
+	}
+	return store, fmt.Errorf("Unknown credential store '%s' (use %s or %s)\n", store, CredentialsHelper, CredentialsKeyring)
+}
+
+// Removes the config's credential from the helper and keyring, returning
+// which were asked to forget it.
+func (self *ApiConfig) EraseCredentials() ([]string, error) {
+	cred := self.Credential()
+	cred.Password = ""
+	out := make([]string, 0, 2)
+	if self.CredentialHelper != "" {
+		if err := (&CredentialHelper{Command: self.CredentialHelper}).Erase(cred); err != nil {
+			return out, err
+		}
+		out = append(out, CredentialsHelper)
+	}
+	if keyring := (&SecretService{}); keyring.Available() {
+		if err := keyring.Erase(cred); err != nil {
+			return out, err
+		}
+		out = append(out, CredentialsKeyring)
+	}
+	return out, nil
+}
+
+// An external program speaking git's credential helper protocol. As with
+// git, a command starting with '!' is run by the shell, a path is run as
+// is, and a bare name NAME runs git-credential-NAME, so git's own helpers
+// (store, cache, libsecret, osxkeychain, manager...) can be used.
+type CredentialHelper struct {
+	Command string
+}
+
+func (self *CredentialHelper) command(action string) *exec.Cmd {
+	c := strings.TrimSpace(self.Command)
+	if strings.HasPrefix(c, "!") {
+		return exec.Command("/bin/sh", "-c", c[1:]+" \"$@\"", c[1:], action)
+	}
+	fields := strings.Fields(c)
+	if !strings.ContainsRune(fields[0], os.PathSeparator) {
+		fields[0] = "git-credential-" + fields[0]
+	}
+	return exec.Command(fields[0], append(fields[1:], action)...)
+}
+
+func (self *CredentialHelper) run(action string, cred *Credential) ([]byte, error) {
+	if strings.TrimSpace(self.Command) == "" {
+		return nil, fmt.Errorf("Empty credential helper command\n")
+	}
+	var in bytes.Buffer
+	writeCredential(&in, cred)
+	cmd := self.command(action)
+	cmd.Stdin = &in
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("Credential helper '%s %s' failed: %s\n", self.Command, action, err.Error())
+	}
+	return out, nil
+}
+
+// Asks the helper for a password. A nil credential means it had none.
+func (self *CredentialHelper) Get(want *Credential) (*Credential, error) {
+	out, err := self.run("get", want)
+	if err != nil {
+		return nil, err
+	}
+	cred := *want
+	cred.Password = ""
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "username":
+			cred.Username = kv[1]
+		case "password":
+			cred.Password = kv[1]
+		case "quit":
+			if kv[1] == "1" || kv[1] == "true" {
+				return nil, nil
+			}
+		}
+	}
+	if cred.Password == "" {
+		return nil, nil
+	}
+	return &cred, nil
+}
+
+func (self *CredentialHelper) Store(cred *Credential) error {
+	_, err := self.run("store", cred)
+	return err
+}
+
+func (self *CredentialHelper) Erase(cred *Credential) error {
+	_, err := self.run("erase", cred)
+	return err
+}
+
+func writeCredential(w *bytes.Buffer, cred *Credential) {
+	fmt.Fprintf(w, "protocol=%s\nhost=%s\n", cred.Protocol, cred.Host)
+	if cred.Username != "" {
+		fmt.Fprintf(w, "username=%s\n", cred.Username)
+	}
+	if cred.Password != "" {
+		fmt.Fprintf(w, "password=%s\n", cred.Password)
+	}
+	w.WriteString("\n")
+}
+
+// The freedesktop Secret Service (GNOME Keyring, KWallet...). This runs
+// libsecret's secret-tool rather than speaking D-Bus itself, so that must be
+// installed (it is in the libsecret-tools package on Debian and Ubuntu, and
+// libsecret elsewhere).
+// Items carry the attributes service=parvati, host and username.
+type SecretService struct {
+	// Path to secret-tool, found on $PATH if empty
+	Tool string
+}
+
+func (self *SecretService) tool() string {
+	if self.Tool == "" {
+		return "secret-tool"
+	}
+	return self.Tool
+}
+
+func (self *SecretService) Available() bool {
+	return self.Check() == nil
+}
+
+// Says why the keyring cannot be used, if it cannot.
+func (self *SecretService) Check() error {
+	if _, err := exec.LookPath(self.tool()); err != nil {
+		return fmt.Errorf("The keyring cannot be used: '%s' was not found. Install libsecret-tools (or libsecret) for it.\n", self.tool())
+	}
+	return nil
+}
+
+func (self *SecretService) attributes(cred *Credential) []string {
+	attrs := []string{"service", "parvati", "host", cred.Host}
+	if cred.Username != "" {
+		attrs = append(attrs, "username", cred.Username)
+	}
+	return attrs
+}
+
+// Looks up a password. Without a username the first matching item's is
+// used. A nil credential means there was none.
+func (self *SecretService) Get(want *Credential) (*Credential, error) {
+	cmd := exec.Command(self.tool(), append([]string{"search", "--unlock"}, self.attributes(want)...)...)
+	out, err := cmd.Output()
+	if err != nil {
+		// secret-tool exits 1 when nothing matches
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Keyring lookup failed: %s\n", err.Error())
+	}
+	var cred *Credential
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "[") {
+			if cred != nil && cred.Password != "" {
+				break
+			}
+			cred = &Credential{Protocol: want.Protocol, Host: want.Host, Username: want.Username}
+			continue
+		}
+		kv := strings.SplitN(line, " = ", 2)
+		if cred == nil || len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "secret":
+			cred.Password = kv[1]
+		case "attribute.username":
+			cred.Username = kv[1]
+		}
+	}
+	if cred == nil || cred.Password == "" {
+		return nil, nil
+	}
+	return cred, nil
+}
+
+func (self *SecretService) Store(cred *Credential) error {
+	label := fmt.Sprintf("Parvati password for %s@%s", cred.Username, cred.Host)
+	cmd := exec.Command(self.tool(), append([]string{"store", "--label=" + label}, self.attributes(cred)...)...)
+	cmd.Stdin = strings.NewReader(cred.Password)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("Keyring store failed: %s %s\n", err.Error(), strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (self *SecretService) Erase(cred *Credential) error {
+	cmd := exec.Command(self.tool(), append([]string{"clear"}, self.attributes(cred)...)...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("Keyring clear failed: %s %s\n", err.Error(), strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// $NETRC, else ~/.netrc (~/_netrc on Windows, as curl does).
+func NetrcPath() (string, error) {
+	if p := os.Getenv("NETRC"); p != "" {
+		return p, nil
+	}
+	usr, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	name := ".netrc"
+	if os.PathSeparator == '\\' {
+		name = "_netrc"
+	}
+	return filepath.Join(usr.HomeDir, name), nil
+}
+
+// Complains if others can read the netrc file, as ftp and curl's --netrc
+// do. Windows has no such mode bits to check.
+func checkNetrcMode(path string) error {
+	if os.PathSeparator == '\\' {
+		return nil
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("'%s' holds your password but can be read by other users; run chmod 600 '%s'\n", path, path)
+	}
+	return nil
+}
+
+// Finds the login for want's host (tried with and without the port) in a
+// netrc file, falling back to any default entry. A missing file or entry
+// gives a nil credential.
+func ReadNetrc(path string, want *Credential) (*Credential, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	hosts := []string{want.Host}
+	if i := strings.LastIndexByte(want.Host, ':'); i >= 0 && !strings.HasSuffix(want.Host, "]") {
+		hosts = append(hosts, want.Host[:i])
+	}
+	var found, def *Credential
+	var cur *Credential
+	tokens := netrcTokens(string(data))
+	for i := 0; i < len(tokens); i++ {
+		next := ""
+		if i+1 < len(tokens) {
+			next = tokens[i+1]
+		}
+		switch tokens[i] {
+		case "machine":
+			cur = nil
+			for _, h := range hosts {
+				if strings.EqualFold(next, h) {
+					cur = &Credential{Protocol: want.Protocol, Host: want.Host}
+				}
+			}
+			i++
+		case "default":
+			cur = &Credential{Protocol: want.Protocol, Host: want.Host}
+			def = cur
+		case "login", "password", "account":
+			if cur != nil {
+				if tokens[i] == "login" {
+					cur.Username = next
+				} else if tokens[i] == "password" {
+					cur.Password = next
+				}
+			}
+			i++
+		case "macdef":
+			// macros run to the next blank line, which netrcTokens marks
+			for i < len(tokens) && tokens[i] != "" {
+				i++
+			}
+			cur = nil
+		}
+		if cur != nil && cur != def && cur.Password != "" && (want.Username == "" || cur.Username == want.Username) && found == nil {
+			found = cur
+		}
+	}
+	if found != nil {
+		return found, nil
+	}
+	if def != nil && def.Password != "" && (want.Username == "" || def.Username == want.Username) {
+		return def, nil
+	}
+	return nil, nil
+}
+
+// Splits a netrc file into tokens, with an empty token for each blank line
+// so macdef bodies can be skipped. Double quoted tokens may hold spaces.
+func netrcTokens(data string) []string {
+	out := make([]string, 0, 32)
+	for _, line := range strings.Split(strings.Replace(data, "\r\n", "\n", -1), "\n") {
+		if strings.TrimSpace(line) == "" {
+			out = append(out, "")
+			continue
+		}
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		for len(line) > 0 {
+			line = strings.TrimLeft(line, " \t")
+			if line == "" {
+				break
+			}
+			if line[0] == '"' {
+				end := strings.IndexByte(line[1:], '"')
+				if end < 0 {
+					out = append(out, line[1:])
+					break
+				}
+				out = append(out, line[1:end+1])
+				line = line[end+2:]
+				continue
+			}
+			end := strings.IndexAny(line, " \t")
+			if end < 0 {
+				out = append(out, line)
+				break
+			}
+			out = append(out, line[:end])
+			line = line[end:]
+		}
+	}
+	return out
+}
@@ -0,0 +1,195 @@
+package parvatigo
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testNetrc = `# comment
+machine other.example.com login bob password nope
+machine parvati.example.com
+	login alice
+	password "two words"
+
+macdef init
+machine parvati.example.com login mallory password macro
+
+default login anon password anonpw
+`
+
+func writeFile(t *testing.T, dir, name, content string, mode os.FileMode) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), mode); err != nil {
+		t.Fatalf("Unable to write %s: %s", path, err.Error())
+	}
+	return path
+}
+
+func TestReadNetrc(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netrc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := writeFile(t, dir, "netrc", testNetrc, 0600)
+
+	cred, err := ReadNetrc(path, &Credential{Host: "parvati.example.com:443"})
+	if err != nil || cred == nil || cred.Username != "alice" || cred.Password != "two words" {
+		t.Errorf("Expected alice's entry, got %+v (%v)", cred, err)
+	}
+	// mallory only appears inside a macro, and the default is anon's
+	if cred, _ := ReadNetrc(path, &Credential{Host: "parvati.example.com", Username: "mallory"}); cred != nil {
+		t.Errorf("Expected no entry for mallory, got %+v", cred)
+	}
+	cred, _ = ReadNetrc(path, &Credential{Host: "unknown.example.com"})
+	if cred == nil || cred.Username != "anon" || cred.Password != "anonpw" {
+		t.Errorf("Expected default entry, got %+v", cred)
+	}
+	if cred, err := ReadNetrc(filepath.Join(dir, "missing"), &Credential{Host: "x"}); cred != nil || err != nil {
+		t.Errorf("Missing netrc should give nothing, got %+v (%v)", cred, err)
+	}
+}
+
+func TestCredentialHelper(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := filepath.Join(dir, "store")
+	// stores the input for store, echoes it back (less the blank line) for get
+	script := writeFile(t, dir, "helper", `#!/bin/sh
+case "$1" in
+store) cat > "`+store+`" ;;
+get) [ -f "`+store+`" ] && grep -v '^$' "`+store+`" ;;
+erase) rm -f "`+store+`" ;;
+esac
+exit 0
+`, 0700)
+
+	for _, command := range []string{script, "!" + script} {
+		conf := &ApiConfig{URI: "https://parvati.example.com", Username: "alice", Password: "secret", CredentialHelper: command}
+		if where, err := conf.StoreCredentials(""); err != nil || where != CredentialsHelper {
+			t.Fatalf("%s: store failed in %s: %v", command, where, err)
+		}
+		data, _ := ioutil.ReadFile(store)
+		if string(data) != "protocol=https\nhost=parvati.example.com\nusername=alice\npassword=secret\n\n" {
+			t.Errorf("%s: unexpected helper input %q", command, string(data))
+		}
+		conf = &ApiConfig{URI: "https://parvati.example.com", CredentialHelper: command}
+		if conf.LoadCredentials(); conf.Password != "secret" || conf.Username != "alice" || conf.PasswordSource != CredentialsHelper {
+			t.Errorf("%s: unexpected load %+v", command, conf)
+		}
+		if erased, err := conf.EraseCredentials(); err != nil || len(erased) == 0 || erased[0] != CredentialsHelper {
+			t.Errorf("%s: unexpected erase %v (%v)", command, erased, err)
+		}
+		if _, err := os.Stat(store); !os.IsNotExist(err) {
+			t.Errorf("%s: helper was not asked to erase", command)
+		}
+	}
+}
+
+func TestSecretService(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	saved := filepath.Join(dir, "saved")
+	tool := writeFile(t, dir, "secret-tool", `#!/bin/sh
+cmd="$1"; shift
+case "$cmd" in
+store) echo "$*" > "`+saved+`.args"; cat > "`+saved+`" ;;
+search)
+	[ -f "`+saved+`" ] || exit 1
+	echo "[/org/freedesktop/secrets/collection/login/1]"
+	echo "label = Parvati"
+	echo "secret = $(cat "`+saved+`")"
+	echo "attribute.username = alice"
+	;;
+clear) rm -f "`+saved+`" ;;
+esac
+`, 0700)
+	keyring := &SecretService{Tool: tool}
+	want := &Credential{Host: "parvati.example.com"}
+	if cred, err := keyring.Get(want); cred != nil || err != nil {
+		t.Errorf("Expected empty keyring, got %+v (%v)", cred, err)
+	}
+	if err := keyring.Store(&Credential{Host: "parvati.example.com", Username: "alice", Password: "secret"}); err != nil {
+		t.Fatalf("Store failed: %s", err.Error())
+	}
+	args, _ := ioutil.ReadFile(saved + ".args")
+	if !strings.Contains(string(args), "service parvati host parvati.example.com username alice") {
+		t.Errorf("Unexpected store arguments: %s", string(args))
+	}
+	cred, err := keyring.Get(want)
+	if err != nil || cred == nil || cred.Username != "alice" || cred.Password != "secret" {
+		t.Errorf("Unexpected lookup %+v (%v)", cred, err)
+	}
+	if err := keyring.Erase(cred); err != nil {
+		t.Errorf("Erase failed: %s", err.Error())
+	}
+	if cred, _ := keyring.Get(want); cred != nil {
+		t.Errorf("Password still found after erase: %+v", cred)
+	}
+}
+
+func TestLoadCredentialsOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "creds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldPath, oldNetrc := os.Getenv("PATH"), os.Getenv("NETRC")
+	defer func() {
+		os.Setenv("PATH", oldPath)
+		os.Setenv("NETRC", oldNetrc)
+	}()
+	// no secret-tool to be found
+	os.Setenv("PATH", dir)
+	os.Setenv("NETRC", writeFile(t, dir, "netrc", testNetrc, 0600))
+
+	conf := &ApiConfig{URI: "https://parvati.example.com", Password: "inline"}
+	if conf.LoadCredentials(); conf.Password != "inline" || conf.PasswordSource != CredentialsConfig {
+		t.Errorf("Config password should win: %+v", conf)
+	}
+	conf = &ApiConfig{URI: "https://parvati.example.com"}
+	if conf.LoadCredentials(); conf.Password != "two words" || conf.PasswordSource != CredentialsNetrc {
+		t.Errorf("Expected netrc password, got %+v", conf)
+	}
+	if err := checkNetrcMode(os.Getenv("NETRC")); err != nil {
+		t.Errorf("A private netrc was complained about: %s", err.Error())
+	}
+	if os.PathSeparator != '\\' {
+		os.Chmod(os.Getenv("NETRC"), 0644)
+		if err := checkNetrcMode(os.Getenv("NETRC")); err == nil || !strings.Contains(err.Error(), "chmod 600") {
+			t.Errorf("Expected a readable netrc to be complained about, got %v", err)
+		}
+	}
+	conf = &ApiConfig{URI: "https://parvati.example.com", Username: "carol"}
+	if conf.LoadCredentials(); conf.Password != "" || conf.PasswordSource != "" {
+		t.Errorf("Another user's password was used: %+v", conf)
+	}
+	// the missing keyring is explained when no password is found
+	err = conf.CheckAuth()
+	if err == nil || !strings.Contains(err.Error(), "'secret-tool' was not found") || !strings.Contains(err.Error(), "libsecret-tools") {
+		t.Errorf("Expected the missing secret-tool to be reported, got %v", err)
+	}
+	if _, err := conf.StoreCredentials(CredentialsKeyring); err == nil || !strings.Contains(err.Error(), "libsecret-tools") {
+		t.Errorf("Expected storing without secret-tool to explain why, got %v", err)
+	}
+
+	// a failing helper and keyring fall through to netrc
+	writeFile(t, dir, "secret-tool", "#!/bin/sh\necho 'no D-Bus session' >&2\nexit 2\n", 0700)
+	failing := writeFile(t, dir, "failing-helper", "#!/bin/sh\nexit 1\n", 0700)
+	conf = &ApiConfig{URI: "https://parvati.example.com", CredentialHelper: failing}
+	if conf.LoadCredentials(); conf.Password != "two words" || conf.PasswordSource != CredentialsNetrc {
+		t.Errorf("Expected netrc password after failures, got %+v", conf)
+	}
+	if len(conf.CredentialErrors) != 2 {
+		t.Errorf("Expected the helper and keyring failures to be noted, got %v", conf.CredentialErrors)
+	}
+}
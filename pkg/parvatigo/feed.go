@@ -0,0 +1,308 @@
+package parvatigo
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/misatosangel/parvati-api-client/pkg/swagger"
+)
+
+// A single host or waiter announcement, as shown in a feed.
+type FeedEntry struct {
+	Waiter swagger.Waiter
+	Status string
+	Live   bool
+}
+
+// Unique, stable id for the announcement, derived from the waiter id.
+func (self *FeedEntry) GUID(base string) string {
+	host := base
+	if u, err := url.Parse(base); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	return fmt.Sprintf("tag:%s,2016:waiter/%d", host, self.Waiter.Id)
+}
+
+func (self *FeedEntry) Title() string {
+	nick := self.Waiter.User.Nick
+	if nick == "" {
+		nick = self.Waiter.DisplayName
+	}
+	game := self.Waiter.Game.Name
+	if game == "" {
+		game = self.Waiter.Game.UrlShortName
+	}
+	what := "waiting for a host"
+	if self.Waiter.IsHosting {
+		what = "hosting"
+	}
+	s := fmt.Sprintf("%s %s %s", nick, what, game)
+	if self.Status != "" {
+		s += " [" + self.Status + "]"
+	}
+	return s
+}
+
+func (self *FeedEntry) Summary() string {
+	s := self.Waiter.Message
+	if !self.Live {
+		if s != "" {
+			s += " "
+		}
+		s += "(no longer listed)"
+	}
+	return s
+}
+
+// Gets the current host list for a game plus up to historyLimit recent
+// announcements, newest first. If user is given, history is that user's
+// history, otherwise the global history filtered down to the game. A
+// negative historyLimit is taken as 0.
+func (self *Api) GetFeedEntries(game *swagger.Game, user string, historyLimit int32) ([]FeedEntry, *ApiError) {
+	if historyLimit < 0 {
+		historyLimit = 0
+	}
+	list, err := self.CheckListedHosts(game, nil)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]FeedEntry, 0, len(list.Hosts)+len(list.Waits)+int(historyLimit))
+	seen := make(map[uint64]bool)
+	add := func(w swagger.Waiter, status string, live bool) {
+		if seen[w.Id] {
+			return
+		}
+		seen[w.Id] = true
+		if w.Game.UrlShortName == "" {
+			w.Game = *game
+		}
+		out = append(out, FeedEntry{Waiter: w, Status: status, Live: live})
+	}
+	for _, h := range list.Hosts {
+		add(h.Host.BaseInfo, h.Status.Status, true)
+	}
+	for _, w := range list.Waits {
+		add(w.Waiter, w.Status.Status, true)
+	}
+	if historyLimit > 0 {
+		hosts, hErr := self.gameHistory(game, user, historyLimit)
+		if hErr != nil {
+			return nil, hErr
+		}
+		for _, h := range hosts {
+			status := ""
+			if l := len(h.Checks); l > 0 && h.Checks[l-1] != nil {
+				status = h.Checks[l-1].Status
+			}
+			add(h.BaseInfo, status, false)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].Waiter.Started.After(out[j].Waiter.Started)
+	})
+	return out, nil
+}
+
+// The most history pages read looking for a game's announcements, as the
+// history APIs cannot filter by game.
+const gameHistoryPages = 5
+
+// Up to limit of a game's most recent announcements, newest first, from the
+// user's history or else the global one. Whole pages are read, going back
+// until enough are found, so other games' announcements do not crowd the
+// game out.
+func (self *Api) gameHistory(game *swagger.Game, user string, limit int32) ([]swagger.Host, *ApiError) {
+	const pageSize = 100
+	out := make([]swagger.Host, 0, limit)
+	var offset int32
+	var before *time.Time
+	for page := 0; page < gameHistoryPages && int32(len(out)) < limit; page++ {
+		var hosts []swagger.Host
+		more := false
+		if user != "" {
+			var err *ApiError
+			if hosts, err = self.userHistoryBefore(user, before, pageSize); err != nil {
+				return nil, err
+			}
+			more = len(hosts) == pageSize
+		} else {
+			hist, err := self.GetHistory(offset, pageSize)
+			if err != nil {
+				return nil, err
+			}
+			for _, h := range hist.Hosts.Hosts {
+				hosts = append(hosts, h.Host)
+			}
+			offset += int32(len(hosts))
+			more = len(hosts) == pageSize && offset < hist.Count
+		}
+		for _, h := range hosts {
+			if h.BaseInfo.Game.Id != 0 && h.BaseInfo.Game.Id != game.Id {
+				continue
+			}
+			if int32(len(out)) < limit {
+				out = append(out, h)
+			}
+		}
+		if !more {
+			break
+		}
+		oldest := hosts[len(hosts)-1].BaseInfo.Started
+		before = &oldest
+	}
+	return out, nil
+}
+
+// Global recent host history.
+func (self *Api) GetHistory(offset, limit int32) (*swagger.UserHistory, *ApiError) {
+	var hist *swagger.UserHistory
+	r, err := self.call(func(c *apiClients) (r *swagger.APIResponse, err error) {
+		hist, r, err = c.HApi.HistoryGet(offset, limit)
+		return
+	})
+	self.Metrics.observeCall("history", r, err)
+	if err != nil {
+		return nil, ApiErr(r, err)
+	}
+	return hist, nil
+}
+
+// Host history of a single user, optionally only since a given time.
+func (self *Api) GetUserHistory(user string, since *time.Time, limit int32) ([]swagger.Host, *ApiError) {
+	var hosts []swagger.Host
+	r, err := self.call(func(c *apiClients) (r *swagger.APIResponse, err error) {
+		hosts, r, err = c.UApi.HistoryGet(user, since, nil, false, limit)
+		return
+	})
+	self.Metrics.observeCall("user_history", r, err)
+	if err != nil {
+		return nil, ApiErr(r, err)
+	}
+	return hosts, nil
+}
+
+// Host history of a single user from before a given time, if any.
+func (self *Api) userHistoryBefore(user string, before *time.Time, limit int32) ([]swagger.Host, *ApiError) {
+	var hosts []swagger.Host
+	r, err := self.call(func(c *apiClients) (r *swagger.APIResponse, err error) {
+		hosts, r, err = c.UApi.HistoryGet(user, nil, before, false, limit)
+		return
+	})
+	self.Metrics.observeCall("user_history", r, err)
+	if err != nil {
+		return nil, ApiErr(r, err)
+	}
+	return hosts, nil
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Link    atomLink    `xml:"link"`
+	Updated string      `xml:"updated"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	Title   string     `xml:"title"`
+	ID      string     `xml:"id"`
+	Updated string     `xml:"updated"`
+	Author  atomAuthor `xml:"author"`
+	Summary string     `xml:"summary,omitempty"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title       string    `xml:"title"`
+	Link        string    `xml:"link"`
+	Description string    `xml:"description"`
+	Items       []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	GUID        rssGUID `xml:"guid"`
+	PubDate     string  `xml:"pubDate"`
+	Description string  `xml:"description,omitempty"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+// Renders entries as an "atom" or "rss" document. link is the backend
+// base URI, used both as the feed link and to build entry GUIDs.
+func RenderFeed(w io.Writer, format, title, link string, entries []FeedEntry) error {
+	var doc interface{}
+	switch format {
+	case "atom":
+		updated := time.Now()
+		if len(entries) > 0 {
+			updated = entries[0].Waiter.Started
+		}
+		feed := atomFeed{
+			Title:   title,
+			ID:      link,
+			Link:    atomLink{Href: link},
+			Updated: updated.UTC().Format(time.RFC3339),
+			Entries: make([]atomEntry, len(entries)),
+		}
+		for i := range entries {
+			e := &entries[i]
+			feed.Entries[i] = atomEntry{
+				Title:   e.Title(),
+				ID:      e.GUID(link),
+				Updated: e.Waiter.Started.UTC().Format(time.RFC3339),
+				Author:  atomAuthor{Name: e.Waiter.User.Nick},
+				Summary: e.Summary(),
+			}
+		}
+		doc = feed
+	case "rss":
+		feed := rssFeed{
+			Version: "2.0",
+			Channel: rssChannel{Title: title, Link: link, Description: title, Items: make([]rssItem, len(entries))},
+		}
+		for i := range entries {
+			e := &entries[i]
+			feed.Channel.Items[i] = rssItem{
+				Title:       e.Title(),
+				GUID:        rssGUID{Value: e.GUID(link)},
+				PubDate:     e.Waiter.Started.UTC().Format(time.RFC1123Z),
+				Description: e.Summary(),
+			}
+		}
+		doc = feed
+	default:
+		return fmt.Errorf("Unknown feed format: '%s'. Use atom or rss.\n", format)
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
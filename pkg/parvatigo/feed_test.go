@@ -0,0 +1,165 @@
+package parvatigo
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/misatosangel/parvati-api-client/pkg/swagger"
+)
+
+func testFeedEntries() []FeedEntry {
+	started := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	return []FeedEntry{
+		{
+			Waiter: swagger.Waiter{Id: 7, User: swagger.User{Nick: "alice"}, Message: "come & play", IsHosting: true,
+				Game: swagger.Game{Name: "Hisoutensoku"}, Started: started},
+			Status: "Waiting",
+			Live:   true,
+		},
+		{
+			Waiter: swagger.Waiter{Id: 3, DisplayName: "bob", Game: swagger.Game{UrlShortName: "th105"}, Started: started.Add(-time.Hour)},
+		},
+	}
+}
+
+func TestRenderFeed(t *testing.T) {
+	entries := testFeedEntries()
+	link := "https://parvati.example.com/api"
+
+	var buf bytes.Buffer
+	if err := RenderFeed(&buf, "atom", "Parvati hosts", link, entries); err != nil {
+		t.Fatalf("Atom render failed: %s", err.Error())
+	}
+	if !strings.HasPrefix(buf.String(), xml.Header) {
+		t.Errorf("Atom feed has no XML header")
+	}
+	var atom atomFeed
+	if err := xml.Unmarshal(buf.Bytes(), &atom); err != nil {
+		t.Fatalf("Atom feed does not parse: %s", err.Error())
+	}
+	if atom.Title != "Parvati hosts" || atom.Link.Href != link || atom.Updated != "2020-01-02T03:04:05Z" || len(atom.Entries) != 2 {
+		t.Fatalf("Unexpected atom feed: %+v", atom)
+	}
+	first := atom.Entries[0]
+	if first.Title != "alice hosting Hisoutensoku [Waiting]" || first.ID != "tag:parvati.example.com,2016:waiter/7" ||
+		first.Author.Name != "alice" || first.Summary != "come & play" {
+		t.Errorf("Unexpected atom entry: %+v", first)
+	}
+	if got := atom.Entries[1]; got.Title != "bob waiting for a host th105" || got.Summary != "(no longer listed)" || got.Updated != "2020-01-02T02:04:05Z" {
+		t.Errorf("Unexpected atom entry: %+v", got)
+	}
+
+	buf.Reset()
+	if err := RenderFeed(&buf, "rss", "Parvati hosts", link, entries); err != nil {
+		t.Fatalf("RSS render failed: %s", err.Error())
+	}
+	var rss rssFeed
+	if err := xml.Unmarshal(buf.Bytes(), &rss); err != nil {
+		t.Fatalf("RSS feed does not parse: %s", err.Error())
+	}
+	if rss.Version != "2.0" || rss.Channel.Title != "Parvati hosts" || rss.Channel.Link != link || len(rss.Channel.Items) != 2 {
+		t.Fatalf("Unexpected rss feed: %+v", rss)
+	}
+	item := rss.Channel.Items[0]
+	if item.Title != "alice hosting Hisoutensoku [Waiting]" || item.GUID.Value != "tag:parvati.example.com,2016:waiter/7" ||
+		item.GUID.IsPermaLink || item.PubDate != "Thu, 02 Jan 2020 03:04:05 +0000" || item.Description != "come & play" {
+		t.Errorf("Unexpected rss item: %+v", item)
+	}
+
+	buf.Reset()
+	if err := RenderFeed(&buf, "rss", "Empty", link, nil); err != nil {
+		t.Fatalf("Empty RSS render failed: %s", err.Error())
+	}
+	if err := RenderFeed(&buf, "json", "Parvati hosts", link, entries); err == nil {
+		t.Errorf("Expected an unknown format to fail")
+	}
+}
+
+func TestGameHistory(t *testing.T) {
+	// 250 announcements, newest first, one in ten of them for game 1
+	start := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	all := make([]swagger.Host, 250)
+	for i := range all {
+		game := swagger.Game{Id: 2}
+		if i%10 == 0 {
+			game.Id = 1
+		}
+		all[i] = swagger.Host{BaseInfo: swagger.Waiter{Id: uint64(i + 1), Game: game, Started: start.Add(-time.Duration(i) * time.Minute)}}
+	}
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		q := r.URL.Query()
+		limit, _ := strconv.Atoi(q.Get("limit"))
+		from := 0
+		var body interface{}
+		switch r.URL.Path {
+		case "/history":
+			from, _ = strconv.Atoi(q.Get("offset"))
+		case "/users/alice/history":
+			if before, err := time.Parse(time.RFC3339Nano, q.Get("before")); err == nil {
+				for from < len(all) && !all[from].BaseInfo.Started.Before(before) {
+					from++
+				}
+			}
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		to := from + limit
+		if to > len(all) {
+			to = len(all)
+		}
+		page := all[from:to]
+		if r.URL.Path == "/history" {
+			hist := &swagger.UserHistory{Offset: int32(from), Limit: int32(limit), Count: int32(len(all))}
+			for _, h := range page {
+				hist.Hosts.Hosts = append(hist.Hosts.Hosts, swagger.HosterStatus{Host: h})
+			}
+			body = hist
+		} else {
+			body = page
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(body)
+	}))
+	defer srv.Close()
+	api, err := NewApi(&ApiConfig{URI: srv.URL, Username: "alice", Password: "x"}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	game := &swagger.Game{Id: 1}
+	for _, test := range []struct {
+		user     string
+		limit    int32
+		want     int
+		requests int
+	}{
+		{"", 15, 15, 2},
+		{"", 30, 25, 3},
+		{"alice", 15, 15, 2},
+		{"alice", 30, 25, 3},
+	} {
+		requests = 0
+		hosts, apiErr := api.gameHistory(game, test.user, test.limit)
+		if apiErr != nil {
+			t.Fatalf("gameHistory failed: %s", apiErr.Error())
+		}
+		if len(hosts) != test.want || requests != test.requests {
+			t.Errorf("User '%s' limit %d: expected %d in %d requests, got %d in %d", test.user, test.limit, test.want, test.requests, len(hosts), requests)
+		}
+		for i, h := range hosts {
+			if h.BaseInfo.Game.Id != 1 || h.BaseInfo.Id != uint64(i*10+1) {
+				t.Errorf("User '%s': unexpected announcement %d: %+v", test.user, i, h.BaseInfo)
+				break
+			}
+		}
+	}
+}
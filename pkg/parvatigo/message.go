@@ -0,0 +1,200 @@
+package parvatigo
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/misatosangel/parvati-api-client/pkg/swagger"
+)
+
+// What host and wait messages, which are Go templates, can use, e.g.
+// "{{.Game}} from {{.Region}}, game {{.Played}} tonight".
+type MessageVars struct {
+	// The game's name and short name on Parvati
+	Game      string
+	ShortName string
+	// Your nick
+	Nick string
+	// Your continent, from your Parvati location, if known
+	Region string
+	// How long you have been hosting the game, to the second
+	Uptime time.Duration
+	// When the message is used
+	Time time.Time
+	// The games of this game played this session, from your history
+	played func() int
+}
+
+// The vars for a game, with Time set to now.
+func NewMessageVars(game *swagger.Game, user *swagger.User, hostingSince time.Time) *MessageVars {
+	vars := &MessageVars{Time: time.Now()}
+	if game != nil {
+		vars.Game = game.Name
+		vars.ShortName = game.UrlShortName
+	}
+	if user != nil {
+		vars.Nick = user.Nick
+		vars.Region = Region(user.Location)
+	}
+	if !hostingSince.IsZero() {
+		vars.Uptime = vars.Time.Sub(hostingSince).Truncate(time.Second)
+	}
+	return vars
+}
+
+// Sets how to count the games played, which is only asked for if a
+// message uses it.
+func (self *MessageVars) SetPlayed(count func() int) {
+	self.played = count
+}
+
+func (self *MessageVars) Played() int {
+	if self.played == nil {
+		return 0
+	}
+	return self.played()
+}
+
+// "morning", "afternoon", "evening" or "night", by the hour of Time.
+func (self *MessageVars) TimeOfDay() string {
+	switch h := self.Time.Hour(); {
+	case h >= 5 && h < 12:
+		return "morning"
+	case h >= 12 && h < 17:
+		return "afternoon"
+	case h >= 17 && h < 22:
+		return "evening"
+	}
+	return "night"
+}
+
+// A continent, as a box of latitudes and longitudes.
+type continent struct {
+	name         string
+	south, north float64
+	west, east   float64
+}
+
+// Checked in order, so a box comes before any larger one it overlaps. The
+// boxes are coarse: places near a border, such as in the Mediterranean or
+// the Caucasus, may be given the neighbouring continent.
+var continents = []continent{
+	{"Antarctica", -90, -60, -180, 181},
+	{"Oceania", -50, 30, -180, -130},
+	{"North America", 12, 85, -180, -31.5},
+	{"North America", 7, 12, -92.3, -77.2},
+	{"South America", -60, 12, -92.3, -30},
+	{"Africa", 27.6, 36, -13.2, -1},
+	{"Africa", 19, 37.3, -1, 11.6},
+	{"Asia", 29.5, 37.5, 34.2, 50},
+	{"Europe", 35, 72, -31.5, 29.5},
+	{"Europe", 42, 72, 29.5, 60},
+	{"Africa", -40, 35, -25.5, 35},
+	{"Africa", -40, 12, 35, 64},
+	{"Oceania", -30, 20, 140, 181},
+	{"Oceania", -50, -10.5, 110, 181},
+	{"Asia", -11, 85, 29.5, 181},
+}
+
+// The continent for a location, e.g. "Europe" or "Asia", or "" if it is in
+// none, such as (0, 0).
+func Region(loc swagger.Location) string {
+	if loc.Lat == 0 && loc.Long == 0 {
+		return ""
+	}
+	for _, c := range continents {
+		if loc.Lat >= c.south && loc.Lat < c.north && loc.Long >= c.west && loc.Long < c.east {
+			return c.name
+		}
+	}
+	return ""
+}
+
+// Parses a message as a template, checking it runs with empty vars so
+// unknown variables are found before it is used.
+func ParseMessage(text string) (*template.Template, error) {
+	tmpl, err := template.New("message").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if err := tmpl.Execute(ioutil.Discard, &MessageVars{}); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// Expands a message given outside the config, such as with --host-message.
+// A message that does not parse is logged and used as it is.
+func ExpandMessage(text string, vars *MessageVars) string {
+	if !strings.Contains(text, "{{") {
+		return text
+	}
+	tmpl, err := ParseMessage(text)
+	if err != nil {
+		log.Printf("Using message '%s' as it is: %s\n", text, err.Error())
+		return text
+	}
+	return expand(tmpl, text, vars)
+}
+
+func expand(tmpl *template.Template, text string, vars *MessageVars) string {
+	if tmpl == nil || vars == nil {
+		return text
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, vars); err != nil {
+		log.Printf("Using message '%s' as it is: %s\n", text, err.Error())
+		return text
+	}
+	return buf.String()
+}
+
+// Parses every game's host and wait messages, as ReadConfig does.
+func (self *ApiConfig) ParseMessages() error {
+	for name, g := range self.Games {
+		if err := g.parseMessages(name); err != nil {
+			return err
+		}
+		self.Games[name] = g
+	}
+	return nil
+}
+
+func (self *GameInfo) parseMessages(name string) error {
+	var err error
+	self.parsed = true
+	if self.host, err = newMessageList(name, "hostMessage", self.HostOrder, self.HostMessages, self.HostWeights, self.HostSchedule); err != nil {
+		return err
+	}
+	self.wait, err = newMessageList(name, "waitMessage", self.WaitOrder, self.WaitMessages, self.WaitWeights, self.WaitSchedule)
+	return err
+}
+
+// Parses the messages of a GameInfo not from ReadConfig. Messages that do
+// not parse are used as they are, in turn.
+func (self *GameInfo) ensureParsed() {
+	if self.parsed {
+		return
+	}
+	if err := self.parseMessages(self.PrettyName()); err != nil {
+		self.host = messageList{messages: self.HostMessages}
+		self.wait = messageList{messages: self.WaitMessages}
+	}
+}
+
+func parseMessages(game, key string, messages []string) ([]*template.Template, error) {
+	out := make([]*template.Template, len(messages))
+	for i, m := range messages {
+		tmpl, err := ParseMessage(m)
+		if err != nil {
+			return nil, fmt.Errorf("Bad game.%s.%s '%s': %s\n", game, key, m, err.Error())
+		}
+		out[i] = tmpl
+	}
+	return out, nil
+}
@@ -0,0 +1,111 @@
+package parvatigo
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/misatosangel/parvati-api-client/pkg/swagger"
+)
+
+func TestHostMessageTemplates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "messages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := writeFile(t, dir, "config", `[game "th123"]
+	hostMessage = Good {{.TimeOfDay}} from {{.Nick}} in {{.Region}}
+	hostMessage = {{.Game}} up {{.Uptime}}, game {{.Played}}
+	hostMessage = plain
+`, 0600)
+	conf, err := ReadConfig(path)
+	if err != nil {
+		t.Fatalf("ReadConfig failed: %s", err.Error())
+	}
+	g := conf.Games["th123"]
+	started := time.Date(2020, 1, 1, 20, 0, 0, 0, time.Local)
+	vars := NewMessageVars(&swagger.Game{Name: "Hisoutensoku", UrlShortName: "th123"},
+		&swagger.User{Nick: "alice", Location: swagger.Location{Lat: 51.5, Long: -0.1}}, started)
+	vars.Time = started.Add(90 * time.Second)
+	vars.Uptime = vars.Time.Sub(started)
+	vars.SetPlayed(func() int { return 3 })
+	for _, want := range []string{"Good evening from alice in Europe", "Hisoutensoku up 1m30s, game 3", "plain", "Good evening from alice in Europe"} {
+		if got := g.HostMessage(vars); got != want {
+			t.Errorf("Expected '%s', got '%s'", want, got)
+		}
+	}
+	if got := ExpandMessage("{{.Nick}} here", vars); got != "alice here" {
+		t.Errorf("Unexpected expansion '%s'", got)
+	}
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+	if got := ExpandMessage("{{.Nick", vars); got != "{{.Nick" {
+		t.Errorf("Bad template not used as is: '%s'", got)
+	}
+	if !strings.Contains(logged.String(), "Using message '{{.Nick' as it is") {
+		t.Errorf("Bad template not logged: '%s'", logged.String())
+	}
+
+	for _, bad := range []string{"{{.Nick", "{{.Nope}}"} {
+		path := writeFile(t, dir, "bad", "[game \"th123\"]\n\thostMessage = "+bad+"\n", 0600)
+		if _, err := ReadConfig(path); err == nil || !strings.Contains(err.Error(), "game.th123.hostMessage") {
+			t.Errorf("Expected '%s' to fail at load, got %v", bad, err)
+		}
+		f, _ := OpenConfigFile(path)
+		loaded, _ := f.Load()
+		if len(loaded.Validate()) != 1 {
+			t.Errorf("Expected Validate to report '%s'", bad)
+		}
+	}
+}
+
+func TestRegion(t *testing.T) {
+	tests := []struct {
+		place     string
+		lat, long float64
+		want      string
+	}{
+		{"McMurdo", -77.8, 166.7, "Antarctica"},
+		{"Honolulu", 21.3, -157.9, "Oceania"},
+		{"Waitangi", -43.95, -176.56, "Oceania"},
+		{"Anchorage", 61.2, -149.9, "North America"},
+		{"New York", 40.7, -74.0, "North America"},
+		{"Havana", 23.1, -82.4, "North America"},
+		{"Panama City", 9.0, -79.5, "North America"},
+		{"Cartagena", 10.4, -75.5, "South America"},
+		{"Buenos Aires", -34.6, -58.4, "South America"},
+		{"Casablanca", 33.6, -7.6, "Africa"},
+		{"Algiers", 36.8, 3.1, "Africa"},
+		{"Tel Aviv", 32.1, 34.8, "Asia"},
+		{"Reykjavik", 64.1, -21.9, "Europe"},
+		{"Ponta Delgada", 37.7, -25.7, "Europe"},
+		{"Malaga", 36.7, -4.4, "Europe"},
+		{"Istanbul", 41.0, 28.98, "Europe"},
+		{"Moscow", 55.75, 37.6, "Europe"},
+		{"Cairo", 30.0, 31.2, "Africa"},
+		{"Nairobi", -1.3, 36.8, "Africa"},
+		{"Port Louis", -20.2, 57.5, "Africa"},
+		{"Hagatna", 13.5, 144.75, "Oceania"},
+		{"Sydney", -33.9, 151.2, "Oceania"},
+		{"Ankara", 39.9, 32.9, "Asia"},
+		{"Riyadh", 24.7, 46.7, "Asia"},
+		{"Delhi", 28.6, 77.2, "Asia"},
+		{"Jakarta", -6.2, 106.8, "Asia"},
+		{"Tokyo", 35.7, 139.7, "Asia"},
+		{"nowhere", 0, 0, ""},
+	}
+	for _, test := range tests {
+		loc := swagger.Location{Lat: test.lat, Long: test.long}
+		vars := NewMessageVars(nil, &swagger.User{Nick: "alice", Location: loc}, time.Time{})
+		if got := ExpandMessage("{{.Region}}", vars); got != test.want {
+			t.Errorf("Expected %s to be in '%s', got '%s'", test.place, test.want, got)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package parvatigo
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/misatosangel/parvati-api-client/pkg/swagger"
+)
+
+// Metrics holds counters and gauges describing what an Api has been doing.
+// It renders in the Prometheus text exposition format, so can be scraped
+// directly. All methods are safe to call on a nil *Metrics.
+type Metrics struct {
+	mu       sync.Mutex
+	families map[string]*metricFamily
+	statuses map[string]gameStatus
+}
+
+type metricFamily struct {
+	name   string
+	help   string
+	kind   string // "counter" or "gauge"
+	values map[string]float64
+}
+
+type gameStatus struct {
+	status string
+	since  time.Time
+}
+
+const (
+	MetricAPICalls         = "parvati_api_calls_total"
+	MetricAPILastSuccess   = "parvati_api_last_success_timestamp_seconds"
+	MetricChecks           = "parvati_host_checks_total"
+	MetricGameStatus       = "parvati_game_status"
+	MetricStatusSeconds    = "parvati_game_status_seconds_total"
+	MetricIPChanges        = "parvati_ip_changes_total"
+	MetricLastIPUpdate     = "parvati_last_ip_update_timestamp_seconds"
+	MetricAnnounces        = "parvati_announcements_total"
+	MetricAnnounceFailures = "parvati_announcement_failures_total"
+	MetricLastAnnounce     = "parvati_last_announcement_timestamp_seconds"
+)
+
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		families: make(map[string]*metricFamily, 10),
+		statuses: make(map[string]gameStatus, 3),
+	}
+	m.register(MetricAPICalls, "counter", "Parvati API calls by endpoint and HTTP status code.")
+	m.register(MetricAPILastSuccess, "gauge", "Unix time of the last successful call to each endpoint.")
+	m.register(MetricChecks, "counter", "Host check results by game and status.")
+	m.register(MetricGameStatus, "gauge", "Set to 1 for the current status of each game.")
+	m.register(MetricStatusSeconds, "counter", "Seconds spent in each status by game, e.g. hosting (Waiting) or Playing.")
+	m.register(MetricIPChanges, "counter", "Stored IP changes sent to Parvati by address family.")
+	m.register(MetricLastIPUpdate, "gauge", "Unix time of the last successful IP update.")
+	m.register(MetricAnnounces, "counter", "Successful host/wait announcements by game.")
+	m.register(MetricAnnounceFailures, "counter", "Failed host/wait announcements by game.")
+	m.register(MetricLastAnnounce, "gauge", "Unix time of the last successful announcement by game.")
+	return m
+}
+
+func (self *Metrics) register(name, kind, help string) {
+	self.families[name] = &metricFamily{name: name, help: help, kind: kind, values: make(map[string]float64)}
+}
+
+// labels are given as alternating name, value pairs
+func labelString(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		v := strings.Replace(labels[i+1], "\\", "\\\\", -1)
+		v = strings.Replace(v, "\"", "\\\"", -1)
+		v = strings.Replace(v, "\n", "\\n", -1)
+		parts = append(parts, labels[i]+"=\""+v+"\"")
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// Add increments the named metric with the given label pairs by v.
+func (self *Metrics) Add(name string, v float64, labels ...string) {
+	if self == nil {
+		return
+	}
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if f := self.families[name]; f != nil {
+		f.values[labelString(labels)] += v
+	}
+}
+
+// Set sets the named metric with the given label pairs to v.
+func (self *Metrics) Set(name string, v float64, labels ...string) {
+	if self == nil {
+		return
+	}
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if f := self.families[name]; f != nil {
+		f.values[labelString(labels)] = v
+	}
+}
+
+// Get returns the current value of the named metric with the given label pairs.
+func (self *Metrics) Get(name string, labels ...string) float64 {
+	if self == nil {
+		return 0
+	}
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if f := self.families[name]; f != nil {
+		return f.values[labelString(labels)]
+	}
+	return 0
+}
+
+func (self *Metrics) observeCall(endpoint string, r *swagger.APIResponse, err error) {
+	if self == nil {
+		return
+	}
+	code := "none"
+	if r != nil && r.Response != nil {
+		code = fmt.Sprintf("%d", r.StatusCode)
+	}
+	self.Add(MetricAPICalls, 1, "endpoint", endpoint, "code", code)
+	if err == nil {
+		self.Set(MetricAPILastSuccess, float64(time.Now().Unix()), "endpoint", endpoint)
+	}
+}
+
+// ObserveStatus records a status seen for a game, accumulating the time
+// spent in the previous status.
+func (self *Metrics) ObserveStatus(game, status string) {
+	if self == nil || status == "" {
+		return
+	}
+	self.Add(MetricChecks, 1, "game", game, "status", status)
+	now := time.Now()
+	self.mu.Lock()
+	last, seen := self.statuses[game]
+	self.statuses[game] = gameStatus{status: status, since: now}
+	self.mu.Unlock()
+	if seen {
+		self.Add(MetricStatusSeconds, now.Sub(last.since).Seconds(), "game", game, "status", last.status)
+		if last.status != status {
+			self.Set(MetricGameStatus, 0, "game", game, "status", last.status)
+		}
+	}
+	self.Set(MetricGameStatus, 1, "game", game, "status", status)
+}
+
+func (self *Metrics) observeAnnounce(game string, err error) {
+	if self == nil {
+		return
+	}
+	if err != nil {
+		self.Add(MetricAnnounceFailures, 1, "game", game)
+		return
+	}
+	self.Add(MetricAnnounces, 1, "game", game)
+	self.Set(MetricLastAnnounce, float64(time.Now().Unix()), "game", game)
+}
+
+// WriteTo writes all metrics in the Prometheus text exposition format.
+func (self *Metrics) WriteTo(w io.Writer) (int64, error) {
+	if self == nil {
+		return 0, nil
+	}
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	names := make([]string, 0, len(self.families))
+	for n := range self.families {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	var total int64
+	for _, n := range names {
+		f := self.families[n]
+		cnt, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+		total += int64(cnt)
+		if err != nil {
+			return total, err
+		}
+		keys := make([]string, 0, len(f.values))
+		for k := range f.values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			cnt, err = fmt.Fprintf(w, "%s%s %g\n", f.name, k, f.values[k])
+			total += int64(cnt)
+			if err != nil {
+				return total, err
+			}
+		}
+	}
+	return total, nil
+}
+
+func (self *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	self.WriteTo(w)
+}
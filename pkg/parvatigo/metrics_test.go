@@ -0,0 +1,75 @@
+package parvatigo
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+)
+
+func testMetrics() *Metrics {
+	m := &Metrics{families: make(map[string]*metricFamily), statuses: make(map[string]gameStatus)}
+	m.register(MetricAPICalls, "counter", "Parvati API calls by endpoint and HTTP status code.")
+	m.register(MetricLastIPUpdate, "gauge", "Unix time of the last successful IP update.")
+	return m
+}
+
+const testMetricsText = `# HELP parvati_api_calls_total Parvati API calls by endpoint and HTTP status code.
+# TYPE parvati_api_calls_total counter
+parvati_api_calls_total{endpoint="games",code="200"} 2
+parvati_api_calls_total{endpoint="odd \"name\"\\path\nline",code="none"} 1
+# HELP parvati_last_ip_update_timestamp_seconds Unix time of the last successful IP update.
+# TYPE parvati_last_ip_update_timestamp_seconds gauge
+parvati_last_ip_update_timestamp_seconds 1.5e+09
+`
+
+func TestMetricsWriteTo(t *testing.T) {
+	m := testMetrics()
+	m.Add(MetricAPICalls, 1, "endpoint", "games", "code", "200")
+	m.Add(MetricAPICalls, 1, "endpoint", "games", "code", "200")
+	m.Add(MetricAPICalls, 1, "endpoint", "odd \"name\"\\path\nline", "code", "none")
+	m.Set(MetricLastIPUpdate, 1500000000)
+	m.Add("parvati_unknown_total", 1)
+
+	var buf bytes.Buffer
+	n, err := m.WriteTo(&buf)
+	if err != nil {
+		t.Fatalf("WriteTo failed: %s", err.Error())
+	}
+	if buf.String() != testMetricsText {
+		t.Errorf("Unexpected metrics:\n%s\nexpected:\n%s", buf.String(), testMetricsText)
+	}
+	if n != int64(buf.Len()) {
+		t.Errorf("WriteTo reported %d bytes, wrote %d", n, buf.Len())
+	}
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4" {
+		t.Errorf("Unexpected content type '%s'", ct)
+	}
+	if rec.Body.String() != testMetricsText {
+		t.Errorf("Unexpected metrics served:\n%s", rec.Body.String())
+	}
+}
+
+func TestMetricsObserveStatus(t *testing.T) {
+	m := NewMetrics()
+	m.ObserveStatus("th123", "Waiting")
+	m.ObserveStatus("th123", "Playing")
+	if m.Get(MetricGameStatus, "game", "th123", "status", "Waiting") != 0 || m.Get(MetricGameStatus, "game", "th123", "status", "Playing") != 1 {
+		t.Errorf("Expected only Playing to be the current status")
+	}
+	if m.Get(MetricChecks, "game", "th123", "status", "Waiting") != 1 || m.Get(MetricChecks, "game", "th123", "status", "Playing") != 1 {
+		t.Errorf("Expected one check counted for each status")
+	}
+	if m.Get(MetricStatusSeconds, "game", "th123", "status", "Waiting") < 0 {
+		t.Errorf("Negative time spent Waiting")
+	}
+
+	// a nil Metrics does nothing
+	var none *Metrics
+	none.ObserveStatus("th123", "Waiting")
+	if n, err := none.WriteTo(&bytes.Buffer{}); n != 0 || err != nil {
+		t.Errorf("Expected nil metrics to write nothing, got %d (%v)", n, err)
+	}
+}
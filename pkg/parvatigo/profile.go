@@ -0,0 +1,132 @@
+package parvatigo
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Environment variable picking a profile when --profile is not given.
+const ProfileEnv = "PARVATI_PROFILE"
+
+// A named account from a [profile "name"] section. Unset keys are inherited
+// from the parvati section, except that a profile with its own uri or
+// username does not inherit the password or token. Each field is paired
+// with the ApiConfig field whose gcKey is parvati.KEY, so a key is added to
+// both with no other changes.
+type ProfileConfig struct {
+	URI              string `gcKey:"uri"`
+	Username         string `gcKey:"username"`
+	Password         string `gcKey:"password" gcSecret:"true"`
+	Announcer        string `gcKey:"announcer"`
+	CredentialHelper string `gcKey:"credentialHelper"`
+	CredentialStore  string `gcKey:"credentialStore"`
+	AuthMethod       string `gcKey:"authMethod"`
+	Token            string `gcKey:"token" gcSecret:"true"`
+	OAuthClientID    string `gcKey:"oauthClientId"`
+	OAuthDeviceURL   string `gcKey:"oauthDeviceUrl"`
+	OAuthTokenURL    string `gcKey:"oauthTokenUrl"`
+	OAuthScope       string `gcKey:"oauthScope"`
+	TokenCache       string `gcKey:"tokenCache"`
+}
+
+// The names of the configured profiles, sorted.
+func (self *ApiConfig) ProfileNames() []string {
+	out := make([]string, 0, len(self.Profiles))
+	for n := range self.Profiles {
+		out = append(out, n)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Applies the named profile over the parvati section. An empty name means
+// $PARVATI_PROFILE, else parvati.profile, else no profile. Call once, after
+// reading the config.
+func (self *ApiConfig) UseProfile(name string) error {
+	if name == "" {
+		name = os.Getenv(ProfileEnv)
+	}
+	if name == "" {
+		name = self.DefaultProfile
+	}
+	if name == "" {
+		return nil
+	}
+	p, ok := self.Profiles[name]
+	if !ok {
+		known := "none are configured"
+		if len(self.Profiles) != 0 {
+			known = "known profiles: " + strings.Join(self.ProfileNames(), ", ")
+		}
+		return fmt.Errorf("Unknown profile '%s' (%s)\n", name, known)
+	}
+	base := self.BaseProfile()
+	self.base = &base
+	// keys set by the environment or flags beat the profile
+	overridden := func(key string) bool {
+		return self.Override("parvati."+key) != nil
+	}
+	if p.URI != "" || p.Username != "" {
+		// another account, so the default one's secrets don't apply
+		if !overridden("password") {
+			self.Password = ""
+		}
+		if !overridden("token") {
+			self.Token = ""
+		}
+	}
+	eachProfileField(self, &p, func(key string, conf, profile *string) {
+		if *profile != "" && !overridden(key) {
+			*conf = *profile
+		}
+	})
+	self.Profile = name
+	return nil
+}
+
+// The parvati section's settings, as they were before UseProfile.
+func (self *ApiConfig) BaseProfile() ProfileConfig {
+	if self.base != nil {
+		return *self.base
+	}
+	var out ProfileConfig
+	eachProfileField(self, &out, func(key string, conf, profile *string) {
+		*profile = *conf
+	})
+	return out
+}
+
+// Calls f with each ProfileConfig key and its field in conf and p, matched
+// by their gcKey tags.
+func eachProfileField(conf *ApiConfig, p *ProfileConfig, f func(key string, conf, profile *string)) {
+	cv := reflect.ValueOf(conf).Elem()
+	ct := cv.Type()
+	pv := reflect.ValueOf(p).Elem()
+	pt := pv.Type()
+	for i := 0; i < pt.NumField(); i++ {
+		key := pt.Field(i).Tag.Get("gcKey")
+		for j := 0; j < ct.NumField(); j++ {
+			if ct.Field(j).Tag.Get("gcKey") == "parvati."+key {
+				f(key, cv.Field(j).Addr().Interface().(*string), pv.Field(i).Addr().Interface().(*string))
+				break
+			}
+		}
+	}
+}
+
+// Whether a game section applies to the active profile. Games without a
+// profile key apply to all of them.
+func (self *ApiConfig) inProfile(g *GameInfo) bool {
+	if len(g.Profiles) == 0 {
+		return true
+	}
+	for _, p := range g.Profiles {
+		if p == self.Profile {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,124 @@
+package parvatigo
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+const testProfiles = `[parvati]
+	username = alice
+	password = secret
+	uri = https://parvati.example.com
+[profile "bot"]
+	username = announcer-bot
+[profile "staging"]
+	uri = https://staging.example.com
+	username = alice
+	password = staged
+[game "th123"]
+	hostMessage = everyone
+[game "th123-staging"]
+	name = th123
+	hostMessage = testing
+	profile = staging
+[game "th105"]
+	hostMessage = bots only
+	profile = bot
+`
+
+func readTestProfiles(t *testing.T) *ApiConfig {
+	dir, err := ioutil.TempDir("", "profiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf, err := ReadConfig(writeFile(t, dir, "config", testProfiles, 0600))
+	if err != nil {
+		t.Fatalf("Unable to read config: %s", err.Error())
+	}
+	return conf
+}
+
+func gameMessages(conf *ApiConfig) map[string]string {
+	out := make(map[string]string)
+	for _, g := range conf.GetEnabledGames(nil, nil) {
+		out[g.Name] = g.HostMessages[0]
+	}
+	return out
+}
+
+func TestUseProfile(t *testing.T) {
+	old := os.Getenv(ProfileEnv)
+	defer os.Setenv(ProfileEnv, old)
+	os.Setenv(ProfileEnv, "")
+
+	conf := readTestProfiles(t)
+	if err := conf.UseProfile(""); err != nil || conf.Profile != "" || conf.Username != "alice" {
+		t.Errorf("Expected no profile, got %+v (%v)", conf, err)
+	}
+	if games := gameMessages(conf); len(games) != 1 || games["th123"] != "everyone" {
+		t.Errorf("Unexpected default games: %v", games)
+	}
+
+	conf = readTestProfiles(t)
+	if err := conf.UseProfile("bot"); err != nil {
+		t.Fatalf("UseProfile failed: %s", err.Error())
+	}
+	if conf.Username != "announcer-bot" || conf.Password != "" || conf.URI != "https://parvati.example.com" {
+		t.Errorf("Unexpected bot profile: %+v", conf)
+	}
+	if base := conf.BaseProfile(); base.Username != "alice" || base.Password != "secret" {
+		t.Errorf("Base settings lost: %+v", base)
+	}
+	if games := gameMessages(conf); len(games) != 2 || games["th105"] != "bots only" {
+		t.Errorf("Unexpected bot games: %v", games)
+	}
+
+	os.Setenv(ProfileEnv, "staging")
+	conf = readTestProfiles(t)
+	if err := conf.UseProfile(""); err != nil || conf.URI != "https://staging.example.com" || conf.Password != "staged" {
+		t.Errorf("Expected staging profile from the environment, got %+v (%v)", conf, err)
+	}
+	if games := gameMessages(conf); len(games) != 1 || games["th123"] != "testing" {
+		t.Errorf("Scoped game did not replace the default: %v", games)
+	}
+
+	conf = readTestProfiles(t)
+	if err := conf.UseProfile("prod"); err == nil {
+		t.Errorf("Expected unknown profile to fail")
+	}
+}
+
+func TestProfileKeysMatchParvati(t *testing.T) {
+	keys := ConfigKeys(&ApiConfig{})
+	n := 0
+	for _, k := range keys {
+		if !strings.HasPrefix(k.Name, "profile.*.") {
+			continue
+		}
+		n++
+		name := strings.TrimPrefix(k.Name, "profile.*.")
+		base := FindConfigKey(keys, "parvati."+name)
+		if base == nil || base.Type != k.Type || base.Secret != k.Secret {
+			t.Errorf("Expected profile key %s to match a parvati key, got %+v", name, base)
+		}
+		if want := "This profile's parvati." + name + "."; k.Description != want {
+			t.Errorf("Expected '%s' for %s, got '%s'", want, k.Name, k.Description)
+		}
+	}
+	paired := 0
+	var conf ApiConfig
+	var p ProfileConfig
+	eachProfileField(&conf, &p, func(key string, conf, profile *string) {
+		paired++
+		*conf = key
+	})
+	if paired != n || n == 0 {
+		t.Errorf("Expected all %d profile keys to be paired, got %d", n, paired)
+	}
+	if conf.OAuthDeviceURL != "oauthDeviceUrl" || conf.BaseProfile().OAuthDeviceURL != "oauthDeviceUrl" {
+		t.Errorf("Fields paired wrongly: %+v", conf.BaseProfile())
+	}
+}
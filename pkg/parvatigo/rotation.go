@@ -0,0 +1,250 @@
+package parvatigo
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// How host and wait messages are picked, from game.NAME.hostMessageOrder
+// and waitMessageOrder.
+const (
+	OrderRoundRobin = "round-robin"
+	OrderRandom     = "random"
+	// random, by hostMessageWeight
+	OrderWeighted = "weighted"
+	// each message once in a random order, then again in another
+	OrderShuffle = "shuffle"
+	// in turn, from those whose hostMessageSchedule covers the time
+	OrderSchedule = "schedule"
+	// one random message for the whole HostWatch session
+	OrderSticky = "sticky"
+)
+
+var MessageOrders = []string{OrderRoundRobin, OrderRandom, OrderWeighted, OrderShuffle, OrderSchedule, OrderSticky}
+
+// Where picking from a list of messages is up to, kept by HostWatch across
+// runs while the messages and order stay the same.
+type MessageRotation struct {
+	// Identifies the order and messages it is for
+	For  string `json:"for"`
+	Next uint   `json:"next"`
+	// The shuffled order being worked through
+	Shuffle []uint `json:"shuffle,omitempty"`
+	// the sticky message, which only lasts the session
+	sticky *uint
+}
+
+// A time of day a scheduled message is used, in minutes after midnight.
+// A window ending before it starts runs past midnight.
+type timeWindow struct {
+	from, to int
+	any      bool
+}
+
+// A game's host or wait messages with how to pick them.
+type messageList struct {
+	order     string
+	messages  []string
+	templates []*template.Template
+	weights   []uint
+	windows   []timeWindow
+	rotation  MessageRotation
+}
+
+// ~/.cache/parvati/hostwatch.json or the OS's equivalent.
+func DefaultWatchStateFile() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "parvati", "hostwatch.json"), nil
+}
+
+// Checks and parses the messages for game.NAME.KEY, with their
+// KEYOrder, KEYWeight and KEYSchedule.
+func newMessageList(game, key, order string, messages []string, weights []uint, schedule []string) (messageList, error) {
+	if order == "" {
+		order = OrderRoundRobin
+	}
+	l := messageList{order: order, messages: messages, weights: weights}
+	known := false
+	for _, o := range MessageOrders {
+		known = known || o == order
+	}
+	if !known {
+		return l, fmt.Errorf("Unknown game.%s.%sOrder '%s' (use %s)\n", game, key, order, strings.Join(MessageOrders, ", "))
+	}
+	if len(weights) > len(messages) {
+		return l, fmt.Errorf("game.%s has more %sWeight values (%d) than %ss (%d)\n", game, key, len(weights), key, len(messages))
+	}
+	if len(schedule) > len(messages) {
+		return l, fmt.Errorf("game.%s has more %sSchedule values (%d) than %ss (%d)\n", game, key, len(schedule), key, len(messages))
+	}
+	if order == OrderWeighted && len(messages) != 0 && l.totalWeight() == 0 {
+		return l, fmt.Errorf("game.%s.%sWeight values are all 0\n", game, key)
+	}
+	for _, s := range schedule {
+		w, err := parseTimeWindow(s)
+		if err != nil {
+			return l, fmt.Errorf("Bad game.%s.%sSchedule '%s': %s\n", game, key, s, err.Error())
+		}
+		l.windows = append(l.windows, w)
+	}
+	var err error
+	if l.templates, err = parseMessages(game, key, messages); err != nil {
+		return l, err
+	}
+	h := fnv.New64a()
+	h.Write([]byte(order))
+	for _, m := range messages {
+		h.Write([]byte{0})
+		h.Write([]byte(m))
+	}
+	l.rotation.For = fmt.Sprintf("%x", h.Sum64())
+	return l, nil
+}
+
+// Parses 'HH:MM-HH:MM', or '*' or nothing for any time.
+func parseTimeWindow(s string) (timeWindow, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "*" {
+		return timeWindow{any: true}, nil
+	}
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return timeWindow{}, fmt.Errorf("use HH:MM-HH:MM")
+	}
+	var w timeWindow
+	for i, p := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(p))
+		if err != nil {
+			return timeWindow{}, fmt.Errorf("use HH:MM-HH:MM")
+		}
+		if i == 0 {
+			w.from = t.Hour()*60 + t.Minute()
+		} else {
+			w.to = t.Hour()*60 + t.Minute()
+		}
+	}
+	return w, nil
+}
+
+func (self timeWindow) contains(t time.Time) bool {
+	if self.any {
+		return true
+	}
+	m := t.Hour()*60 + t.Minute()
+	if self.from <= self.to {
+		return m >= self.from && m < self.to
+	}
+	return m >= self.from || m < self.to
+}
+
+func (self *messageList) weight(i int) uint {
+	if i < len(self.weights) {
+		return self.weights[i]
+	}
+	return 1
+}
+
+func (self *messageList) totalWeight() uint {
+	total := uint(0)
+	for i := range self.messages {
+		total += self.weight(i)
+	}
+	return total
+}
+
+func (self *messageList) restore(r MessageRotation) {
+	if r.For != self.rotation.For {
+		return
+	}
+	for _, i := range r.Shuffle {
+		if i >= uint(len(self.messages)) {
+			return
+		}
+	}
+	self.rotation.Next = r.Next
+	self.rotation.Shuffle = r.Shuffle
+}
+
+// The next message, expanded with vars.
+func (self *messageList) next(vars *MessageVars) string {
+	if len(self.messages) == 0 {
+		return ""
+	}
+	now := time.Now()
+	if vars != nil && !vars.Time.IsZero() {
+		now = vars.Time
+	}
+	i := self.pick(now)
+	if i < uint(len(self.templates)) {
+		return expand(self.templates[i], self.messages[i], vars)
+	}
+	return ExpandMessage(self.messages[i], vars)
+}
+
+func (self *messageList) pick(now time.Time) uint {
+	n := uint(len(self.messages))
+	r := &self.rotation
+	switch self.order {
+	case OrderRandom:
+		return uint(rand.Int63n(int64(n)))
+	case OrderWeighted:
+		x := uint(rand.Int63n(int64(self.totalWeight())))
+		for i := range self.messages {
+			if x < self.weight(i) {
+				return uint(i)
+			}
+			x -= self.weight(i)
+		}
+	case OrderShuffle:
+		if r.Next >= uint(len(r.Shuffle)) || uint(len(r.Shuffle)) != n {
+			last := -1
+			if len(r.Shuffle) != 0 {
+				last = int(r.Shuffle[len(r.Shuffle)-1])
+			}
+			r.Shuffle = make([]uint, n)
+			for i, p := range rand.Perm(int(n)) {
+				r.Shuffle[i] = uint(p)
+			}
+			// don't repeat a message across the reshuffle
+			if n > 1 && int(r.Shuffle[0]) == last {
+				r.Shuffle[0], r.Shuffle[1] = r.Shuffle[1], r.Shuffle[0]
+			}
+			r.Next = 0
+		}
+		r.Next++
+		return r.Shuffle[r.Next-1]
+	case OrderSticky:
+		if r.sticky == nil || *r.sticky >= n {
+			i := uint(rand.Int63n(int64(n)))
+			r.sticky = &i
+		}
+		return *r.sticky
+	case OrderSchedule:
+		due := make([]uint, 0, n)
+		for i := range self.messages {
+			if i >= len(self.windows) || self.windows[i].contains(now) {
+				due = append(due, uint(i))
+			}
+		}
+		if len(due) != 0 {
+			i := due[r.Next%uint(len(due))]
+			r.Next++
+			return i
+		}
+	}
+	i := r.Next
+	if i >= n {
+		i = 0
+	}
+	r.Next = i + 1
+	return i
+}
@@ -0,0 +1,125 @@
+package parvatigo
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testRotationConfig = `[game "shuffled"]
+	hostMessage = a
+	hostMessage = b
+	hostMessage = c
+	hostMessageOrder = shuffle
+[game "weighted"]
+	hostMessage = never
+	hostMessage = always
+	hostMessageOrder = weighted
+	hostMessageWeight = 0
+	hostMessageWeight = 3
+[game "scheduled"]
+	hostMessage = day
+	hostMessage = night
+	hostMessage = any
+	hostMessageOrder = schedule
+	hostMessageSchedule = 08:00-20:00
+	hostMessageSchedule = 22:00-02:00
+[game "sticky"]
+	hostMessage = a
+	hostMessage = b
+	hostMessage = c
+	hostMessageOrder = sticky
+`
+
+func TestMessageRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := writeFile(t, dir, "config", testRotationConfig, 0600)
+	conf, err := ReadConfig(path)
+	if err != nil {
+		t.Fatalf("ReadConfig failed: %s", err.Error())
+	}
+
+	g := conf.Games["shuffled"]
+	last := ""
+	for round := 0; round < 5; round++ {
+		seen := make(map[string]bool)
+		for i := 0; i < 3; i++ {
+			m := g.HostMessage(nil)
+			if seen[m] || m == last {
+				t.Fatalf("Shuffle repeated '%s' in round %d", m, round)
+			}
+			seen[m] = true
+			last = m
+		}
+	}
+
+	g = conf.Games["weighted"]
+	for i := 0; i < 50; i++ {
+		if m := g.HostMessage(nil); m != "always" {
+			t.Fatalf("Picked '%s' with weight 0", m)
+		}
+	}
+
+	g = conf.Games["scheduled"]
+	at := func(hour int) *MessageVars {
+		return &MessageVars{Time: time.Date(2020, 1, 1, hour, 30, 0, 0, time.Local)}
+	}
+	for _, c := range []struct {
+		hour int
+		want []string
+	}{{12, []string{"day", "any"}}, {23, []string{"night", "any"}}, {1, []string{"night", "any"}}, {21, []string{"any", "any"}}} {
+		g.host.rotation.Next = 0
+		for _, want := range c.want {
+			if got := g.HostMessage(at(c.hour)); got != want {
+				t.Errorf("Expected '%s' at %d:30, got '%s'", want, c.hour, got)
+			}
+		}
+	}
+
+	g = conf.Games["sticky"]
+	first := g.HostMessage(nil)
+	for i := 0; i < 10; i++ {
+		if m := g.HostMessage(nil); m != first {
+			t.Fatalf("Sticky message changed from '%s' to '%s'", first, m)
+		}
+	}
+
+	// a later run carries on, unless the messages changed
+	g = conf.Games["shuffled"]
+	g.HostMessage(nil)
+	host, wait := g.Rotations()
+	again := conf.Games["shuffled"]
+	again.host.rotation = MessageRotation{For: again.host.rotation.For}
+	again.RestoreRotations(host, wait)
+	if a, b := g.HostMessage(nil), again.HostMessage(nil); a != b {
+		t.Errorf("Restored rotation gave '%s', expected '%s'", b, a)
+	}
+	changed := GameInfo{HostMessages: []string{"a", "b"}, HostOrder: OrderShuffle}
+	changed.RestoreRotations(host, wait)
+	if r, _ := changed.Rotations(); len(r.Shuffle) != 0 {
+		t.Errorf("Restored a rotation for other messages: %+v", r)
+	}
+
+	for _, bad := range []string{
+		"hostMessageOrder = randm",
+		"hostMessageOrder = weighted\n\thostMessageWeight = 0",
+		"hostMessageOrder = schedule\n\thostMessageSchedule = 8am",
+		"hostMessageWeight = 1\n\thostMessageWeight = 1",
+	} {
+		path := writeFile(t, dir, "bad", "[game \"th123\"]\n\thostMessage = hi\n\t"+bad+"\n", 0600)
+		if _, err := ReadConfig(path); err == nil || !strings.Contains(err.Error(), "game.th123") {
+			t.Errorf("Expected '%s' to fail at load, got %v", bad, err)
+		}
+		f, _ := OpenConfigFile(path)
+		loaded, _ := f.Load()
+		if len(loaded.Validate()) != 1 {
+			t.Errorf("Expected Validate to report '%s'", bad)
+		}
+	}
+}
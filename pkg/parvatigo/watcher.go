@@ -0,0 +1,174 @@
+package parvatigo
+
+import (
+	"sync"
+	"time"
+
+	"github.com/misatosangel/parvati-api-client/pkg/swagger"
+)
+
+type EventType string
+
+const (
+	HostAppeared      EventType = "HostAppeared"
+	HostStatusChanged EventType = "HostStatusChanged"
+	HostGone          EventType = "HostGone"
+	WaiterAppeared    EventType = "WaiterAppeared"
+	WaiterExpired     EventType = "WaiterExpired"
+)
+
+// A change seen between two successive host lists for a game.
+// Host is set for host events, Waiter for waiter events.
+type Event struct {
+	Type      EventType             `json:"type"`
+	Game      string                `json:"game"`
+	Time      time.Time             `json:"time"`
+	Host      *swagger.HosterStatus `json:"host,omitempty"`
+	Waiter    *swagger.WaiterStatus `json:"waiter,omitempty"`
+	OldStatus string                `json:"old_status,omitempty"`
+}
+
+// Id of the announcement the event refers to.
+func (self *Event) ID() uint64 {
+	if self.Host != nil {
+		return self.Host.Host.BaseInfo.Id
+	}
+	if self.Waiter != nil {
+		return self.Waiter.Waiter.Id
+	}
+	return 0
+}
+
+// The user who made the announcement the event refers to.
+func (self *Event) User() swagger.User {
+	if self.Host != nil {
+		return self.Host.Host.BaseInfo.User
+	}
+	if self.Waiter != nil {
+		return self.Waiter.Waiter.User
+	}
+	return swagger.User{}
+}
+
+// Compares two host lists for a game and returns the changes between them.
+// A nil prev list is treated as empty, so every entry in cur is new.
+func DiffHostLists(game string, prev, cur *swagger.HostList) []Event {
+	now := time.Now()
+	out := make([]Event, 0, 4)
+	oldHosts := make(map[uint64]*swagger.HosterStatus)
+	oldWaits := make(map[uint64]*swagger.WaiterStatus)
+	if prev != nil {
+		for i := range prev.Hosts {
+			oldHosts[prev.Hosts[i].Host.BaseInfo.Id] = &prev.Hosts[i]
+		}
+		for i := range prev.Waits {
+			oldWaits[prev.Waits[i].Waiter.Id] = &prev.Waits[i]
+		}
+	}
+	if cur == nil {
+		cur = &swagger.HostList{}
+	}
+	for i := range cur.Hosts {
+		h := cur.Hosts[i]
+		id := h.Host.BaseInfo.Id
+		old, seen := oldHosts[id]
+		if !seen {
+			out = append(out, Event{Type: HostAppeared, Game: game, Time: now, Host: &h})
+			continue
+		}
+		delete(oldHosts, id)
+		if old.Status.Status != h.Status.Status {
+			out = append(out, Event{Type: HostStatusChanged, Game: game, Time: now, Host: &h, OldStatus: old.Status.Status})
+		}
+	}
+	for i := range cur.Waits {
+		w := cur.Waits[i]
+		if _, seen := oldWaits[w.Waiter.Id]; seen {
+			delete(oldWaits, w.Waiter.Id)
+			continue
+		}
+		out = append(out, Event{Type: WaiterAppeared, Game: game, Time: now, Waiter: &w})
+	}
+	// keep output order stable by walking the previous list again
+	if prev != nil {
+		for i := range prev.Hosts {
+			if h := oldHosts[prev.Hosts[i].Host.BaseInfo.Id]; h != nil {
+				out = append(out, Event{Type: HostGone, Game: game, Time: now, Host: h, OldStatus: h.Status.Status})
+			}
+		}
+		for i := range prev.Waits {
+			if w := oldWaits[prev.Waits[i].Waiter.Id]; w != nil {
+				out = append(out, Event{Type: WaiterExpired, Game: game, Time: now, Waiter: w})
+			}
+		}
+	}
+	return out
+}
+
+// Polls the host lists of a set of games and delivers the differences
+// between successive lists as events.
+type Watcher struct {
+	api      *Api
+	games    []*swagger.Game
+	interval time.Duration
+	events   chan Event
+	stop     chan struct{}
+	once     sync.Once
+	// Called with any error fetching a list; the game is retried next poll.
+	OnError func(game *swagger.Game, err *ApiError)
+}
+
+func NewWatcher(api *Api, games []*swagger.Game, interval time.Duration) *Watcher {
+	if interval <= 0 {
+		interval = 15 * time.Second
+	}
+	return &Watcher{
+		api:      api,
+		games:    games,
+		interval: interval,
+		events:   make(chan Event, 64),
+		stop:     make(chan struct{}),
+	}
+}
+
+// Channel events are delivered on. It is closed once the watcher stops.
+func (self *Watcher) Events() <-chan Event {
+	return self.events
+}
+
+// Polls until Stop is called. The first poll reports everything currently
+// listed as having appeared.
+func (self *Watcher) Run() {
+	defer close(self.events)
+	last := make(map[int32]*swagger.HostList, len(self.games))
+	ticker := time.NewTicker(self.interval)
+	defer ticker.Stop()
+	for {
+		for _, game := range self.games {
+			list, err := self.api.CheckListedHosts(game, nil)
+			if err != nil {
+				if self.OnError != nil {
+					self.OnError(game, err)
+				}
+				continue
+			}
+			for _, ev := range DiffHostLists(game.UrlShortName, last[game.Id], list) {
+				select {
+				case self.events <- ev:
+				case <-self.stop:
+					return
+				}
+			}
+			last[game.Id] = list
+		}
+		select {
+		case <-ticker.C:
+		case <-self.stop:
+			return
+		}
+	}
+}
+
+func (self *Watcher) Stop() {
+	self.once.Do(func() { close(self.stop) })
+}
@@ -0,0 +1,61 @@
+package parvatigo
+
+import (
+	"testing"
+
+	"github.com/misatosangel/parvati-api-client/pkg/swagger"
+)
+
+func makeHost(id uint64, status string) swagger.HosterStatus {
+	var h swagger.HosterStatus
+	h.Host.BaseInfo.Id = id
+	h.Status.Status = status
+	return h
+}
+
+func makeWait(id uint64) swagger.WaiterStatus {
+	var w swagger.WaiterStatus
+	w.Waiter.Id = id
+	return w
+}
+
+func TestDiffHostLists(t *testing.T) {
+	prev := &swagger.HostList{
+		Hosts: []swagger.HosterStatus{makeHost(1, "Waiting"), makeHost(2, "Waiting"), makeHost(3, "Playing")},
+		Waits: []swagger.WaiterStatus{makeWait(10), makeWait(11)},
+	}
+	cur := &swagger.HostList{
+		Hosts: []swagger.HosterStatus{makeHost(1, "Waiting"), makeHost(2, "Playing"), makeHost(4, "Waiting")},
+		Waits: []swagger.WaiterStatus{makeWait(11), makeWait(12)},
+	}
+	want := []struct {
+		t  EventType
+		id uint64
+	}{
+		{HostStatusChanged, 2},
+		{HostAppeared, 4},
+		{WaiterAppeared, 12},
+		{HostGone, 3},
+		{WaiterExpired, 10},
+	}
+	got := DiffHostLists("soku", prev, cur)
+	if len(got) != len(want) {
+		t.Fatalf("Expected %d events, got %d: %+v", len(want), len(got), got)
+	}
+	for i, w := range want {
+		if got[i].Type != w.t || got[i].ID() != w.id {
+			t.Errorf("Event %d: expected %s for %d, got %s for %d", i, w.t, w.id, got[i].Type, got[i].ID())
+		}
+	}
+	if got[0].OldStatus != "Waiting" {
+		t.Errorf("Expected old status 'Waiting' on status change, got '%s'", got[0].OldStatus)
+	}
+
+	first := DiffHostLists("soku", nil, cur)
+	if len(first) != 5 {
+		t.Errorf("Expected every entry to appear against a nil list, got %d events", len(first))
+	}
+	if same := DiffHostLists("soku", cur, cur); len(same) != 0 {
+		t.Errorf("Expected no events for identical lists, got %+v", same)
+	}
+}
@@ -0,0 +1,238 @@
+// Package probe checks a game host by speaking the game's own network
+// protocol to it, rather than asking one of Parvati's remote check APIs.
+package probe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/misatosangel/parvati-api-client/pkg/swagger"
+)
+
+// Touhou 12.3 Hisoutensoku packet types
+const (
+	sokuHello       = 1
+	sokuPunch       = 2
+	sokuOlleh       = 3
+	sokuChain       = 4
+	sokuInitRequest = 5
+	sokuInitSuccess = 6
+	sokuInitError   = 7
+	sokuRedirect    = 8
+	sokuQuit        = 11
+)
+
+const (
+	sokuSpectateRequest = 0
+	sokuPlayRequest     = 1
+)
+
+// Reasons given in an INIT_ERROR
+const (
+	sokuErrSpectateDisabled = 0
+	sokuErrNotPlaying       = 1
+	sokuErrWrongVersion     = 2
+)
+
+const (
+	sokuHelloLen       = 37
+	sokuInitRequestLen = 65
+	sokuInitSuccessLen = 81
+	sokuInitErrorLen   = 5
+	sokuProfileLen     = 32
+	sokuProfileOffset  = 13
+)
+
+// A Hisoutensoku release, identified on the wire by its 16 byte game ID.
+type SokuVersion struct {
+	Name   string
+	GameID [16]byte
+}
+
+// Releases tried, in order, when no others are given.
+var SokuVersions = []SokuVersion{
+	{Name: "1.10a", GameID: [16]byte{0x6e, 0x73, 0x89, 0x64, 0x39, 0x1a, 0xb6, 0x4f, 0x93, 0x25, 0x26, 0xff, 0xdd, 0x3d, 0x2c, 0xf6}},
+}
+
+func init() {
+	Register(&Hisoutensoku{}, "hisoutensoku")
+}
+
+// Probes a Hisoutensoku host; the reference Protocol. The host is greeted
+// with HELLO, then asked to let us spectate, which it answers with the
+// players' profile names if a match is on, and an error saying why not
+// otherwise. We never ask to play, as that would start a match.
+type Hisoutensoku struct {
+	// Versions to try, defaults to SokuVersions
+	Versions []SokuVersion
+	// Total time to wait for each answer, defaults to 2s
+	Timeout time.Duration
+}
+
+func (self *Hisoutensoku) Name() string {
+	return "th123"
+}
+
+// Works out the state of the host at hostPort. The handshake is cheap, so
+// every level gets the full state; game info for "full" is not supported.
+// A host that does not answer gives status "Unreachable" rather than an
+// error, matching the check APIs.
+func (self *Hisoutensoku) Check(hostPort, level string) (swagger.GameCheckInfo, error) {
+	info := swagger.GameCheckInfo{Address: hostPort, Spectate: 'u'}
+	if err := checkLevel(level); err != nil {
+		return info, err
+	}
+	addr, err := net.ResolveUDPAddr("udp", hostPort)
+	if err != nil {
+		return info, err
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return info, err
+	}
+	defer conn.Close()
+
+	if _, err := self.exchange(conn, sokuHelloPacket(addr), sokuOlleh); err != nil {
+		info.Status = "Unreachable"
+		info.Error = err.Error()
+		return info, nil
+	}
+	versions := self.Versions
+	if len(versions) == 0 {
+		versions = SokuVersions
+	}
+	for _, v := range versions {
+		resp, err := self.exchange(conn, sokuInitRequestPacket(v.GameID, sokuSpectateRequest), sokuInitSuccess, sokuInitError)
+		if err != nil {
+			info.Status = "Unknown"
+			info.Error = err.Error()
+			return info, nil
+		}
+		if resp[0] == sokuInitSuccess {
+			if len(resp) < sokuInitSuccessLen {
+				info.Status = "Unknown"
+				info.Error = fmt.Sprintf("Short INIT_SUCCESS packet (%d bytes)", len(resp))
+				return info, nil
+			}
+			// don't leave the host waiting on a spectator that never comes
+			conn.Write([]byte{sokuQuit})
+			info.Status = "Playing"
+			info.Version = v.Name
+			info.Spectate = 'y'
+			host := sokuProfileName(resp[sokuProfileOffset : sokuProfileOffset+sokuProfileLen])
+			client := sokuProfileName(resp[sokuProfileOffset+sokuProfileLen : sokuProfileOffset+2*sokuProfileLen])
+			info.Profiles = []string{host, client}
+			info.Opponent = client
+			return info, nil
+		}
+		if len(resp) < sokuInitErrorLen {
+			info.Status = "Unknown"
+			info.Error = fmt.Sprintf("Short INIT_ERROR packet (%d bytes)", len(resp))
+			return info, nil
+		}
+		switch reason := binary.LittleEndian.Uint32(resp[1:5]); reason {
+		case sokuErrWrongVersion:
+			continue
+		case sokuErrSpectateDisabled:
+			info.Status = "Playing"
+			info.Spectate = 'n'
+		case sokuErrNotPlaying:
+			info.Status = "Waiting"
+		default:
+			info.Status = "Unknown"
+			info.Error = fmt.Sprintf("Unknown INIT_ERROR reason %d", reason)
+		}
+		info.Version = v.Name
+		return info, nil
+	}
+	info.Status = "Unknown"
+	info.Error = "Host is running an unknown version"
+	return info, nil
+}
+
+// Sends req until an answer of one of the wanted types arrives or the
+// timeout passes.
+func (self *Hisoutensoku) exchange(conn *net.UDPConn, req []byte, want ...byte) ([]byte, error) {
+	timeout := self.Timeout
+	if timeout == 0 {
+		timeout = 2 * time.Second
+	}
+	deadline := time.Now().Add(timeout)
+	wait := 250 * time.Millisecond
+	buf := make([]byte, 1024)
+	for time.Now().Before(deadline) {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		tryUntil := time.Now().Add(wait)
+		if tryUntil.After(deadline) {
+			tryUntil = deadline
+		}
+		conn.SetReadDeadline(tryUntil)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				if nErr, ok := err.(net.Error); ok && nErr.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			if n > 0 && bytes.IndexByte(want, buf[0]) >= 0 {
+				out := make([]byte, n)
+				copy(out, buf[:n])
+				return out, nil
+			}
+		}
+		wait *= 2
+	}
+	return nil, fmt.Errorf("No answer from %s within %s", conn.RemoteAddr().String(), timeout.String())
+}
+
+// HELLO carries the host's address twice (as the peer and the target) as
+// packed sockaddr_in structures.
+func sokuHelloPacket(addr *net.UDPAddr) []byte {
+	p := make([]byte, sokuHelloLen)
+	p[0] = sokuHello
+	sa := sokuSockAddr(addr)
+	copy(p[1:17], sa)
+	copy(p[17:33], sa)
+	p[33] = 0xbc
+	return p
+}
+
+func sokuSockAddr(addr *net.UDPAddr) []byte {
+	sa := make([]byte, 16)
+	binary.LittleEndian.PutUint16(sa[0:2], 2) // AF_INET
+	binary.BigEndian.PutUint16(sa[2:4], uint16(addr.Port))
+	if v4 := addr.IP.To4(); v4 != nil {
+		copy(sa[4:8], v4)
+	}
+	return sa
+}
+
+func sokuInitRequestPacket(gameID [16]byte, reqType byte) []byte {
+	p := make([]byte, sokuInitRequestLen)
+	p[0] = sokuInitRequest
+	copy(p[1:17], gameID[:])
+	p[25] = reqType
+	return p
+}
+
+// Profile names are NUL terminated Shift-JIS; bytes outside printable
+// ASCII are shown as '?' as we do not carry a Shift-JIS decoder.
+func sokuProfileName(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	out := make([]byte, len(b))
+	for i, c := range b {
+		if c < 0x20 || c >= 0x7f {
+			c = '?'
+		}
+		out[i] = c
+	}
+	return string(out)
+}
@@ -0,0 +1,158 @@
+package probe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A host answering like the game does in a given state.
+type fakeSoku struct {
+	conn   *net.UDPConn
+	gameID [16]byte
+	mu     sync.Mutex
+	state  string // "waiting", "playing", "nospectate" or "silent"
+	quits  int
+}
+
+func newFakeSoku(t *testing.T, state string, gameID [16]byte) *fakeSoku {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err.Error())
+	}
+	f := &fakeSoku{conn: conn, gameID: gameID, state: state}
+	go f.serve()
+	return f
+}
+
+func (self *fakeSoku) serve() {
+	buf := make([]byte, 1024)
+	for {
+		n, from, err := self.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		self.mu.Lock()
+		resp := self.answer(buf[:n])
+		self.mu.Unlock()
+		if resp != nil {
+			self.conn.WriteToUDP(resp, from)
+		}
+	}
+}
+
+// QUIT is sent without waiting for an answer, so may arrive after Check.
+func (self *fakeSoku) waitForQuit() {
+	for i := 0; i < 50; i++ {
+		self.mu.Lock()
+		n := self.quits
+		self.mu.Unlock()
+		if n > 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func initError(reason uint32) []byte {
+	p := make([]byte, sokuInitErrorLen)
+	p[0] = sokuInitError
+	binary.LittleEndian.PutUint32(p[1:], reason)
+	return p
+}
+
+func (self *fakeSoku) answer(req []byte) []byte {
+	if self.state == "silent" {
+		return nil
+	}
+	switch req[0] {
+	case sokuHello:
+		if len(req) != sokuHelloLen || binary.BigEndian.Uint16(req[3:5]) != uint16(self.conn.LocalAddr().(*net.UDPAddr).Port) {
+			return nil
+		}
+		return []byte{sokuOlleh}
+	case sokuQuit:
+		self.quits++
+		return nil
+	case sokuInitRequest:
+		if len(req) != sokuInitRequestLen || !bytes.Equal(req[1:17], self.gameID[:]) {
+			return initError(sokuErrWrongVersion)
+		}
+		if req[25] != sokuSpectateRequest {
+			return nil
+		}
+		switch self.state {
+		case "waiting":
+			return initError(sokuErrNotPlaying)
+		case "nospectate":
+			return initError(sokuErrSpectateDisabled)
+		}
+		p := make([]byte, sokuInitSuccessLen)
+		p[0] = sokuInitSuccess
+		copy(p[sokuProfileOffset:], "reimu")
+		copy(p[sokuProfileOffset+sokuProfileLen:], "marisa\x82\xa0")
+		return p
+	}
+	return nil
+}
+
+func TestHisoutensokuCheck(t *testing.T) {
+	cases := []struct {
+		state, status string
+		spectate      int
+	}{
+		{"waiting", "Waiting", 'u'},
+		{"playing", "Playing", 'y'},
+		{"nospectate", "Playing", 'n'},
+		{"silent", "Unreachable", 'u'},
+	}
+	for _, c := range cases {
+		f := newFakeSoku(t, c.state, SokuVersions[0].GameID)
+		p := &Hisoutensoku{Timeout: 500 * time.Millisecond}
+		info, err := p.Check(f.conn.LocalAddr().String(), "state")
+		if c.state == "playing" {
+			f.waitForQuit()
+		}
+		f.conn.Close()
+		if err != nil {
+			t.Errorf("%s: Check failed: %s", c.state, err.Error())
+			continue
+		}
+		if info.Status != c.status || info.Spectate != c.spectate {
+			t.Errorf("%s: got status %s spectate %c, wanted %s %c", c.state, info.Status, info.Spectate, c.status, c.spectate)
+		}
+		if c.state != "silent" && info.Version != "1.10a" {
+			t.Errorf("%s: unexpected version '%s'", c.state, info.Version)
+		}
+		if c.state == "playing" {
+			if len(info.Profiles) != 2 || info.Profiles[0] != "reimu" || info.Opponent != "marisa??" {
+				t.Errorf("Unexpected profiles %v, opponent %s", info.Profiles, info.Opponent)
+			}
+			f.mu.Lock()
+			if f.quits != 1 {
+				t.Errorf("Expected one QUIT after spectating, got %d", f.quits)
+			}
+			f.mu.Unlock()
+		}
+	}
+}
+
+func TestHisoutensokuVersions(t *testing.T) {
+	f := newFakeSoku(t, "waiting", [16]byte{1, 2, 3})
+	defer f.conn.Close()
+	p := &Hisoutensoku{
+		Versions: append([]SokuVersion{{Name: "old"}}, SokuVersion{Name: "new", GameID: f.gameID}),
+		Timeout:  500 * time.Millisecond,
+	}
+	info, err := p.Check(f.conn.LocalAddr().String(), "state")
+	if err != nil || info.Version != "new" || info.Status != "Waiting" {
+		t.Errorf("Expected waiting host on version new, got %+v (%v)", info, err)
+	}
+	p.Versions = p.Versions[:1]
+	if info, _ := p.Check(f.conn.LocalAddr().String(), "state"); info.Status != "Unknown" || info.Error == "" {
+		t.Errorf("Expected unknown version, got %+v", info)
+	}
+}
@@ -0,0 +1,96 @@
+package probe
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/misatosangel/parvati-api-client/pkg/swagger"
+)
+
+// A game's network protocol, able to check a host by speaking it.
+//
+// To add a game, implement Protocol and Register it from an init function
+// under the protocol name Parvati lists in swagger.Game.Protocols, without
+// the 4/6 address family suffix. Check should:
+//   - do whatever handshake the game uses to find if the host is up;
+//   - report Status as "Waiting" or "Playing" when it is, "Unreachable" when
+//     nothing answers and "Unknown" when the answer makes no sense;
+//   - fill in Version, Spectate ('y', 'n' or 'u'), Profiles and Opponent
+//     where the protocol gives them away;
+//   - never join the game as a player, as that would start a match.
+//
+// Only problems on our side (e.g. a bad address) are returned as errors.
+// Implementations must be safe to use from several goroutines.
+type Protocol interface {
+	// Protocol name, as listed in swagger.Game.Protocols less the suffix
+	Name() string
+	// Checks the host at hostPort ("ip:port") at a check level, as given to
+	// the check APIs: "basic", "state" or "full".
+	Check(hostPort, level string) (swagger.GameCheckInfo, error)
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]Protocol)
+)
+
+// Makes p available under its name and any aliases. Registering a name
+// twice panics, as with database/sql drivers.
+func Register(p Protocol, aliases ...string) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	for _, name := range append([]string{p.Name()}, aliases...) {
+		key := strings.ToLower(name)
+		if _, dup := registry[key]; dup {
+			panic("probe: Register called twice for protocol " + name)
+		}
+		registry[key] = p
+	}
+}
+
+// Finds the protocol for a name as listed in swagger.Game.Protocols, with or
+// without its 4/6 suffix.
+func Lookup(name string) Protocol {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	key := strings.ToLower(name)
+	if p, ok := registry[key]; ok {
+		return p
+	}
+	if l := len(key); l > 1 && (key[l-1] == '4' || key[l-1] == '6') {
+		return registry[key[:l-1]]
+	}
+	return nil
+}
+
+// The first of game's protocols that can be probed locally, or nil.
+func ForGame(game *swagger.Game) Protocol {
+	for _, name := range game.Protocols {
+		if p := Lookup(name); p != nil {
+			return p
+		}
+	}
+	return nil
+}
+
+// Registered protocol names and aliases, sorted.
+func Names() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	out := make([]string, 0, len(registry))
+	for name := range registry {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func checkLevel(level string) error {
+	switch level {
+	case "", "basic", "state", "full":
+		return nil
+	}
+	return fmt.Errorf("Unknown check level '%s'\n", level)
+}
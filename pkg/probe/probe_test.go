@@ -0,0 +1,36 @@
+package probe
+
+import (
+	"testing"
+
+	"github.com/misatosangel/parvati-api-client/pkg/swagger"
+)
+
+func TestLookup(t *testing.T) {
+	for _, name := range []string{"th123", "TH1234", "th1236", "hisoutensoku", "hisoutensoku6"} {
+		if _, ok := Lookup(name).(*Hisoutensoku); !ok {
+			t.Errorf("Expected %s to find the Hisoutensoku probe", name)
+		}
+	}
+	if p := Lookup("th1235"); p != nil {
+		t.Errorf("Unexpected probe for th1235: %s", p.Name())
+	}
+	if p := ForGame(&swagger.Game{Protocols: []string{"http4", "th1236"}}); p == nil || p.Name() != "th123" {
+		t.Errorf("Expected ForGame to skip unknown protocols, got %v", p)
+	}
+	if p := ForGame(&swagger.Game{Name: "Hisoutensoku", Protocols: []string{"udp4"}}); p != nil {
+		t.Errorf("ForGame should only go by protocols, got %s", p.Name())
+	}
+	if _, err := (&Hisoutensoku{}).Check("127.0.0.1:1", "everything"); err == nil {
+		t.Errorf("Expected an unknown check level to be rejected")
+	}
+}
+
+func TestRegisterTwicePanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected registering th123 twice to panic")
+		}
+	}()
+	Register(&Hisoutensoku{})
+}
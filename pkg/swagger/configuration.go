@@ -21,7 +21,7 @@ type Configuration struct {
 	Password      string            `json:"password,omitempty"`
 	APIKeyPrefix  map[string]string `json:"APIKeyPrefix,omitempty"`
 	APIKey        map[string]string `json:"APIKey,omitempty"`
-	debug         bool              `json:"debug,omitempty"`
+	debug         bool
 	DebugFile     string            `json:"debugFile,omitempty"`
 	OAuthToken    string            `json:"oAuthToken,omitempty"`
 	Timeout       int               `json:"timeout,omitempty"`